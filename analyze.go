@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of the analyze command: how long black frames or silence must
+// last to be reported, and the level below which audio is silence.
+const (
+	defaultBlackDuration   = 2 * time.Second
+	defaultSilenceDuration = 2 * time.Second
+	defaultSilenceNoise    = -60.0
+)
+
+// blankSpan is a stretch of a chapter, black or silent, counted from its
+// start.
+type blankSpan struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// MarshalJSON encodes the span with its times in seconds.
+func (s blankSpan) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Start    float64 `json:"start"`
+		End      float64 `json:"end"`
+		Duration float64 `json:"duration"`
+	}{s.Start.Seconds(), s.End.Seconds(), (s.End - s.Start).Seconds()})
+}
+
+func (s blankSpan) String() string {
+	return fmt.Sprintf("%s - %s (%s)", formatOffset(s.Start), formatOffset(s.End), (s.End - s.Start).Round(time.Millisecond))
+}
+
+// chapterAnalysis is what the analyze command found in a chapter.
+type chapterAnalysis struct {
+	Path    string      `json:"path"`
+	Black   []blankSpan `json:"black"`
+	Silence []blankSpan `json:"silence"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// analyzeArgs builds the ffmpeg arguments decoding the first video and
+// audio streams of path through the blackdetect and silencedetect filters,
+// which print what they detect at the info level.
+func analyzeArgs(path string, blackDuration, silenceDuration time.Duration, silenceNoise float64) []string {
+	args := ffmpegArgs("info")
+	return append(args,
+		"-i", path,
+		"-vf", fmt.Sprintf("blackdetect=d=%g:pix_th=0.10", blackDuration.Seconds()),
+		"-af", fmt.Sprintf("silencedetect=n=%gdB:d=%g", silenceNoise, silenceDuration.Seconds()),
+		"-f", "null", "-",
+	)
+}
+
+var (
+	blackPattern        = regexp.MustCompile(`black_start:\s*(-?[\d.]+)\s+black_end:\s*(-?[\d.]+)`)
+	silenceStartPattern = regexp.MustCompile(`silence_start:\s*(-?[\d.]+)`)
+	silenceEndPattern   = regexp.MustCompile(`silence_end:\s*(-?[\d.]+)`)
+)
+
+// parseBlankSpans reads the black and silent spans the detect filters
+// printed to output. Silence still going on at the end of a chapter of
+// duration is cut there, older ffmpeg versions do not close it.
+func parseBlankSpans(output string, duration time.Duration) (black, silence []blankSpan) {
+	seconds := func(s string) time.Duration {
+		value, _ := strconv.ParseFloat(s, 64)
+		return max(time.Duration(value*float64(time.Second)), 0)
+	}
+	black, silence = []blankSpan{}, []blankSpan{}
+	silenceStart := time.Duration(-1)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := blackPattern.FindStringSubmatch(line); m != nil {
+			black = append(black, blankSpan{Start: seconds(m[1]), End: seconds(m[2])})
+		}
+		if m := silenceStartPattern.FindStringSubmatch(line); m != nil {
+			silenceStart = seconds(m[1])
+		}
+		if m := silenceEndPattern.FindStringSubmatch(line); m != nil && silenceStart >= 0 {
+			silence = append(silence, blankSpan{Start: silenceStart, End: seconds(m[1])})
+			silenceStart = -1
+		}
+	}
+	if silenceStart >= 0 && duration > silenceStart {
+		silence = append(silence, blankSpan{Start: silenceStart, End: duration})
+	}
+	return black, silence
+}
+
+// analyzeChapter looks for black frames and silence in the chapter at
+// path.
+func analyzeChapter(path string, blackDuration, silenceDuration time.Duration, silenceNoise float64) (chapterAnalysis, error) {
+	probe, err := probeFile(path)
+	if err != nil {
+		return chapterAnalysis{}, err
+	}
+	var stderr bytes.Buffer
+	cmd := ffmpegCommand(analyzeArgs(path, blackDuration, silenceDuration, silenceNoise)...)
+	cmd.Stderr = &stderr
+	if err := runCommand(discardLogger, cmd); err != nil {
+		return chapterAnalysis{}, fmt.Errorf("failed to analyze: %v", err)
+	}
+	black, silence := parseBlankSpans(stderr.String(), time.Duration(probe.Duration*float64(time.Second)))
+	return chapterAnalysis{Path: path, Black: black, Silence: silence}, nil
+}
+
+// printAnalysis lists the black and silent spans of a chapter.
+func printAnalysis(w io.Writer, analysis chapterAnalysis) {
+	fmt.Fprintln(w, filepath.Base(analysis.Path))
+	for _, kind := range []struct {
+		name  string
+		spans []blankSpan
+	}{
+		{"Black", analysis.Black},
+		{"Silence", analysis.Silence},
+	} {
+		if len(kind.spans) == 0 {
+			fmt.Fprintf(w, "  %s: none\n", kind.name)
+			continue
+		}
+		fmt.Fprintf(w, "  %s:\n", kind.name)
+		for _, span := range kind.spans {
+			fmt.Fprintf(w, "    %s\n", span)
+		}
+	}
+}
+
+// runAnalyze implements the analyze subcommand and returns the process
+// exit code.
+func runAnalyze(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	blackDuration := flags.Duration("black-duration", defaultBlackDuration, "shortest stretch of black frames reported")
+	silenceDuration := flags.Duration("silence-duration", defaultSilenceDuration, "shortest silence reported")
+	silenceNoise := flags.Float64("silence-noise", defaultSilenceNoise, "level in dB below which the audio counts as silence")
+	jsonOutput := flags.Bool("json", false, "print the analysis as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: GoProConcat analyze [options] file1 [file2 ...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	if *blackDuration <= 0 || *silenceDuration <= 0 {
+		fmt.Fprintln(stderr, "-black-duration and -silence-duration must be positive")
+		return exitUsage
+	}
+	if *silenceNoise >= 0 {
+		fmt.Fprintln(stderr, "-silence-noise must be negative, in dB below full scale")
+		return exitUsage
+	}
+
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			fmt.Fprintf(stderr, "%s is not installed. Please install ffmpeg using Homebrew:\n\nbrew install ffmpeg\n", tool)
+			return exitError
+		}
+	}
+
+	code := exitOK
+	analyses := []chapterAnalysis{}
+	for _, path := range flags.Args() {
+		analysis, err := analyzeChapter(path, *blackDuration, *silenceDuration, *silenceNoise)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error analyzing %s: %v\n", path, err)
+			analysis = chapterAnalysis{Path: path, Error: err.Error()}
+			code = exitError
+		} else if !*jsonOutput {
+			printAnalysis(stdout, analysis)
+		}
+		analyses = append(analyses, analysis)
+	}
+	if *jsonOutput {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(analyses); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	return code
+}
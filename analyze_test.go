@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBlankSpans(t *testing.T) {
+	output := `Input #0, mov,mp4,m4a,3gp,3g2,mj2, from 'GH010042.MP4':
+[blackdetect @ 0x600001c3c000] black_start:0 black_end:4.2042 black_duration:4.2042
+[silencedetect @ 0x600001c3c100] silence_start: -0.00133333
+[silencedetect @ 0x600001c3c100] silence_end: 3.5 | silence_duration: 3.50133
+[blackdetect @ 0x600001c3c000] black_start:120.12 black_end:125.625 black_duration:5.505
+[silencedetect @ 0x600001c3c100] silence_start: 410.25
+`
+	black, silence := parseBlankSpans(output, 412*time.Second)
+	expectedBlack := []blankSpan{{0, 4204200 * time.Microsecond}, {120120 * time.Millisecond, 125625 * time.Millisecond}}
+	if len(black) != 2 || black[0] != expectedBlack[0] || black[1] != expectedBlack[1] {
+		t.Errorf("Expected black %v, got %v", expectedBlack, black)
+	}
+	// The silence at the end is not closed by ffmpeg, it runs to the end
+	expectedSilence := []blankSpan{{0, 3500 * time.Millisecond}, {410250 * time.Millisecond, 412 * time.Second}}
+	if len(silence) != 2 || silence[0] != expectedSilence[0] || silence[1] != expectedSilence[1] {
+		t.Errorf("Expected silence %v, got %v", expectedSilence, silence)
+	}
+	if got := black[1].String(); got != "00:02:00.120 - 00:02:05.625 (5.505s)" {
+		t.Errorf("Unexpected span: %s", got)
+	}
+
+	black, silence = parseBlankSpans("", time.Minute)
+	if black == nil || silence == nil || len(black)+len(silence) != 0 {
+		t.Errorf("Expected no spans, got %v and %v", black, silence)
+	}
+}
+
+func TestAnalyzeArgs(t *testing.T) {
+	args := strings.Join(analyzeArgs("GH010042.MP4", 2*time.Second, 1500*time.Millisecond, -50), " ")
+	for _, part := range []string{"-loglevel info", "-i GH010042.MP4", "-vf blackdetect=d=2:pix_th=0.10", "-af silencedetect=n=-50dB:d=1.5", "-f null -"} {
+		if !strings.Contains(args, part) {
+			t.Errorf("Expected %q in %s", part, args)
+		}
+	}
+}
+
+// TestAnalyzeChapter analyzes a clip starting with three seconds of black
+// frames and silence, like a chapter recorded with the lens cap on.
+func TestAnalyzeChapter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GH010042.MP4")
+	cmd := exec.Command("ffmpeg", "-y",
+		"-f", "lavfi", "-i", "color=c=black:s=320x240:r=30:d=3",
+		"-f", "lavfi", "-i", "anullsrc=r=48000:cl=stereo:d=3",
+		"-f", "lavfi", "-i", "testsrc=s=320x240:r=30:d=2",
+		"-f", "lavfi", "-i", "sine=f=440:r=48000:d=2",
+		"-filter_complex", "[0:v][1:a][2:v][3:a]concat=n=2:v=1:a=1[v][a]",
+		"-map", "[v]", "-map", "[a]", "-c:v", "libx264", "-c:a", "aac", path)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to create the test clip: %v\n%s", err, output)
+	}
+
+	analysis, err := analyzeChapter(path, time.Second, time.Second, defaultSilenceNoise)
+	if err != nil {
+		t.Fatalf("analyzeChapter() error: %v", err)
+	}
+	near := func(got, expected time.Duration) bool {
+		return (got - expected).Abs() < 200*time.Millisecond
+	}
+	if len(analysis.Black) != 1 || !near(analysis.Black[0].Start, 0) || !near(analysis.Black[0].End, 3*time.Second) {
+		t.Errorf("Expected the first 3s to be black, got %v", analysis.Black)
+	}
+	if len(analysis.Silence) != 1 || !near(analysis.Silence[0].Start, 0) || !near(analysis.Silence[0].End, 3*time.Second) {
+		t.Errorf("Expected the first 3s to be silent, got %v", analysis.Silence)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"analyze", "-json", "-black-duration", "1s", path}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Expected exit code %d, got %d: %s", exitOK, code, stderr.String())
+	}
+	var analyses []struct {
+		Path  string `json:"path"`
+		Black []struct {
+			Duration float64 `json:"duration"`
+		} `json:"black"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &analyses); err != nil || len(analyses) != 1 || len(analyses[0].Black) != 1 {
+		t.Errorf("Expected the analysis as JSON, got %v: %s", err, stdout.String())
+	}
+}
+
+func TestRunAnalyzeInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"analyze"},
+		{"analyze", "-black-duration", "0s", "GH010042.MP4"},
+		{"analyze", "-silence-noise", "3", "GH010042.MP4"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := run(args, &stdout, &stderr); code != exitUsage {
+			t.Errorf("Expected %v to be refused, got %d: %s", args, code, stderr.String())
+		}
+	}
+}
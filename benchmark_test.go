@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// benchmarkChapters is the number of chapters of the benchmarks, about
+// the chapters of a full 256GB card.
+const benchmarkChapters = 1000
+
+// benchmarkPaths returns the paths of benchmarkChapters chapters of
+// recordings of up to 10 chapters each, in reverse merge order.
+func benchmarkPaths(dir string) []string {
+	paths := make([]string, 0, benchmarkChapters)
+	for i := benchmarkChapters - 1; i >= 0; i-- {
+		paths = append(paths, filepath.Join(dir, formatFileName("GX", i%10+1, i/10+1)))
+	}
+	return paths
+}
+
+// stubBenchmarkProbes makes probeFile return the hero fixture without
+// running ffprobe, and restores it when b ends.
+func stubBenchmarkProbes(b *testing.B) {
+	b.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "hero_probe.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	probe, err := parseProbeOutput(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+	origProbeFile := probeFile
+	b.Cleanup(func() { probeFile = origProbeFile })
+	probeFile = func(path string) (ProbeResult, error) {
+		return probe, nil
+	}
+}
+
+func BenchmarkParseFileName(b *testing.B) {
+	paths := benchmarkPaths("/Volumes/GOPRO/DCIM/100GOPRO")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, path := range paths {
+			if _, err := parseFileName(path, defaultFileNamePattern); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkOrderFiles(b *testing.B) {
+	paths := benchmarkPaths("/Volumes/GOPRO/DCIM/100GOPRO")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		files, err := orderFiles(paths, Options{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if files[0].FileNumber != 1 || files[0].ChapterNumber != 1 {
+			b.Fatalf("Unexpected first file %+v", files[0])
+		}
+	}
+}
+
+func BenchmarkSortByKey(b *testing.B) {
+	files, err := collectFiles(benchmarkPaths("/Volumes/GOPRO/DCIM/100GOPRO"), defaultFileNamePattern)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Newest recording first, as for an archive listing
+	key := func(file FileInfo) (int, int) {
+		return -file.FileNumber, file.ChapterNumber
+	}
+	shuffled := make([]FileInfo, len(files))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(shuffled, files)
+		sortByKey(shuffled, key)
+	}
+}
+
+func BenchmarkBuildPlan(b *testing.B) {
+	stubBenchmarkProbes(b)
+	paths := benchmarkPaths("/Volumes/GOPRO/DCIM/100GOPRO")
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		plan, err := buildPlan("/Volumes/Archive/merged.mp4", paths, now, now, Options{probes: newProbeCache()})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(plan.Files) != benchmarkChapters {
+			b.Fatalf("Expected %d files in the plan, got %d", benchmarkChapters, len(plan.Files))
+		}
+	}
+}
+
+// BenchmarkMergeFiles measures what mergeFiles does around ffmpeg for 99
+// chapters: ordering, probing, checking the inputs and writing the concat
+// list, with ffmpeg stubbed out.
+func BenchmarkMergeFiles(b *testing.B) {
+	stubBenchmarkProbes(b)
+	dir := b.TempDir()
+	var inputPaths []string
+	for i := 1; i <= 99; i++ {
+		path := filepath.Join(dir, formatFileName("GH", i, 42))
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("chapter %d", i)), 0644); err != nil {
+			b.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	origRunCommand := runCommand
+	b.Cleanup(func() { runCommand = origRunCommand })
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := mergeFiles(outputPath, inputPaths, now, now, Options{probes: newProbeCache()}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
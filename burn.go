@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Corners of the video -timestamp-position puts the burnt-in timestamp in.
+const (
+	positionTopLeft     = "top-left"
+	positionTopRight    = "top-right"
+	positionBottomLeft  = "bottom-left"
+	positionBottomRight = "bottom-right"
+)
+
+// defaultTimestampFormat is the strftime format of the burnt-in timestamp.
+const defaultTimestampFormat = "%Y-%m-%d %H:%M:%S"
+
+// timestampPositions are the x and y expressions of drawtext placing the
+// text in each corner, a fortieth of the height away from the edges.
+var timestampPositions = map[string][2]string{
+	positionTopLeft:     {"h/40", "h/40"},
+	positionTopRight:    {"w-tw-h/40", "h/40"},
+	positionBottomLeft:  {"h/40", "h-th-h/40"},
+	positionBottomRight: {"w-tw-h/40", "h-th-h/40"},
+}
+
+// TimestampOverlay is the recording time burnt into the video, like a
+// dashcam does.
+type TimestampOverlay struct {
+	// Position is the corner of the timestamp, such as positionBottomRight.
+	Position string `json:"position"`
+	// FontSize is the height of the text in pixels. Zero scales it with
+	// the video, to a twenty-fourth of its height.
+	FontSize int `json:"font_size,omitempty"`
+	// Format is the strftime format of the time, defaultTimestampFormat
+	// when empty.
+	Format string `json:"format"`
+}
+
+func validateTimestampOverlay(overlay TimestampOverlay) error {
+	if _, ok := timestampPositions[overlay.Position]; !ok {
+		return fmt.Errorf("invalid -timestamp-position %q: must be top-left, top-right, bottom-left or bottom-right", overlay.Position)
+	}
+	if overlay.FontSize < 0 {
+		return fmt.Errorf("invalid -timestamp-size %d: must not be negative", overlay.FontSize)
+	}
+	if strings.TrimSpace(overlay.Format) == "" {
+		return fmt.Errorf("-timestamp-format cannot be empty")
+	}
+	return nil
+}
+
+// timestampFilter is the drawtext filter burning the time into the video
+// of a merge that starts at start, shown in loc. drawtext counts from the
+// timestamp of each frame, which runs on across the joins of the
+// chapters, so the time shown keeps up with the recording. The offset of
+// loc at start is added to it, to show local time whatever the timezone
+// of ffmpeg; a daylight saving change during the recording is not
+// followed.
+func timestampFilter(overlay TimestampOverlay, start time.Time, loc *time.Location) string {
+	format := overlay.Format
+	if format == "" {
+		format = defaultTimestampFormat
+	}
+	_, offset := start.In(loc).Zone()
+	seconds := float64(start.UnixMilli())/1000 + float64(offset)
+	// The format is an argument of the pts function, escaped as such
+	argument := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`, `}`, `\}`).Replace(format)
+	text := "%{pts:gmtime:" + strconv.FormatFloat(seconds, 'f', 3, 64) + ":" + argument + "}"
+
+	fontSize := "h/24"
+	if overlay.FontSize > 0 {
+		fontSize = strconv.Itoa(overlay.FontSize)
+	}
+	position := timestampPositions[overlay.Position]
+	return fmt.Sprintf("drawtext=text=%s:fontsize=%s:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=8:x=%s:y=%s",
+		escapeFilterValue(text), fontSize, position[0], position[1])
+}
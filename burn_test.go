@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestampFilter(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("no timezone database")
+	}
+	start := time.Date(2026, 7, 4, 12, 30, 0, 250*int(time.Millisecond), time.UTC)
+
+	// Counted from the wall clock of Paris, two hours ahead in summer,
+	// with the colons of the format escaped three times
+	overlay := TimestampOverlay{Position: positionTopLeft, FontSize: 48, Format: "%d.%m.%Y %H:%M"}
+	expected := `drawtext=text=%{pts\\:gmtime\\:1783175400.250\\:%d.%m.%Y %H\\\\\\:%M}:fontsize=48:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=8:x=h/40:y=h/40`
+	if got := timestampFilter(overlay, start, paris); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+
+	got := timestampFilter(TimestampOverlay{Position: positionBottomRight}, start, time.UTC)
+	for _, part := range []string{`gmtime\\:1783168200.250\\:%Y-%m-%d %H\\\\\\:%M\\\\\\:%S}`, "fontsize=h/24", "x=w-tw-h/40:y=h-th-h/40"} {
+		if !strings.Contains(got, part) {
+			t.Errorf("Expected %s in %s", part, got)
+		}
+	}
+}
+
+func TestValidateTimestampOverlay(t *testing.T) {
+	if err := validateTimestampOverlay(TimestampOverlay{Position: positionTopRight, Format: defaultTimestampFormat}); err != nil {
+		t.Errorf("Expected a valid overlay, got %v", err)
+	}
+	for _, overlay := range []TimestampOverlay{
+		{Position: "center", Format: defaultTimestampFormat},
+		{Position: positionTopLeft, FontSize: -1, Format: defaultTimestampFormat},
+		{Position: positionTopLeft, Format: " "},
+	} {
+		if err := validateTimestampOverlay(overlay); err == nil {
+			t.Errorf("Expected %+v to be refused", overlay)
+		}
+	}
+}
+
+func TestBurnTimestampArgs(t *testing.T) {
+	start := time.Date(2026, 7, 4, 12, 30, 0, 0, time.UTC)
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4", CreationTime: start}
+	overlay := &TimestampOverlay{Position: positionBottomRight, Format: defaultTimestampFormat}
+	opts := Options{Reencode: true, LUT: "/luts/protune.cube", BurnTimestamp: overlay, Location: time.UTC}
+
+	// The timestamp goes on top of the graded video, not through the LUT
+	args := strings.Join(mergeArgs(spec, opts), " ")
+	if !strings.Contains(args, "-filter:v lut3d=file=/luts/protune.cube,drawtext=text=%{pts\\\\:gmtime\\\\:1783168200.000") {
+		t.Errorf("Expected the timestamp after the LUT, got: %s", args)
+	}
+
+	target := encodeSettings{VideoCodec: "libx264", Width: 1920, Height: 1080}
+	opts.LUT = ""
+	args = strings.Join(reencodeArgs(spec, []string{"a.mp4", "b.mp4"}, target, -1, opts), " ")
+	if !strings.Contains(args, "concat=n=2:v=1:a=0[v];[v]drawtext=") || !strings.Contains(args, "[graded] -map [graded]") {
+		t.Errorf("Expected the timestamp after the concat filter, got: %s", args)
+	}
+}
+
+func TestBurnTimestampNeedsReencode(t *testing.T) {
+	dir := t.TempDir()
+	overlay := &TimestampOverlay{Position: positionBottomRight, Format: defaultTimestampFormat}
+	for _, test := range []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{BurnTimestamp: overlay}, "-burn-timestamp only applies when re-encoding"},
+		{Options{BurnTimestamp: overlay, Reencode: true, Intro: filepath.Join(dir, "intro.mp4")}, "cannot be combined with -intro or -outro"},
+	} {
+		err := mergeFiles(filepath.Join(dir, "merged.mp4"), []string{filepath.Join(dir, "GH011234.MP4")}, time.Now(), time.Now(), test.opts)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected %q, got %v", test.expected, err)
+		}
+	}
+
+	for args, expected := range map[string]string{
+		"-burn-timestamp": "Add -reencode",
+		"-reencode -burn-timestamp -timestamp-size -2":    "invalid -timestamp-size",
+		"-reencode -burn-timestamp -timestamp-position x": "invalid -timestamp-position",
+		"-reencode -timestamp-position top-left":          "only apply with -burn-timestamp",
+	} {
+		var stdout, stderr bytes.Buffer
+		code := run(append(strings.Fields(args), "out.mp4", "GH011234.MP4"), &stdout, &stderr)
+		if code != exitUsage || !strings.Contains(stderr.String(), expected) {
+			t.Errorf("Expected %s to be refused with %q, got %d: %s", args, expected, code, stderr.String())
+		}
+	}
+}
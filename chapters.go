@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// chapterMark is a chapter written into the merged output.
+type chapterMark struct {
+	Start time.Duration
+	End   time.Duration
+	Title string
+}
+
+// MarshalJSON encodes the chapter with its times in seconds.
+func (c chapterMark) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+		Title string  `json:"title"`
+	}{c.Start.Seconds(), c.End.Seconds(), c.Title})
+}
+
+// inputDurations returns the duration of every input from its probe result.
+func inputDurations(probes []ProbeResult) []time.Duration {
+	durations := make([]time.Duration, len(probes))
+	for i, probe := range probes {
+		durations[i] = time.Duration(probe.Duration * float64(time.Second))
+	}
+	return durations
+}
+
+// fileChapters returns a chapter for every input file, starting where the
+// file begins in the merged output.
+func fileChapters(files []FileInfo, durations []time.Duration) []chapterMark {
+	var chapters []chapterMark
+	var start time.Duration
+	for i, file := range files {
+		name := filepath.Base(file.Path)
+		chapters = append(chapters, chapterMark{
+			Start: start,
+			End:   start + durations[i],
+			Title: fmt.Sprintf("Chapter %d – %s", i+1, strings.TrimSuffix(name, filepath.Ext(name))),
+		})
+		start += durations[i]
+	}
+	return chapters
+}
+
+var ffmetadataEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"=", `\=`,
+	";", `\;`,
+	"#", `\#`,
+	"\n", "\\\n",
+)
+
+// writeFFMetadata writes chapters in ffmpeg's FFMETADATA format.
+func writeFFMetadata(w io.Writer, chapters []chapterMark) error {
+	if _, err := fmt.Fprintln(w, ";FFMETADATA1"); err != nil {
+		return err
+	}
+	for _, chapter := range chapters {
+		_, err := fmt.Fprintf(w, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			chapter.Start.Milliseconds(), chapter.End.Milliseconds(), ffmetadataEscaper.Replace(chapter.Title))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeChaptersFile writes chapters to a temporary FFMETADATA file for
+// the merge into outputPath and returns its path. The caller removes it.
+func writeChaptersFile(outputPath string, chapters []chapterMark, opts Options) (string, error) {
+	file, err := opts.createTempFile(outputPath, ".ffmetadata")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer file.Close()
+
+	if err := writeFFMetadata(file, chapters); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write to temp file: %v", err)
+	}
+	return file.Name(), nil
+}
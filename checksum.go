@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Hashes -checksum writes a sidecar with.
+const (
+	checksumSHA256 = "sha256"
+	checksumMD5    = "md5"
+	checksumXXH64  = "xxh64"
+)
+
+// checksumAlgorithms are the hashes of -checksum, in the order verify
+// looks for their sidecars.
+var checksumAlgorithms = []string{checksumSHA256, checksumMD5, checksumXXH64}
+
+// checksumResult is the digest of one output, as recorded in the JSON
+// report.
+type checksumResult struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"`
+	Sidecar   string `json:"sidecar"`
+}
+
+func validateChecksum(algo string) error {
+	if _, err := newHash(algo); err != nil {
+		return fmt.Errorf("invalid -checksum %q: must be sha256, md5 or xxh64", algo)
+	}
+	return nil
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case checksumSHA256:
+		return sha256.New(), nil
+	case checksumMD5:
+		return md5.New(), nil
+	case checksumXXH64:
+		return newXXH64(), nil
+	}
+	return nil, fmt.Errorf("unknown hash %s", algo)
+}
+
+// checksumPath is the sidecar holding the algo digest of path, e.g.
+// out.mp4.sha256.
+func checksumPath(path, algo string) string {
+	return path + "." + algo
+}
+
+// hashProgress rewrites a status line on w as the bytes of a file of
+// size go through it.
+type hashProgress struct {
+	w       io.Writer
+	label   string
+	size    int64
+	done    int64
+	percent int
+}
+
+func (p *hashProgress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	percent := 100
+	if p.size > 0 {
+		percent = int(100 * p.done / p.size)
+	}
+	// Only print when the percentage changes, hashing reads in small blocks
+	if percent != p.percent {
+		p.percent = percent
+		fmt.Fprintf(p.w, "\r%s: %3d%% (%s of %s)", p.label, percent, formatSize(p.done), formatSize(p.size))
+		if percent >= 100 {
+			fmt.Fprintln(p.w)
+		}
+	}
+	return len(b), nil
+}
+
+// isTerminal reports whether w is a terminal, where a progress line can
+// be rewritten in place.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// fileChecksum streams path through the algo hash and returns its hex
+// digest. When progress is a terminal, it shows how far the hash has come,
+// since outputs of several gigabytes take a while.
+func fileChecksum(path, algo string, progress io.Writer) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var w io.Writer = h
+	if isTerminal(progress) {
+		info, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		w = io.MultiWriter(h, &hashProgress{w: progress, label: "hashing " + filepath.Base(path), size: info.Size(), percent: -1})
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeChecksum hashes path with algo and writes the digest next to it in
+// the "HASH  filename" format of sha256sum and md5sum, so that they can
+// check it too. It must run on the final path, after the rename of the
+// output, so that the sidecar names the file that is kept.
+func writeChecksum(path, algo string, progress io.Writer) (checksumResult, error) {
+	digest, err := fileChecksum(path, algo, progress)
+	if err != nil {
+		return checksumResult{}, err
+	}
+	sidecar := checksumPath(path, algo)
+	line := fmt.Sprintf("%s  %s\n", digest, filepath.Base(path))
+	if err := os.WriteFile(sidecar, []byte(line), 0644); err != nil {
+		return checksumResult{}, fmt.Errorf("failed to write checksum: %v", err)
+	}
+	return checksumResult{Path: path, Algorithm: algo, Digest: digest, Sidecar: sidecar}, nil
+}
+
+// writeChecksums writes the checksum of the output at outputPath, or of
+// each of its parts when it was split, and returns those written until
+// the first that fails.
+func writeChecksums(outputPath string, parts []Part, algo string, progress io.Writer) ([]checksumResult, error) {
+	hashed := []string{outputPath}
+	if len(parts) > 0 {
+		hashed = nil
+		for _, part := range parts {
+			hashed = append(hashed, part.Path)
+		}
+	}
+	var results []checksumResult
+	for _, path := range hashed {
+		result, err := writeChecksum(path, algo, progress)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// readChecksum reads the digest of path from its sidecar. A sidecar
+// written by hand may list several files, the line naming path counts.
+func readChecksum(sidecar, path string) (string, error) {
+	f, err := os.Open(sidecar)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		digest, name, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		// A * before the name marks binary mode in the format of sha256sum
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		if name == filepath.Base(path) {
+			return strings.ToLower(digest), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s has no checksum of %s", sidecar, filepath.Base(path))
+}
+
+// verifyChecksum hashes path again and compares the digest with the one
+// in its sidecar, the first of checksumAlgorithms found. It returns the
+// algorithm and whether the digests match.
+func verifyChecksum(path string, progress io.Writer) (string, bool, error) {
+	for _, algo := range checksumAlgorithms {
+		sidecar := checksumPath(path, algo)
+		if _, err := os.Stat(sidecar); err != nil {
+			continue
+		}
+		expected, err := readChecksum(sidecar, path)
+		if err != nil {
+			return algo, false, err
+		}
+		digest, err := fileChecksum(path, algo, progress)
+		if err != nil {
+			return algo, false, err
+		}
+		return algo, digest == expected, nil
+	}
+	return "", false, fmt.Errorf("no checksum sidecar found for %s", path)
+}
+
+// runVerify re-checks files against the sidecars -checksum wrote.
+func runVerify(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: GoProConcat verify file1 [file2 ...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	code := exitOK
+	for _, path := range flags.Args() {
+		algo, ok, err := verifyChecksum(path, stderr)
+		switch {
+		case err != nil:
+			fmt.Fprintf(stderr, "Error verifying %s: %v\n", path, err)
+			code = exitError
+		case !ok:
+			fmt.Fprintf(stdout, "%s: FAILED (%s)\n", path, algo)
+			code = exitError
+		default:
+			fmt.Fprintf(stdout, "%s: OK (%s)\n", path, algo)
+		}
+	}
+	return code
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestXXH64(t *testing.T) {
+	for input, expected := range map[string]string{
+		"":    "ef46db3751d8e999",
+		"a":   "d24ec4f1a98c6e5b",
+		"abc": "44bc2cf5ad770999",
+		"Nobody inspects the spammish repetition": "fbcea83c8a378bf1",
+	} {
+		h := newXXH64()
+		h.Write([]byte(input))
+		if digest := fmt.Sprintf("%x", h.Sum(nil)); digest != expected {
+			t.Errorf("%q: expected %s, got %s", input, expected, digest)
+		}
+
+		// Writes of any size give the same digest
+		h.Reset()
+		for i := range len(input) {
+			h.Write([]byte{input[i]})
+		}
+		if digest := fmt.Sprintf("%016x", h.Sum64()); digest != expected {
+			t.Errorf("%q byte by byte: expected %s, got %s", input, expected, digest)
+		}
+	}
+}
+
+func TestChecksumSidecar(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "merged.mp4")
+	if err := os.WriteFile(path, []byte("recording"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for algo, expected := range map[string]string{
+		checksumSHA256: "3ebb153fb24e4411400e94a9a92b0ec458c3a8473e51e03cd37d4a34c99dfda6",
+		checksumMD5:    "fb89b9c2b78261ef2ab506e30d9c84f7",
+	} {
+		result, err := writeChecksum(path, algo, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Digest != expected {
+			t.Errorf("%s: expected %s, got %s", algo, expected, result.Digest)
+		}
+		sidecar, err := os.ReadFile(checksumPath(path, algo))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line := result.Digest + "  merged.mp4\n"; string(sidecar) != line {
+			t.Errorf("%s: expected the sidecar %q, got %q", algo, line, sidecar)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"verify", path}, &stdout, &stderr); code != exitOK || !strings.Contains(stdout.String(), "merged.mp4: OK (sha256)") {
+		t.Errorf("Expected the output to verify, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+
+	// A changed file fails
+	if err := os.WriteFile(path, []byte("recordinG"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	if code := run([]string{"verify", path}, &stdout, &stderr); code != exitError || !strings.Contains(stdout.String(), "FAILED") {
+		t.Errorf("Expected a changed file to fail, got %d: %s", code, stdout.String())
+	}
+
+	// So does a file without a sidecar
+	stderr.Reset()
+	if code := run([]string{"verify", filepath.Join(dir, "other.mp4")}, &stdout, &stderr); code != exitError || !strings.Contains(stderr.String(), "no checksum sidecar") {
+		t.Errorf("Expected a missing sidecar to fail, got %d: %s", code, stderr.String())
+	}
+}
+
+func TestReadChecksum(t *testing.T) {
+	dir := t.TempDir()
+	sidecar := filepath.Join(dir, "SHA256SUMS")
+	content := "0123abcd  GH010042.MP4\nABCDEF01 *merged.mp4\n"
+	if err := os.WriteFile(sidecar, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if digest, err := readChecksum(sidecar, filepath.Join(dir, "merged.mp4")); err != nil || digest != "abcdef01" {
+		t.Errorf("Expected the digest of the binary mode line, got %q: %v", digest, err)
+	}
+	if _, err := readChecksum(sidecar, filepath.Join(dir, "other.mp4")); err == nil {
+		t.Error("Expected an error for a file the sidecar does not list")
+	}
+}
+
+func TestChecksumFlag(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-checksum", "crc32", "out.mp4", "GH011234.MP4"}, &stdout, &stderr); code != exitUsage || !strings.Contains(stderr.String(), "invalid -checksum") {
+		t.Errorf("Expected an unknown hash to be refused, got %d: %s", code, stderr.String())
+	}
+}
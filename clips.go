@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Roles of the inputs that are not GoPro chapters.
+const (
+	roleIntro = "intro"
+	roleOutro = "outro"
+)
+
+// clipFiles returns the intro and outro of opts as inputs, in the order
+// they are merged around the chapters.
+func clipFiles(opts Options) (intro, outro []FileInfo) {
+	if opts.Intro != "" {
+		intro = []FileInfo{{Path: opts.Intro, Role: roleIntro}}
+	}
+	if opts.Outro != "" {
+		outro = []FileInfo{{Path: opts.Outro, Role: roleOutro}}
+	}
+	return intro, outro
+}
+
+// conformArgs builds the ffmpeg arguments re-encoding the clip read with
+// the input arguments into the format of target at outputPath. A clip
+// without audio gets a silent track, so it has the same streams as the
+// chapters.
+func conformArgs(input []string, clipAudio bool, target encodeSettings, opts Options, outputPath string) []string {
+	args := append(ffmpegArgs(opts.FFmpegLogLevel), input...)
+	audioInput := "0:a:0"
+	if target.Audio && !clipAudio {
+		args = append(args, "-f", "lavfi", "-i", "anullsrc")
+		audioInput = "1:a:0"
+	}
+
+	video := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1",
+		target.Width, target.Height, target.Width, target.Height)
+	if target.FrameRate != "" {
+		video += ",fps=" + target.FrameRate
+	}
+	if target.PixFmt != "" {
+		video += ",format=" + target.PixFmt
+	}
+	args = append(args, "-map", "0:v:0", "-vf", video)
+	args = append(args, encoderArgs(opts)...)
+	if target.Audio {
+		args = append(args,
+			"-map", audioInput,
+			"-c:a", "aac",
+			"-ar", target.SampleRate,
+			"-ac", fmt.Sprint(target.Channels),
+			"-shortest")
+	}
+	return append(args, "-y", "-f", "mp4", outputPath)
+}
+
+// chapterTarget returns the settings that re-encode a clip into the format
+// of the chapters described by chapter, and the options to encode it with.
+// Stream copy needs the codec of the chapters, not just their format.
+func chapterTarget(chapter ProbeResult, opts Options) (encodeSettings, Options, error) {
+	video, ok := chapter.firstStream("video")
+	if _, known := softwareCodecEncoders[video.CodecName]; !ok || !known {
+		return encodeSettings{}, opts, fmt.Errorf("no encoder matches chapters with video codec %q", video.CodecName)
+	}
+	opts.VideoCodec = video.CodecName
+	opts.Bitrate = ""
+	return reencodeTarget([]ProbeResult{chapter}, opts), opts, nil
+}
+
+// conformClip returns clip unchanged when it can be concatenated with the
+// chapters described by chapter with stream copy, otherwise it re-encodes
+// clip to their format into a temporary file. The returned function
+// removes that file.
+func conformClip(outputPath string, clip FileInfo, chapter ProbeResult, opts Options) (string, func(), error) {
+	logger := opts.logger()
+	probe, err := opts.probe(clip.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	mismatches := checkConsistency([]FileInfo{{}, clip}, []ProbeResult{chapter, probe})
+	if len(mismatches) == 0 {
+		return clip.Path, func() {}, nil
+	}
+	for _, mismatch := range mismatches {
+		logger.Info("clip differs from the chapters", "clip", clip.Path, "param", mismatch.Param, "expected", mismatch.Expected, "actual", mismatch.Actual)
+	}
+
+	target, clipOpts, err := chapterTarget(chapter, opts)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot re-encode the %s %s: %v", clip.Role, clip.Path, err)
+	}
+	_, clipAudio := probe.firstStream("audio")
+
+	conformed, err := opts.createTempFile(outputPath, "."+clip.Role+".mp4")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	conformed.Close()
+	remove := func() { os.Remove(conformed.Name()) }
+
+	logger.Info("re-encoding clip to match the chapters", "clip", clip.Path, "settings", target.String())
+	cmd := ffmpegCommand(conformArgs([]string{"-i", clip.Path}, clipAudio, target, clipOpts, conformed.Name())...)
+	if err := runCommand(logger, cmd); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("failed to re-encode the %s %s: %v", clip.Role, filepath.Base(clip.Path), err)
+	}
+	return conformed.Name(), remove, nil
+}
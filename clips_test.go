@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeFilesIntroOutro(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	// Given out of order, the chapters are still sorted between the clips
+	for _, name := range []string{"GH021234.MP4", "GH011234.MP4", "intro.mov", "outro.mp4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("clip "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	introPath, outroPath := inputPaths[2], inputPaths[3]
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	// A 720p intro without audio, an outro in the format of the chapters
+	intro := ProbeResult{Duration: 5, Streams: []StreamInfo{
+		{Index: 0, CodecType: "video", CodecName: "h264", Width: 1280, Height: 720, FrameRate: "30/1", PixFmt: "yuv420p"},
+	}}
+	outro := ProbeResult{Duration: 3, Streams: []StreamInfo{hero.Streams[0], hero.Streams[1]}}
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		switch path {
+		case introPath:
+			return intro, nil
+		case outroPath:
+			return outro, nil
+		case partialPath(outputPath):
+			return ProbeResult{Streams: []StreamInfo{hero.Streams[0], hero.Streams[1]}}, nil
+		}
+		return hero, nil
+	}
+
+	var commands [][]string
+	var list string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		commands = append(commands, cmd.Args)
+		if i := indexOf(cmd.Args, "concat"); i >= 0 {
+			data, err := os.ReadFile(cmd.Args[i+4])
+			if err != nil {
+				return err
+			}
+			list = string(data)
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	opts := Options{Intro: introPath, Outro: outroPath}
+	if err := mergeFiles(outputPath, inputPaths[:2], time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if len(commands) != 2 {
+		t.Fatalf("Expected the intro to be re-encoded before the merge, got %v", commands)
+	}
+
+	conform := strings.Join(commands[0], " ")
+	for _, expected := range []string{
+		"-i " + introPath + " -f lavfi -i anullsrc",
+		"-vf scale=1920:1080:force_original_aspect_ratio=decrease,pad=1920:1080:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=60000/1001,format=yuvj420p",
+		"-c:v libx264 -crf 20 -preset medium -map 1:a:0 -c:a aac -ar 48000 -ac 2",
+	} {
+		if !strings.Contains(conform, expected) {
+			t.Errorf("Expected %q in the intro command, got: %s", expected, conform)
+		}
+	}
+
+	conformed := commands[0][len(commands[0])-1]
+	expectedList := "file '" + conformed + "'\n" +
+		"file '" + filepath.Join(dir, "GH011234.MP4") + "'\n" +
+		"file '" + filepath.Join(dir, "GH021234.MP4") + "'\n" +
+		"file '" + outroPath + "'\n"
+	if list != expectedList {
+		t.Errorf("Expected concat list\n%s\ngot\n%s", expectedList, list)
+	}
+
+	// The intro has no data streams, so they and the timecode are left out
+	merge := strings.Join(commands[1], " ")
+	if !strings.Contains(merge, "-map 0:0 -map 0:1 -copy_unknown") || strings.Contains(merge, "gpmd") || strings.Contains(merge, "timecode") {
+		t.Errorf("Expected only video and audio to be mapped, got: %s", merge)
+	}
+	if _, err := os.Stat(conformed); !os.IsNotExist(err) {
+		t.Errorf("Expected the re-encoded intro to be removed, got: %v", err)
+	}
+}
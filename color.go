@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// colorInfo is the color description of a video stream. GoPro writes it
+// for HDR and 10-bit recordings, e.g. bt2020 primaries with the HLG
+// (arib-std-b67) transfer; without it players show them washed out.
+type colorInfo struct {
+	Primaries string
+	Transfer  string
+	Space     string
+	Range     string
+}
+
+// color returns the color description of the stream. ffprobe reports
+// unknown or leaves out the properties a stream does not describe.
+func (s StreamInfo) color() colorInfo {
+	known := func(value string) string {
+		if value == "unknown" {
+			return ""
+		}
+		return value
+	}
+	return colorInfo{
+		Primaries: known(s.ColorPrimaries),
+		Transfer:  known(s.ColorTransfer),
+		Space:     known(s.ColorSpace),
+		Range:     known(s.ColorRange),
+	}
+}
+
+// known reports whether the stream describes any of its color properties.
+func (c colorInfo) known() bool {
+	return c != colorInfo{}
+}
+
+func (c colorInfo) String() string {
+	if !c.known() {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", orUnknown(c.Primaries), orUnknown(c.Transfer), orUnknown(c.Space), orUnknown(c.Range))
+}
+
+// colorArgs restates c for the video stream of the output, so it reaches
+// the muxer even where the concat demuxer or a decoder drops it, and an
+// encoder tags the video it writes with it.
+func colorArgs(c colorInfo) []string {
+	var args []string
+	for _, option := range []struct{ name, value string }{
+		{"-color_primaries:v:0", c.Primaries},
+		{"-color_trc:v:0", c.Transfer},
+		{"-colorspace:v:0", c.Space},
+		{"-color_range:v:0", c.Range},
+	} {
+		if option.value != "" {
+			args = append(args, option.name, option.value)
+		}
+	}
+	return args
+}
+
+// verifyColor checks that the video stream of outputPath has the color
+// description expected, the one of the first chapter.
+func verifyColor(outputPath string, expected colorInfo) error {
+	probe, err := probeFile(outputPath)
+	if err != nil {
+		return err
+	}
+	video, ok := probe.firstStream("video")
+	if !ok {
+		return fmt.Errorf("merged file %s has no video stream", outputPath)
+	}
+	got := video.color()
+	var lost []string
+	for _, property := range []struct{ name, expected, got string }{
+		{"primaries", expected.Primaries, got.Primaries},
+		{"transfer", expected.Transfer, got.Transfer},
+		{"matrix", expected.Space, got.Space},
+		{"range", expected.Range, got.Range},
+	} {
+		if property.expected != property.got {
+			lost = append(lost, fmt.Sprintf("%s %s instead of %s", property.name, orUnknown(property.got), orUnknown(property.expected)))
+		}
+	}
+	if len(lost) > 0 {
+		return fmt.Errorf("merged file %s lost the color description of the inputs: %s", outputPath, strings.Join(lost, ", "))
+	}
+	return nil
+}
+
+// orUnknown returns value, or "unknown" when it is empty.
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hdrProbe returns the hero fixture with the color description of a 10-bit
+// HLG recording.
+func hdrProbe(t *testing.T) ProbeResult {
+	t.Helper()
+	probe := loadProbeFixture(t, "hero_probe.json")
+	probe.Streams = append([]StreamInfo(nil), probe.Streams...)
+	video := &probe.Streams[0]
+	video.PixFmt = "yuv420p10le"
+	video.ColorPrimaries = "bt2020"
+	video.ColorTransfer = "arib-std-b67"
+	video.ColorSpace = "bt2020nc"
+	video.ColorRange = "tv"
+	return probe
+}
+
+func TestColorArgs(t *testing.T) {
+	video, _ := hdrProbe(t).firstStream("video")
+	expected := []string{
+		"-color_primaries:v:0", "bt2020",
+		"-color_trc:v:0", "arib-std-b67",
+		"-colorspace:v:0", "bt2020nc",
+		"-color_range:v:0", "tv",
+	}
+	if got := colorArgs(video.color()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	// ffprobe reports unknown for the properties a stream leaves out
+	sdr := StreamInfo{ColorPrimaries: "unknown", ColorRange: "tv"}
+	if got := colorArgs(sdr.color()); !reflect.DeepEqual(got, []string{"-color_range:v:0", "tv"}) {
+		t.Errorf("Expected only the range, got %q", got)
+	}
+	if (StreamInfo{ColorSpace: "unknown"}).color().known() {
+		t.Error("Expected a stream with only unknown properties to have no color description")
+	}
+}
+
+func TestCheckConsistencyColor(t *testing.T) {
+	hdr := hdrProbe(t)
+	sdr := loadProbeFixture(t, "hero_probe.json")
+	sdr.Streams[0].PixFmt = hdr.Streams[0].PixFmt
+	files := []FileInfo{{Path: "GX011234.MP4"}, {Path: "GX021234.MP4"}}
+
+	mismatches := checkConsistency(files, []ProbeResult{hdr, sdr})
+	if len(mismatches) != 1 || mismatches[0].Param != "color" || mismatches[0].Expected != "bt2020/arib-std-b67/bt2020nc/tv" || mismatches[0].Actual != "unknown" {
+		t.Errorf("Expected a color mismatch, got %+v", mismatches)
+	}
+}
+
+func TestMergeFilesColor(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GX011234.MP4", "GX021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hdr := hdrProbe(t)
+	output := hdr
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		if path == partialPath(outputPath) {
+			return output, nil
+		}
+		return hdr, nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	command := strings.Join(merge, " ")
+	for _, arg := range []string{"-movflags +write_colr", "-color_primaries:v:0 bt2020", "-color_trc:v:0 arib-std-b67", "-colorspace:v:0 bt2020nc"} {
+		if !strings.Contains(command, arg) {
+			t.Errorf("Expected %q in the merge command, got: %s", arg, command)
+		}
+	}
+
+	// An output that lost the transfer fails verification
+	output.Streams = append([]StreamInfo(nil), hdr.Streams...)
+	output.Streams[0].ColorTransfer = "unknown"
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{})
+	if err == nil || !strings.Contains(err.Error(), "transfer unknown instead of arib-std-b67") {
+		t.Errorf("Expected the lost transfer to fail the merge, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// concatListEntry is the line of an ffmpeg concat list for path. Inside
+// single quotes nothing is special but the quote itself, which is closed,
+// escaped and reopened.
+func concatListEntry(path string) string {
+	return "file '" + strings.ReplaceAll(path, "'", `'\''`) + "'\n"
+}
+
+// writeConcatList writes the concat list of the files, in their order, to
+// listPath.
+func writeConcatList(listPath string, files []FileInfo) error {
+	var list strings.Builder
+	for _, file := range files {
+		list.WriteString(concatListEntry(file.Path))
+	}
+	if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write concat list %s: %v", listPath, err)
+	}
+	return nil
+}
+
+// readConcatList returns the paths of the file directives of the ffmpeg
+// concat list at listPath, in their order. Relative paths are resolved
+// against the directory of the list, like ffmpeg does. Other directives
+// are refused, as the merge builds its own.
+func readConcatList(listPath string) ([]string, error) {
+	f, err := os.Open(listPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read concat list %s: %v", listPath, err)
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		tokens, err := concatListTokens(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", listPath, line, err)
+		}
+		switch {
+		case len(tokens) == 0:
+		case tokens[0] == "ffconcat" && line == 1 && len(tokens) == 3 && tokens[1] == "version":
+		case tokens[0] == "file" && len(tokens) == 2:
+			path := tokens[1]
+			if !filepath.IsAbs(path) && !isRemote(path) {
+				path = filepath.Join(filepath.Dir(listPath), path)
+			}
+			paths = append(paths, path)
+		case tokens[0] == "file":
+			return nil, fmt.Errorf("%s:%d: expected a single path after file", listPath, line)
+		default:
+			return nil, fmt.Errorf("%s:%d: unsupported directive %s, only file is", listPath, line, tokens[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read concat list %s: %v", listPath, err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w in concat list %s", errNoInputFiles, listPath)
+	}
+	return paths, nil
+}
+
+// concatListTokens splits a line of a concat list into words the way
+// ffmpeg does: whitespace separates them, single quotes keep everything up
+// to the next quote, a backslash escapes the next character and # starts a
+// comment.
+func concatListTokens(line string) ([]string, error) {
+	var tokens []string
+	var token strings.Builder
+	inToken := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '#' && !inToken:
+			return tokens, nil
+		case c == ' ' || c == '\t' || c == '\r':
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		case c == '\\':
+			if i+1 == len(line) {
+				return nil, fmt.Errorf("backslash at the end of the line")
+			}
+			i++
+			token.WriteByte(line[i])
+			inToken = true
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			token.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inToken = true
+		default:
+			token.WriteByte(c)
+			inToken = true
+		}
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
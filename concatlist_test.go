@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConcatList(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "trip.txt")
+	list := "ffconcat version 1.0\n" +
+		"# first day\n" +
+		"file '/Volumes/GOPRO/Tom'\\''s trip/GH010001.MP4'\n" +
+		"\n" +
+		"  file GH020001.MP4 # relative to the list\n" +
+		"file sub\\ dir/GH030001.MP4\r\n" +
+		"file 'https://camera.local/GH040001.MP4'\n"
+	if err := os.WriteFile(listPath, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := readConcatList(listPath)
+	if err != nil {
+		t.Fatalf("readConcatList() error: %v", err)
+	}
+	expected := []string{
+		"/Volumes/GOPRO/Tom's trip/GH010001.MP4",
+		filepath.Join(dir, "GH020001.MP4"),
+		filepath.Join(dir, "sub dir", "GH030001.MP4"),
+		"https://camera.local/GH040001.MP4",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %q, got %q", expected, paths)
+	}
+
+	for list, expected := range map[string]string{
+		"file 'GH010001.MP4\n":                "trip.txt:1: unterminated quote",
+		"file GH010001.MP4 GH020001.MP4\n":    "trip.txt:1: expected a single path after file",
+		"file GH010001.MP4\ninpoint 10\n":     "trip.txt:2: unsupported directive inpoint",
+		"# nothing but a comment\n":           "no GoPro files found in concat list",
+		"file GH010001.MP4\nffconcat version": "trip.txt:2: unsupported directive ffconcat",
+	} {
+		if err := os.WriteFile(listPath, []byte(list), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConcatList(listPath); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q for %q, got %v", expected, list, err)
+		}
+	}
+}
+
+func TestConcatListRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), `Tom's "best" trip \ 2024`)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var inputPaths []string
+	for _, name := range []string{"GH021234.MP4", "GH011234.MP4", "GH031234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		if strings.HasSuffix(path, partialSuffix) {
+			return ProbeResult{Streams: hero.Streams}, nil
+		}
+		return hero, nil
+	}
+	var list string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		if i := indexOf(cmd.Args, "concat"); i >= 0 {
+			data, err := os.ReadFile(cmd.Args[i+4])
+			if err != nil {
+				return err
+			}
+			list = string(data)
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	var stdout, stderr bytes.Buffer
+	listPath := filepath.Join(t.TempDir(), "trip.txt")
+	if code := run([]string{"-list-only", listPath, dir}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Expected -list-only to succeed, got %d: %s", code, stderr.String())
+	}
+	written, err := os.ReadFile(listPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(name string) string {
+		return "file '" + strings.ReplaceAll(filepath.Join(dir, name), "'", `'\''`) + "'\n"
+	}
+	expected := entry("GH011234.MP4") + entry("GH021234.MP4") + entry("GH031234.MP4")
+	if string(written) != expected {
+		t.Fatalf("Expected the list in merge order\n%s\ngot\n%s", expected, written)
+	}
+
+	if err := mergeFiles(filepath.Join(dir, "direct.mp4"), inputPaths, time.Now(), time.Now(), Options{}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	direct := list
+
+	listed, err := readConcatList(listPath)
+	if err != nil {
+		t.Fatalf("readConcatList() error: %v", err)
+	}
+	if !reflect.DeepEqual(listed, []string{inputPaths[1], inputPaths[0], inputPaths[2]}) {
+		t.Errorf("Expected the escaped paths to read back unchanged, got %q", listed)
+	}
+	if err := mergeFiles(filepath.Join(dir, "listed.mp4"), listed, time.Now(), time.Now(), Options{KeepOrder: true}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if list != direct || list != string(written) {
+		t.Errorf("Expected the merge from the list to concatenate\n%s\nlike the direct merge, got\n%s", direct, list)
+	}
+}
+
+func TestOrderFilesKeepOrder(t *testing.T) {
+	inputPaths := []string{"/trip/GH030001.MP4", "/trip/GH010001.MP4", "/trip/GH020001.MP4"}
+	files, err := orderFiles(inputPaths, Options{KeepOrder: true, OrderBy: orderByModTime})
+	if err != nil {
+		t.Fatalf("orderFiles() error: %v", err)
+	}
+	for i, file := range files {
+		if file.Path != inputPaths[i] {
+			t.Errorf("Expected %s at %d, got %s", inputPaths[i], i, file.Path)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// inputMismatch is a parameter in which an input differs from the first
+// one. Concatenating such inputs with stream copy produces broken files.
+type inputMismatch struct {
+	Path     string `json:"path"`
+	Param    string `json:"param"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+func (m inputMismatch) String() string {
+	return fmt.Sprintf("%s: %s is %s, expected %s", filepath.Base(m.Path), m.Param, m.Actual, m.Expected)
+}
+
+// mismatchError aborts a merge of inputs that differ from the first one.
+type mismatchError struct {
+	First      string
+	Mismatches []inputMismatch
+}
+
+func (e *mismatchError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "inputs differ from %s, concatenating them with stream copy would produce a broken file:\n", filepath.Base(e.First))
+	writeMismatchTable(&b, e.Mismatches)
+	for _, m := range slowMotionMismatches(e.Mismatches) {
+		fmt.Fprintf(&b, "%s looks like slow motion mixed with normal speed video, merged it will not play back slowed down\n", filepath.Base(m.Path))
+	}
+	if hasAudioMismatch(e.Mismatches) {
+		b.WriteString("Use -drop-audio to merge them without audio")
+	} else if onlySampleRates(e.Mismatches) {
+		b.WriteString("Use -resample-audio to resample their audio to the rate of the first chapter while the video is copied, or -reencode to re-encode them entirely")
+	} else {
+		b.WriteString("Use -reencode to re-encode them to the format of the first chapter, or -allow-mismatch to merge them anyway")
+	}
+	return b.String()
+}
+
+// hasAudioMismatch reports whether some inputs have an audio track and
+// others do not. Neither re-encoding nor stream copy can join those.
+func hasAudioMismatch(mismatches []inputMismatch) bool {
+	for _, m := range mismatches {
+		if m.Param == "audio" {
+			return true
+		}
+	}
+	return false
+}
+
+// onlySampleRates reports whether the inputs differ in nothing but the
+// sample rate of their audio, which -resample-audio fixes.
+func onlySampleRates(mismatches []inputMismatch) bool {
+	sampleRates, others := splitSampleRates(mismatches)
+	return len(sampleRates) > 0 && len(others) == 0
+}
+
+// splitSampleRates separates the sample rate mismatches from the others.
+func splitSampleRates(mismatches []inputMismatch) (sampleRates, others []inputMismatch) {
+	for _, m := range mismatches {
+		if m.Param == "sample rate" {
+			sampleRates = append(sampleRates, m)
+		} else {
+			others = append(others, m)
+		}
+	}
+	return sampleRates, others
+}
+
+// slowMotionRate is the lowest frame rate GoPro records slow motion at,
+// 120 and 240 fps, to be played back at a normal frame rate.
+const slowMotionRate = 100
+
+// isSlowMotion reports whether a chapter recorded at actual fps next to
+// one at expected fps looks like slow motion mixed with normal speed
+// video: one of them at slowMotionRate or above, and at least twice the
+// other. A 50 against a 60 fps chapter is a different mismatch.
+func isSlowMotion(expected, actual string) bool {
+	e, err1 := parseFrameRate(expected)
+	a, err2 := parseFrameRate(actual)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	high, low := max(e, a), min(e, a)
+	return high >= slowMotionRate && high >= 2*low
+}
+
+// slowMotionMismatches returns the frame rate mismatches that look like
+// slow motion, see isSlowMotion. Merged, a slow motion chapter plays at
+// real speed instead of slowed down: with stream copy at a frame rate that
+// changes mid-file, re-encoded with the extra frames dropped.
+func slowMotionMismatches(mismatches []inputMismatch) []inputMismatch {
+	var slowMotion []inputMismatch
+	for _, m := range mismatches {
+		if m.Param == "frame rate" && isSlowMotion(m.Expected, m.Actual) {
+			slowMotion = append(slowMotion, m)
+		}
+	}
+	return slowMotion
+}
+
+// writeMismatchTable lists mismatches in aligned columns.
+func writeMismatchTable(w io.Writer, mismatches []inputMismatch) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  FILE\tPARAMETER\tEXPECTED\tACTUAL")
+	for _, m := range mismatches {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", filepath.Base(m.Path), m.Param, m.Expected, m.Actual)
+	}
+	tw.Flush()
+}
+
+// streamParam is a named parameter compared between inputs, or between
+// the inputs and the output.
+type streamParam struct {
+	Name  string
+	Value string
+}
+
+// concatParams lists the parameters stream copy concatenation needs to be
+// the same in every input. The presence of video and audio comes first,
+// the parameters of a missing stream are left out.
+func concatParams(probe ProbeResult) []streamParam {
+	var params []streamParam
+	if video, ok := probe.firstStream("video"); ok {
+		params = append(params,
+			streamParam{"video", "present"},
+			streamParam{"video codec", video.CodecName},
+			streamParam{"resolution", fmt.Sprintf("%dx%d", video.Width, video.Height)},
+			streamParam{"frame rate", video.FrameRate},
+			streamParam{"pixel format", video.PixFmt},
+			streamParam{"color", video.color().String()})
+	} else {
+		params = append(params, streamParam{"video", "none"})
+	}
+	if audio, ok := probe.firstStream("audio"); ok {
+		params = append(params,
+			streamParam{"audio", "present"},
+			streamParam{"audio codec", audio.CodecName},
+			streamParam{"sample rate", audio.SampleRate},
+			streamParam{"channels", strconv.Itoa(audio.Channels)})
+	} else {
+		params = append(params, streamParam{"audio", "none"})
+	}
+	return params
+}
+
+// checkConsistency compares every file against the first one. probes holds
+// the probe result of each file.
+func checkConsistency(files []FileInfo, probes []ProbeResult) []inputMismatch {
+	if len(probes) == 0 {
+		return nil
+	}
+	expected := concatParams(probes[0])
+	var mismatches []inputMismatch
+	for i := 1; i < len(files); i++ {
+		actual := make(map[string]string)
+		for _, param := range concatParams(probes[i]) {
+			actual[param.Name] = param.Value
+		}
+		for _, param := range expected {
+			// A missing stream is reported once by its presence
+			value, ok := actual[param.Name]
+			if ok && value != param.Value {
+				mismatches = append(mismatches, inputMismatch{
+					Path:     files[i].Path,
+					Param:    param.Name,
+					Expected: param.Value,
+					Actual:   value,
+				})
+			}
+		}
+	}
+	return mismatches
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	hero := loadProbeFixture(t, "hero_probe.json")
+	other := loadProbeFixture(t, "hero_probe.json")
+	other.Streams = append([]StreamInfo(nil), other.Streams...)
+	other.Streams[1].SampleRate = "44100"
+	silent := ProbeResult{Streams: []StreamInfo{hero.Streams[0]}}
+
+	files := []FileInfo{{Path: "GH011234.MP4"}, {Path: "GH021234.MP4"}, {Path: "GH031234.MP4"}}
+	if mismatches := checkConsistency(files[:2], []ProbeResult{hero, hero}); len(mismatches) != 0 {
+		t.Errorf("Expected matching inputs, got %v", mismatches)
+	}
+
+	mismatches := checkConsistency(files, []ProbeResult{hero, other, silent})
+	expected := []string{
+		"GH021234.MP4: sample rate is 44100, expected 48000",
+		"GH031234.MP4: audio is none, expected present",
+	}
+	if len(mismatches) != len(expected) {
+		t.Fatalf("Expected %d mismatches, got %v", len(expected), mismatches)
+	}
+	for i, mismatch := range mismatches {
+		if mismatch.String() != expected[i] {
+			t.Errorf("Expected mismatch %q, got %q", expected[i], mismatch.String())
+		}
+	}
+}
+
+func TestMergeFilesWithoutAudio(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	silent := hero
+	silent.Streams = withoutAudioStreams(hero.Streams)
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	inputProbes := map[string]ProbeResult{inputPaths[0]: hero, inputPaths[1]: silent}
+	var outputStreams []StreamInfo
+	probeFile = func(path string) (ProbeResult, error) {
+		if path == partialPath(outputPath) {
+			return ProbeResult{Streams: outputStreams}, nil
+		}
+		return inputProbes[path], nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	// Only the second chapter is silent, neither -reencode nor -allow-mismatch helps
+	for _, opts := range []Options{{}, {Reencode: true}, {AllowMismatch: true}} {
+		err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts)
+		var mismatch *mismatchError
+		if !errors.As(err, &mismatch) || !strings.Contains(err.Error(), "GH021234.MP4  audio      present   none") || !strings.Contains(err.Error(), "-drop-audio") {
+			t.Errorf("Expected the missing audio to abort the merge with %+v, got: %v", opts, err)
+		}
+	}
+
+	// Without audio the telemetry moves up to output stream 1
+	expected := "-map 0:0 -map 0:3 -tag:1 gpmd -map 0:4 -tag:2 fdsc -copy_unknown"
+	outputStreams = silent.Streams
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{DropAudio: true}); err != nil {
+		t.Fatalf("mergeFiles() error with -drop-audio: %v", err)
+	}
+	if command := strings.Join(merge, " "); !strings.Contains(command, expected) {
+		t.Errorf("Expected %q in command, got: %s", expected, command)
+	}
+
+	// A single chapter is remuxed without its audio instead of copied
+	merge = nil
+	if err := mergeFiles(outputPath, inputPaths[:1], time.Now(), time.Now(), Options{DropAudio: true}); err != nil {
+		t.Fatalf("mergeFiles() error with -drop-audio and one input: %v", err)
+	}
+	if command := strings.Join(merge, " "); !strings.Contains(command, expected) {
+		t.Errorf("Expected %q in command, got: %s", expected, command)
+	}
+
+	// The same mapping when every chapter is silent
+	merge = nil
+	inputProbes[inputPaths[0]] = silent
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{}); err != nil {
+		t.Fatalf("mergeFiles() error for silent chapters: %v", err)
+	}
+	if command := strings.Join(merge, " "); !strings.Contains(command, expected) {
+		t.Errorf("Expected %q in command, got: %s", expected, command)
+	}
+}
+
+func TestSlowMotionMismatch(t *testing.T) {
+	hero := loadProbeFixture(t, "hero_probe.json")
+	slowMotion := hero
+	slowMotion.Streams = append([]StreamInfo(nil), hero.Streams...)
+	slowMotion.Streams[0].FrameRate = "240000/1001"
+	pal := hero
+	pal.Streams = append([]StreamInfo(nil), hero.Streams...)
+	pal.Streams[0].FrameRate = "50/1"
+
+	files := []FileInfo{{Path: "GH011234.MP4"}, {Path: "GH021234.MP4"}, {Path: "GH031234.MP4"}}
+	mismatches := checkConsistency(files, []ProbeResult{hero, slowMotion, pal})
+	if len(mismatches) != 2 {
+		t.Fatalf("Expected 2 frame rate mismatches, got %v", mismatches)
+	}
+	// Only the 240 fps chapter is slow motion, not the 50 fps one
+	slow := slowMotionMismatches(mismatches)
+	if len(slow) != 1 || slow[0].Path != "GH021234.MP4" {
+		t.Errorf("Expected the 240 fps chapter to be slow motion, got %v", slow)
+	}
+	if !isSlowMotion("240000/1001", "30000/1001") || isSlowMotion("60000/1001", "30000/1001") {
+		t.Error("Expected slow motion to need a high frame rate, whichever chapter comes first")
+	}
+
+	err := (&mismatchError{First: files[0].Path, Mismatches: mismatches}).Error()
+	if !strings.Contains(err, "GH021234.MP4 looks like slow motion mixed with normal speed video") || strings.Contains(err, "GH031234.MP4 looks like") {
+		t.Errorf("Expected the slow motion chapter to be pointed out, got:\n%s", err)
+	}
+}
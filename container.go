@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Output containers for Options.Container.
+const (
+	containerMP4 = "mp4"
+	// containerMOV is the QuickTime file format MP4 derives from, which
+	// some editors such as Final Cut Pro handle better.
+	containerMOV = "mov"
+	// containerMKV cannot hold data streams, so GPMF telemetry is stored
+	// as an attachment instead.
+	containerMKV = "mkv"
+)
+
+// containerMuxers maps each output container to its ffmpeg muxer.
+var containerMuxers = map[string]string{
+	containerMP4: "mp4",
+	containerMOV: "mov",
+	containerMKV: "matroska",
+}
+
+// containerExtensions maps output file extensions to containers.
+var containerExtensions = map[string]string{
+	".mp4": containerMP4,
+	".m4v": containerMP4,
+	".mov": containerMOV,
+	".mkv": containerMKV,
+}
+
+// isMP4Family reports whether container is MP4 or QuickTime, which share
+// the box structure, data streams, tmcd tracks and movflags.
+func isMP4Family(container string) bool {
+	return container == containerMP4 || container == containerMOV
+}
+
+// telemetryAttachmentName is the file name of the GPMF telemetry attached
+// to Matroska outputs.
+const telemetryAttachmentName = "telemetry.gpmd"
+
+func validateContainer(container string) error {
+	if _, ok := containerMuxers[container]; !ok && container != "" {
+		return fmt.Errorf("invalid container %q: must be %s, %s or %s", container, containerMP4, containerMOV, containerMKV)
+	}
+	return nil
+}
+
+// outputContainer returns the container of outputPath: override when it
+// is set, otherwise the one matching the extension, MP4 by default.
+func outputContainer(outputPath, override string) (string, error) {
+	if override != "" {
+		return override, validateContainer(override)
+	}
+	if container, ok := containerExtensions[strings.ToLower(filepath.Ext(outputPath))]; ok {
+		return container, nil
+	}
+	return containerMP4, nil
+}
+
+// withoutDataStreams drops the data streams, which Matroska cannot hold.
+func withoutDataStreams(streams []StreamInfo) []StreamInfo {
+	var kept []StreamInfo
+	for _, stream := range streams {
+		if stream.CodecType != "data" {
+			kept = append(kept, stream)
+		}
+	}
+	return kept
+}
+
+// extractTelemetryArgs builds the ffmpeg arguments writing the raw GPMF
+// packets of stream index of the concat list of spec to outputPath, with
+// ffmpeg log level logLevel.
+func extractTelemetryArgs(spec mergeSpec, index int, outputPath, logLevel string) []string {
+	args := append(ffmpegArgs(logLevel), concatInputArgs(spec.ListPath, spec.Remote)...)
+	return append(args,
+		"-map", fmt.Sprintf("0:%d", index),
+		"-c", "copy",
+		"-f", "data",
+		"-y", outputPath,
+	)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputContainer(t *testing.T) {
+	tests := []struct {
+		output, override, expected string
+	}{
+		{"merged.mp4", "", containerMP4},
+		{"merged.MKV", "", containerMKV},
+		{"merged", "", containerMP4},
+		{"merged.mp4", containerMKV, containerMKV},
+	}
+	for _, test := range tests {
+		container, err := outputContainer(test.output, test.override)
+		if err != nil || container != test.expected {
+			t.Errorf("outputContainer(%q, %q) = %q, %v, expected %q", test.output, test.override, container, err, test.expected)
+		}
+	}
+
+	if _, err := outputContainer("merged.avi", "avi"); err == nil {
+		t.Errorf("Expected an error for an unsupported container")
+	}
+}
+
+func TestMergeFilesMatroska(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mkv")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		if path != partialPath(outputPath) {
+			return hero, nil
+		}
+		// Matroska keeps the timecode as an upper case tag
+		return ProbeResult{Streams: []StreamInfo{
+			{Index: 0, CodecType: "video", CodecName: "h264", Tags: map[string]string{"TIMECODE": "14:32:07:12"}},
+			{Index: 1, CodecType: "audio", CodecName: "aac"},
+			{Index: 2, CodecType: "attachment", Tags: map[string]string{"filename": telemetryAttachmentName}},
+		}}, nil
+	}
+
+	var commands [][]string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		commands = append(commands, cmd.Args)
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{})
+	if err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if len(commands) != 2 {
+		t.Fatalf("Expected telemetry extraction and merge, got %v", commands)
+	}
+
+	extract := strings.Join(commands[0], " ")
+	if !strings.Contains(extract, "-map 0:3 -c copy -f data") {
+		t.Errorf("Expected the gpmd stream to be extracted, got: %s", extract)
+	}
+
+	merge := strings.Join(commands[1], " ")
+	if strings.Contains(merge, "-map 0:3") || strings.Contains(merge, "-map 0:4") || strings.Contains(merge, "-tag:") {
+		t.Errorf("Expected no data streams in the Matroska merge, got: %s", merge)
+	}
+	if !strings.Contains(merge, "-attach "+commands[0][len(commands[0])-1]) {
+		t.Errorf("Expected the extracted telemetry to be attached, got: %s", merge)
+	}
+	if strings.Contains(merge, "-write_tmcd") || !strings.Contains(merge, "timecode=14:32:07:12") {
+		t.Errorf("Expected only the timecode tag, got: %s", merge)
+	}
+	if !strings.HasSuffix(merge, "-f matroska "+partialPath(outputPath)) {
+		t.Errorf("Expected the matroska muxer, got: %s", merge)
+	}
+
+	// -faststart needs the MP4 box structure
+	err = mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{Faststart: true})
+	if err == nil || !strings.Contains(err.Error(), "faststart") {
+		t.Errorf("Expected -faststart to be rejected for Matroska, got: %v", err)
+	}
+}
+
+func TestMergeFilesQuickTime(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mov")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	// The output keeps every stream except fdsc, which the check must notice
+	outputStreams := []StreamInfo{hero.Streams[0], hero.Streams[1], hero.Streams[2], hero.Streams[3]}
+	probeFile = func(path string) (ProbeResult, error) {
+		if path == partialPath(outputPath) {
+			return ProbeResult{Streams: outputStreams}, nil
+		}
+		return hero, nil
+	}
+
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	creationTime := time.Date(2024, time.May, 1, 12, 30, 0, 0, time.UTC)
+	opts := Options{Location: time.UTC}
+	err := mergeFiles(outputPath, inputPaths, creationTime, creationTime, opts)
+	if err == nil || !strings.Contains(err.Error(), "fdsc") {
+		t.Fatalf("Expected the missing fdsc stream to be reported, got: %v", err)
+	}
+
+	command := strings.Join(merge, " ")
+	for _, expected := range []string{
+		"-map 0:3 -tag:2 gpmd",
+		"-write_tmcd 1",
+		"-metadata com.apple.quicktime.creationdate=2024-05-01T12:30:00Z",
+		"-movflags +use_metadata_tags",
+		"-metadata creation_time=2024-05-01T12:30:00Z",
+		"-f mov " + outputPath,
+	} {
+		if !strings.Contains(command, expected) {
+			t.Errorf("Expected %q in command, got: %s", expected, command)
+		}
+	}
+
+	// With every stream present the merge succeeds
+	outputStreams = hero.Streams
+	if err := mergeFiles(outputPath, inputPaths, creationTime, creationTime, opts); err != nil {
+		t.Errorf("mergeFiles() error: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sources of the cover art of Options.CoverArt.
+const (
+	// coverArtTHM is the .THM thumbnail the camera writes next to the first
+	// chapter.
+	coverArtTHM = "thm"
+	// coverArtFrame is the frame of the output at Options.ThumbnailAt.
+	coverArtFrame = "frame"
+)
+
+// jpegDataType is the type indicator of JPEG data in an ilst item.
+const jpegDataType = 13
+
+func validateCoverArt(source string) error {
+	switch source {
+	case "", coverArtTHM, coverArtFrame:
+		return nil
+	}
+	return fmt.Errorf("invalid cover art source %q: must be %s or %s", source, coverArtTHM, coverArtFrame)
+}
+
+// thmPath returns the .THM thumbnail next to the chapter at chapterPath,
+// e.g. GH011234.THM for GH011234.MP4, or "" when there is none.
+func thmPath(chapterPath string) string {
+	if isRemote(chapterPath) {
+		return ""
+	}
+	base := strings.TrimSuffix(chapterPath, filepath.Ext(chapterPath))
+	for _, ext := range []string{".THM", ".thm"} {
+		if info, err := os.Stat(base + ext); err == nil && info.Mode().IsRegular() {
+			return base + ext
+		}
+	}
+	return ""
+}
+
+// isJPEG reports whether data starts with a JPEG start of image marker.
+func isJPEG(data []byte) bool {
+	return len(data) > 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF
+}
+
+// coverArtImage returns the JPEG of opts.CoverArt for the merged
+// outputPath. Without a usable .THM file next to firstChapter, a frame of
+// the output is used instead.
+func coverArtImage(outputPath, firstChapter string, opts Options) ([]byte, error) {
+	logger := opts.logger()
+	if opts.CoverArt == coverArtTHM {
+		path := thmPath(firstChapter)
+		if path == "" {
+			logger.Warn("the first chapter has no .THM thumbnail, using a frame of the output as cover art", "input", firstChapter)
+		} else if data, err := os.ReadFile(path); err != nil || !isJPEG(data) {
+			logger.Warn("the .THM thumbnail is not a JPEG, using a frame of the output as cover art", "thm", path, "error", err)
+		} else {
+			return data, nil
+		}
+	}
+
+	// -thumbnail has already extracted the frame
+	if opts.Thumbnail != "" {
+		return os.ReadFile(opts.Thumbnail)
+	}
+	temp, err := opts.createTempFile(outputPath, ".cover.jpg")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	temp.Close()
+	defer os.Remove(temp.Name())
+	if err := extractFrame(outputPath, opts.ThumbnailAt, temp.Name(), opts); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(temp.Name())
+}
+
+// coverArtSidecarPath is where the cover art of outputPath goes when its
+// container cannot hold it, e.g. out.jpg for out.mkv.
+func coverArtSidecarPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".jpg"
+}
+
+// embedCoverArt attaches the cover art of opts.CoverArt to mergedPath,
+// the merge into outputPath, as the covr item of moov/udta/meta/ilst,
+// which Finder and media managers show. Other containers get it as a JPEG
+// next to outputPath instead, see coverArtSidecarPath.
+func embedCoverArt(mergedPath, outputPath, firstChapter string, opts Options) error {
+	if opts.CoverArt == "" {
+		return nil
+	}
+	logger := opts.logger()
+	image, err := coverArtImage(mergedPath, firstChapter, opts)
+	if err != nil {
+		return fmt.Errorf("failed to get cover art: %v", err)
+	}
+
+	if !isMP4Family(opts.Container) {
+		sidecar := coverArtSidecarPath(outputPath)
+		logger.Warn("the container cannot hold cover art, writing it next to the output", "container", opts.Container, "cover_art", sidecar)
+		if err := os.WriteFile(sidecar, image, 0644); err != nil {
+			return fmt.Errorf("failed to write cover art %s: %v", sidecar, err)
+		}
+		return nil
+	}
+
+	logger.Info("embedding cover art", "output", outputPath, "source", opts.CoverArt, "size", len(image))
+	return rewriteMoov(mergedPath, func(moov []byte) ([]byte, error) {
+		newMoov, err := setCoverArt(moov, image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add cover art to %s: %v", outputPath, err)
+		}
+		return newMoov, nil
+	})
+}
+
+// coverArtBox builds the covr item of ilst holding the JPEG image.
+func coverArtBox(image []byte) []byte {
+	data := mp4BoxHeader("data", 8+len(image))
+	data = binary.BigEndian.AppendUint32(data, jpegDataType)
+	data = binary.BigEndian.AppendUint32(data, 0) // Locale
+	data = append(data, image...)
+	return append(mp4BoxHeader("covr", len(data)), data...)
+}
+
+// iTunesHandler is the hdlr box of a meta box holding an ilst.
+func iTunesHandler() []byte {
+	payload := make([]byte, 25)
+	copy(payload[8:], "mdir")
+	copy(payload[12:], "appl")
+	return append(mp4BoxHeader("hdlr", len(payload)), payload...)
+}
+
+// setCoverArt puts a covr item holding image into moov/udta/meta/ilst of
+// moov (a complete moov box), replacing any it has, and returns the new
+// moov box. The missing boxes on the way are created.
+func setCoverArt(moov, image []byte) ([]byte, error) {
+	moovBox := mp4Box{Type: "moov", HeaderSize: 8, Size: int64(len(moov))}
+	if binary.BigEndian.Uint32(moov[:4]) == 1 {
+		moovBox.HeaderSize = 16
+	}
+	return replaceChild("moov", moov, moovBox, nil, "udta", func(udta []byte, udtaBox mp4Box) ([]byte, error) {
+		return replaceChild("udta", udta, udtaBox, nil, "meta", func(meta []byte, metaBox mp4Box) ([]byte, error) {
+			// meta is a full box in MP4, but QuickTime writes it without
+			// version and flags
+			prefix := []byte{0, 0, 0, 0}
+			if metaBox.Size == 0 {
+				return replaceChild("meta", nil, metaBox, prefix, "ilst", setCoverItem(image), iTunesHandler())
+			}
+			payload := meta[metaBox.PayloadOffset():]
+			if len(payload) >= 8 && string(payload[4:8]) == "hdlr" {
+				prefix = nil
+			}
+			metaBox.HeaderSize += int64(len(prefix))
+			return replaceChild("meta", meta, metaBox, prefix, "ilst", setCoverItem(image))
+		})
+	})
+}
+
+// setCoverItem returns the edit of replaceChild replacing the covr item of
+// an ilst box with one holding image.
+func setCoverItem(image []byte) func([]byte, mp4Box) ([]byte, error) {
+	return func(ilst []byte, ilstBox mp4Box) ([]byte, error) {
+		var items [][]byte
+		if ilstBox.Size > 0 {
+			children, err := childBoxes(ilst, ilstBox)
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				if child.Type != "covr" {
+					items = append(items, ilst[child.Offset:child.End()])
+				}
+			}
+		}
+		items = append(items, coverArtBox(image))
+		payload := bytes.Join(items, nil)
+		return append(mp4BoxHeader("ilst", len(payload)), payload...), nil
+	}
+}
+
+// replaceChild rebuilds the parentType box parent stored in data, with
+// prefix in front of its children and its child of childType replaced by
+// the one edit makes of it. A parent of zero size stands for a new, empty
+// box. When there is no such child, edit gets a box of zero size and the
+// new child is added after extra.
+func replaceChild(parentType string, data []byte, parent mp4Box, prefix []byte, childType string, edit func([]byte, mp4Box) ([]byte, error), extra ...[]byte) ([]byte, error) {
+	var children []mp4Box
+	if parent.Size > 0 {
+		var err error
+		children, err = childBoxes(data, parent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var payload [][]byte
+	if len(prefix) > 0 {
+		payload = append(payload, prefix)
+	}
+	found := false
+	for _, child := range children {
+		if child.Type != childType || found {
+			payload = append(payload, data[child.Offset:child.End()])
+			continue
+		}
+		found = true
+		newChild, err := edit(data, child)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, newChild)
+	}
+	if !found {
+		payload = append(payload, extra...)
+		newChild, err := edit(nil, mp4Box{Type: childType})
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, newChild)
+	}
+	joined := bytes.Join(payload, nil)
+	return append(mp4BoxHeader(parentType, len(joined)), joined...), nil
+}
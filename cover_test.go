@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// coverArtOf returns the image of the covr item in moov/udta/meta/ilst of
+// moov, and the types of the ilst items.
+func coverArtOf(t *testing.T, moov []byte) ([]byte, []string) {
+	t.Helper()
+	if int(binary.BigEndian.Uint32(moov)) != len(moov) {
+		t.Fatalf("moov size %d does not match its %d bytes", binary.BigEndian.Uint32(moov), len(moov))
+	}
+	box := mp4Box{Type: "moov", HeaderSize: 8, Size: int64(len(moov))}
+	for _, boxType := range []string{"udta", "meta", "ilst"} {
+		children, err := childBoxes(moov, box)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", box.Type, err)
+		}
+		found := false
+		for _, child := range children {
+			if child.Type == boxType {
+				box, found = child, true
+			}
+		}
+		if !found {
+			t.Fatalf("Expected a %s box in %s", boxType, box.Type)
+		}
+		if boxType == "meta" && string(moov[box.PayloadOffset()+4:box.PayloadOffset()+8]) != "hdlr" {
+			box.HeaderSize += 4
+		}
+	}
+	items, err := childBoxes(moov, box)
+	if err != nil {
+		t.Fatalf("Failed to parse ilst: %v", err)
+	}
+	var image []byte
+	var types []string
+	for _, item := range items {
+		types = append(types, item.Type)
+		if item.Type == "covr" {
+			data := moov[item.PayloadOffset():item.End()]
+			if string(data[4:8]) != "data" || binary.BigEndian.Uint32(data[8:]) != jpegDataType {
+				t.Fatalf("Expected a JPEG data box in covr, got %q", data[:16])
+			}
+			image = data[16:]
+		}
+	}
+	return image, types
+}
+
+func TestSetCoverArt(t *testing.T) {
+	image := []byte("\xff\xd8\xff\xe0cover")
+	mvhd := mp4BoxBytes("mvhd", make([]byte, 100))
+	tool := mp4BoxBytes("\xa9too", mp4BoxBytes("data", []byte("\x00\x00\x00\x01\x00\x00\x00\x00Lavf")))
+	oldCover := coverArtBox([]byte("\xff\xd8\xff\xe0old"))
+
+	tests := []struct {
+		name     string
+		moov     []byte
+		expected []string
+	}{
+		{"no udta", mp4BoxBytes("moov", mvhd), []string{"covr"}},
+		{"udta without meta", mp4BoxBytes("moov", mvhd, cameraUserData()), []string{"covr"}},
+		{"ffmpeg metadata", mp4BoxBytes("moov", mvhd, mp4BoxBytes("udta",
+			mp4BoxBytes("meta", []byte{0, 0, 0, 0}, iTunesHandler(), mp4BoxBytes("ilst", tool, oldCover)))),
+			[]string{"\xa9too", "covr"}},
+		// QuickTime writes meta without version and flags
+		{"quicktime meta", mp4BoxBytes("moov", mvhd, mp4BoxBytes("udta",
+			mp4BoxBytes("meta", iTunesHandler(), mp4BoxBytes("ilst", tool)))),
+			[]string{"\xa9too", "covr"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			moov, err := setCoverArt(test.moov, image)
+			if err != nil {
+				t.Fatalf("setCoverArt() error: %v", err)
+			}
+			got, types := coverArtOf(t, moov)
+			if !bytes.Equal(got, image) {
+				t.Errorf("Expected cover art %q, got %q", image, got)
+			}
+			if len(types) != len(test.expected) || types[0] != test.expected[0] {
+				t.Errorf("Expected ilst items %q, got %q", test.expected, types)
+			}
+			if !bytes.Contains(moov, mvhd) {
+				t.Error("Expected mvhd to be kept")
+			}
+		})
+	}
+
+	// The camera boxes stay next to the new meta box
+	moov, err := setCoverArt(mp4BoxBytes("moov", mvhd, cameraUserData()), image)
+	if err != nil {
+		t.Fatalf("setCoverArt() error: %v", err)
+	}
+	if !bytes.Contains(moov, []byte("H22.01.01.10.00")) {
+		t.Error("Expected the FIRM box to be kept")
+	}
+}
+
+func TestMergeFilesCoverArt(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	thm := []byte("\xff\xd8\xff\xe0thumbnail")
+	if err := os.WriteFile(filepath.Join(dir, "GH011234.THM"), thm, 0644); err != nil {
+		t.Fatalf("Failed to create THM file: %v", err)
+	}
+	frame := []byte("\xff\xd8\xff\xe0frame")
+	merged := bytes.Join([][]byte{
+		mp4BoxBytes("ftyp", []byte("isom\x00\x00\x02\x00isom")),
+		mp4BoxBytes("mdat", make([]byte, 1024)),
+		mp4BoxBytes("moov", mp4BoxBytes("mvhd", make([]byte, 100))),
+	}, nil)
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	var frames int
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		target := cmd.Args[len(cmd.Args)-1]
+		if filepath.Ext(target) == ".jpg" {
+			frames++
+			return os.WriteFile(target, frame, 0644)
+		}
+		return os.WriteFile(target, merged, 0644)
+	}
+
+	tests := []struct {
+		name     string
+		output   string
+		coverArt string
+		expected []byte
+		sidecar  bool
+	}{
+		{"thm", "merged.mp4", coverArtTHM, thm, false},
+		{"frame", "merged.mov", coverArtFrame, frame, false},
+		{"sidecar", "merged.mkv", coverArtTHM, thm, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outputPath := filepath.Join(dir, test.output)
+			opts := Options{CoverArt: test.coverArt, ThumbnailAt: time.Second}
+			if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+				t.Fatalf("mergeFiles() error: %v", err)
+			}
+			if test.sidecar {
+				got, err := os.ReadFile(filepath.Join(dir, "merged.jpg"))
+				if err != nil || !bytes.Equal(got, test.expected) {
+					t.Errorf("Expected cover art %q next to the output, got %q: %v", test.expected, got, err)
+				}
+				return
+			}
+			moov, err := readFileBox(outputPath, "moov")
+			if err != nil {
+				t.Fatalf("Failed to read moov of the output: %v", err)
+			}
+			got, _ := coverArtOf(t, append(mp4BoxHeader("moov", len(moov)), moov...))
+			if !bytes.Equal(got, test.expected) {
+				t.Errorf("Expected cover art %q, got %q", test.expected, got)
+			}
+		})
+	}
+
+	// Without a THM file a frame of the output is used
+	os.Remove(filepath.Join(dir, "GH011234.THM"))
+	frames = 0
+	outputPath := filepath.Join(dir, "fallback.mp4")
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{CoverArt: coverArtTHM}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	moov, err := readFileBox(outputPath, "moov")
+	if err != nil {
+		t.Fatalf("Failed to read moov of the output: %v", err)
+	}
+	if got, _ := coverArtOf(t, append(mp4BoxHeader("moov", len(moov)), moov...)); !bytes.Equal(got, frame) || frames != 1 {
+		t.Errorf("Expected a frame as cover art, got %q after %d frame extractions", got, frames)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Reasons why an input is a duplicate of another.
+const (
+	duplicateSamePath = "same path"
+	// duplicateSameFile is a hard link or a path differing in case on a
+	// case-insensitive volume.
+	duplicateSameFile = "same file"
+)
+
+// duplicateGroup is an input given more than once. The first occurrence
+// is kept and the others are skipped.
+type duplicateGroup struct {
+	Kept    string             `json:"kept"`
+	Skipped []skippedDuplicate `json:"skipped"`
+}
+
+// skippedDuplicate is an input left out as a duplicate of the kept one.
+type skippedDuplicate struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// findDuplicates groups the inputPaths that name the same input, by their
+// absolute path or normalized URL, or by being the same local file, and
+// returns inputPaths without the duplicates. Paths that cannot be resolved
+// are left to the checks that report them.
+func findDuplicates(inputPaths []string) ([]string, []duplicateGroup) {
+	type kept struct {
+		group int
+		info  os.FileInfo
+	}
+	var unique []string
+	var groups []duplicateGroup
+	byKey := make(map[string]int)
+	var files []kept
+	for _, path := range inputPaths {
+		key, err := filepath.Abs(path)
+		if isRemote(path) {
+			key, err = normalizeURL(path)
+		}
+		if err != nil {
+			unique = append(unique, path)
+			continue
+		}
+		if group, ok := byKey[key]; ok {
+			groups[group].Skipped = append(groups[group].Skipped, skippedDuplicate{Path: path, Reason: duplicateSamePath})
+			continue
+		}
+
+		var info os.FileInfo
+		if !isRemote(path) {
+			info, _ = os.Stat(path)
+		}
+		if info != nil {
+			found := false
+			for _, file := range files {
+				if os.SameFile(file.info, info) {
+					groups[file.group].Skipped = append(groups[file.group].Skipped, skippedDuplicate{Path: path, Reason: duplicateSameFile})
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+		}
+
+		byKey[key] = len(groups)
+		if info != nil {
+			files = append(files, kept{group: len(groups), info: info})
+		}
+		groups = append(groups, duplicateGroup{Kept: path})
+		unique = append(unique, path)
+	}
+
+	var duplicates []duplicateGroup
+	for _, group := range groups {
+		if len(group.Skipped) > 0 {
+			duplicates = append(duplicates, group)
+		}
+	}
+	return unique, duplicates
+}
+
+// printDuplicates lists every group of duplicates with the input kept and
+// the ones skipped.
+func printDuplicates(w io.Writer, duplicates []duplicateGroup) {
+	count := 0
+	for _, group := range duplicates {
+		count += len(group.Skipped)
+	}
+	fmt.Fprintf(w, "%d duplicate input(s):\n", count)
+	for _, group := range duplicates {
+		fmt.Fprintf(w, "  kept:    %s\n", group.Kept)
+		for _, duplicate := range group.Skipped {
+			fmt.Fprintf(w, "  skipped: %s (%s)\n", duplicate.Path, duplicate.Reason)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "GH011234.MP4")
+	second := filepath.Join(dir, "GH021234.MP4")
+	for _, path := range []string{first, second} {
+		if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A hard link is the same file under another name
+	link := filepath.Join(t.TempDir(), "GH011234.MP4")
+	if err := os.Link(first, link); err != nil {
+		t.Skipf("Cannot create hard links here: %v", err)
+	}
+	relative, err := filepath.Rel(".", second)
+	if err != nil {
+		relative = second
+	}
+
+	inputPaths := []string{first, second, link, relative, first}
+	unique, duplicates := findDuplicates(inputPaths)
+	if !reflect.DeepEqual(unique, []string{first, second}) {
+		t.Errorf("Expected %q to be kept, got %q", []string{first, second}, unique)
+	}
+	expected := []duplicateGroup{
+		{Kept: first, Skipped: []skippedDuplicate{{link, duplicateSameFile}, {first, duplicateSamePath}}},
+		{Kept: second, Skipped: []skippedDuplicate{{relative, duplicateSamePath}}},
+	}
+	if !reflect.DeepEqual(duplicates, expected) {
+		t.Errorf("Expected duplicates %+v, got %+v", expected, duplicates)
+	}
+
+	var buf bytes.Buffer
+	printDuplicates(&buf, duplicates)
+	report := buf.String()
+	for _, line := range []string{
+		"3 duplicate input(s):",
+		"  kept:    " + first,
+		"  skipped: " + link + " (same file)",
+		"  skipped: " + first + " (same path)",
+		"  kept:    " + second,
+		"  skipped: " + relative + " (same path)",
+	} {
+		if !strings.Contains(report, line+"\n") {
+			t.Errorf("Expected %q in the report, got:\n%s", line, report)
+		}
+	}
+
+	// The report is part of the printed plans
+	plan := Plan{Output: "merged.mp4", Duplicates: duplicates}
+	buf.Reset()
+	printPlan(&buf, plan)
+	if !strings.Contains(buf.String(), "skipped: "+link+" (same file)") {
+		t.Errorf("Expected the duplicates in the plan, got:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := printPlanJSON(&buf, plan); err != nil {
+		t.Fatalf("printPlanJSON() error: %v", err)
+	}
+	var decoded struct {
+		Duplicates []duplicateGroup `json:"duplicates"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode plan: %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Duplicates, expected) {
+		t.Errorf("Expected duplicates %+v in the JSON plan, got %+v", expected, decoded.Duplicates)
+	}
+
+	if unique, duplicates := findDuplicates([]string{first, second}); len(duplicates) != 0 || len(unique) != 2 {
+		t.Errorf("Expected no duplicates, got %+v", duplicates)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// destinationList collects the repeated -output flags.
+type destinationList []string
+
+func (d *destinationList) String() string {
+	return strings.Join(*d, ", ")
+}
+
+func (d *destinationList) Set(path string) error {
+	if path == "" {
+		return fmt.Errorf("empty path")
+	}
+	*d = append(*d, path)
+	return nil
+}
+
+// destinationPath returns where the copy of outputPath goes for
+// destination, which is a file or an existing directory to copy into.
+func destinationPath(outputPath, destination string) string {
+	if info, err := os.Stat(destination); err == nil && info.IsDir() {
+		return filepath.Join(destination, filepath.Base(outputPath))
+	}
+	return destination
+}
+
+// destinationResult is the outcome of copying the output to one
+// destination. Err is nil when the copy succeeded.
+type destinationResult struct {
+	Path string
+	Err  error
+}
+
+// copyToDestinations copies the merged outputPath to every destination and
+// gives each copy the permissions of opts and creationTime and modTime,
+// like the output. A failed copy is removed and does not stop the others.
+func copyToDestinations(outputPath string, destinations []string, creationTime, modTime time.Time, opts Options) []destinationResult {
+	logger := opts.logger()
+	var results []destinationResult
+	for _, destination := range destinations {
+		path := destinationPath(outputPath, destination)
+		logger.Info("copying output", "output", outputPath, "destination", path)
+		err := copyVerified(outputPath, path)
+		if err == nil {
+			err = setOutputPermissions(path, opts)
+		}
+		if err == nil {
+			err = setOutputTimes(path, creationTime, modTime, opts)
+		}
+		if err != nil {
+			logger.Warn("failed to copy output", "destination", path, "error", err)
+		}
+		results = append(results, destinationResult{Path: path, Err: err})
+	}
+	return results
+}
+
+// copyVerified copies src to dst and checks that the whole file arrived,
+// as network volumes can fail silently when they fill up. A partial copy
+// is removed.
+func copyVerified(src, dst string) error {
+	err := copyFile(src, dst)
+	if err == nil {
+		err = checkSameSize(src, dst)
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// checkSameSize reports an error when dst is not as large as src.
+func checkSameSize(src, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	if srcInfo.Size() != dstInfo.Size() {
+		return fmt.Errorf("copied %d of %d bytes", dstInfo.Size(), srcInfo.Size())
+	}
+	return nil
+}
+
+// printDestinations lists where the output was copied, and the
+// destinations that failed with their error. It returns the number of
+// failures.
+func printDestinations(stdout, stderr io.Writer, results []destinationResult) int {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Fprintf(stderr, "Error copying the output to %s: %v\n", result.Path, result.Err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(stdout, "Copied to %s\n", result.Path)
+	}
+	return failed
+}
+
+// secondOutput is the copy of the output to Options.AlsoOutput, made while
+// the merge finishes the output.
+type secondOutput struct {
+	Path    string
+	partial string
+	done    chan error
+}
+
+// startSecondOutput starts copying partial, the finished output of
+// outputPath, to the partial path of opts.AlsoOutput. The copy is checked
+// to be complete and, unless streams is nil, to have streams, and is
+// stamped by stamp like the output. It returns nil without
+// opts.AlsoOutput.
+func startSecondOutput(partial, outputPath string, streams []StreamInfo, stamp func(path string) error, opts Options) *secondOutput {
+	if opts.AlsoOutput == "" {
+		return nil
+	}
+	path := destinationPath(outputPath, opts.AlsoOutput)
+	second := &secondOutput{Path: path, partial: partialPath(path), done: make(chan error, 1)}
+	// partial is renamed into place during the copy, which reads it
+	// through the file opened here
+	source, err := os.Open(partial)
+	if err != nil {
+		second.done <- err
+		return second
+	}
+	opts.logger().Info("writing second output", "output", outputPath, "second_output", path)
+	go func() {
+		defer source.Close()
+		err := copyOpenVerified(source, second.partial)
+		if err == nil && streams != nil {
+			err = verifyStreams(second.partial, streams)
+		}
+		if err == nil {
+			err = stamp(second.partial)
+		}
+		second.done <- err
+	}()
+	return second
+}
+
+// finish waits for the copy and moves it into place, unless the merge
+// failed with mergeErr, then passes its path and error to
+// opts.AlsoOutputFunc. A failed copy is removed, the output is kept.
+func (s *secondOutput) finish(mergeErr error, opts Options) {
+	if s == nil {
+		return
+	}
+	err := <-s.done
+	if mergeErr != nil {
+		os.Remove(s.partial)
+		return
+	}
+	if err == nil {
+		err = renamePartial(s.partial, s.Path)
+	}
+	if err != nil {
+		os.Remove(s.partial)
+		opts.logger().Warn("failed to write second output", "second_output", s.Path, "error", err)
+	}
+	if opts.AlsoOutputFunc != nil {
+		opts.AlsoOutputFunc(s.Path, err)
+	}
+}
+
+// copyOpenVerified is copyVerified from the open file source, which is
+// copied from its start.
+func copyOpenVerified(source *os.File, dst string) error {
+	destination, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(destination, source)
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	// source may have been renamed, its size is read from the open file
+	var srcInfo, dstInfo os.FileInfo
+	if err == nil {
+		srcInfo, err = source.Stat()
+	}
+	if err == nil {
+		dstInfo, err = os.Stat(dst)
+	}
+	if err == nil && srcInfo.Size() != dstInfo.Size() {
+		err = fmt.Errorf("copied %d of %d bytes", dstInfo.Size(), srcInfo.Size())
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
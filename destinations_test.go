@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCopyToDestinations(t *testing.T) {
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "merged.mp4")
+	if err := os.WriteFile(outputPath, []byte("merged recording"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "archive")
+	nas := filepath.Join(dir, "nas")
+	for _, d := range []string{archive, nas} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	origRunCommand := runCommand
+	defer func() { runCommand = origRunCommand }()
+	var setFile []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		setFile = append(setFile, cmd.Args[len(cmd.Args)-1])
+		return nil
+	}
+
+	// One destination is a directory, the other a file name, the last one
+	// is on a volume that is not mounted
+	var destinations destinationList
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Var(&destinations, "output", "")
+	args := []string{"-output", archive, "-output", filepath.Join(nas, "2024-05-01.mp4"), "-output", filepath.Join(dir, "unmounted", "merged.mp4")}
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	creationTime := time.Date(2024, time.May, 1, 10, 0, 0, 0, time.UTC)
+	modTime := time.Date(2024, time.May, 1, 10, 30, 0, 0, time.UTC)
+	results := copyToDestinations(outputPath, destinations, creationTime, modTime, Options{Mode: 0600})
+	if len(results) != 3 {
+		t.Fatalf("Expected a result per destination, got %+v", results)
+	}
+	for _, path := range []string{filepath.Join(archive, "merged.mp4"), filepath.Join(nas, "2024-05-01.mp4")} {
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != "merged recording" {
+			t.Errorf("Expected a copy at %s, got %q (%v)", path, data, err)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(modTime) || info.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s to be stamped like the output, got %v %v", path, info.ModTime(), info.Mode())
+		}
+	}
+	if len(setFile) != 2 {
+		t.Errorf("Expected the creation time of both copies to be set, got %v", setFile)
+	}
+	if results[0].Err != nil || results[1].Err != nil || results[2].Err == nil {
+		t.Errorf("Expected only the unmounted destination to fail, got %+v", results)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if failed := printDestinations(&stdout, &stderr, results); failed != 1 {
+		t.Errorf("Expected 1 failure, got %d", failed)
+	}
+	if !strings.Contains(stdout.String(), "Copied to "+filepath.Join(archive, "merged.mp4")+"\n") {
+		t.Errorf("Expected the copies to be listed, got: %s", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Error copying the output to "+filepath.Join(dir, "unmounted", "merged.mp4")) {
+		t.Errorf("Expected the failed destination to be reported, got: %s", stderr.String())
+	}
+}
+
+func TestMergeAlsoOutput(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	backup := filepath.Join(dir, "backup")
+	if err := os.Mkdir(backup, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	probe := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return probe, nil
+	}
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("merged recording"), 0644)
+	}
+
+	creationTime := time.Date(2024, time.May, 1, 10, 0, 0, 0, time.UTC)
+	modTime := time.Date(2024, time.May, 1, 10, 30, 0, 0, time.UTC)
+	var secondPath string
+	var secondErr error
+	opts := Options{Mode: 0600, AlsoOutput: backup, AlsoOutputFunc: func(path string, err error) {
+		secondPath, secondErr = path, err
+	}}
+	for _, inputs := range [][]string{inputPaths, inputPaths[:1]} {
+		outputPath := filepath.Join(dir, "merged.mp4")
+		os.Remove(outputPath)
+		os.Remove(filepath.Join(backup, "merged.mp4"))
+		if err := mergeFiles(outputPath, inputs, creationTime, modTime, opts); err != nil {
+			t.Fatalf("mergeFiles() error: %v", err)
+		}
+		if secondPath != filepath.Join(backup, "merged.mp4") || secondErr != nil {
+			t.Errorf("Expected the second output to be reported, got %s, %v", secondPath, secondErr)
+		}
+		output, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := os.ReadFile(secondPath)
+		if err != nil || !bytes.Equal(second, output) {
+			t.Errorf("Expected the second output to be a copy of the output, got %q (%v)", second, err)
+		}
+		info, err := os.Stat(secondPath)
+		if err == nil && (!info.ModTime().Equal(modTime) || info.Mode().Perm() != 0600) {
+			t.Errorf("Expected the second output to be stamped like the output, got %v %v", info.ModTime(), info.Mode())
+		}
+		if _, err := os.Stat(partialPath(secondPath)); err == nil {
+			t.Errorf("Expected no partial second output left")
+		}
+	}
+
+	// A second output on a drive that is not mounted does not fail the merge
+	outputPath := filepath.Join(dir, "unplugged.mp4")
+	opts.AlsoOutput = filepath.Join(dir, "unmounted", "unplugged.mp4")
+	if err := mergeFiles(outputPath, inputPaths, creationTime, modTime, opts); err != nil {
+		t.Fatalf("Expected the merge to succeed, got %v", err)
+	}
+	if _, err := os.Stat(outputPath); err != nil || secondErr == nil {
+		t.Errorf("Expected the output to be kept and the second output to fail, got %v", secondErr)
+	}
+
+	// A failed merge writes neither
+	secondPath, secondErr = "", nil
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		return fmt.Errorf("exit status 1")
+	}
+	opts.AlsoOutput = backup
+	if err := mergeFiles(filepath.Join(dir, "failed.mp4"), inputPaths, creationTime, modTime, opts); err == nil {
+		t.Fatal("Expected the merge to fail")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(backup, "failed.mp4*")); len(matches) > 0 || secondPath != "" {
+		t.Errorf("Expected no second output, got %v", matches)
+	}
+
+	for args, expected := range map[string]string{
+		"-also-output backup -max-size 4G":    "cannot be combined with -max-size",
+		"-also-output out.mp4":                "must not be the output itself",
+		"-split-chapters -also-output backup": "cannot be combined with -also-output",
+	} {
+		var stdout, stderr bytes.Buffer
+		code := run(append(strings.Fields(args), "out.mp4", "GH011234.MP4"), &stdout, &stderr)
+		if code != exitUsage || !strings.Contains(stderr.String(), expected) {
+			t.Errorf("Expected %s to be refused with %q, got %d: %s", args, expected, code, stderr.String())
+		}
+	}
+}
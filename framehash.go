@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Levels of -verify.
+const (
+	verifyBasic = "basic"
+	verifyDeep  = "deep"
+)
+
+// frameHash is a line of the framemd5 muxer: the hash of a frame of a
+// stream, with its time.
+type frameHash struct {
+	Stream int
+	Time   time.Duration
+	Hash   string
+}
+
+// FrameCheck is the comparison of the frames of the inputs and of the
+// output by verifyFrames.
+type FrameCheck struct {
+	// Frames is the number of video and audio frames that match.
+	Frames int `json:"frames"`
+	// Mismatch is the first frame that differs, nil when none does.
+	Mismatch *FrameMismatch `json:"mismatch,omitempty"`
+}
+
+// FrameMismatch locates the first frame of the output that is not the one
+// of the inputs.
+type FrameMismatch struct {
+	Stream    int    `json:"stream"`
+	MediaType string `json:"media_type"`
+	// Frame is the index of the frame in its stream, from 0.
+	Frame int `json:"frame"`
+	// Time is where the frame is in the inputs, or in the output for a
+	// frame the inputs do not have.
+	Time time.Duration `json:"-"`
+	// Expected and Actual are the MD5 hashes of the frame in the inputs
+	// and in the output, empty when one of them lacks it.
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// MarshalJSON encodes the mismatch with its time in seconds.
+func (m FrameMismatch) MarshalJSON() ([]byte, error) {
+	type mismatch FrameMismatch
+	return json.Marshal(struct {
+		mismatch
+		Time float64 `json:"time"`
+	}{mismatch(m), m.Time.Seconds()})
+}
+
+func (m FrameMismatch) String() string {
+	frame := fmt.Sprintf("%s frame %d of stream %d, at %s,", m.MediaType, m.Frame, m.Stream, formatOffset(m.Time))
+	switch {
+	case m.Actual == "":
+		return frame + " is missing from the output"
+	case m.Expected == "":
+		return frame + " is not in the inputs"
+	}
+	return frame + " differs from the inputs"
+}
+
+// frameHashArgs builds the ffmpeg arguments printing the MD5 hash of every
+// frame of the first video stream and of the audio stream audioTrack,
+// counting from 0, of input, the arguments opening it, with the framemd5
+// muxer. A negative audioTrack hashes no audio. The frames are copied,
+// not decoded, so the hashes are of the bytes stored.
+func frameHashArgs(input []string, audioTrack int, logLevel string) []string {
+	args := append(ffmpegArgs(logLevel), input...)
+	args = append(args, "-map", "0:v:0")
+	if audioTrack >= 0 {
+		args = append(args, "-map", fmt.Sprintf("0:a:%d?", audioTrack))
+	}
+	return append(args, "-c", "copy", "-f", "framemd5", "-")
+}
+
+// frameHashWriter parses the output of the framemd5 muxer and passes each
+// frame to fn. An error of fn stops the writes, and so ffmpeg.
+type frameHashWriter struct {
+	fn  func(frameHash) error
+	buf bytes.Buffer
+	// timeBases are the time bases of the streams in seconds, and
+	// mediaTypes their kinds, from the header.
+	timeBases  map[int]float64
+	mediaTypes map[int]string
+}
+
+func newFrameHashWriter(fn func(frameHash) error) *frameHashWriter {
+	return &frameHashWriter{fn: fn, timeBases: map[int]float64{}, mediaTypes: map[int]string{}}
+}
+
+func (w *frameHashWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		if err := w.parseLine(strings.TrimSpace(line)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// parseLine reads a header line such as "#tb 0: 1001/60000" or
+// "#media_type 0: video", or a frame line "stream, dts, pts, duration,
+// size, hash".
+func (w *frameHashWriter) parseLine(line string) error {
+	if header, ok := strings.CutPrefix(line, "#"); ok {
+		key, rest, _ := strings.Cut(header, " ")
+		index, value, _ := strings.Cut(rest, ": ")
+		stream, err := strconv.Atoi(index)
+		if err != nil {
+			return nil
+		}
+		switch key {
+		case "tb":
+			num, den, _ := strings.Cut(value, "/")
+			n, err1 := strconv.ParseFloat(num, 64)
+			d, err2 := strconv.ParseFloat(den, 64)
+			if err1 == nil && err2 == nil && d != 0 {
+				w.timeBases[stream] = n / d
+			}
+		case "media_type":
+			w.mediaTypes[stream] = value
+		}
+		return nil
+	}
+	if line == "" {
+		return nil
+	}
+	fields := strings.Split(line, ",")
+	if len(fields) < 6 {
+		return fmt.Errorf("unexpected framemd5 line %q", line)
+	}
+	stream, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return fmt.Errorf("unexpected framemd5 line %q", line)
+	}
+	pts, _ := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+	at := time.Duration(float64(pts) * w.timeBases[stream] * float64(time.Second))
+	return w.fn(frameHash{Stream: stream, Time: at, Hash: strings.TrimSpace(fields[5])})
+}
+
+// errFrameMismatch stops hashing the output at the first frame that
+// differs.
+var errFrameMismatch = errors.New("frame mismatch")
+
+// hashFrames runs the framemd5 muxer with args and passes each frame to fn,
+// reporting the progress of stage over total to opts.ProgressFunc. It
+// returns the media types of the streams.
+func hashFrames(args []string, stage string, total time.Duration, fn func(frameHash) error, opts Options) (map[int]string, error) {
+	var current, reported time.Duration
+	w := newFrameHashWriter(func(frame frameHash) error {
+		current = max(current, frame.Time)
+		// A report per second of footage, there are dozens of frames per second
+		if opts.ProgressFunc != nil && total > 0 && current-reported >= time.Second {
+			reported = current
+			opts.ProgressFunc(Progress{Stage: stage, Percent: min(100, 100*float64(current)/float64(total)), Current: current, Total: total})
+		}
+		return fn(frame)
+	})
+	cmd := ffmpegCommand(args...)
+	cmd.Stdout = w
+	err := runCommand(opts.logger(), cmd)
+	if err == nil && opts.ProgressFunc != nil {
+		opts.ProgressFunc(Progress{Stage: stage, Percent: 100, Current: total, Total: total})
+	}
+	return w.mediaTypes, err
+}
+
+// verifyFrames compares the hash of every frame of the first video and
+// audio streams of partial, the output of a stream copy lasting total,
+// with the ones of the inputs, read through the concat list at listPath
+// as the merge read them. The inputs are hashed first, then the output
+// stops being hashed at the first frame that differs, which is the
+// Mismatch of the check. The error is for frames that could not be
+// hashed.
+func verifyFrames(listPath string, remote bool, partial string, total time.Duration, opts Options) (FrameCheck, error) {
+	logger := opts.logger()
+	// The output has only the audio track of Options.AudioTrack
+	inputAudio, outputAudio := max(opts.AudioTrack-1, 0), 0
+	if opts.DropAudio {
+		inputAudio, outputAudio = -1, -1
+	}
+
+	// The concat demuxer converts H.264 to Annex B for the merge, which the
+	// MP4 muxer converts back, the inputs are hashed as they are stored
+	input := append(append(inputArgs(opts), "-auto_convert", "0"), concatInputArgs(listPath, remote)...)
+	logger.Info("hashing the frames of the inputs", "list", listPath)
+	expected := map[int][]frameHash{}
+	mediaTypes, err := hashFrames(frameHashArgs(input, inputAudio, opts.FFmpegLogLevel), stageHashInputs, total, func(frame frameHash) error {
+		expected[frame.Stream] = append(expected[frame.Stream], frame)
+		return nil
+	}, opts)
+	if err != nil {
+		return FrameCheck{}, fmt.Errorf("failed to hash the frames of the inputs: %v", err)
+	}
+
+	logger.Info("hashing the frames of the output", "output", partial)
+	var check FrameCheck
+	actual := map[int]int{}
+	outputTypes, err := hashFrames(frameHashArgs([]string{"-i", partial}, outputAudio, opts.FFmpegLogLevel), stageHashOutput, total, func(frame frameHash) error {
+		index := actual[frame.Stream]
+		actual[frame.Stream]++
+		frames := expected[frame.Stream]
+		switch {
+		case index >= len(frames):
+			check.Mismatch = &FrameMismatch{Stream: frame.Stream, Frame: index, Time: frame.Time, Actual: frame.Hash}
+		case frames[index].Hash != frame.Hash:
+			check.Mismatch = &FrameMismatch{Stream: frame.Stream, Frame: index, Time: frames[index].Time, Expected: frames[index].Hash, Actual: frame.Hash}
+		default:
+			check.Frames++
+			return nil
+		}
+		return errFrameMismatch
+	}, opts)
+	if err != nil && check.Mismatch == nil {
+		return FrameCheck{}, fmt.Errorf("failed to hash the frames of the output: %v", err)
+	}
+	// A frame of the inputs past the end of the output is missing
+	for stream := 0; check.Mismatch == nil && stream < len(expected); stream++ {
+		if frames := expected[stream]; actual[stream] < len(frames) {
+			missing := frames[actual[stream]]
+			check.Mismatch = &FrameMismatch{Stream: stream, Frame: actual[stream], Time: missing.Time, Expected: missing.Hash}
+		}
+	}
+	if check.Mismatch != nil {
+		check.Mismatch.MediaType = mediaTypes[check.Mismatch.Stream]
+		if check.Mismatch.MediaType == "" {
+			check.Mismatch.MediaType = outputTypes[check.Mismatch.Stream]
+		}
+	}
+	return check, nil
+}
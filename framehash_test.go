@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// framemd5Header is the header the framemd5 muxer prints for a GoPro
+// chapter, a 59.94 fps video stream and a 48 kHz audio stream.
+const framemd5Header = `#format: frame checksums
+#version: 2
+#hash: MD5
+#tb 0: 1/60000
+#media_type 0: video
+#codec_id 0: hevc
+#dimensions 0: 3840x2160
+#sar 0: 1/1
+#tb 1: 1/48000
+#media_type 1: audio
+#codec_id 1: aac
+#sample_rate 1: 48000
+#channel_layout_name 1: stereo
+#stream#, dts,        pts, duration,     size, hash
+`
+
+// framemd5Lines is what the framemd5 muxer prints for frames, given as
+// stream and hash, at one video frame or audio frame after the other.
+func framemd5Lines(frames ...string) string {
+	var lines strings.Builder
+	lines.WriteString(framemd5Header)
+	counts := map[string]int{}
+	for _, frame := range frames {
+		stream, hash, _ := strings.Cut(frame, ":")
+		duration := 1001
+		if stream == "1" {
+			duration = 1024
+		}
+		pts := counts[stream] * duration
+		counts[stream]++
+		fmt.Fprintf(&lines, "%s, %10d, %10d, %8d, %8d, %s\n", stream, pts, pts, duration, 4096, hash)
+	}
+	return lines.String()
+}
+
+func TestFrameHashWriter(t *testing.T) {
+	var frames []frameHash
+	w := newFrameHashWriter(func(frame frameHash) error {
+		frames = append(frames, frame)
+		return nil
+	})
+	text := framemd5Lines("0:8e1f", "1:a0b1", "1:a0b2", "0:8e20")
+	// ffmpeg writes in blocks that split lines
+	for _, chunk := range []string{text[:100], text[100 : len(text)-10], text[len(text)-10:]} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(frames) != 4 {
+		t.Fatalf("Expected 4 frames, got %+v", frames)
+	}
+	if frames[2] != (frameHash{Stream: 1, Time: 1024 * time.Second / 48000, Hash: "a0b2"}) {
+		t.Errorf("Unexpected audio frame %+v", frames[2])
+	}
+	if frames[3].Stream != 0 || frames[3].Time != 1001*time.Second/60000 || w.mediaTypes[0] != "video" {
+		t.Errorf("Unexpected video frame %+v", frames[3])
+	}
+	if _, err := w.Write([]byte("0, 0, 0\n")); err == nil {
+		t.Error("Expected a truncated line to be refused")
+	}
+}
+
+func TestFrameHashArgs(t *testing.T) {
+	args := strings.Join(frameHashArgs([]string{"-f", "concat", "-safe", "0", "-i", "list.txt"}, 0, ""), " ")
+	if !strings.HasSuffix(args, "-f concat -safe 0 -i list.txt -map 0:v:0 -map 0:a:0? -c copy -f framemd5 -") {
+		t.Errorf("Unexpected arguments: %s", args)
+	}
+	if args := strings.Join(frameHashArgs([]string{"-i", "merged.mp4"}, -1, ""), " "); strings.Contains(args, "0:a") {
+		t.Errorf("Expected no audio without it, got: %s", args)
+	}
+}
+
+// stubFrameHashes makes the framemd5 runs print inputs for the concat
+// list and output for the output, and the merge write its output.
+func stubFrameHashes(t *testing.T, inputs, output string) {
+	t.Helper()
+	origRunCommand := runCommand
+	t.Cleanup(func() { runCommand = origRunCommand })
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		if !slices.Contains(cmd.Args, "framemd5") {
+			return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+		}
+		text := output
+		if slices.Contains(cmd.Args, "concat") {
+			text = inputs
+			if !slices.Contains(cmd.Args, "-auto_convert") {
+				t.Errorf("Expected the inputs to be hashed as stored, got %v", cmd.Args)
+			}
+		}
+		_, err := cmd.Stdout.Write([]byte(text))
+		return err
+	}
+}
+
+func TestVerifyFrames(t *testing.T) {
+	inputs := framemd5Lines("0:v0", "1:a0", "0:v1", "1:a1", "0:v2", "1:a2")
+	for _, test := range []struct {
+		name     string
+		output   string
+		frames   int
+		mismatch *FrameMismatch
+	}{
+		// The muxer interleaves the streams of the output differently
+		{"identical", framemd5Lines("0:v0", "0:v1", "1:a0", "1:a1", "0:v2", "1:a2"), 6, nil},
+		{"different", framemd5Lines("0:v0", "1:a0", "0:vX", "1:a1", "0:v2", "1:a2"), 2,
+			&FrameMismatch{Stream: 0, MediaType: "video", Frame: 1, Time: 1001 * time.Second / 60000, Expected: "v1", Actual: "vX"}},
+		{"missing", framemd5Lines("0:v0", "1:a0", "0:v1", "1:a1", "0:v2"), 5,
+			&FrameMismatch{Stream: 1, MediaType: "audio", Frame: 2, Time: 2048 * time.Second / 48000, Expected: "a2"}},
+		{"extra", framemd5Lines("0:v0", "1:a0", "0:v1", "1:a1", "0:v2", "1:a2", "0:v3"), 6,
+			&FrameMismatch{Stream: 0, MediaType: "video", Frame: 3, Time: 3003 * time.Second / 60000, Actual: "v3"}},
+	} {
+		stubFrameHashes(t, inputs, test.output)
+		var progress []Progress
+		opts := Options{ProgressFunc: func(p Progress) { progress = append(progress, p) }}
+		check, err := verifyFrames("list.txt", false, "merged.mp4.partial", 100*time.Millisecond, opts)
+		if err != nil {
+			t.Fatalf("%s: verifyFrames() error: %v", test.name, err)
+		}
+		if check.Frames != test.frames {
+			t.Errorf("%s: expected %d frames, got %d", test.name, test.frames, check.Frames)
+		}
+		if (check.Mismatch == nil) != (test.mismatch == nil) || check.Mismatch != nil && *check.Mismatch != *test.mismatch {
+			t.Errorf("%s: expected the mismatch %+v, got %+v", test.name, test.mismatch, check.Mismatch)
+		}
+		if test.mismatch == nil && (len(progress) != 2 || progress[0].Stage != stageHashInputs || progress[1].Stage != stageHashOutput || progress[1].Percent != 100) {
+			t.Errorf("%s: expected the progress of both stages, got %+v", test.name, progress)
+		}
+	}
+
+	mismatch := FrameMismatch{Stream: 0, MediaType: "video", Frame: 5120, Time: 85418 * time.Millisecond, Expected: "v1", Actual: "vX"}
+	if got := mismatch.String(); got != "video frame 5120 of stream 0, at 00:01:25.418, differs from the inputs" {
+		t.Errorf("Unexpected description: %s", got)
+	}
+	data, err := json.Marshal(FrameCheck{Frames: 2, Mismatch: &mismatch})
+	if err != nil || !strings.Contains(string(data), `"frame":5120,"expected":"v1","actual":"vX","time":85.418`) {
+		t.Errorf("Expected the time in seconds, got %s (%v)", data, err)
+	}
+}
+
+func TestMergeVerifyFrames(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	probe := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		return probe, nil
+	}
+
+	inputs := framemd5Lines("0:v0", "1:a0", "0:v1", "1:a1")
+	stubFrameHashes(t, inputs, inputs)
+	var check *FrameCheck
+	opts := Options{VerifyFrames: true, FramesFunc: func(c FrameCheck) { check = &c }}
+	outputPath := filepath.Join(dir, "merged.mp4")
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if check == nil || check.Frames != 4 || check.Mismatch != nil {
+		t.Errorf("Expected the 4 frames to match, got %+v", check)
+	}
+
+	// A frame that differs keeps the output as incomplete
+	stubFrameHashes(t, inputs, framemd5Lines("0:v0", "1:a0", "0:vX", "1:a1"))
+	outputPath = filepath.Join(dir, "damaged.mp4")
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts)
+	if err == nil || !strings.Contains(err.Error(), "frame verification failed: video frame 1 of stream 0") {
+		t.Errorf("Expected the mismatch to fail the merge, got %v", err)
+	}
+	if _, err := os.Stat(outputPath + incompleteSuffix); err != nil {
+		t.Errorf("Expected the output to be kept as incomplete: %v", err)
+	}
+	if check == nil || check.Mismatch == nil {
+		t.Errorf("Expected the mismatch to be reported, got %+v", check)
+	}
+
+	// With -audio-track the inputs are hashed on that track, the only
+	// one of the output
+	withRaw := probe
+	withRaw.Streams = append(append([]StreamInfo(nil), probe.Streams...), StreamInfo{Index: 5, CodecType: "audio", CodecName: "pcm_s24le", SampleRate: "48000", Channels: 2})
+	probeFile = func(path string) (ProbeResult, error) {
+		return withRaw, nil
+	}
+	track1 := framemd5Lines("0:v0", "1:a0", "0:v1", "1:a1")
+	track2 := framemd5Lines("0:v0", "1:r0", "0:v1", "1:r1")
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		if !slices.Contains(cmd.Args, "framemd5") {
+			return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+		}
+		text := track1
+		if slices.Contains(cmd.Args, "0:a:1?") || !slices.Contains(cmd.Args, "concat") {
+			text = track2
+		}
+		_, err := cmd.Stdout.Write([]byte(text))
+		return err
+	}
+	check = nil
+	opts.AudioTrack = 2
+	if err := mergeFiles(filepath.Join(dir, "track2.mp4"), inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error with -audio-track: %v", err)
+	}
+	if check == nil || check.Frames != 4 {
+		t.Errorf("Expected the frames of audio track 2 to match, got %+v", check)
+	}
+
+	for _, refused := range []Options{
+		{VerifyFrames: true, Reencode: true},
+		{VerifyFrames: true, NormalizeAudio: true},
+		{VerifyFrames: true, End: -30 * time.Second},
+	} {
+		if err := mergeFiles(filepath.Join(dir, "refused.mp4"), inputPaths, time.Now(), time.Now(), refused); err == nil || !strings.Contains(err.Error(), "-verify deep cannot be combined") {
+			t.Errorf("Expected %+v to be refused, got %v", refused, err)
+		}
+	}
+
+	for args, expected := range map[string]string{
+		"-verify full":            `invalid -verify "full"`,
+		"-verify deep -no-verify": "cannot be combined with -no-verify",
+	} {
+		var stdout, stderr bytes.Buffer
+		code := run(append(strings.Fields(args), "out.mp4", "GH011234.MP4"), &stdout, &stderr)
+		if code != exitUsage || !strings.Contains(stderr.String(), expected) {
+			t.Errorf("Expected %s to be refused with %q, got %d: %s", args, expected, code, stderr.String())
+		}
+	}
+}
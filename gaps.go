@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultGapThreshold allows for the file times of the chapters, which are
+// taken when the camera opens and closes the file rather than at the first
+// and last frame.
+const defaultGapThreshold = 2 * time.Second
+
+// ChapterGap is the time between the end of a chapter and the start of the
+// next one. The camera starts a chapter it splits off right where the last
+// one ends, so a gap means it stopped recording in between. A negative gap
+// is an overlap, from file times that are off.
+type ChapterGap struct {
+	Path string
+	Next string
+	// End is when Path ended, Start when Next started.
+	End   time.Time
+	Start time.Time
+}
+
+// Gap is how long the camera did not record between the chapters.
+func (g ChapterGap) Gap() time.Duration {
+	return g.Start.Sub(g.End)
+}
+
+// gapThreshold returns opts.GapThreshold, or defaultGapThreshold when it
+// is zero.
+func (o Options) gapThreshold() time.Duration {
+	if o.GapThreshold == 0 {
+		return defaultGapThreshold
+	}
+	return o.GapThreshold
+}
+
+// chapterStart returns when the chapter at path started recording: its
+// birth time, or where the file system records none, its modification
+// time less its duration, as the camera last writes a chapter when it
+// ends.
+func chapterStart(path string, duration time.Duration) (time.Time, error) {
+	birthTime, modTime, err := fileTimes(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if birthTime.IsZero() {
+		return modTime.Add(-duration), nil
+	}
+	return birthTime, nil
+}
+
+// findGaps returns the gaps between consecutive files longer than
+// threshold either way. durations holds the duration of each file.
+func findGaps(files []FileInfo, durations []time.Duration, threshold time.Duration) ([]ChapterGap, error) {
+	starts := make([]time.Time, len(files))
+	for i, file := range files {
+		start, err := chapterStart(file.Path, durations[i])
+		if err != nil {
+			return nil, err
+		}
+		starts[i] = start
+	}
+	return gapsBetween(files, starts, durations, threshold), nil
+}
+
+// gapsBetween is findGaps for files that started at starts.
+func gapsBetween(files []FileInfo, starts []time.Time, durations []time.Duration, threshold time.Duration) []ChapterGap {
+	var gaps []ChapterGap
+	for i := 0; i < len(files)-1; i++ {
+		gap := ChapterGap{
+			Path:  files[i].Path,
+			Next:  files[i+1].Path,
+			End:   starts[i].Add(durations[i]),
+			Start: starts[i+1],
+		}
+		if gap.Gap() > threshold || -gap.Gap() > threshold {
+			gaps = append(gaps, gap)
+		}
+	}
+	return gaps
+}
+
+// printGaps lists the gaps between chapters with when the recording
+// stopped and started again.
+func printGaps(w io.Writer, gaps []ChapterGap, threshold time.Duration, loc *time.Location) {
+	if len(gaps) == 0 {
+		fmt.Fprintf(w, "Gaps checked: every chapter starts within %v of the end of the one before\n", threshold)
+		return
+	}
+	fmt.Fprintf(w, "%d gap(s) of more than %v between chapters, where the camera stopped recording:\n", len(gaps), threshold)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  CHAPTER\tENDED\tNEXT\tSTARTED\tGAP")
+	for _, gap := range gaps {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%+.3fs\n", filepath.Base(gap.Path), gap.End.In(loc).Format("2006-01-02 15:04:05.000"),
+			filepath.Base(gap.Next), gap.Start.In(loc).Format("2006-01-02 15:04:05.000"), gap.Gap().Seconds())
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "Negative gaps are overlaps, which point at file times changed by copying or a wrong camera clock")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGapsBetween(t *testing.T) {
+	files := []FileInfo{
+		{Path: "/trip/GH010042.MP4"},
+		{Path: "/trip/GH020042.MP4"},
+		{Path: "/trip/GH030042.MP4"},
+		{Path: "/trip/GH040042.MP4"},
+	}
+	chapter := 8*time.Minute + 51*time.Second
+	start := time.Date(2024, time.June, 1, 10, 0, 0, 0, time.UTC)
+	starts := []time.Time{
+		start,
+		// Split off by the camera, opened a moment after the last frame
+		start.Add(chapter + 300*time.Millisecond),
+		// The camera was stopped for 95 seconds
+		start.Add(2*chapter + 95*time.Second),
+		// A copy changed the file time, so it overlaps
+		start.Add(3*chapter + 80*time.Second),
+	}
+	durations := []time.Duration{chapter, chapter, chapter, chapter}
+
+	gaps := gapsBetween(files, starts, durations, defaultGapThreshold)
+	if len(gaps) != 2 {
+		t.Fatalf("Expected the stop and the overlap, got %+v", gaps)
+	}
+	if gaps[0].Path != files[1].Path || gaps[0].Next != files[2].Path || gaps[0].Gap() != 94700*time.Millisecond {
+		t.Errorf("Expected a 94.7s gap after chapter 2, got %+v (%v)", gaps[0], gaps[0].Gap())
+	}
+	if gaps[1].Path != files[2].Path || gaps[1].Gap() != -15*time.Second {
+		t.Errorf("Expected a 15s overlap after chapter 3, got %+v (%v)", gaps[1], gaps[1].Gap())
+	}
+	if gaps := gapsBetween(files[:2], starts[:2], durations[:2], defaultGapThreshold); len(gaps) != 0 {
+		t.Errorf("Expected no gap between split chapters, got %+v", gaps)
+	}
+
+	var out bytes.Buffer
+	printGaps(&out, gaps[:1], defaultGapThreshold, time.UTC)
+	for _, expected := range []string{
+		"1 gap(s) of more than 2s between chapters",
+		"GH020042.MP4  2024-06-01 10:17:42.300  GH030042.MP4  2024-06-01 10:19:17.000  +94.700s",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in the report, got:\n%s", expected, out.String())
+		}
+	}
+	out.Reset()
+	printGaps(&out, nil, defaultGapThreshold, time.UTC)
+	if !strings.Contains(out.String(), "every chapter starts within 2s") {
+		t.Errorf("Expected no gaps to be reported, got: %s", out.String())
+	}
+}
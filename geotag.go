@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// defaultGeotagMaxGap is how far the nearest point of a -geotag track may
+// be from the start of the recording. A phone logging a track records a
+// point every few seconds, a larger gap means the track does not cover
+// the recording.
+const defaultGeotagMaxGap = 5 * time.Minute
+
+// TrackPoint is a point of a GPS track.
+type TrackPoint struct {
+	Time      time.Time
+	Latitude  float64
+	Longitude float64
+	// Elevation is in meters, nil when the track has none.
+	Elevation *float64
+}
+
+// gpxFile is the part of a GPX file read: the points of its tracks.
+type gpxFile struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []struct {
+				Latitude  float64  `xml:"lat,attr"`
+				Longitude float64  `xml:"lon,attr"`
+				Elevation *float64 `xml:"ele"`
+				Time      string   `xml:"time"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// readGPX reads the track points of the GPX file path, as phone apps log
+// them, in time order. Points without a time are left out, they cannot be
+// matched to a recording.
+func readGPX(path string) ([]TrackPoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GPX track: %v", err)
+	}
+	var gpx gpxFile
+	if err := xml.Unmarshal(data, &gpx); err != nil {
+		return nil, fmt.Errorf("invalid GPX track %s: %v", path, err)
+	}
+	var points []TrackPoint
+	for _, track := range gpx.Tracks {
+		for _, segment := range track.Segments {
+			for _, point := range segment.Points {
+				if point.Time == "" {
+					continue
+				}
+				at, err := time.Parse(time.RFC3339, point.Time)
+				if err != nil {
+					return nil, fmt.Errorf("invalid GPX track %s: invalid time %q", path, point.Time)
+				}
+				if point.Latitude < -90 || point.Latitude > 90 || point.Longitude < -180 || point.Longitude > 180 {
+					return nil, fmt.Errorf("invalid GPX track %s: invalid coordinates %g, %g", path, point.Latitude, point.Longitude)
+				}
+				points = append(points, TrackPoint{Time: at, Latitude: point.Latitude, Longitude: point.Longitude, Elevation: point.Elevation})
+			}
+		}
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("GPX track %s has no track points with a time", path)
+	}
+	slices.SortStableFunc(points, func(a, b TrackPoint) int {
+		return a.Time.Compare(b.Time)
+	})
+	return points, nil
+}
+
+// GeotagMatch is the point of a track locating a recording.
+type GeotagMatch struct {
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Elevation *float64  `json:"elevation,omitempty"`
+	Time      time.Time `json:"time"`
+	// Delta is how long after the start of the recording, on the clock
+	// of the track, the point was logged. Negative is before.
+	Delta time.Duration `json:"-"`
+}
+
+// MarshalJSON encodes the match with its delta in seconds.
+func (m GeotagMatch) MarshalJSON() ([]byte, error) {
+	type match GeotagMatch
+	return json.Marshal(struct {
+		match
+		Delta float64 `json:"delta"`
+	}{match(m), m.Delta.Seconds()})
+}
+
+// ISO6709 is the location of the match as QuickTime stores it, e.g.
+// +46.5083+011.7606+2240.000/.
+func (m GeotagMatch) ISO6709() string {
+	location := fmt.Sprintf("%+08.4f%+09.4f", m.Latitude, m.Longitude)
+	if m.Elevation != nil {
+		location += fmt.Sprintf("%+.3f", *m.Elevation)
+	}
+	return location + "/"
+}
+
+// String describes the match for a person.
+func (m GeotagMatch) String() string {
+	when := "at the start of the recording"
+	switch {
+	case m.Delta > 0:
+		when = fmt.Sprintf("%s after the start of the recording", m.Delta)
+	case m.Delta < 0:
+		when = fmt.Sprintf("%s before the start of the recording", -m.Delta)
+	}
+	return fmt.Sprintf("%.6f, %.6f, from the track point %s", m.Latitude, m.Longitude, when)
+}
+
+// nearestTrackPoint matches the point of points, in time order, nearest
+// at. A nearest point further than maxGap fails instead of guessing.
+func nearestTrackPoint(points []TrackPoint, at time.Time, maxGap time.Duration) (GeotagMatch, error) {
+	if len(points) == 0 {
+		return GeotagMatch{}, fmt.Errorf("the GPX track has no points")
+	}
+	i, _ := slices.BinarySearchFunc(points, at, func(p TrackPoint, t time.Time) int {
+		return p.Time.Compare(t)
+	})
+	nearest := min(i, len(points)-1)
+	if i > 0 && (i == len(points) || at.Sub(points[i-1].Time) <= points[i].Time.Sub(at)) {
+		nearest = i - 1
+	}
+	point := points[nearest]
+	delta := point.Time.Sub(at)
+	if delta.Abs() > maxGap {
+		return GeotagMatch{}, fmt.Errorf("the GPX track has no point within %s of the recording at %s, the nearest is %s away. Use -geotag-offset if the clock of the camera is off, or -geotag-max-gap to accept it",
+			maxGap, at.UTC().Format(time.RFC3339), delta.Abs())
+	}
+	return GeotagMatch{
+		Latitude:  point.Latitude,
+		Longitude: point.Longitude,
+		Elevation: point.Elevation,
+		Time:      point.Time,
+		Delta:     delta,
+	}, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testGPX is a track logged by a phone app, with its points out of order
+// across two segments and one without a time.
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="Tracker" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk>
+    <name>Sella pass</name>
+    <trkseg>
+      <trkpt lat="46.5083" lon="11.7606"><ele>2240.0</ele><time>2026-07-04T12:30:10Z</time></trkpt>
+      <trkpt lat="46.5090" lon="11.7611"><ele>2244.5</ele><time>2026-07-04T12:30:40Z</time></trkpt>
+    </trkseg>
+    <trkseg>
+      <trkpt lat="46.5001" lon="11.7502"><time>2026-07-04T12:20:00Z</time></trkpt>
+      <trkpt lat="46.6000" lon="11.8000"></trkpt>
+    </trkseg>
+  </trk>
+</gpx>
+`
+
+func writeGPX(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "track.gpx")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadGPX(t *testing.T) {
+	dir := t.TempDir()
+	points, err := readGPX(writeGPX(t, dir, testGPX))
+	if err != nil {
+		t.Fatalf("readGPX() error: %v", err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("Expected the 3 points with a time, got %+v", points)
+	}
+	if !points[0].Time.Equal(time.Date(2026, 7, 4, 12, 20, 0, 0, time.UTC)) || points[0].Elevation != nil {
+		t.Errorf("Expected the points in time order, got %+v", points[0])
+	}
+	if points[2].Latitude != 46.5090 || points[2].Elevation == nil || *points[2].Elevation != 2244.5 {
+		t.Errorf("Expected the last point with its elevation, got %+v", points[2])
+	}
+
+	for content, expected := range map[string]string{
+		`<gpx><trk><trkseg><trkpt lat="46.5" lon="11.7"><time>yesterday</time></trkpt></trkseg></trk></gpx>`:             `invalid time "yesterday"`,
+		`<gpx><trk><trkseg><trkpt lat="146.5" lon="11.7"><time>2026-07-04T12:20:00Z</time></trkpt></trkseg></trk></gpx>`: "invalid coordinates",
+		`<gpx><wpt lat="46.5" lon="11.7"/></gpx>`: "has no track points with a time",
+		`not a track`: "invalid GPX track",
+		`<gpx><trk>`:  "invalid GPX track",
+	} {
+		if _, err := readGPX(writeGPX(t, dir, content)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestNearestTrackPoint(t *testing.T) {
+	points, err := readGPX(writeGPX(t, t.TempDir(), testGPX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 7, 4, 12, 30, 0, 0, time.UTC)
+
+	match, err := nearestTrackPoint(points, start, defaultGeotagMaxGap)
+	if err != nil {
+		t.Fatalf("nearestTrackPoint() error: %v", err)
+	}
+	if match.Latitude != 46.5083 || match.Delta != 10*time.Second {
+		t.Errorf("Expected the point 10s after the start, got %+v", match)
+	}
+	if got := match.ISO6709(); got != "+46.5083+011.7606+2240.000/" {
+		t.Errorf("Expected +46.5083+011.7606+2240.000/, got %s", got)
+	}
+	if got := match.String(); got != "46.508300, 11.760600, from the track point 10s after the start of the recording" {
+		t.Errorf("Unexpected description: %s", got)
+	}
+	data, err := json.Marshal(match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"elevation":2240,"time":"2026-07-04T12:30:10Z","delta":10`) {
+		t.Errorf("Expected the delta in seconds, got %s", data)
+	}
+
+	// Nearer to the earlier point, without an elevation
+	match, err = nearestTrackPoint(points, start.Add(-6*time.Minute), defaultGeotagMaxGap)
+	if err != nil || match.Latitude != 46.5001 || match.Delta != -4*time.Minute || match.ISO6709() != "+46.5001+011.7502/" {
+		t.Errorf("Expected the point 4m before, got %+v, %v", match, err)
+	}
+	// Past the end of the track
+	match, err = nearestTrackPoint(points, start.Add(2*time.Minute), defaultGeotagMaxGap)
+	if err != nil || match.Latitude != 46.5090 {
+		t.Errorf("Expected the last point, got %+v, %v", match, err)
+	}
+
+	// The recording an hour later than the track is not guessed
+	if _, err := nearestTrackPoint(points, start.Add(time.Hour), defaultGeotagMaxGap); err == nil || !strings.Contains(err.Error(), "the nearest is 59m20s away") {
+		t.Errorf("Expected a track that does not cover the recording to be refused, got %v", err)
+	}
+}
+
+func TestMergeGeotag(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+	points, err := readGPX(writeGPX(t, dir, testGPX))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	probe := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return probe, nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	// The camera runs 90 seconds fast
+	var matched *GeotagMatch
+	creationTime := time.Date(2026, 7, 4, 12, 31, 30, 0, time.UTC)
+	opts := Options{Geotag: points, GeotagOffset: -90 * time.Second, GeotagFunc: func(m GeotagMatch) { matched = &m }}
+	if err := mergeFiles(outputPath, inputPaths, creationTime, creationTime, opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	command := strings.Join(merge, " ")
+	for _, arg := range []string{
+		"-metadata location=+46.5083+011.7606+2240.000/",
+		"-metadata com.apple.quicktime.location.ISO6709=+46.5083+011.7606+2240.000/",
+	} {
+		if !strings.Contains(command, arg) {
+			t.Errorf("Expected %q in the merge command, got: %s", arg, command)
+		}
+	}
+	if matched == nil || matched.Delta != 10*time.Second {
+		t.Errorf("Expected the match to be reported, got %+v", matched)
+	}
+
+	// A location of the metadata CSV is kept
+	matched = nil
+	opts.Metadata = map[int]RecordingMetadata{1234: {Location: "+48.8584+002.2945/"}}
+	if err := mergeFiles(outputPath, inputPaths, creationTime, creationTime, opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if command := strings.Join(merge, " "); !strings.Contains(command, "location=+48.8584+002.2945/") || strings.Contains(command, "+46.5083") || matched != nil {
+		t.Errorf("Expected the location of the CSV, got: %s", command)
+	}
+
+	// A recording an hour after the track is refused before merging
+	merge = nil
+	opts = Options{Geotag: points, GeotagMaxGap: time.Minute}
+	err = mergeFiles(outputPath, inputPaths, creationTime.Add(time.Hour), creationTime, opts)
+	if err == nil || !strings.Contains(err.Error(), "no point within 1m0s") || merge != nil {
+		t.Errorf("Expected the merge to be refused, got %v and %v", err, merge)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-geotag-offset", "10s", "out.mp4", "GH011234.MP4"}, &stdout, &stderr); code != exitUsage || !strings.Contains(stderr.String(), "only apply with -geotag") {
+		t.Errorf("Expected -geotag-offset without -geotag to be refused, got %d: %s", code, stderr.String())
+	}
+}
@@ -3,6 +3,6 @@ module GoProConcat
 go 1.22
 
 require (
-	github.com/djherbis/times v1.6.0 // indirect
-	golang.org/x/sys v0.0.0-20220615213510-4f61da869c0c // indirect
+	github.com/djherbis/times v1.6.0
+	golang.org/x/sys v0.0.0-20220615213510-4f61da869c0c
 )
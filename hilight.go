@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// readHiLights returns the HiLight moments marked on the camera while
+// recording, as offsets from the start of the file. They are stored in the
+// moov/udta/HMMT box as a count followed by millisecond offsets.
+func readHiLights(filePath string) ([]time.Duration, error) {
+	payload, err := readFileBox(filePath, "moov", "udta", "HMMT")
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 4 {
+		return nil, nil
+	}
+
+	count := int(binary.BigEndian.Uint32(payload[:4]))
+	if 4+count*4 > len(payload) {
+		return nil, fmt.Errorf("invalid HiLight box in %s: %d entries do not fit in %d bytes", filePath, count, len(payload))
+	}
+
+	hilights := make([]time.Duration, 0, count)
+	for i := 0; i < count; i++ {
+		ms := binary.BigEndian.Uint32(payload[4+i*4:])
+		if ms == 0 {
+			// Unused slots are zero-filled
+			continue
+		}
+		hilights = append(hilights, time.Duration(ms)*time.Millisecond)
+	}
+	return hilights, nil
+}
+
+// hiLightBox encodes hilights as an HMMT box, the format readHiLights
+// reads.
+func hiLightBox(hilights []time.Duration) []byte {
+	payload := make([]byte, 4+4*len(hilights))
+	binary.BigEndian.PutUint32(payload, uint32(len(hilights)))
+	for i, hilight := range hilights {
+		binary.BigEndian.PutUint32(payload[4+i*4:], uint32(hilight.Milliseconds()))
+	}
+	return append(mp4BoxHeader("HMMT", len(payload)), payload...)
+}
+
+// formatOffset formats an offset into the merged file as HH:MM:SS.mmm.
+func formatOffset(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// printHiLights lists the HiLights of the merged file.
+func printHiLights(w io.Writer, hilights []time.Duration) {
+	if len(hilights) == 0 {
+		fmt.Fprintln(w, "No HiLights")
+		return
+	}
+	fmt.Fprintln(w, "HiLights:")
+	for i, hilight := range hilights {
+		fmt.Fprintf(w, "  %d. %s\n", i+1, formatOffset(hilight))
+	}
+}
+
+// mergedHiLights reads the HiLights of every chapter in files and shifts
+// each by the duration of the chapters before it. It also returns the
+// total duration of files. Durations are only probed when there is at
+// least one HiLight.
+func mergedHiLights(files []FileInfo, opts Options) ([]time.Duration, time.Duration, error) {
+	chapterHiLights := make([][]time.Duration, len(files))
+	found := false
+	for i, file := range files {
+		// Only local files can be read box by box
+		if isRemote(file.Path) {
+			continue
+		}
+		hilights, err := readHiLights(file.Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		chapterHiLights[i] = hilights
+		found = found || len(hilights) > 0
+	}
+	if !found {
+		return nil, 0, nil
+	}
+
+	var hilights []time.Duration
+	var offset time.Duration
+	for i, file := range files {
+		for _, hilight := range chapterHiLights[i] {
+			hilights = append(hilights, offset+hilight)
+		}
+
+		probe, err := opts.probe(file.Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += time.Duration(probe.Duration * float64(time.Second))
+	}
+	return hilights, offset, nil
+}
+
+// hiLightChapters turns HiLight moments into chapters, each lasting until
+// the next HiLight or the end of the output.
+func hiLightChapters(hilights []time.Duration, total time.Duration) []chapterMark {
+	var chapters []chapterMark
+	for i, hilight := range hilights {
+		end := total
+		if i+1 < len(hilights) {
+			end = hilights[i+1]
+		}
+		chapters = append(chapters, chapterMark{
+			Start: hilight,
+			End:   end,
+			Title: fmt.Sprintf("HiLight %d", i+1),
+		})
+	}
+	return chapters
+}
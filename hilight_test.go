@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mp4BoxBytes encodes a box with the given type and payload.
+func mp4BoxBytes(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], boxType)
+	return append(box, body...)
+}
+
+// createHiLightFixture writes a minimal MP4 whose udta holds an HMMT box
+// with the given millisecond offsets, padded with unused zero slots.
+func createHiLightFixture(t *testing.T, dir, name string, offsets ...uint32) string {
+	t.Helper()
+	hmmt := make([]byte, 4+4*(len(offsets)+2))
+	binary.BigEndian.PutUint32(hmmt, uint32(len(offsets)+2))
+	for i, offset := range offsets {
+		binary.BigEndian.PutUint32(hmmt[4+i*4:], offset)
+	}
+
+	data := bytes.Join([][]byte{
+		mp4BoxBytes("ftyp", []byte("mp41\x00\x00\x00\x00mp41")),
+		mp4BoxBytes("moov", mp4BoxBytes("udta", mp4BoxBytes("FIRM", []byte("HD9.01.01.60.00")), mp4BoxBytes("HMMT", hmmt))),
+		mp4BoxBytes("mdat", make([]byte, 64)),
+	}, nil)
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write fixture %s: %v", path, err)
+	}
+	return path
+}
+
+func TestReadHiLights(t *testing.T) {
+	dir := t.TempDir()
+	path := createHiLightFixture(t, dir, "GH011234.MP4", 1500, 61000)
+
+	hilights, err := readHiLights(path)
+	if err != nil {
+		t.Fatalf("readHiLights() error: %v", err)
+	}
+	expected := []time.Duration{1500 * time.Millisecond, 61 * time.Second}
+	if len(hilights) != len(expected) || hilights[0] != expected[0] || hilights[1] != expected[1] {
+		t.Errorf("Expected HiLights %v, got %v", expected, hilights)
+	}
+
+	// Files without an HMMT box have no HiLights
+	hilights, err = readHiLights(createHiLightFixture(t, dir, "GH021234.MP4"))
+	if err != nil || len(hilights) != 0 {
+		t.Errorf("Expected no HiLights, got %v (error: %v)", hilights, err)
+	}
+}
+
+func TestMergedHiLightChapters(t *testing.T) {
+	dir := t.TempDir()
+	files := []FileInfo{
+		{Path: createHiLightFixture(t, dir, "GH011234.MP4", 10000), ChapterNumber: 1},
+		{Path: createHiLightFixture(t, dir, "GH021234.MP4"), ChapterNumber: 2},
+		{Path: createHiLightFixture(t, dir, "GH031234.MP4", 5000), ChapterNumber: 3},
+	}
+
+	// Every chapter is 100 seconds long
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		return ProbeResult{Duration: 100}, nil
+	}
+
+	hilights, total, err := mergedHiLights(files, Options{})
+	if err != nil {
+		t.Fatalf("mergedHiLights() error: %v", err)
+	}
+	if total != 300*time.Second {
+		t.Errorf("Expected total duration 300s, got %v", total)
+	}
+	expected := []time.Duration{10 * time.Second, 205 * time.Second}
+	if len(hilights) != 2 || hilights[0] != expected[0] || hilights[1] != expected[1] {
+		t.Fatalf("Expected HiLights %v, got %v", expected, hilights)
+	}
+
+	var buf bytes.Buffer
+	if err := writeFFMetadata(&buf, hiLightChapters(hilights, total)); err != nil {
+		t.Fatalf("writeFFMetadata() error: %v", err)
+	}
+	metadata := buf.String()
+	if !strings.HasPrefix(metadata, ";FFMETADATA1\n") {
+		t.Errorf("Expected FFMETADATA header, got:\n%s", metadata)
+	}
+	if !strings.Contains(metadata, "START=10000\nEND=205000\ntitle=HiLight 1\n") {
+		t.Errorf("Expected first HiLight chapter, got:\n%s", metadata)
+	}
+	if !strings.Contains(metadata, "START=205000\nEND=300000\ntitle=HiLight 2\n") {
+		t.Errorf("Expected second HiLight chapter, got:\n%s", metadata)
+	}
+}
+
+func TestMergedHiLightsWithoutHiLights(t *testing.T) {
+	dir := t.TempDir()
+	files := []FileInfo{
+		{Path: createHiLightFixture(t, dir, "GH011234.MP4"), ChapterNumber: 1},
+		{Path: createHiLightFixture(t, dir, "GH021234.MP4"), ChapterNumber: 2},
+	}
+
+	// Nothing needs probing when there are no HiLights
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		t.Errorf("Unexpected probe of %s", path)
+		return ProbeResult{}, nil
+	}
+
+	hilights, _, err := mergedHiLights(files, Options{})
+	if err != nil || hilights != nil {
+		t.Errorf("Expected no HiLights, got %v (error: %v)", hilights, err)
+	}
+}
+
+func TestPrintHiLights(t *testing.T) {
+	var buf bytes.Buffer
+	printHiLights(&buf, []time.Duration{1500 * time.Millisecond, time.Hour + 2*time.Minute + 3*time.Second + 45*time.Millisecond})
+	expected := "HiLights:\n  1. 00:00:01.500\n  2. 01:02:03.045\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	printHiLights(&buf, nil)
+	if buf.String() != "No HiLights\n" {
+		t.Errorf("Expected no HiLights message, got %q", buf.String())
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// inputsPlaceholder is replaced by the input paths in hook commands.
+const inputsPlaceholder = "{inputs}"
+
+// shellQuote quotes s as a single sh word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// hookScript substitutes the quoted inputPaths for {inputs} in command.
+func hookScript(command string, inputPaths []string) string {
+	quoted := make([]string, len(inputPaths))
+	for i, path := range inputPaths {
+		quoted[i] = shellQuote(path)
+	}
+	return strings.ReplaceAll(command, inputsPlaceholder, strings.Join(quoted, " "))
+}
+
+// runPreMergeHook runs opts.PreMerge through sh with the inputs of a merge,
+// in merge order. A failing hook aborts the merge.
+func runPreMergeHook(inputPaths []string, opts Options) error {
+	if opts.PreMerge == "" {
+		return nil
+	}
+	logger := opts.logger()
+	script := hookScript(opts.PreMerge, inputPaths)
+	logger.Info("running pre-merge hook", "script", script)
+	if err := runCommand(logger, exec.Command("sh", "-c", script)); err != nil {
+		return fmt.Errorf("pre-merge hook failed: %v", err)
+	}
+	return nil
+}
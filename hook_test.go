@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookScript(t *testing.T) {
+	script := hookScript("check-gopro --strict {inputs}", []string{"/videos/GH011234.MP4", "/videos/it's here/GH021234.MP4"})
+	expected := `check-gopro --strict '/videos/GH011234.MP4' '/videos/it'\''s here/GH021234.MP4'`
+	if script != expected {
+		t.Errorf("Expected script %s, got %s", expected, script)
+	}
+}
+
+func TestPreMergeHookAbortsMerge(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	// Given out of order, the hook sees them in merge order
+	for _, name := range []string{"GH021234.MP4", "GH011234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+	hookOutput := filepath.Join(dir, "hook.txt")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	merged := false
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] == "ffmpeg" {
+			merged = true
+			return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+		}
+		if cmd.Args[0] == "sh" {
+			return runLoggedCommand(logger, cmd)
+		}
+		return nil
+	}
+
+	opts := Options{PreMerge: "printf '%s\\n' {inputs} > " + shellQuote(hookOutput) + " && echo corrupt chapter >&2 && exit 1"}
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts)
+	if err == nil || !strings.Contains(err.Error(), "pre-merge hook failed") || !strings.Contains(err.Error(), "corrupt chapter") {
+		t.Fatalf("Expected the failing hook to abort the merge, got: %v", err)
+	}
+	if merged {
+		t.Errorf("Expected ffmpeg not to run after the hook failed")
+	}
+	hookInputs, err := os.ReadFile(hookOutput)
+	if err != nil {
+		t.Fatalf("Failed to read the hook output: %v", err)
+	}
+	if string(hookInputs) != inputPaths[1]+"\n"+inputPaths[0]+"\n" {
+		t.Errorf("Expected the hook to get the inputs in merge order, got:\n%s", hookInputs)
+	}
+
+	opts.PreMerge = "test -f {inputs}"
+	if err := mergeFiles(outputPath, inputPaths[:1], time.Now(), time.Now(), opts); err != nil {
+		t.Errorf("Expected a passing hook to let the merge run, got: %v", err)
+	}
+}
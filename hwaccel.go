@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// hwaccelPlatforms lists the supported hardware accelerations and the
+// platform each is available on.
+var hwaccelPlatforms = map[string]string{
+	"videotoolbox": "darwin",
+}
+
+// Video codecs -video-codec accepts besides encoder names. They select
+// the hardware encoder of the codec with HWAccel, the software one without.
+const (
+	codecH264 = "h264"
+	codecHEVC = "hevc"
+)
+
+// softwareCodecEncoders maps a video codec to its software encoder.
+var softwareCodecEncoders = map[string]string{
+	codecH264: "libx264",
+	codecHEVC: "libx265",
+}
+
+// hwaccelEncoders maps a hardware acceleration to its encoder of each
+// video codec.
+var hwaccelEncoders = map[string]map[string]string{
+	"videotoolbox": {
+		codecH264: "h264_videotoolbox",
+		codecHEVC: "hevc_videotoolbox",
+	},
+}
+
+// listHWAccels is a variable so tests can simulate different ffmpeg builds.
+var listHWAccels = ffmpegHWAccels
+
+func ffmpegHWAccels() ([]string, error) {
+	out, err := ffmpegCommand("-hide_banner", "-hwaccels").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ffmpeg hardware accelerations: %v", err)
+	}
+	return parseHWAccels(string(out)), nil
+}
+
+// parseHWAccels parses the output of ffmpeg -hwaccels, which is a header
+// line followed by one method per line.
+func parseHWAccels(output string) []string {
+	var methods []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		methods = append(methods, line)
+	}
+	return methods
+}
+
+func validateHWAccel(name string) error {
+	platform, ok := hwaccelPlatforms[name]
+	if !ok {
+		return fmt.Errorf("unsupported hardware acceleration %q: supported values are videotoolbox", name)
+	}
+	if runtime.GOOS != platform {
+		return fmt.Errorf("hardware acceleration %s is not available on %s", name, runtime.GOOS)
+	}
+
+	methods, err := listHWAccels()
+	if err != nil {
+		return err
+	}
+	for _, method := range methods {
+		if method == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("the installed ffmpeg does not support %s hardware acceleration", name)
+}
+
+// videoEncoder returns the encoder of codec, or of H.264 when it is empty,
+// used when re-encoding with hwaccel.
+func videoEncoder(hwaccel, codec string) string {
+	if codec == "" {
+		codec = codecH264
+	}
+	if encoder, ok := hwaccelEncoders[hwaccel][codec]; ok {
+		return encoder
+	}
+	return softwareCodecEncoders[codec]
+}
+
+// hardwareEncoderCodec returns the video codec of encoder if it is a
+// hardware encoder.
+func hardwareEncoderCodec(encoder string) (string, bool) {
+	for _, encoders := range hwaccelEncoders {
+		for codec, name := range encoders {
+			if name == encoder {
+				return codec, true
+			}
+		}
+	}
+	return "", false
+}
+
+// encoderCodec returns the video codec encoder writes, or "" when it is
+// not one of the known encoders.
+func encoderCodec(encoder string) string {
+	if codec, ok := hardwareEncoderCodec(encoder); ok {
+		return codec
+	}
+	for codec, name := range softwareCodecEncoders {
+		if name == encoder {
+			return codec
+		}
+	}
+	return ""
+}
+
+// videoToolboxQuality maps a CRF, 1 (best) to 51, onto the -q:v scale of
+// the VideoToolbox encoders, 100 (best) to 1. The two scales do not
+// correspond exactly, but the default CRF gives a comparable file size.
+func videoToolboxQuality(crf int) int {
+	return 100 - (crf-1)*99/50
+}
+
+// listEncoders is a variable so tests can simulate different ffmpeg builds.
+var listEncoders = ffmpegEncoders
+
+func ffmpegEncoders() ([]string, error) {
+	out, err := ffmpegCommand("-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ffmpeg encoders: %v", err)
+	}
+	return parseEncoders(string(out)), nil
+}
+
+// parseEncoders parses the output of ffmpeg -encoders, which is a legend
+// ending with a dashed line followed by one "FLAGS name description" line
+// per encoder.
+func parseEncoders(output string) []string {
+	var encoders []string
+	listing := false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if !listing {
+			listing = len(fields) == 1 && strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 {
+			encoders = append(encoders, fields[1])
+		}
+	}
+	return encoders
+}
+
+// checkEncoder makes sure the installed ffmpeg has the encoder opts
+// re-encode with. A missing hardware encoder falls back to the software
+// encoder of the same codec with a warning, in the returned options.
+func checkEncoder(opts Options) (Options, error) {
+	encoder := opts.encoder().VideoCodec
+	encoders, err := listEncoders()
+	if err != nil {
+		return opts, err
+	}
+	for _, name := range encoders {
+		if name == encoder {
+			return opts, nil
+		}
+	}
+
+	codec, ok := hardwareEncoderCodec(encoder)
+	if !ok {
+		return opts, fmt.Errorf("the installed ffmpeg does not have the %s encoder", encoder)
+	}
+	fallback := opts
+	fallback.HWAccel = ""
+	fallback.VideoCodec = codec
+	opts.logger().Warn("hardware encoder not available in the installed ffmpeg, falling back to software encoding",
+		"encoder", encoder, "fallback", fallback.encoder().VideoCodec)
+	return checkEncoder(fallback)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func indexOf(args []string, value string) int {
+	for i, arg := range args {
+		if arg == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestMergeArgsHWAccel(t *testing.T) {
+	creationTime := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4", CreationTime: creationTime}
+
+	args := mergeArgs(spec, Options{Reencode: true, HWAccel: "videotoolbox"})
+	command := strings.Join(args, " ")
+
+	// -hwaccel is an input option and must precede -i
+	hwaccelIndex := indexOf(args, "-hwaccel")
+	if hwaccelIndex < 0 || args[hwaccelIndex+1] != "videotoolbox" {
+		t.Fatalf("Expected -hwaccel videotoolbox in command, got: %s", command)
+	}
+	if hwaccelIndex > indexOf(args, "-i") {
+		t.Errorf("Expected -hwaccel before -i, got: %s", command)
+	}
+	if !strings.Contains(command, "-c:v h264_videotoolbox") {
+		t.Errorf("Expected VideoToolbox encoder in command, got: %s", command)
+	}
+
+	// Without -reencode the streams are copied and hwaccel is irrelevant
+	args = mergeArgs(spec, Options{HWAccel: "videotoolbox"})
+	if indexOf(args, "-hwaccel") >= 0 || indexOf(args, "-c:v") >= 0 {
+		t.Errorf("Expected plain stream copy without -reencode, got: %s", strings.Join(args, " "))
+	}
+}
+
+func TestParseHWAccels(t *testing.T) {
+	output := "Hardware acceleration methods:\nvideotoolbox\n\n"
+	methods := parseHWAccels(output)
+	if len(methods) != 1 || methods[0] != "videotoolbox" {
+		t.Errorf("Expected [videotoolbox], got %v", methods)
+	}
+}
+
+func TestValidateHWAccel(t *testing.T) {
+	origListHWAccels := listHWAccels
+	defer func() { listHWAccels = origListHWAccels }()
+
+	if err := validateHWAccel("cuda"); err == nil {
+		t.Errorf("Expected error for unsupported hardware acceleration")
+	}
+
+	if runtime.GOOS != "darwin" {
+		if err := validateHWAccel("videotoolbox"); err == nil {
+			t.Errorf("Expected videotoolbox to be rejected on %s", runtime.GOOS)
+		}
+		return
+	}
+
+	// An ffmpeg build without VideoToolbox support
+	listHWAccels = func() ([]string, error) { return []string{"opencl"}, nil }
+	if err := validateHWAccel("videotoolbox"); err == nil {
+		t.Errorf("Expected error when ffmpeg lacks videotoolbox")
+	}
+
+	listHWAccels = func() ([]string, error) { return []string{"videotoolbox", "opencl"}, nil }
+	if err := validateHWAccel("videotoolbox"); err != nil {
+		t.Errorf("validateHWAccel() error: %v", err)
+	}
+}
+
+func TestVideoEncoder(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{}, "-c:v libx264 -crf 20 -preset medium"},
+		{Options{VideoCodec: "hevc"}, "-c:v libx265 -crf 20 -preset medium"},
+		{Options{HWAccel: "videotoolbox"}, "-c:v h264_videotoolbox -q:v 63"},
+		{Options{HWAccel: "videotoolbox", VideoCodec: "hevc", CRF: 1}, "-c:v hevc_videotoolbox -q:v 100"},
+		{Options{HWAccel: "videotoolbox", VideoCodec: "hevc", Bitrate: "50M"}, "-c:v hevc_videotoolbox -b:v 50M"},
+		// An encoder name is used as is
+		{Options{HWAccel: "videotoolbox", VideoCodec: "libx264", Bitrate: "20M"}, "-c:v libx264 -b:v 20M"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(encoderArgs(test.opts), " "); got != test.expected {
+			t.Errorf("encoderArgs(%+v) = %q, expected %q", test.opts, got, test.expected)
+		}
+	}
+}
+
+func TestParseEncoders(t *testing.T) {
+	output := `Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC (codec h264)
+ V....D h264_videotoolbox    VideoToolbox H.264 Encoder (codec h264)
+ A....D aac                  AAC (Advanced Audio Coding)
+`
+	encoders := parseEncoders(output)
+	if strings.Join(encoders, " ") != "libx264 h264_videotoolbox aac" {
+		t.Errorf("Expected [libx264 h264_videotoolbox aac], got %v", encoders)
+	}
+}
+
+func TestCheckEncoder(t *testing.T) {
+	origListEncoders := listEncoders
+	defer func() { listEncoders = origListEncoders }()
+	listEncoders = func() ([]string, error) {
+		return []string{"libx264", "libx265", "h264_videotoolbox", "aac"}, nil
+	}
+
+	opts := Options{Reencode: true, HWAccel: "videotoolbox"}
+	checked, err := checkEncoder(opts)
+	if err != nil || checked.HWAccel != "videotoolbox" {
+		t.Errorf("Expected h264_videotoolbox to be kept, got %+v, %v", checked, err)
+	}
+
+	// No HEVC hardware encoder, so libx265 takes over
+	opts.VideoCodec = "hevc"
+	checked, err = checkEncoder(opts)
+	if err != nil {
+		t.Fatalf("checkEncoder() error: %v", err)
+	}
+	if got := strings.Join(encoderArgs(checked), " "); got != "-c:v libx265 -crf 20 -preset medium" {
+		t.Errorf("Expected the software fallback, got %s", got)
+	}
+	if indexOf(mergeArgs(mergeSpec{}, checked), "-hwaccel") >= 0 {
+		t.Errorf("Expected no hardware decoding after the fallback")
+	}
+
+	if _, err := checkEncoder(Options{Reencode: true, VideoCodec: "libvpx-vp9"}); err == nil {
+		t.Errorf("Expected an error for a missing software encoder")
+	}
+}
+
+func TestReencodeArgsHWAccel(t *testing.T) {
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4"}
+	target := encodeSettings{Width: 1920, Height: 1080}
+	args := reencodeArgs(spec, []string{"a.mp4", "b.mp4"}, target, -1, Options{Reencode: true, HWAccel: "videotoolbox"})
+	command := strings.Join(args, " ")
+	if !strings.Contains(command, "-hwaccel videotoolbox -i a.mp4 -hwaccel videotoolbox -i b.mp4") {
+		t.Errorf("Expected hardware decoding of every input, got: %s", command)
+	}
+	if !strings.Contains(command, "-c:v h264_videotoolbox -q:v 63") {
+		t.Errorf("Expected the VideoToolbox encoder, got: %s", command)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// printFileInfo describes a single recording: the camera that shot it, its
+// duration and its streams.
+func printFileInfo(w io.Writer, path string) error {
+	probe, err := probeFile(path)
+	if err != nil {
+		return err
+	}
+	camera, err := readCameraInfo(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, filepath.Base(path))
+	if s := camera.String(); s != "" {
+		fmt.Fprintf(w, "  Camera: %s\n", s)
+	} else {
+		fmt.Fprintln(w, "  Camera: unknown")
+	}
+	duration := time.Duration(probe.Duration * float64(time.Second)).Round(time.Millisecond)
+	fmt.Fprintf(w, "  Duration: %s\n", duration)
+	fmt.Fprintln(w, "  Streams:")
+	for _, stream := range probe.Streams {
+		codec := stream.CodecName
+		if codec == "" || codec == "none" {
+			codec = stream.CodecTagString
+		}
+		fmt.Fprintf(w, "    %d. %s (%s)\n", stream.Index, streamKind(stream), codec)
+	}
+	return nil
+}
+
+// runInfo implements the info subcommand and returns the process exit code.
+func runInfo(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("info", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: GoProConcat info file1 [file2 ...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		fmt.Fprintln(stderr, "ffprobe is not installed. Please install ffmpeg using Homebrew:\n\nbrew install ffmpeg")
+		return exitError
+	}
+
+	code := exitOK
+	for _, path := range flags.Args() {
+		if err := printFileInfo(stdout, path); err != nil {
+			fmt.Fprintf(stderr, "Error reading %s: %v\n", path, err)
+			code = exitError
+		}
+	}
+	return code
+}
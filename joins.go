@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultJoinThreshold allows for the audio of a chapter to end within a
+// couple of AAC frames, 21ms each at 48kHz, of its video.
+const defaultJoinThreshold = 50 * time.Millisecond
+
+// JoinDrift is a chapter whose audio and video lengths differ. The concat
+// demuxer starts the next chapter after the longer of the two, so the
+// shorter one gets a gap at the join: a pop, or audio drifting further out
+// of sync with every such chapter.
+type JoinDrift struct {
+	Path  string
+	Video time.Duration
+	Audio time.Duration
+	// Drift is how far the audio is ahead of the video after the join,
+	// adding up the differences of this and the earlier chapters.
+	Drift time.Duration
+}
+
+// Difference is how much longer the audio of the chapter is than its
+// video, negative when it is shorter.
+func (d JoinDrift) Difference() time.Duration {
+	return d.Audio - d.Video
+}
+
+// joinThreshold returns opts.JoinThreshold, or defaultJoinThreshold when it
+// is zero.
+func (o Options) joinThreshold() time.Duration {
+	if o.JoinThreshold == 0 {
+		return defaultJoinThreshold
+	}
+	return o.JoinThreshold
+}
+
+// checkJoins returns the files, but the last one which has no join after
+// it, whose audio and video lengths differ by more than threshold. probes
+// holds the probe result of each file. Files without audio, or without the
+// stream durations, do not count.
+func checkJoins(files []FileInfo, probes []ProbeResult, threshold time.Duration) []JoinDrift {
+	var drifts []JoinDrift
+	var drift time.Duration
+	for i := 0; i < len(files)-1; i++ {
+		video, hasVideo := probes[i].firstStream("video")
+		audio, hasAudio := probes[i].firstStream("audio")
+		if !hasVideo || !hasAudio {
+			continue
+		}
+		videoSeconds, videoKnown := video.durationSeconds()
+		audioSeconds, audioKnown := audio.durationSeconds()
+		if !videoKnown || !audioKnown {
+			continue
+		}
+		join := JoinDrift{
+			Path:  files[i].Path,
+			Video: time.Duration(videoSeconds * float64(time.Second)),
+			Audio: time.Duration(audioSeconds * float64(time.Second)),
+		}
+		drift += join.Difference()
+		join.Drift = drift
+		if join.Difference() > threshold || -join.Difference() > threshold {
+			drifts = append(drifts, join)
+		}
+	}
+	return drifts
+}
+
+// printJoinDrifts lists the chapters of drifts with the lengths of their
+// audio and video, and what to do about them.
+func printJoinDrifts(w io.Writer, drifts []JoinDrift, threshold time.Duration) {
+	if len(drifts) == 0 {
+		fmt.Fprintf(w, "Joins checked: the audio and video of every chapter end within %v of each other\n", threshold)
+		return
+	}
+	fmt.Fprintf(w, "%d chapter(s) with audio and video lengths differing by more than %v, which can cause a pop or drift at the join after them:\n", len(drifts), threshold)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  CHAPTER\tVIDEO\tAUDIO\tDIFFERENCE\tDRIFT AFTER")
+	for _, drift := range drifts {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%+.3fs\t%+.3fs\n", filepath.Base(drift.Path),
+			formatOffset(drift.Video), formatOffset(drift.Audio), drift.Difference().Seconds(), drift.Drift.Seconds())
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "If the audio of the output is out of sync after these chapters, merge again with -fix-timestamps")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chapterProbe returns a probe result of a chapter whose video and audio
+// streams last video and audio seconds.
+func chapterProbe(t *testing.T, video, audio string) ProbeResult {
+	t.Helper()
+	probe := loadProbeFixture(t, "hero_probe.json")
+	probe.Streams = append([]StreamInfo(nil), probe.Streams...)
+	probe.Streams[0].Duration = video
+	probe.Streams[1].Duration = audio
+	return probe
+}
+
+func TestCheckJoins(t *testing.T) {
+	files := []FileInfo{{Path: "/videos/GH010042.MP4"}, {Path: "/videos/GH020042.MP4"}, {Path: "/videos/GH030042.MP4"}, {Path: "/videos/GH040042.MP4"}}
+	probes := []ProbeResult{
+		chapterProbe(t, "530.530000", "530.650000"),
+		chapterProbe(t, "530.530000", "530.500000"),
+		chapterProbe(t, "530.530000", "530.400000"),
+		// The last chapter has no join after it
+		chapterProbe(t, "100.000000", "90.000000"),
+	}
+
+	drifts := checkJoins(files, probes, defaultJoinThreshold)
+	if len(drifts) != 2 {
+		t.Fatalf("Expected 2 chapters to be reported, got %+v", drifts)
+	}
+	first, third := drifts[0], drifts[1]
+	if first.Path != files[0].Path || first.Difference() != 120*time.Millisecond || first.Drift != 120*time.Millisecond {
+		t.Errorf("Unexpected first chapter %+v", first)
+	}
+	// The second chapter is within the threshold, but still adds to the drift
+	if third.Path != files[2].Path || third.Difference() != -130*time.Millisecond || third.Drift != -40*time.Millisecond {
+		t.Errorf("Unexpected third chapter %+v", third)
+	}
+
+	var buf bytes.Buffer
+	printJoinDrifts(&buf, drifts, defaultJoinThreshold)
+	for _, line := range []string{
+		"2 chapter(s) with audio and video lengths differing by more than 50ms",
+		"GH010042.MP4  00:08:50.530  00:08:50.650  +0.120s     +0.120s",
+		"GH030042.MP4  00:08:50.530  00:08:50.400  -0.130s     -0.040s",
+		"merge again with -fix-timestamps",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Expected %q in the report, got:\n%s", line, buf.String())
+		}
+	}
+
+	// Without audio, or without stream durations, there is nothing to compare
+	probes[0].Streams = withoutAudioStreams(probes[0].Streams)
+	probes[2] = loadProbeFixture(t, "hero_probe.json")
+	if drifts := checkJoins(files, probes, defaultJoinThreshold); len(drifts) != 0 {
+		t.Errorf("Expected no chapter to be reported, got %+v", drifts)
+	}
+}
+
+func TestMergeFilesCheckJoins(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH010042.MP4", "GH020042.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probe := chapterProbe(t, "530.530000", "530.700000")
+	probeFile = func(path string) (ProbeResult, error) {
+		return probe, nil
+	}
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	var drifts []JoinDrift
+	called := false
+	opts := Options{CheckJoins: true, JoinsFunc: func(d []JoinDrift) {
+		drifts, called = d, true
+	}}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if !called || len(drifts) != 1 || drifts[0].Path != inputPaths[0] || drifts[0].Difference() != 170*time.Millisecond {
+		t.Errorf("Expected the first chapter to be reported, got %+v", drifts)
+	}
+
+	// A higher threshold lets it pass
+	opts.JoinThreshold = 200 * time.Millisecond
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if len(drifts) != 0 {
+		t.Errorf("Expected no chapter above 200ms, got %+v", drifts)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discardLogger is used when Options.Logger is unset.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// logWriter forwards everything written to it to a logger at debug level,
+// one record per line. It keeps the last ffmpegErrorLines lines for the
+// error of a failed command.
+type logWriter struct {
+	logger   *slog.Logger
+	command  string
+	stream   string
+	buf      bytes.Buffer
+	lastLine string
+	// tail is a ring buffer of the last lines, next is where the line
+	// after them goes.
+	tail []string
+	next int
+}
+
+func newLogWriter(logger *slog.Logger, command, stream string) *logWriter {
+	return &logWriter{logger: logger, command: command, stream: stream}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		w.logLine(line)
+	}
+}
+
+// Flush logs a trailing line that was not terminated by a newline.
+func (w *logWriter) Flush() {
+	if w.buf.Len() > 0 {
+		w.logLine(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+func (w *logWriter) logLine(line string) {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return
+	}
+	w.lastLine = line
+	if len(w.tail) < ffmpegErrorLines {
+		w.tail = append(w.tail, line)
+	} else {
+		w.tail[w.next] = line
+	}
+	w.next = (w.next + 1) % ffmpegErrorLines
+	if w.command == "ffmpeg" && w.stream == "stderr" && isFFmpegWarning(line) {
+		w.logger.Warn(line, "command", w.command, "stream", w.stream, ffmpegWarningKey, true)
+		return
+	}
+	w.logger.Debug(line, "command", w.command, "stream", w.stream)
+}
+
+// lines returns the last lines written, oldest first.
+func (w *logWriter) lines() []string {
+	if len(w.tail) < ffmpegErrorLines {
+		return append([]string(nil), w.tail...)
+	}
+	return append(append([]string(nil), w.tail[w.next:]...), w.tail[:w.next]...)
+}
+
+// ffmpegErrorLines is how many of the last lines of its stderr the error
+// of a failed ffmpeg run includes.
+const ffmpegErrorLines = 40
+
+// FFmpegError is the error of an ffmpeg run that failed, with what is
+// needed to reproduce it.
+type FFmpegError struct {
+	// Args is the command line ffmpeg ran with, starting with ffmpeg.
+	Args []string
+	// Stderr holds the last lines ffmpeg wrote to stderr, oldest first.
+	Stderr []string
+	// ListPath is the concat list of a failed merge, which is kept for
+	// inspection. Empty for other ffmpeg runs.
+	ListPath string
+	Err      error
+}
+
+func (e *FFmpegError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Err.Error())
+	if len(e.Stderr) > 0 {
+		fmt.Fprintf(&b, ": %s", e.Stderr[len(e.Stderr)-1])
+	}
+	fmt.Fprintf(&b, "\ncommand: %s", strings.Join(e.Args, " "))
+	if e.ListPath != "" {
+		fmt.Fprintf(&b, "\nconcat list: %s", e.ListPath)
+	}
+	if len(e.Stderr) > 0 {
+		fmt.Fprintf(&b, "\nlast %d line(s) of ffmpeg output:", len(e.Stderr))
+		for _, line := range e.Stderr {
+			fmt.Fprintf(&b, "\n  %s", line)
+		}
+	}
+	return b.String()
+}
+
+func (e *FFmpegError) Unwrap() error {
+	return e.Err
+}
+
+// defaultFFmpegLogLevel shows only the errors of ffmpeg. Its warnings are
+// still collected for the summary after a merge and the -fix-timestamps
+// hint, see ffmpegArgs.
+const defaultFFmpegLogLevel = "error"
+
+// ffmpegLogLevels are the values of the ffmpeg -loglevel option.
+var ffmpegLogLevels = []string{"quiet", "panic", "fatal", "error", "warning", "info", "verbose", "debug", "trace"}
+
+func validateFFmpegLogLevel(level string) error {
+	for _, known := range ffmpegLogLevels {
+		if level == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid -loglevel %q: must be one of %s", level, strings.Join(ffmpegLogLevels, ", "))
+}
+
+// showsFFmpegWarnings reports whether the ffmpeg log level level, or
+// defaultFFmpegLogLevel when it is empty, includes the warnings.
+func showsFFmpegWarnings(level string) bool {
+	if level == "" {
+		level = defaultFFmpegLogLevel
+	}
+	for _, known := range ffmpegLogLevels {
+		if known == level {
+			return false
+		}
+		if known == "error" {
+			return true
+		}
+	}
+	return false
+}
+
+// ffmpegArgs are the arguments every ffmpeg command starts with. They
+// leave out the banner and the statistics line and keep ffmpeg to messages
+// of level, or defaultFFmpegLogLevel when it is empty. ffmpeg always runs
+// at the warning level at least, since the warning summary is built from
+// what it prints; hideFFmpegWarnings keeps them from being shown below it.
+func ffmpegArgs(level string) []string {
+	if !showsFFmpegWarnings(level) {
+		level = "warning"
+	}
+	return []string{"-hide_banner", "-nostats", "-loglevel", level}
+}
+
+// ffmpegWarningKey marks the log records of ffmpeg warnings.
+const ffmpegWarningKey = "ffmpeg_warning"
+
+// ffmpegProblemPatterns are ffmpeg messages that point at damaged or
+// badly joined inputs without containing the word warning, besides the
+// timestampProblemPatterns.
+var ffmpegProblemPatterns = []string{
+	"invalid data found",
+	"error while decoding",
+	"corrupt",
+	"missing picture",
+	"past duration",
+	"invalid timestamps",
+}
+
+// isFFmpegWarning reports whether a line of ffmpeg output is a warning
+// worth showing the user.
+func isFFmpegWarning(line string) bool {
+	if isTimestampProblem(line) || classifyWarning(line) != nil {
+		return true
+	}
+	line = strings.ToLower(line)
+	if strings.Contains(line, "warning") {
+		return true
+	}
+	for _, pattern := range ffmpegProblemPatterns {
+		if strings.Contains(line, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFFmpegWarnings returns the warnings in ffmpeg output.
+func parseFFmpegWarnings(output string) []string {
+	var warnings []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if isFFmpegWarning(line) {
+			warnings = append(warnings, line)
+		}
+	}
+	return warnings
+}
+
+// warningCollector is a log handler that remembers the ffmpeg warnings
+// passing through it, so they can be summarized after a merge.
+type warningCollector struct {
+	slog.Handler
+	warnings *[]string
+	mu       *sync.Mutex
+}
+
+// collectFFmpegWarnings returns a logger writing to the handler of logger
+// that appends every ffmpeg warning it logs to warnings.
+func collectFFmpegWarnings(logger *slog.Logger, warnings *[]string) *slog.Logger {
+	return slog.New(&warningCollector{Handler: logger.Handler(), warnings: warnings, mu: &sync.Mutex{}})
+}
+
+func (c *warningCollector) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || c.Handler.Enabled(ctx, level)
+}
+
+func (c *warningCollector) Handle(ctx context.Context, r slog.Record) error {
+	r.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == ffmpegWarningKey {
+			c.mu.Lock()
+			*c.warnings = append(*c.warnings, r.Message)
+			c.mu.Unlock()
+			return false
+		}
+		return true
+	})
+	if !c.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return c.Handler.Handle(ctx, r)
+}
+
+func (c *warningCollector) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &warningCollector{Handler: c.Handler.WithAttrs(attrs), warnings: c.warnings, mu: c.mu}
+}
+
+func (c *warningCollector) WithGroup(name string) slog.Handler {
+	return &warningCollector{Handler: c.Handler.WithGroup(name), warnings: c.warnings, mu: c.mu}
+}
+
+// ffmpegWarningFilter is a log handler that drops the records of ffmpeg
+// warnings, for an ffmpeg log level below the warning level.
+type ffmpegWarningFilter struct {
+	slog.Handler
+}
+
+// hideFFmpegWarnings returns a logger writing to the handler of logger
+// everything but the ffmpeg warnings. Wrapped by collectFFmpegWarnings,
+// they are still collected.
+func hideFFmpegWarnings(logger *slog.Logger) *slog.Logger {
+	return slog.New(&ffmpegWarningFilter{Handler: logger.Handler()})
+}
+
+func (f *ffmpegWarningFilter) Handle(ctx context.Context, r slog.Record) error {
+	hidden := false
+	r.Attrs(func(attr slog.Attr) bool {
+		hidden = attr.Key == ffmpegWarningKey
+		return !hidden
+	})
+	if hidden {
+		return nil
+	}
+	return f.Handler.Handle(ctx, r)
+}
+
+func (f *ffmpegWarningFilter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ffmpegWarningFilter{Handler: f.Handler.WithAttrs(attrs)}
+}
+
+func (f *ffmpegWarningFilter) WithGroup(name string) slog.Handler {
+	return &ffmpegWarningFilter{Handler: f.Handler.WithGroup(name)}
+}
+
+// runCommand is a variable so tests can replace external commands.
+var runCommand = runLoggedCommand
+
+// ffmpegCommand returns the ffmpeg command with args. It never reads the
+// terminal: -nostdin turns off its keyboard interaction, and Stdin is left
+// nil so it reads from the null device instead of inheriting the one of
+// GoProConcat. ffmpeg can still ask whether to overwrite a file, so every
+// output is either checked to be new or passed with -y after GoProConcat
+// decided to write it.
+func ffmpegCommand(args ...string) *exec.Cmd {
+	return exec.Command("ffmpeg", append([]string{"-nostdin"}, args...)...)
+}
+
+// runLoggedCommand runs cmd with its stdout and stderr forwarded to logger,
+// unless cmd already has a Stdout. Its stderr is forwarded either way, and
+// also written to a Stderr cmd already has, for the analysis filters of
+// ffmpeg that print their results there. The last line written to stderr
+// is included in the returned error, which is an *FFmpegError with the
+// last ffmpegErrorLines lines for ffmpeg.
+func runLoggedCommand(logger *slog.Logger, cmd *exec.Cmd) error {
+	stdout := newLogWriter(logger, cmd.Args[0], "stdout")
+	stderr := newLogWriter(logger, cmd.Args[0], "stderr")
+	if cmd.Stdout == nil {
+		cmd.Stdout = stdout
+	}
+	if cmd.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, stderr)
+	} else {
+		cmd.Stderr = stderr
+	}
+
+	logger.Debug("running command", "argv", cmd.Args)
+	start := time.Now()
+	err := cmd.Run()
+	stdout.Flush()
+	stderr.Flush()
+	logger.Debug("command finished", "command", cmd.Args[0], "duration", time.Since(start), "error", err)
+
+	if err != nil && cmd.Args[0] == "ffmpeg" {
+		return &FFmpegError{Args: cmd.Args, Stderr: stderr.lines(), Err: err}
+	}
+	if err != nil && stderr.lastLine != "" {
+		return fmt.Errorf("%v: %s", err, stderr.lastLine)
+	}
+	return err
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogWriterForwardsLines(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	// Lines split across writes must be reassembled before logging
+	w := newLogWriter(logger, "ffmpeg", "stderr")
+	w.Write([]byte("first line\nsecond "))
+	w.Write([]byte("line\n\nthird"))
+	w.Flush()
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Failed to decode log record %q: %v", line, err)
+		}
+		if record["level"] != "DEBUG" || record["command"] != "ffmpeg" || record["stream"] != "stderr" {
+			t.Errorf("Unexpected log record attributes: %v", record)
+		}
+		messages = append(messages, record["msg"].(string))
+	}
+
+	expected := []string{"first line", "second line", "third"}
+	if strings.Join(messages, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected log messages %v, got %v", expected, messages)
+	}
+	if w.lastLine != "third" {
+		t.Errorf("Expected last line %q, got %q", "third", w.lastLine)
+	}
+}
+
+func TestOptionsDefaultLogger(t *testing.T) {
+	// An unset logger must be usable and silent
+	var opts Options
+	if opts.logger() == nil {
+		t.Fatalf("Expected a no-op logger when Options.Logger is unset")
+	}
+	opts.logger().Info("discarded")
+}
+
+func TestParseFFmpegWarnings(t *testing.T) {
+	stderr := `[mov,mp4,m4a,3gp,3g2,mj2 @ 0x7f8] Auto-inserting h264_mp4toannexb bitstream filter
+[mp4 @ 0x7f9] Non-monotonous DTS in output stream 0:1; previous: 2701312, current: 2700288; changing to 2701313. This may result in incorrect timestamps in the output file.
+[h264 @ 0x7fa] Warning: not compiled with thread support, using thread emulation
+[concat @ 0x7fb] Impossible to open 'GH021234.MP4'
+[mp4 @ 0x7fc] Application provided invalid, non monotonically increasing dts to muxer in stream 3: 1000 >= 1000
+`
+	warnings := parseFFmpegWarnings(stderr)
+	expected := []string{
+		"[mp4 @ 0x7f9] Non-monotonous DTS in output stream 0:1; previous: 2701312, current: 2700288; changing to 2701313. This may result in incorrect timestamps in the output file.",
+		"[h264 @ 0x7fa] Warning: not compiled with thread support, using thread emulation",
+		"[mp4 @ 0x7fc] Application provided invalid, non monotonically increasing dts to muxer in stream 3: 1000 >= 1000",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected warnings %q, got %q", expected, warnings)
+	}
+}
+
+func TestCollectFFmpegWarnings(t *testing.T) {
+	var buf bytes.Buffer
+	var warnings []string
+	logger := collectFFmpegWarnings(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError})), &warnings)
+
+	w := newLogWriter(logger, "ffmpeg", "stderr")
+	w.Write([]byte("Stream mapping:\n[mp4 @ 0x1] Non-monotonous DTS in output stream 0:1\n"))
+	w.Flush()
+	// Only ffmpeg warnings are collected
+	logger.Warn("Non-monotonous DTS", "command", "SetFile")
+
+	if len(warnings) != 1 || warnings[0] != "[mp4 @ 0x1] Non-monotonous DTS in output stream 0:1" {
+		t.Errorf("Expected the DTS warning to be collected, got %q", warnings)
+	}
+	// The wrapped handler still decides what is printed
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing logged below the error level, got: %s", buf.String())
+	}
+
+	var summary bytes.Buffer
+	printFFmpegWarnings(&summary, warnings, nil)
+	if summary.String() != "ffmpeg reported 1 warning(s):\n  1 non-monotonous timestamps — the audio may drift out of sync from there\n" {
+		t.Errorf("Unexpected warning summary: %q", summary.String())
+	}
+}
+
+func TestFFmpegLogLevel(t *testing.T) {
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4"}
+	// ffmpeg runs at the warning level for the summary, whatever is shown
+	for _, level := range []string{"", "error", "quiet"} {
+		opts := Options{FFmpegLogLevel: level}
+		if command := strings.Join(mergeArgs(spec, opts), " "); !strings.HasPrefix(command, "-hide_banner -nostats -loglevel warning ") {
+			t.Errorf("Expected ffmpeg to log warnings at log level %q, got: %s", level, command)
+		}
+	}
+	opts := Options{FFmpegLogLevel: "info"}
+	if command := strings.Join(mergeArgs(spec, opts), " "); !strings.Contains(command, "-loglevel info ") {
+		t.Errorf("Expected -loglevel info in the merge command, got: %s", command)
+	}
+	args := reencodeArgs(spec, []string{"a.mp4", "b.mp4"}, encodeSettings{}, -1, opts)
+	if command := strings.Join(args, " "); !strings.Contains(command, "-loglevel info ") {
+		t.Errorf("Expected -loglevel info in the re-encode command, got: %s", command)
+	}
+
+	if err := validateFFmpegLogLevel("warning"); err != nil {
+		t.Errorf("validateFFmpegLogLevel(warning) error: %v", err)
+	}
+	if err := validateFFmpegLogLevel("loud"); err == nil {
+		t.Errorf("Expected an error for an unknown log level")
+	}
+}
+
+func TestHideFFmpegWarnings(t *testing.T) {
+	for _, test := range []struct {
+		level string
+		shown bool
+	}{
+		{"", false},
+		{"error", false},
+		{"warning", true},
+		{"info", true},
+	} {
+		if shown := showsFFmpegWarnings(test.level); shown != test.shown {
+			t.Errorf("showsFFmpegWarnings(%q) = %v, expected %v", test.level, shown, test.shown)
+		}
+	}
+
+	var buf bytes.Buffer
+	var warnings []string
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	logger = collectFFmpegWarnings(hideFFmpegWarnings(logger), &warnings)
+
+	w := newLogWriter(logger, "ffmpeg", "stderr")
+	w.Write([]byte("[mp4 @ 0x1] Non-monotonous DTS in output stream 0:1\n"))
+	w.Flush()
+	logger.Warn("Failed to set the creation time")
+
+	if len(warnings) != 1 || warnings[0] != "[mp4 @ 0x1] Non-monotonous DTS in output stream 0:1" {
+		t.Errorf("Expected the hidden DTS warning to be collected, got %q", warnings)
+	}
+	if shown := buf.String(); strings.Contains(shown, "Non-monotonous") || !strings.Contains(shown, "Failed to set the creation time") {
+		t.Errorf("Expected only the other warning to be shown, got: %s", shown)
+	}
+}
+
+func TestLogWriterKeepsLastLines(t *testing.T) {
+	w := newLogWriter(discardLogger, "ffmpeg", "stderr")
+	for i := 1; i <= ffmpegErrorLines+10; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	lines := w.lines()
+	if len(lines) != ffmpegErrorLines || lines[0] != "line 11" || lines[len(lines)-1] != "line 50" {
+		t.Errorf("Expected lines 11 to 50, got %q", lines)
+	}
+}
+
+func TestMergeFilesFFmpegError(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+
+	// A fake ffmpeg that prints more lines than the error keeps and fails
+	bin := t.TempDir()
+	script := "#!/bin/sh\ni=1\nwhile [ $i -le 50 ]; do echo \"line $i\" >&2; i=$((i+1)); done\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write fake ffmpeg: %v", err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+
+	err := mergeFiles(filepath.Join(dir, "merged.mp4"), inputPaths, time.Now(), time.Now(), Options{TempDir: dir})
+	var ffmpegErr *FFmpegError
+	if !errors.As(err, &ffmpegErr) {
+		t.Fatalf("Expected an FFmpegError, got %v", err)
+	}
+	if len(ffmpegErr.Stderr) != ffmpegErrorLines || ffmpegErr.Stderr[0] != "line 11" {
+		t.Errorf("Expected the last %d lines of stderr, got %q", ffmpegErrorLines, ffmpegErr.Stderr)
+	}
+	if ffmpegErr.Args[0] != "ffmpeg" || indexOf(ffmpegErr.Args, ffmpegErr.ListPath) < 0 {
+		t.Errorf("Expected the ffmpeg command line reading the concat list, got %q", ffmpegErr.Args)
+	}
+	message := err.Error()
+	for _, expected := range []string{"exit status 1: line 50", "command: ffmpeg -", "concat list: " + ffmpegErr.ListPath, "  line 11\n", "  line 50"} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("Expected %q in the error, got:\n%s", expected, message)
+		}
+	}
+	if strings.Contains(message, "line 10\n") {
+		t.Errorf("Expected only the last %d lines in the error, got:\n%s", ffmpegErrorLines, message)
+	}
+
+	// The concat list is kept to reproduce the failure
+	list, err := os.ReadFile(ffmpegErr.ListPath)
+	if err != nil || !strings.Contains(string(list), inputPaths[1]) {
+		t.Errorf("Expected the concat list to be kept, got %q: %v", list, err)
+	}
+}
+
+func TestFFmpegNeverReadsStdin(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	probe := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return probe, nil
+	}
+	ffmpegRuns := 0
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		ffmpegRuns++
+		if cmd.Args[1] != "-nostdin" {
+			t.Errorf("Expected ffmpeg to be run with -nostdin first, got: %s", strings.Join(cmd.Args, " "))
+		}
+		// Without -y ffmpeg would ask before overwriting, so the output is new
+		if _, err := os.Lstat(cmd.Args[len(cmd.Args)-1]); indexOf(cmd.Args, "-y") < 0 && err == nil {
+			t.Errorf("Expected ffmpeg to be told to overwrite its output, got: %s", strings.Join(cmd.Args, " "))
+		}
+		if cmd.Stdin != nil {
+			t.Errorf("Expected ffmpeg not to inherit stdin, got %v", cmd.Stdin)
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	// A poster frame of an earlier merge is replaced
+	opts := Options{Thumbnail: filepath.Join(dir, "poster.jpg")}
+	if err := os.WriteFile(opts.Thumbnail, []byte("earlier poster"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if ffmpegRuns < 2 {
+		t.Errorf("Expected the merge and the thumbnail to run ffmpeg, got %d run(s)", ffmpegRuns)
+	}
+}
+
+func TestCheckOutputNew(t *testing.T) {
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "merged.mp4")
+	if err := checkOutputNew(outputPath, false); err != nil {
+		t.Errorf("Expected a new output to be accepted, got %v", err)
+	}
+
+	if err := os.WriteFile(outputPath, []byte("earlier merge"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := checkOutputNew(outputPath, false)
+	if err == nil || !strings.Contains(err.Error(), "already exists. Use -force") {
+		t.Errorf("Expected an existing output to be refused, got %v", err)
+	}
+	if err := checkOutputNew(outputPath, true); err != nil {
+		t.Errorf("Expected -force to allow overwriting, got %v", err)
+	}
+
+	// run refuses before doing anything else
+	var stdout, stderr bytes.Buffer
+	code := run([]string{outputPath, filepath.Join(dir, "GH011234.MP4")}, &stdout, &stderr)
+	if code != exitError || !strings.Contains(stderr.String(), "already exists") {
+		t.Errorf("Expected run to refuse the existing output, got code %d: %s", code, stderr.String())
+	}
+	if data, _ := os.ReadFile(outputPath); string(data) != "earlier merge" {
+		t.Errorf("Expected the existing output to be untouched, got %q", data)
+	}
+
+	// and so are the files written next to a new output
+	newOutput := filepath.Join(dir, "new.mp4")
+	sidecars := map[string][]string{
+		"new.jpg":        {"-thumbnail", filepath.Join(dir, "new.jpg")},
+		"new_proxy.mp4":  {"-proxy"},
+		"new_part01.mp4": {"-max-size", "3.9G"},
+	}
+	for name, flags := range sidecars {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("earlier "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stderr.Reset()
+		code := run(append(flags, newOutput, filepath.Join(dir, "GH011234.MP4")), &stdout, &stderr)
+		if code != exitError || !strings.Contains(stderr.String(), path+" already exists") {
+			t.Errorf("Expected run to refuse the existing %s, got code %d: %s", name, code, stderr.String())
+		}
+		if data, _ := os.ReadFile(path); string(data) != "earlier "+name {
+			t.Errorf("Expected the existing %s to be untouched, got %q", name, data)
+		}
+		os.Remove(path)
+	}
+}
+
+func TestRunLoggedCommandKeepsStderr(t *testing.T) {
+	var buf, stderr bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	// An analysis reads what the command prints, which is logged all the same
+	cmd := exec.Command("sh", "-c", "echo measured >&2")
+	cmd.Stderr = &stderr
+	if err := runLoggedCommand(logger, cmd); err != nil {
+		t.Fatal(err)
+	}
+	if stderr.String() != "measured\n" || !strings.Contains(buf.String(), "msg=measured") {
+		t.Errorf("Expected the line in both the Stderr of the command and the log, got %q and %q", stderr.String(), buf.String())
+	}
+}
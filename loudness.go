@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Settings of the loudnorm filter of -normalize-audio. The target is the
+// one of most streaming and upload platforms, the true peak leaves room
+// for their own encoding.
+const (
+	defaultLoudnessTarget = -16.0
+	loudnessTruePeak      = -1.5
+	loudnessRange         = 11.0
+	// minLoudnessTarget and maxLoudnessTarget are the range of loudnorm.
+	minLoudnessTarget = -70.0
+	maxLoudnessTarget = -5.0
+)
+
+// aacBitrate is the bitrate of audio re-encoded while the video is copied,
+// normalized or resampled, above the one of the camera so the second
+// encoding loses little.
+const aacBitrate = "256k"
+
+// Loudness is the integrated loudness of the audio of a merge measured by
+// the first pass of -normalize-audio, and the Target it is normalized to.
+type Loudness struct {
+	// Measured is in LUFS, TruePeak in dBTP and Range in LU.
+	Measured  float64 `json:"measured"`
+	TruePeak  float64 `json:"true_peak"`
+	Range     float64 `json:"range"`
+	Threshold float64 `json:"-"`
+	// Offset is the gain loudnorm applies after its correction.
+	Offset float64 `json:"-"`
+	Target float64 `json:"target"`
+}
+
+func (l Loudness) String() string {
+	return fmt.Sprintf("%.1f LUFS (measured %.1f LUFS, true peak %.1f dBTP, range %.1f LU)", l.Target, l.Measured, l.TruePeak, l.Range)
+}
+
+func (o Options) loudnessTarget() float64 {
+	if o.LoudnessTarget == 0 {
+		return defaultLoudnessTarget
+	}
+	return o.LoudnessTarget
+}
+
+func validateLoudnessTarget(target float64) error {
+	if target < minLoudnessTarget || target > maxLoudnessTarget {
+		return fmt.Errorf("invalid -loudness-target %g: must be between %g and %g LUFS", target, minLoudnessTarget, maxLoudnessTarget)
+	}
+	return nil
+}
+
+// loudnormSettings are the options of the loudnorm filter aiming at target.
+func loudnormSettings(target float64) string {
+	return fmt.Sprintf("loudnorm=I=%.1f:TP=%.1f:LRA=%.1f", target, loudnessTruePeak, loudnessRange)
+}
+
+// loudnessArgs builds the ffmpeg arguments of the first pass of
+// -normalize-audio, which measures the audio stream audioIndex of the
+// concat list of spec without writing anything. loudnorm prints its
+// measurement at the info level, whatever opts.FFmpegLogLevel is.
+func loudnessArgs(spec mergeSpec, audioIndex int, target float64, opts Options) []string {
+	args := ffmpegArgs("info")
+	args = append(args, inputArgs(opts)...)
+	args = append(args, trimInputArgs(spec.Trim)...)
+	args = append(args, concatInputArgs(spec.ListPath, spec.Remote)...)
+	args = append(args, trimOutputArgs(spec.Trim, false)...)
+	return append(args,
+		"-map", fmt.Sprintf("0:%d", audioIndex),
+		"-af", loudnormSettings(target)+":print_format=json",
+		"-vn", "-sn", "-dn",
+		"-f", "null", "-",
+	)
+}
+
+// parseLoudnorm parses the measurement loudnorm prints at the end of its
+// output as a JSON object of strings.
+func parseLoudnorm(output string, target float64) (Loudness, error) {
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return Loudness{}, fmt.Errorf("loudnorm printed no measurement")
+	}
+	var values map[string]string
+	if err := json.Unmarshal([]byte(output[start:end+1]), &values); err != nil {
+		return Loudness{}, fmt.Errorf("failed to parse the loudnorm measurement: %v", err)
+	}
+
+	loudness := Loudness{Target: target}
+	for key, field := range map[string]*float64{
+		"input_i":       &loudness.Measured,
+		"input_tp":      &loudness.TruePeak,
+		"input_lra":     &loudness.Range,
+		"input_thresh":  &loudness.Threshold,
+		"target_offset": &loudness.Offset,
+	} {
+		value, err := strconv.ParseFloat(values[key], 64)
+		if err != nil {
+			return Loudness{}, fmt.Errorf("invalid %s in the loudnorm measurement: %q", key, values[key])
+		}
+		*field = value
+	}
+	// Silence measures as -inf, there is nothing to bring up
+	if math.IsInf(loudness.Measured, 0) || math.IsInf(loudness.Threshold, 0) {
+		return Loudness{}, fmt.Errorf("the audio is silent, there is nothing to normalize")
+	}
+	return loudness, nil
+}
+
+// measureLoudness runs the first pass of -normalize-audio over the audio
+// stream audioIndex of the merge of spec.
+func measureLoudness(spec mergeSpec, audioIndex int, opts Options) (Loudness, error) {
+	var stderr bytes.Buffer
+	cmd := ffmpegCommand(loudnessArgs(spec, audioIndex, opts.loudnessTarget(), opts)...)
+	cmd.Stderr = &stderr
+	if err := runCommand(opts.logger(), cmd); err != nil {
+		return Loudness{}, fmt.Errorf("failed to measure the loudness of the audio: %v", err)
+	}
+	return parseLoudnorm(stderr.String(), opts.loudnessTarget())
+}
+
+// loudnormFilter is the loudnorm filter of the second pass, which applies
+// the measurement as one linear gain, so the dynamics of the recording
+// are kept.
+func loudnormFilter(l Loudness) string {
+	return fmt.Sprintf("%s:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true",
+		loudnormSettings(l.Target), l.Measured, l.TruePeak, l.Range, l.Threshold, l.Offset)
+}
+
+// normalizeAudioArgs re-encode the audio streams of a stream copy merge
+// with the loudnorm filter of spec. The filter is a simple one on each
+// audio stream, so the -map arguments and with them the output index of
+// the telemetry and its tag stay as they are. loudnorm resamples to
+// 192 kHz, the output goes back to the rate of the inputs.
+func normalizeAudioArgs(spec mergeSpec) []string {
+	if spec.AudioFilter == "" {
+		return nil
+	}
+	args := []string{"-af", spec.AudioFilter, "-c:a", "aac", "-b:a", aacBitrate}
+	if spec.SampleRate != "" {
+		args = append(args, "-ar", spec.SampleRate)
+	}
+	return args
+}
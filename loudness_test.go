@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loudnormOutput is what the first pass of loudnorm prints at the end of
+// its run.
+const loudnormOutput = `[Parsed_loudnorm_0 @ 0x6000031c4000] 
+{
+	"input_i" : "-23.40",
+	"input_tp" : "-4.12",
+	"input_lra" : "6.30",
+	"input_thresh" : "-33.75",
+	"output_i" : "-16.02",
+	"output_tp" : "-1.50",
+	"output_lra" : "5.80",
+	"output_thresh" : "-26.30",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.02"
+}
+`
+
+func TestParseLoudnorm(t *testing.T) {
+	loudness, err := parseLoudnorm("[out#0/null @ 0x600] video:0kB audio:0kB\n"+loudnormOutput, -16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Loudness{Measured: -23.4, TruePeak: -4.12, Range: 6.3, Threshold: -33.75, Offset: 0.02, Target: -16}
+	if loudness != expected {
+		t.Errorf("Expected %+v, got %+v", expected, loudness)
+	}
+	if s := loudness.String(); s != "-16.0 LUFS (measured -23.4 LUFS, true peak -4.1 dBTP, range 6.3 LU)" {
+		t.Errorf("Unexpected summary %q", s)
+	}
+	filter := "loudnorm=I=-16.0:TP=-1.5:LRA=11.0:measured_I=-23.40:measured_TP=-4.12:measured_LRA=6.30:measured_thresh=-33.75:offset=0.02:linear=true"
+	if f := loudnormFilter(loudness); f != filter {
+		t.Errorf("Expected the filter %q, got %q", filter, f)
+	}
+
+	silent := strings.NewReplacer(`"-23.40"`, `"-inf"`, `"-33.75"`, `"-inf"`).Replace(loudnormOutput)
+	if _, err := parseLoudnorm(silent, -16); err == nil || !strings.Contains(err.Error(), "silent") {
+		t.Errorf("Expected silent audio to fail, got %v", err)
+	}
+	if _, err := parseLoudnorm("Conversion failed!", -16); err == nil {
+		t.Error("Expected an output without a measurement to fail")
+	}
+}
+
+func TestMergeFilesNormalizeAudio(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH010042.MP4", "GH020042.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	var analysis, merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		if cmd.Args[len(cmd.Args)-1] == "-" {
+			analysis = cmd.Args
+			_, err := io.WriteString(cmd.Stderr, loudnormOutput)
+			return err
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	var loudness Loudness
+	opts := Options{NormalizeAudio: true, LoudnessTarget: -14, LoudnessFunc: func(l Loudness) { loudness = l }}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if args := strings.Join(analysis, " "); !strings.Contains(args, "-loglevel info") || !strings.Contains(args, "-map 0:1 -af loudnorm=I=-14.0:TP=-1.5:LRA=11.0:print_format=json") {
+		t.Errorf("Expected the first pass to measure the audio, got: %s", args)
+	}
+	command := strings.Join(merge, " ")
+	for _, expected := range []string{
+		"-c copy -af loudnorm=I=-14.0:TP=-1.5:LRA=11.0:measured_I=-23.40:",
+		"-c:a aac -b:a 256k -ar 48000",
+		// The telemetry keeps its output index and tag
+		"-map 0:0 -map 0:1 -map 0:3 -tag:2 gpmd",
+	} {
+		if !strings.Contains(command, expected) {
+			t.Errorf("Expected %q in the merge command, got: %s", expected, command)
+		}
+	}
+	if loudness.Measured != -23.4 || loudness.Target != -14 {
+		t.Errorf("Expected the measurement to be reported, got %+v", loudness)
+	}
+
+	// A single input is normalized too instead of copied as it is
+	analysis, merge = nil, nil
+	if err := mergeFiles(outputPath, inputPaths[:1], time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error with one input: %v", err)
+	}
+	if analysis == nil || !strings.Contains(strings.Join(merge, " "), "-af loudnorm=I=-14.0") {
+		t.Errorf("Expected the single input to be normalized, got: %v", merge)
+	}
+
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{NormalizeAudio: true, DropAudio: true}); err == nil || !strings.Contains(err.Error(), "-drop-audio") {
+		t.Errorf("Expected -drop-audio to be refused, got %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-normalize-audio", "-no-audio", "out.mp4", "GH011234.MP4"}, &stdout, &stderr); code != exitUsage {
+		t.Errorf("Expected exit code %d, got %d: %s", exitUsage, code, stderr.String())
+	}
+	if code := run([]string{"-normalize-audio", "-loudness-target", "-3", "out.mp4", "GH011234.MP4"}, &stdout, &stderr); code != exitUsage {
+		t.Errorf("Expected exit code %d, got %d: %s", exitUsage, code, stderr.String())
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxLUTSize is the largest LUT_3D_SIZE the lut3d filter of ffmpeg reads.
+const maxLUTSize = 256
+
+// checkCubeLUT reads the .cube LUT at path, as color grading tools and
+// camera makers export them, to refuse a missing or malformed one before
+// anything is encoded: a LUT_3D_SIZE line and as many rows of three
+// numbers as the size cubed.
+func checkCubeLUT(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open LUT: %v", err)
+	}
+	defer file.Close()
+
+	size, rows := 0, 0
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return fmt.Errorf("%s:%d: expected a single LUT_3D_SIZE", path, line)
+			}
+			size, err = strconv.Atoi(fields[1])
+			if err != nil || size < 2 || size > maxLUTSize {
+				return fmt.Errorf("%s:%d: invalid LUT_3D_SIZE %q: must be between 2 and %d", path, line, fields[1], maxLUTSize)
+			}
+			continue
+		case "LUT_1D_SIZE":
+			return fmt.Errorf("%s is a 1D LUT, a 3D one is needed", path)
+		}
+		// TITLE, DOMAIN_MIN and the like come before the table
+		if _, err := strconv.ParseFloat(fields[0], 64); err != nil && rows == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected three values, got %d", path, line, len(fields))
+		}
+		for _, field := range fields {
+			if _, err := strconv.ParseFloat(field, 64); err != nil {
+				return fmt.Errorf("%s:%d: invalid value %q", path, line, field)
+			}
+		}
+		rows++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read LUT: %v", err)
+	}
+	if size == 0 {
+		return fmt.Errorf("%s has no LUT_3D_SIZE, it is not a 3D .cube LUT", path)
+	}
+	if rows != size*size*size {
+		return fmt.Errorf("%s has %d rows instead of %d for LUT_3D_SIZE %d", path, rows, size*size*size, size)
+	}
+	return nil
+}
+
+// lutFilter is the lut3d filter grading the video with the LUT at path.
+func lutFilter(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return "lut3d=file=" + escapeFilterValue(path)
+}
+
+// escapeFilterValue escapes value twice, as a filter option value and then
+// within the filter graph, so that any file name or text works.
+func escapeFilterValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(value)
+}
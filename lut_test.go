@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCubeLUT writes an identity LUT of size to dir.
+func writeCubeLUT(t *testing.T, dir string, size int) string {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("# Created by a grading tool\nTITLE \"Protune to Rec709\"\n")
+	fmt.Fprintf(&b, "LUT_3D_SIZE %d\nDOMAIN_MIN 0.0 0.0 0.0\nDOMAIN_MAX 1.0 1.0 1.0\n\n", size)
+	for blue := 0; blue < size; blue++ {
+		for green := 0; green < size; green++ {
+			for red := 0; red < size; red++ {
+				max := float64(size - 1)
+				fmt.Fprintf(&b, "%.6f %.6f %.6f\n", float64(red)/max, float64(green)/max, float64(blue)/max)
+			}
+		}
+	}
+	path := filepath.Join(dir, "protune.cube")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckCubeLUT(t *testing.T) {
+	dir := t.TempDir()
+	path := writeCubeLUT(t, dir, 3)
+	if err := checkCubeLUT(path); err != nil {
+		t.Fatalf("Expected a valid LUT, got %v", err)
+	}
+
+	valid, _ := os.ReadFile(path)
+	for content, expected := range map[string]string{
+		strings.Replace(string(valid), "1.000000 1.000000 1.000000\n", "", 1):         "has 26 rows instead of 27",
+		strings.Replace(string(valid), "0.500000 0.000000 0.000000", "0.5 zero 0", 1): `invalid value "zero"`,
+		strings.Replace(string(valid), "0.500000 0.000000 0.000000", "0.5 0", 1):      "expected three values, got 2",
+		strings.Replace(string(valid), "LUT_3D_SIZE 3", "LUT_3D_SIZE 1024", 1):        "invalid LUT_3D_SIZE",
+		"LUT_1D_SIZE 1024\n":    "is a 1D LUT",
+		"0.0 0.0 0.0\n":         "has no LUT_3D_SIZE",
+		"not a LUT at all\n":    "has no LUT_3D_SIZE",
+		"LUT_3D_SIZE 2 2 2\n\n": "expected a single LUT_3D_SIZE",
+	} {
+		broken := filepath.Join(dir, "broken.cube")
+		if err := os.WriteFile(broken, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkCubeLUT(broken); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q, got %v", expected, err)
+		}
+	}
+	if err := checkCubeLUT(filepath.Join(dir, "missing.cube")); err == nil || !strings.Contains(err.Error(), "failed to open LUT") {
+		t.Errorf("Expected a missing LUT to be refused, got %v", err)
+	}
+}
+
+func TestLUTFilter(t *testing.T) {
+	// Escaped as an option value, then within the filter graph
+	expected := `lut3d=file=/Volumes/LUTs/Tom\\\'s grade\\: v2 \[final\].cube`
+	if got := lutFilter(`/Volumes/LUTs/Tom's grade: v2 [final].cube`); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestLUTArgs(t *testing.T) {
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4"}
+	opts := Options{Reencode: true, LUT: "/luts/protune.cube"}
+
+	args := strings.Join(mergeArgs(spec, opts), " ")
+	if !strings.Contains(args, "-c:v libx264 -crf 20 -preset medium -filter:v lut3d=file=/luts/protune.cube") {
+		t.Errorf("Expected the LUT in the re-encode, got: %s", args)
+	}
+	if args := strings.Join(mergeArgs(spec, Options{Reencode: true}), " "); strings.Contains(args, "lut3d") {
+		t.Errorf("Expected no LUT without -lut, got: %s", args)
+	}
+
+	// Inputs that differ are graded after the concat filter
+	target := encodeSettings{VideoCodec: "libx264", Width: 1920, Height: 1080}
+	args = strings.Join(reencodeArgs(spec, []string{"a.mp4", "b.mp4"}, target, -1, opts), " ")
+	if !strings.Contains(args, "concat=n=2:v=1:a=0[v];[v]lut3d=file=/luts/protune.cube[graded] -map [graded]") {
+		t.Errorf("Expected the LUT after the concat filter, got: %s", args)
+	}
+
+	// The proxy takes its own LUT
+	args = strings.Join(proxyArgs("merged.mp4", "merged_proxy.mp4", proxy720p, "libx264", "/luts/view.cube", ""), " ")
+	if !strings.Contains(args, "-vf lut3d=file=/luts/view.cube,scale=-2:'min(ih,720)'") {
+		t.Errorf("Expected the proxy LUT before the scaling, got: %s", args)
+	}
+}
+
+func TestLUTNeedsReencode(t *testing.T) {
+	dir := t.TempDir()
+	lut := writeCubeLUT(t, dir, 2)
+
+	err := mergeFiles(filepath.Join(dir, "merged.mp4"), []string{filepath.Join(dir, "GH011234.MP4")}, time.Now(), time.Now(), Options{LUT: lut})
+	if err == nil || !strings.Contains(err.Error(), "-lut only applies when re-encoding") {
+		t.Errorf("Expected -lut to be refused with stream copy, got %v", err)
+	}
+
+	for args, expected := range map[string]string{
+		"-lut " + lut: "Add -reencode",
+		"-reencode -lut " + filepath.Join(dir, "x"): "failed to open LUT",
+		"-proxy-lut " + lut:                         "Please add -proxy",
+	} {
+		var stdout, stderr bytes.Buffer
+		code := run(append(strings.Fields(args), "out.mp4", "GH011234.MP4"), &stdout, &stderr)
+		if code != exitUsage || !strings.Contains(stderr.String(), expected) {
+			t.Errorf("Expected %s to be refused with %q, got %d: %s", args, expected, code, stderr.String())
+		}
+	}
+}
@@ -1,25 +1,35 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/djherbis/times"
 )
 
 type FileInfo struct {
-	Path          string
-	FileNumber    int
-	ChapterNumber int
+	Path          string `json:"path"`
+	Prefix        string `json:"prefix"`
+	FileNumber    int    `json:"file_number"`
+	ChapterNumber int    `json:"chapter_number"`
+	HasTelemetry  bool   `json:"has_telemetry"`
+	// Role is roleIntro or roleOutro for the clips merged around the
+	// chapters, empty for chapters.
+	Role string `json:"role,omitempty"`
 }
 
 func checkRequirements() error {
@@ -32,6 +42,11 @@ func checkRequirements() error {
 		return fmt.Errorf("ffmpeg is not installed. Please install it using Homebrew:\n\nbrew install ffmpeg")
 	}
 
+	_, err = exec.LookPath("ffprobe")
+	if err != nil {
+		return fmt.Errorf("ffprobe is not installed. It is part of ffmpeg, please reinstall it using Homebrew:\n\nbrew reinstall ffmpeg")
+	}
+
 	_, err = exec.LookPath("SetFile")
 	if err != nil {
 		return fmt.Errorf("SetFile is not installed. Please install Command Line Tools:\n\nxcode-select --install")
@@ -40,180 +55,2193 @@ func checkRequirements() error {
 	return nil
 }
 
-func parseFileName(filePath string) (FileInfo, error) {
-	re := regexp.MustCompile(`(GH|GX)(\d{2})(\d{4})\.(?i:mp4)`)
-	matches := re.FindStringSubmatch(strings.ToUpper(filepath.Base(filePath)))
-	if len(matches) < 4 {
+// parseFileName parses the name of the chapter filePath with pattern, see
+// compileFileNamePattern.
+func parseFileName(filePath string, pattern *regexp.Regexp) (FileInfo, error) {
+	matches := pattern.FindStringSubmatch(strings.ToUpper(filepath.Base(filePath)))
+	if matches == nil {
 		return FileInfo{}, fmt.Errorf("invalid file format: %s", filePath)
 	}
-	chapterNumber, _ := strconv.Atoi(matches[2])
-	fileNumber, _ := strconv.Atoi(matches[3])
+	// A custom -filename-pattern may capture more than digits
+	chapterNumber, err := strconv.Atoi(matches[pattern.SubexpIndex("chapter")])
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("invalid chapter number in file name %s: %v", filePath, err)
+	}
+	fileNumber, err := strconv.Atoi(matches[pattern.SubexpIndex("file")])
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("invalid file number in file name %s: %v", filePath, err)
+	}
+	var prefix string
+	if i := pattern.SubexpIndex("prefix"); i >= 0 {
+		prefix = matches[i]
+	}
 	return FileInfo{
 		Path:          filePath,
+		Prefix:        prefix,
 		FileNumber:    fileNumber,
 		ChapterNumber: chapterNumber,
 	}, nil
 }
 
-func mergeFiles(outputPath string, inputPaths []string, creationTime, modTime time.Time) error {
-	var files []FileInfo
-	fileMap := make(map[string]bool)
+// formatFileName is the inverse of parseFileName.
+func formatFileName(prefix string, chapterNumber, fileNumber int) string {
+	return fmt.Sprintf("%s%02d%04d.MP4", prefix, chapterNumber, fileNumber)
+}
+
+// maxSourceListLength limits the comment written by -embed-source-list,
+// since players show it in a single line.
+const maxSourceListLength = 250
+
+// sourceListComment lists the names of files, which are sorted in merge
+// order. Names that would make it longer than maxSourceListLength are left
+// out and counted instead.
+func sourceListComment(files []FileInfo) string {
+	prefix := "merged from: "
+	return prefix + fileNameList(files, maxSourceListLength-len(prefix))
+}
+
+// fileNameList lists the names of files, separated by commas. Names that
+// would make it longer than maxLength are left out and counted instead.
+func fileNameList(files []FileInfo, maxLength int) string {
+	var list string
+	for i, file := range files {
+		name := filepath.Base(file.Path)
+		if i > 0 {
+			name = ", " + name
+		}
+		// Keep room to say how many names were left out
+		room := maxLength
+		if i+1 < len(files) {
+			room -= len(fmt.Sprintf(" and %d more", len(files)-i-1))
+		}
+		if len(list)+len(name) > room {
+			return list + fmt.Sprintf(" and %d more", len(files)-i)
+		}
+		list += name
+	}
+	return list
+}
+
+// errNoInputFiles is returned when there is nothing to merge.
+var errNoInputFiles = errors.New("no GoPro files found")
+
+// expandInputs replaces every directory in inputPaths with the files
+// directly inside it whose names match pattern, with the time lapse photos
+// when timelapse is set. It fails with errNoInputFiles when no input is
+// left.
+func expandInputs(inputPaths []string, timelapse bool, pattern *regexp.Regexp) ([]string, error) {
+	var expanded []string
+	for _, inputPath := range inputPaths {
+		info, err := os.Stat(inputPath)
+		if err != nil || !info.IsDir() {
+			// Missing files are reported when they are read
+			expanded = append(expanded, inputPath)
+			continue
+		}
+
+		entries, err := os.ReadDir(inputPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory %s: %v", inputPath, err)
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			if pattern.MatchString(strings.ToUpper(entry.Name())) || timelapse && isTimelapseFrame(entry.Name()) {
+				expanded = append(expanded, filepath.Join(inputPath, entry.Name()))
+			}
+		}
+	}
+
+	if len(expanded) == 0 {
+		return nil, fmt.Errorf("%w in %s", errNoInputFiles, strings.Join(inputPaths, ", "))
+	}
+	return expanded, nil
+}
 
-	if len(inputPaths) == 1 {
-		return copyFile(inputPaths[0], outputPath)
+func collectFiles(inputPaths []string, pattern *regexp.Regexp) ([]FileInfo, error) {
+	files, err := inputFiles(inputPaths, pattern)
+	if err != nil {
+		return nil, err
 	}
 
+	// Sort files by FileNumber and ChapterNumber
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].FileNumber == files[j].FileNumber {
+			return files[i].ChapterNumber < files[j].ChapterNumber
+		}
+		return files[i].FileNumber < files[j].FileNumber
+	})
+
+	return files, nil
+}
+
+// inputFiles parses the names of inputPaths, keeping their order, and
+// refuses duplicates.
+func inputFiles(inputPaths []string, pattern *regexp.Regexp) ([]FileInfo, error) {
+	var files []FileInfo
+	fileMap := make(map[string]bool)
+
 	for _, inputPath := range inputPaths {
 		absPath, err := filepath.Abs(inputPath)
+		if isRemote(inputPath) {
+			absPath, err = normalizeURL(inputPath)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to get absolute path for %s: %v", inputPath, err)
+			return nil, fmt.Errorf("failed to get absolute path for %s: %v", inputPath, err)
 		}
 
 		if fileMap[absPath] {
-			return fmt.Errorf("duplicate file detected: %s. Please remove duplicates and try again", absPath)
+			return nil, fmt.Errorf("duplicate file detected: %s. Please remove duplicates and try again", absPath)
 		}
 		fileMap[absPath] = true
 
-		fileInfo, err := parseFileName(inputPath)
+		fileInfo, err := parseFileName(inputPath, pattern)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		fileInfo.Path = absPath
 		files = append(files, fileInfo)
 	}
+	return files, nil
+}
 
-	// Sort files by FileNumber and ChapterNumber
-	sort.Slice(files, func(i, j int) bool {
-		if files[i].FileNumber == files[j].FileNumber {
-			return files[i].ChapterNumber < files[j].ChapterNumber
-		}
-		return files[i].FileNumber < files[j].FileNumber
-	})
+// checkOutputNew refuses to overwrite an existing outputPath unless force
+// is set. Deciding here lets ffmpeg always be run with -y, so it never
+// stops to ask.
+func checkOutputNew(outputPath string, force bool) error {
+	if force {
+		return nil
+	}
+	if _, err := os.Lstat(outputPath); err == nil {
+		return fmt.Errorf("output file %s already exists. Use -force to overwrite it", outputPath)
+	}
+	return nil
+}
 
-	listFile, err := os.CreateTemp("", "*")
+// checkOutputNotInput guards against ffmpeg reading and overwriting the
+// same file. Besides comparing absolute paths it compares the files
+// themselves, since macOS volumes are usually case-insensitive.
+func checkOutputNotInput(outputPath string, inputPaths []string) error {
+	absOutputPath, err := filepath.Abs(outputPath)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %v", err)
+		return fmt.Errorf("failed to get absolute path for %s: %v", outputPath, err)
 	}
-	defer os.Remove(listFile.Name())
+	outputInfo, outputErr := os.Stat(absOutputPath)
 
-	for _, file := range files {
-		_, err = listFile.WriteString(fmt.Sprintf("file '%s'\n", file.Path))
+	for _, inputPath := range inputPaths {
+		if isRemote(inputPath) {
+			continue
+		}
+		absPath, err := filepath.Abs(inputPath)
 		if err != nil {
-			return fmt.Errorf("failed to write to temp file: %v", err)
+			return fmt.Errorf("failed to get absolute path for %s: %v", inputPath, err)
+		}
+
+		sameFile := absPath == absOutputPath
+		if !sameFile && outputErr == nil {
+			if inputInfo, err := os.Stat(absPath); err == nil {
+				sameFile = os.SameFile(inputInfo, outputInfo)
+			}
+		}
+		if sameFile {
+			return fmt.Errorf("output file %s is also an input file. Please choose a different output path", absOutputPath)
 		}
 	}
-	listFile.Close()
+	return nil
+}
 
-	cmd := exec.Command(
-		"ffmpeg",
-		"-hide_banner", "-nostats", "-loglevel", "error", // Suppress FFmpeg output
-		"-f", "concat",
-		"-safe", "0",
-		"-i", listFile.Name(),
-		"-c", "copy",
-		"-y",
-		"-map", "0:v",
-		"-map", "0:a?",
-		"-map", "0:3?",
-		"-copy_unknown",
-		"-tag:2", "gpmd",
-		"-metadata", fmt.Sprintf("creation_time=%s", creationTime.Format(time.RFC3339)),
-		outputPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	if err != nil {
-		return fmt.Errorf("ffmpeg command failed: %v", err)
+// mergeSpec describes one concat run of ffmpeg.
+type mergeSpec struct {
+	ListPath     string
+	OutputPath   string
+	CreationTime time.Time
+	// MapArgs selects and tags the output streams, see mapStreams.
+	MapArgs []string
+	// ChaptersPath is an optional FFMETADATA file providing chapters.
+	ChaptersPath string
+	// Comment is an optional comment metadata tag.
+	Comment string
+	// Metadata is the title and location of the recording, see
+	// Options.Metadata.
+	Metadata RecordingMetadata
+	// TelemetryPath is an optional file of raw GPMF packets attached to
+	// the output, for containers without data streams.
+	TelemetryPath string
+	// Trim is the range of the inputs the output keeps, nil for all.
+	Trim *trimRange
+	// Remote is set when the list has http or https inputs.
+	Remote bool
+	// Color is the color description of the video, restated for the
+	// output when it is known.
+	Color colorInfo
+	// AudioFilter is the loudnorm filter of Options.NormalizeAudio, which
+	// re-encodes the audio at SampleRate. Empty copies the audio.
+	AudioFilter string
+	SampleRate  string
+}
+
+// mergeArgs builds the ffmpeg arguments for spec.
+func mergeArgs(spec mergeSpec, opts Options) []string {
+	args := ffmpegArgs(opts.FFmpegLogLevel)
+	if opts.Reencode && opts.HWAccel != "" {
+		args = append(args, "-hwaccel", opts.HWAccel)
+	}
+	args = append(args, inputArgs(opts)...)
+	args = append(args, trimInputArgs(spec.Trim)...)
+	args = append(args, rotateInputArgs(opts.Rotate)...)
+	args = append(args, concatInputArgs(spec.ListPath, spec.Remote)...)
+	if spec.ChaptersPath != "" {
+		args = append(args, "-i", spec.ChaptersPath, "-map_chapters", "1")
+	}
+	args = append(args, "-c", "copy")
+	args = append(args, normalizeAudioArgs(spec)...)
+	if opts.Reencode {
+		args = append(args, encoderArgs(opts)...)
+		if filters := videoFilters(spec, opts); len(filters) > 0 {
+			args = append(args, "-filter:v", strings.Join(filters, ","))
+		}
+	}
+	args = append(args, timestampOutputArgs(opts)...)
+	args = append(args, trimOutputArgs(spec.Trim, false)...)
+	args = append(args, "-y")
+	args = append(args, spec.MapArgs...)
+	return append(args, outputArgs(spec, opts)...)
+}
+
+// outputArgs are the muxer and metadata arguments of every kind of merge,
+// ending with the output path.
+func outputArgs(spec mergeSpec, opts Options) []string {
+	var args []string
+	var movflags []string
+	if opts.Faststart {
+		movflags = append(movflags, "+faststart")
+	}
+	if spec.Color.known() && isMP4Family(opts.Container) {
+		movflags = append(movflags, "+write_colr")
+	}
+	// use_metadata_tags writes every metadata key as QuickTime metadata,
+	// where GoPro keeps keys such as the firmware version
+	if opts.Container == containerMOV || (isMP4Family(opts.Container) && !opts.NoVendorMetadata) {
+		movflags = append(movflags, "+use_metadata_tags")
+	}
+	if isMP4Family(opts.Container) {
+		for _, flag := range opts.Movflags {
+			if !slices.Contains(movflags, "+"+flag) {
+				movflags = append(movflags, "+"+flag)
+			}
+		}
+	}
+	if opts.Container == containerMOV {
+		// QuickTime reads the creation date from its own metadata key,
+		// which the mov muxer only writes with use_metadata_tags
+		args = append(args, "-metadata", "com.apple.quicktime.creationdate="+spec.CreationTime.In(opts.location()).Format(time.RFC3339))
+	}
+	if opts.NoVendorMetadata {
+		args = append(args, "-map_metadata", "-1")
+	}
+	if len(movflags) > 0 {
+		args = append(args, "-movflags", strings.Join(movflags, ""))
+	}
+	args = append(args, colorArgs(spec.Color)...)
+	if spec.TelemetryPath != "" {
+		args = append(args,
+			"-attach", spec.TelemetryPath,
+			"-metadata:s:t:0", "mimetype=application/octet-stream",
+			"-metadata:s:t:0", "filename="+telemetryAttachmentName)
+	}
+	// Every track has its own creation_time, which stream copy takes from
+	// the first chapter and encoding sets to the time of the merge
+	creationTime := spec.CreationTime.In(opts.location()).Format(time.RFC3339)
+	args = append(args, "-metadata", "creation_time="+creationTime, "-metadata:s", "creation_time="+creationTime)
+	args = append(args, metadataArgs(spec.Metadata)...)
+	if spec.Comment != "" {
+		args = append(args, "-metadata", "comment="+spec.Comment)
+	}
+	if opts.Container != "" {
+		args = append(args, "-f", containerMuxers[opts.Container])
+	}
+	args = append(args, spec.OutputPath)
+	return args
+}
+
+// needsRemux reports whether a single MP4 input merged with opts, whose
+// Container is resolved, goes through ffmpeg like several because an
+// option changes the bytes of the output, instead of being copied or
+// linked as it is. Every option changing the output belongs here.
+func needsRemux(opts Options) bool {
+	return opts.remux || opts.Reencode ||
+		opts.Container != containerMP4 ||
+		opts.Intro != "" || opts.Outro != "" ||
+		opts.MaxSize > 0 || opts.MaxDuration > 0 ||
+		opts.Start != 0 || opts.End != 0 ||
+		opts.Streams == streamsEssential ||
+		opts.NoTelemetry || opts.DropAudio || opts.AudioTrack > 0 ||
+		opts.NormalizeAudio ||
+		opts.Faststart || len(opts.Movflags) > 0 ||
+		opts.Chapters || opts.EmbedSourceList ||
+		opts.FixTimestamps || opts.NoVendorMetadata ||
+		opts.Metadata != nil || opts.Geotag != nil ||
+		opts.Rotate != 0 || opts.LUT != "" || opts.BurnTimestamp != nil
+}
+
+// mergeFiles concatenates inputPaths into outputPath and stamps it with
+// creationTime and modTime. The output only appears at outputPath once it
+// is complete, see partialPath. It keeps no state outside of its
+// arguments, so it is safe to call concurrently for independent outputs.
+func mergeFiles(outputPath string, inputPaths []string, creationTime, modTime time.Time, opts Options) error {
+	logger := opts.logger()
+
+	if len(inputPaths) == 0 {
+		return errNoInputFiles
 	}
 
-	fmt.Printf("Setting creation time using SetFile: %s\n", creationTime.In(time.Local).Format("01/02/2006 15:04:05"))
-	cmd = exec.Command("SetFile", "-d", creationTime.In(time.Local).Format("01/02/2006 15:04:05"), outputPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	intro, outro := clipFiles(opts)
+	checkedPaths := append([]string(nil), inputPaths...)
+	for _, clip := range append(intro, outro...) {
+		checkedPaths = append(checkedPaths, clip.Path)
+	}
+	err := checkOutputNotInput(outputPath, checkedPaths)
 	if err != nil {
-		return fmt.Errorf("failed to set creation time for %s: %v", outputPath, err)
+		return err
 	}
 
-	err = os.Chtimes(outputPath, creationTime, modTime)
+	opts.Container, err = outputContainer(outputPath, opts.Container)
+	if err != nil {
+		return err
+	}
+	mp4 := isMP4Family(opts.Container)
+	if opts.Faststart && !mp4 {
+		return fmt.Errorf("-faststart only applies to MP4 and MOV output")
+	}
+	if len(opts.Movflags) > 0 && !mp4 {
+		return fmt.Errorf("-movflags only applies to MP4 and MOV output")
+	}
+	if err := validateOptions(opts); err != nil {
+		return err
+	}
+	// An input still being copied from the card merges without an error
+	// into a short output, it is only noticed by its size changing
+	snapshots, err := snapshotInputs(checkedPaths)
 	if err != nil {
-		return fmt.Errorf("failed to set file times for %s: %v", outputPath, err)
+		return err
 	}
 
-	return nil
-}
+	// The output is written and checked under a partial name, and only
+	// renamed to outputPath once it is complete
+	partial := partialPath(outputPath)
+	defer removePartial(partial, opts)
 
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
+	split := opts.MaxSize > 0 || opts.MaxDuration > 0
+	if len(inputPaths) == 1 && !needsRemux(opts) {
+		if err := runPreMergeHook(inputPaths, opts); err != nil {
+			return err
+		}
+		single := []FileInfo{{Path: inputPaths[0]}}
+		// A link shares its mode, owner and contents with the input
+		linkable := opts.Mode == 0 && opts.Owner == "" && opts.CoverArt == ""
+		if opts.LinkSingle && !linkable {
+			logger.Info("copying instead of linking, changing the output would change the input too", "input", inputPaths[0])
+		}
+		if opts.LinkSingle && linkable {
+			linked, err := linkFile(inputPaths[0], outputPath)
+			if err != nil {
+				return err
+			}
+			if linked {
+				// The link shares the times of the input, which are the ones it should have
+				logger.Info("linked single input", "input", inputPaths[0], "output", outputPath)
+				stamp := func(path string) error {
+					return stampOutput(path, single, creationTime, modTime, opts)
+				}
+				second := startSecondOutput(outputPath, outputPath, nil, stamp, opts)
+				writeProxy(outputPath, creationTime, modTime, opts)
+				second.finish(nil, opts)
+				return nil
+			}
+			logger.Info("cannot link across file systems, copying instead", "input", inputPaths[0], "output", outputPath)
+		}
+		logger.Info("copying single input", "input", inputPaths[0], "output", outputPath)
+		if opts.VerifyFrames {
+			logger.Info("the output is a copy of the single input, its frames are not hashed", "input", inputPaths[0])
+		}
+		err = copyFile(inputPaths[0], partial)
+		if err != nil {
+			return err
+		}
+		if err := checkInputsUnchanged(snapshots); err != nil {
+			return err
+		}
+		var manifest []chapterMark
+		if opts.Manifest != "" {
+			probes, err := probeFiles(single, opts)
+			if err != nil {
+				return err
+			}
+			manifest = manifestChapters(single, inputDurations(probes), nil)
+		}
+		if err := writeSidecars(partial, outputPath, inputPaths[0], manifest, opts); err != nil {
+			return err
+		}
+		return finishOutput(partial, outputPath, nil, single, creationTime, modTime, opts)
+	}
+
+	files, err := orderFiles(inputPaths, opts)
 	if err != nil {
 		return err
 	}
-	defer sourceFile.Close()
 
-	destinationFile, err := os.Create(dst)
+	orderedPaths := make([]string, len(files))
+	for i, file := range files {
+		orderedPaths[i] = file.Path
+	}
+	if err := runPreMergeHook(orderedPaths, opts); err != nil {
+		return err
+	}
+
+	if opts.probes == nil {
+		opts.probes = newProbeCache()
+	}
+	probes, err := probeFiles(files, opts)
 	if err != nil {
 		return err
 	}
-	defer destinationFile.Close()
+	if err := selectStreams(files, probes, opts); err != nil {
+		return err
+	}
+	// The concat demuxer exposes the streams of the first input
+	probe := probes[0]
+	if opts.CheckJoins {
+		drifts := checkJoins(files, probes, opts.joinThreshold())
+		for _, drift := range drifts {
+			logger.Info("audio and video lengths of chapter differ", "input", drift.Path, "video", drift.Video, "audio", drift.Audio, "drift", drift.Drift)
+		}
+		if opts.JoinsFunc != nil {
+			opts.JoinsFunc(drifts)
+		}
+	}
+	if opts.ReportGaps {
+		gaps, err := findGaps(files, inputDurations(probes), opts.gapThreshold())
+		if err != nil {
+			return err
+		}
+		for _, gap := range gaps {
+			logger.Info("time gap between chapters", "input", gap.Path, "next", gap.Next, "gap", gap.Gap())
+		}
+		if opts.GapsFunc != nil {
+			opts.GapsFunc(gaps)
+		}
+	}
 
-	if _, err := io.Copy(destinationFile, sourceFile); err != nil {
+	// Concatenating inputs of different formats with stream copy produces broken files
+	mismatches := checkConsistency(files, probes)
+	if hasAudioMismatch(mismatches) {
+		return &mismatchError{First: files[0].Path, Mismatches: mismatches}
+	}
+	// The other mismatches are left to -reencode and -allow-mismatch
+	var resample []inputMismatch
+	if opts.ResampleAudio && !opts.Reencode {
+		resample, mismatches = splitSampleRates(mismatches)
+	}
+	for _, m := range slowMotionMismatches(mismatches) {
+		logger.Warn("input looks like slow motion mixed with normal speed video, it will not play back slowed down",
+			"input", m.Path, "frame_rate", m.Actual, "first_chapter", m.Expected)
+	}
+	reencodeAll := len(mismatches) > 0 && opts.Reencode
+	var target encodeSettings
+	switch {
+	case reencodeAll:
+		if err := checkReencodeInputs(len(intro) + len(files) + len(outro)); err != nil {
+			return err
+		}
+		target = reencodeTarget(probes, opts)
+		logger.Warn("inputs differ, re-encoding all of them to the format of the first chapter", "settings", target.String())
+	case len(mismatches) > 0 && opts.AllowMismatch:
+		for _, mismatch := range mismatches {
+			logger.Warn("input differs from the first chapter", "input", mismatch.Path, "param", mismatch.Param, "expected", mismatch.Expected, "actual", mismatch.Actual)
+		}
+		logger.Warn("inputs differ, merging them anyway because of -allow-mismatch. The merged file may be broken")
+	case len(mismatches) > 0:
+		return &mismatchError{First: files[0].Path, Mismatches: mismatches}
+	}
+
+	// Trimming past the end fails before ffmpeg does any work
+	trimFiles := append(append(append([]FileInfo(nil), intro...), files...), outro...)
+	trimProbes, err := probeFiles(trimFiles, opts)
+	if err != nil {
+		return err
+	}
+	trimDurations := inputDurations(trimProbes)
+	trim, err := resolveTrim(trimFiles, trimDurations, !opts.Reencode, opts)
+	if err != nil {
 		return err
 	}
 
-	return destinationFile.Close()
-}
+	// Clips that cannot be stream copied with the chapters are re-encoded to match them
+	for _, clips := range [][]FileInfo{intro, outro} {
+		for i := range clips {
+			path, remove, err := conformClip(outputPath, clips[i], probe, opts)
+			if err != nil {
+				return err
+			}
+			defer remove()
+			clips[i].Path = path
+		}
+	}
+	// The concat demuxer takes the streams of the intro, which has no
+	// telemetry or timecode
+	if len(intro) > 0 {
+		logger.Warn("the intro has no telemetry or timecode, the output will not contain them", "intro", opts.Intro)
+		probe.Streams = withoutDataStreams(probe.Streams)
+	}
 
-func getFileTimes(inputPaths []string) (time.Time, time.Time, error) {
-	var oldestTime time.Time
-	var modTime time.Time
-	for _, inputPath := range inputPaths {
-		info, err := os.Stat(inputPath)
+	// The native backend copies every track as it is, ffmpeg is not involved
+	var native *nativePlan
+	if opts.Backend == backendNative {
+		native, err = planNative(files, opts)
+		if err != nil {
+			logger.Warn("the native backend cannot merge the inputs, merging with ffmpeg", "reason", err)
+		}
+	}
+	copyUnknown := true
+	if native == nil {
+		probe.Streams, copyUnknown, err = checkCopyUnknown(probe.Streams, opts)
 		if err != nil {
-			return time.Time{}, time.Time{}, fmt.Errorf("failed to stat input file %s: %v", inputPath, err)
+			return err
 		}
+	}
+	mapping := mapStreams(probe.Streams, opts.Streams)
+	if !copyUnknown {
+		mapping.Args = withoutCopyUnknown(mapping.Args)
+	}
+	if opts.NoTelemetry {
+		logger.Info("leaving out the telemetry", "output", outputPath)
+	} else if !mapping.Telemetry && len(intro) == 0 {
+		logger.Warn("no telemetry stream found, the output will not contain GPMF data", "input", files[0].Path)
+	}
+	timecode := probe.Timecode()
+	if len(intro) > 0 {
+		timecode = ""
+	}
 
-		ts := times.Get(info)
-		if ts.HasBirthTime() && (oldestTime.IsZero() || ts.BirthTime().Before(oldestTime)) {
-			oldestTime = ts.BirthTime()
+	// The output starts and ends where it is trimmed, and so do its times
+	if trim != nil {
+		logger.Info("trimming output", "output", outputPath, "range", trim.String())
+		if timecode != "" && trim.Start > 0 {
+			video, _ := probe.firstStream("video")
+			timecode, err = advanceTimecode(timecode, video.FrameRate, trim.Start)
+			if err != nil {
+				logger.Warn("cannot move the timecode to the trimmed start, the output will not contain it", "error", err)
+				timecode = ""
+			}
+		}
+		var total time.Duration
+		for _, duration := range trimDurations {
+			total += duration
+		}
+		creationTime = creationTime.Add(trim.Start)
+		modTime = modTime.Add(trim.End - total)
+		if opts.TrimFunc != nil {
+			opts.TrimFunc(trim.Start, trim.End)
 		}
-		if modTime.Before(info.ModTime()) {
-			modTime = info.ModTime()
+	}
+	// A track that does not cover the recording fails before any work
+	var geotag *GeotagMatch
+	if opts.Geotag != nil {
+		match, err := nearestTrackPoint(opts.Geotag, creationTime.Add(opts.GeotagOffset), opts.geotagMaxGap())
+		if err != nil {
+			return err
 		}
+		geotag = &match
 	}
 
-	if oldestTime.IsZero() {
-		return time.Time{}, time.Time{}, fmt.Errorf("failed to get oldest creation time")
+	concatPaths := make([]string, len(files))
+	for i, file := range files {
+		concatPaths[i] = file.Path
+	}
+	concatProbe := probe
+	concatMapping := mapping
+	selection := opts.Streams
+	if opts.Segmented {
+		concatPaths, err = remuxSegments(outputPath, files, mapping, opts)
+		if err != nil {
+			return err
+		}
+	}
+	if len(resample) > 0 {
+		var remove func()
+		concatPaths, remove, err = resampleChapters(outputPath, files, resample, mapping, opts)
+		if err != nil {
+			return err
+		}
+		defer remove()
+	}
+	if opts.Segmented || len(resample) > 0 {
+		// The segments hold exactly the selected streams
+		concatProbe, err = probeFile(concatPaths[0])
+		if err != nil {
+			return err
+		}
+		selection = streamsAll
+		concatMapping = mapStreams(concatProbe.Streams, selection)
+	}
+	for _, clip := range intro {
+		concatPaths = append([]string{clip.Path}, concatPaths...)
+	}
+	for _, clip := range outro {
+		concatPaths = append(concatPaths, clip.Path)
 	}
 
-	return oldestTime, modTime, nil
-}
+	// Matroska has no data streams, the telemetry is attached as a file instead
+	expectedStreams := mapping.Streams
+	telemetryIndex, attachTelemetry := concatProbe.telemetryStreamIndex()
+	attachTelemetry = attachTelemetry && mapping.Telemetry && !mp4
+	if !mp4 || len(intro) > 0 {
+		concatMapping = mapStreams(withoutDataStreams(concatProbe.Streams), selection)
+		expectedStreams = withoutDataStreams(expectedStreams)
+	}
 
-func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: GoProConcat outputfile inputfile1 [inputfile2 ...]")
-		return
+	if !copyUnknown {
+		concatMapping.Args = withoutCopyUnknown(concatMapping.Args)
 	}
 
-	err := checkRequirements()
+	listFile, err := opts.createTempFile(outputPath, ".concat.txt")
 	if err != nil {
-		fmt.Println(err)
-		return
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	// The list is kept when ffmpeg fails, to reproduce the failure with it
+	keepList := false
+	defer func() {
+		if !keepList {
+			os.Remove(listFile.Name())
+		}
+	}()
+
+	for _, path := range concatPaths {
+		_, err = listFile.WriteString(concatListEntry(path))
+		if err != nil {
+			return fmt.Errorf("failed to write to temp file: %v", err)
+		}
+	}
+	listFile.Close()
+
+	spec := mergeSpec{
+		ListPath:     listFile.Name(),
+		OutputPath:   partial,
+		CreationTime: creationTime,
+		MapArgs:      append(concatMapping.Args, timecodeArgs(timecode, opts.Container)...),
+		Trim:         trim,
+		Remote:       hasRemote(concatPaths),
+	}
+	if opts.Metadata != nil {
+		metadata, ok := opts.Metadata[files[0].FileNumber]
+		if !ok {
+			logger.Warn("the metadata CSV has no row for the recording, the output gets no title, location or comment from it", "file_number", files[0].FileNumber)
+		}
+		spec.Metadata = metadata
+		spec.Comment = metadata.Comment
+	}
+	if geotag != nil && spec.Metadata.Location != "" {
+		logger.Info("the metadata CSV gives the location, not geotagging from the track", "output", outputPath, "location", spec.Metadata.Location)
+	} else if geotag != nil {
+		logger.Info("geotagging from the track", "output", outputPath, "location", geotag.ISO6709(), "delta", geotag.Delta)
+		spec.Metadata.Location = geotag.ISO6709()
+		if opts.GeotagFunc != nil {
+			opts.GeotagFunc(*geotag)
+		}
+	}
+	if opts.EmbedSourceList {
+		// The comment of the recording comes first, then the source list
+		spec.Comment = strings.TrimPrefix(spec.Comment+"\n"+sourceListComment(files), "\n")
 	}
+	if video, ok := probe.firstStream("video"); ok {
+		spec.Color = video.color()
+	}
+
+	if attachTelemetry {
+		telemetryFile, err := opts.createTempFile(outputPath, ".gpmd")
+		if err != nil {
+			return fmt.Errorf("failed to create temp file: %v", err)
+		}
+		telemetryFile.Close()
+		defer os.Remove(telemetryFile.Name())
 
-	outputPath := os.Args[1]
-	inputPaths := os.Args[2:]
+		logger.Info("extracting telemetry to attach it", "output", outputPath, "container", opts.Container)
+		cmd := ffmpegCommand(extractTelemetryArgs(spec, telemetryIndex, telemetryFile.Name(), opts.FFmpegLogLevel)...)
+		if err := runCommand(logger, cmd); err != nil {
+			return fmt.Errorf("failed to extract telemetry: %v", err)
+		}
+		spec.TelemetryPath = telemetryFile.Name()
+	}
 
-	creationTime, modTime, err := getFileTimes(inputPaths)
+	// HiLights and chapters count the clips in, only the chapters have HiLights
+	merged := append(append(append([]FileInfo(nil), intro...), files...), outro...)
+	mergedProbes, err := probeFiles(merged, opts)
 	if err != nil {
-		fmt.Printf("Error getting file times: %v\n", err)
-		return
+		return err
+	}
+	var outputDuration time.Duration
+	for _, duration := range inputDurations(mergedProbes) {
+		outputDuration += duration
+	}
+	if trim != nil {
+		outputDuration = trim.Duration()
 	}
 
-	err = mergeFiles(outputPath, inputPaths, creationTime, modTime)
+	// HiLights are a nice-to-have, a damaged udta box must not fail the merge
+	hilights, total, err := mergedHiLights(merged, opts)
 	if err != nil {
-		fmt.Printf("Error merging files: %v\n", err)
-		return
+		logger.Warn("failed to read HiLights, the output will have no HiLight chapters", "error", err)
+	}
+	var chapters []chapterMark
+	if err == nil && len(hilights) > 0 {
+		logger.Info("adding HiLights as chapters", "output", outputPath, "hilights", len(hilights))
+		chapters = hiLightChapters(hilights, total)
+	}
+	// Chapters at the file boundaries take the place of HiLight chapters,
+	// the HiLights themselves are still kept in the HMMT box
+	if opts.Chapters {
+		logger.Info("adding file boundaries as chapters", "output", outputPath, "chapters", len(merged))
+		chapters = fileChapters(merged, inputDurations(mergedProbes))
+	}
+	if trim != nil {
+		chapters = trimChapters(chapters, *trim)
+		hilights = trimHiLights(hilights, *trim)
+	}
+	if len(chapters) > 0 {
+		spec.ChaptersPath, err = writeChaptersFile(outputPath, chapters, opts)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spec.ChaptersPath)
+	}
+
+	if opts.NormalizeAudio {
+		// The audio track selected, the first one unless -audio-track says otherwise
+		audio, ok := ProbeResult{Streams: concatMapping.Streams}.firstStream("audio")
+		if !ok {
+			return fmt.Errorf("-normalize-audio: the inputs have no audio")
+		}
+		logger.Info("measuring the loudness of the audio, which is then re-encoded (lossy)", "output", outputPath, "target", opts.loudnessTarget())
+		loudness, err := measureLoudness(spec, audio.Index, opts)
+		if err != nil {
+			return err
+		}
+		logger.Info("normalizing the audio", "output", outputPath, "loudness", loudness.String())
+		spec.AudioFilter, spec.SampleRate = loudnormFilter(loudness), audio.SampleRate
+		if opts.LoudnessFunc != nil {
+			opts.LoudnessFunc(loudness)
+		}
+	}
+
+	args := mergeArgs(spec, opts)
+	if reencodeAll {
+		index := -1
+		if mp4 && mapping.Telemetry {
+			index = telemetryIndex
+		}
+		spec.MapArgs = timecodeArgs(timecode, opts.Container)
+		args = reencodeArgs(spec, concatPaths, target, index, opts)
+		expectedStreams = reencodedStreams(probe, target, index >= 0)
+	}
+
+	start := time.Now()
+	if native != nil {
+		logger.Info("merging files natively", "output", outputPath, "inputs", len(files))
+		if err := writeNative(partial, native, hilights, creationTime); err != nil {
+			return fmt.Errorf("native merge failed: %v", err)
+		}
+		logger.Info("native merge finished", "output", outputPath, "duration", time.Since(start))
+	} else {
+		cmd := ffmpegCommand(append(progressArgs(opts), args...)...)
+		if opts.ProgressFunc != nil {
+			cmd.Stdout = newProgressWriter(stageMerge, outputDuration, opts.ProgressFunc)
+		}
+		logger.Info("merging files", "output", outputPath, "inputs", len(files), "list", listFile.Name())
+		err = runCommand(logger, cmd)
+		var ffmpegErr *FFmpegError
+		if errors.As(err, &ffmpegErr) {
+			keepList = true
+			ffmpegErr.ListPath = listFile.Name()
+			return fmt.Errorf("ffmpeg command failed: %w", err)
+		}
+		if err != nil {
+			return fmt.Errorf("ffmpeg command failed: %v", err)
+		}
+		logger.Info("ffmpeg finished", "output", outputPath, "duration", time.Since(start))
+	}
+	if err := checkInputsUnchanged(snapshots); err != nil {
+		return err
 	}
 
-	fmt.Println("Files merged successfully")
+	// ffmpeg drops the vendor boxes identifying the camera and the HiLights, copy them back
+	if mp4 && isRemote(files[0].Path) {
+		logger.Info("the first chapter is remote, the output will have no camera metadata or HiLights", "input", files[0].Path)
+	}
+	if mp4 && !isRemote(files[0].Path) && native == nil {
+		err = graftUserData(partial, files[0].Path, hilights)
+		if err != nil {
+			logger.Warn("failed to copy camera metadata", "output", outputPath, "error", err)
+		}
+	}
+
+	// The muxer rebuilds the timecode track of MP4 and MOV
+	inventory := expectedStreams
+	if timecode != "" && mp4 {
+		inventory = append(append([]StreamInfo(nil), inventory...), StreamInfo{CodecType: "data", CodecTagString: "tmcd"})
+	}
+	if opts.Verify {
+		err = verifyOutput(partial, outputPath, inventory, creationTime, outputDuration, len(concatPaths), opts)
+	} else {
+		err = verifyStreams(partial, expectedStreams)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.VerifyFrames {
+		check, err := verifyFrames(spec.ListPath, spec.Remote, partial, outputDuration, opts)
+		if err != nil {
+			return err
+		}
+		if opts.FramesFunc != nil {
+			opts.FramesFunc(check)
+		}
+		if check.Mismatch != nil {
+			return keepIncomplete(partial, outputPath, fmt.Errorf("frame verification failed: %s", check.Mismatch))
+		}
+		logger.Info("frames verified", "output", outputPath, "frames", check.Frames)
+	}
+	if opts.TwoPass {
+		logger.Info("verifying stream parameters", "output", outputPath, "streams", len(expectedStreams))
+		err = verifyStreamParams(partial, expectedStreams)
+		if err != nil {
+			return err
+		}
+	}
+	if spec.Color.known() {
+		err = verifyColor(partial, spec.Color)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Rotate != 0 {
+		err = verifyRotation(partial, opts.Rotate)
+		if err != nil {
+			return err
+		}
+	}
+	// A shorter output is expected when damaged parts are dropped
+	if opts.IgnoreErrors {
+		err = checkDurationLoss(partial, outputDuration, opts)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.VerifyTelemetry && !mp4 {
+		logger.Warn("-verify-telemetry only applies to MP4 and MOV output, skipping it", "output", outputPath)
+	}
+	if opts.VerifyTelemetry && len(intro) > 0 {
+		logger.Warn("-verify-telemetry does not apply with an intro, skipping it", "output", outputPath)
+	}
+	if opts.VerifyTelemetry && trim != nil {
+		logger.Warn("-verify-telemetry does not apply to a trimmed output, skipping it", "output", outputPath)
+	}
+	if opts.VerifyTelemetry && mp4 && len(intro) == 0 && trim == nil {
+		logger.Info("verifying telemetry", "output", outputPath)
+		err = verifyTelemetry(partial, inputPaths, opts.TelemetryTolerance)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.NoTelemetry {
+		err = verifyNoTelemetry(partial)
+		if err != nil {
+			return err
+		}
+	}
+	if mp4 && opts.Verify && !opts.NoVendorMetadata && len(intro) == 0 {
+		checkVendorMetadata(partial, probe.Tags, opts)
+	}
+	if opts.Faststart {
+		err = verifyFaststart(partial)
+		if err != nil {
+			return err
+		}
+	}
+	if timecode != "" {
+		err = verifyTimecode(partial, timecode)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeSidecars(partial, outputPath, files[0].Path, manifestChapters(merged, inputDurations(mergedProbes), trim), opts)
+	if err != nil {
+		return err
+	}
+	if split {
+		// The parts are named after the output
+		if err := renamePartial(partial, outputPath); err != nil {
+			return err
+		}
+		// The proxy is of the whole recording, the parts are only for storage
+		writeProxy(outputPath, creationTime, modTime, opts)
+		parts, err := splitOutput(outputPath, outputDuration, creationTime, modTime, opts)
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			labelOutput(part.Path, files, opts)
+		}
+		if opts.PartsFunc != nil {
+			opts.PartsFunc(parts)
+		}
+	} else {
+		err = finishOutput(partial, outputPath, expectedStreams, files, creationTime, modTime, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Segmented {
+		logger.Debug("removing segments", "dir", segmentDir(outputPath))
+		os.RemoveAll(segmentDir(outputPath))
+	}
+
+	return nil
+}
+
+// writeSidecars writes what goes with the merge at partial besides the
+// output itself: the thumbnail and cover art taken from it, and the
+// manifest of its chapters.
+func writeSidecars(partial, outputPath, firstChapter string, manifest []chapterMark, opts Options) error {
+	if err := writeThumbnail(partial, opts); err != nil {
+		return err
+	}
+	if err := embedCoverArt(partial, outputPath, firstChapter, opts); err != nil {
+		return err
+	}
+	return writeManifestFile(manifest, opts)
+}
+
+// finishOutput stamps the merge of files at partial and renames it to
+// outputPath, then writes its proxy. The second output is copied from
+// partial meanwhile, checked to have streams, and stamped the same way.
+func finishOutput(partial, outputPath string, streams []StreamInfo, files []FileInfo, creationTime, modTime time.Time, opts Options) error {
+	stamp := func(path string) error {
+		return stampOutput(path, files, creationTime, modTime, opts)
+	}
+	second := startSecondOutput(partial, outputPath, streams, stamp, opts)
+	err := stamp(partial)
+	if err == nil {
+		err = renamePartial(partial, outputPath)
+	}
+	if err == nil {
+		writeProxy(outputPath, creationTime, modTime, opts)
+	}
+	second.finish(err, opts)
+	return err
+}
+
+// stampOutput gives the merge of files at path its permissions, labels
+// and times.
+func stampOutput(path string, files []FileInfo, creationTime, modTime time.Time, opts Options) error {
+	if err := setOutputPermissions(path, opts); err != nil {
+		return err
+	}
+	labelOutput(path, files, opts)
+	return setOutputTimes(path, creationTime, modTime, opts)
+}
+
+// labelOutput copies the Finder tags of the first of files to path and
+// sets its Finder comment, as far as opts ask for them.
+func labelOutput(path string, files []FileInfo, opts Options) {
+	copyXattrs(files[0].Path, path, opts)
+	if opts.FinderComment {
+		setFinderComment(path, finderComment(files, time.Now().In(opts.location())), opts)
+	}
+}
+
+// changeTimes is a variable so tests can simulate file systems that
+// refuse to change file times.
+var changeTimes = os.Chtimes
+
+// setOutputTimes stamps outputPath with creationTime, which needs SetFile
+// on macOS, and modTime. The two steps fail independently. The output is
+// complete by then, so a failure only logs a warning unless
+// opts.StrictTimes is set.
+func setOutputTimes(outputPath string, creationTime, modTime time.Time, opts Options) error {
+	logger := opts.logger()
+
+	// SetFile takes a wall clock time without a zone, which the Finder then displays as is
+	setFileTime := creationTime.In(opts.location()).Format("01/02/2006 15:04:05")
+	logger.Info("setting creation time using SetFile", "output", outputPath, "creation_time", setFileTime)
+	err := runCommand(logger, exec.Command("SetFile", "-d", setFileTime, outputPath))
+	if err != nil {
+		if opts.StrictTimes {
+			return fmt.Errorf("failed to set creation time for %s: %v", outputPath, err)
+		}
+		logger.Warn("failed to set creation time, the output keeps the time it was written", "output", outputPath, "error", err)
+	}
+
+	logger.Debug("setting file times", "output", outputPath, "creation_time", creationTime, "mod_time", modTime)
+	err = changeTimes(outputPath, creationTime, modTime)
+	if err != nil {
+		if opts.StrictTimes {
+			return fmt.Errorf("failed to set file times for %s: %v", outputPath, err)
+		}
+		logger.Warn("failed to set modification time, the output keeps the time it was written", "output", outputPath, "error", err)
+	}
+	return nil
+}
+
+// hardLink is a variable so tests can simulate file systems without hard
+// links.
+var hardLink = os.Link
+
+// linkFile makes dst a hard link to src, replacing dst. It reports false
+// when the file system cannot link the two, because they are on different
+// volumes or it has no hard links, and leaves dst alone in that case.
+// Other failures are returned.
+func linkFile(src, dst string) (bool, error) {
+	// The link is made under a free name next to dst, then renamed over it
+	file, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".link-*")
+	if err != nil {
+		return false, fmt.Errorf("failed to create temp file next to %s: %v", dst, err)
+	}
+	temp := file.Name()
+	file.Close()
+	os.Remove(temp)
+	if err := hardLink(src, temp); err != nil {
+		if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.ENOTSUP) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to link %s to %s: %v", src, dst, err)
+	}
+	if err := os.Rename(temp, dst); err != nil {
+		os.Remove(temp)
+		return false, err
+	}
+	return true, nil
+}
+
+func copyFile(src, dst string) error {
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destinationFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer destinationFile.Close()
+
+	if _, err := io.Copy(destinationFile, sourceFile); err != nil {
+		return err
+	}
+
+	return destinationFile.Close()
+}
+
+// fileTimes returns the birth time of path, which is zero when the file
+// system does not record it, and its modification time.
+func fileTimes(path string) (time.Time, time.Time, error) {
+	if isRemote(path) {
+		return remoteFileTimes(path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to stat input file %s: %v", path, err)
+	}
+
+	var birthTime time.Time
+	if ts := times.Get(info); ts.HasBirthTime() {
+		birthTime = ts.BirthTime()
+	}
+	return birthTime, info.ModTime(), nil
+}
+
+func getFileTimes(inputPaths []string) (time.Time, time.Time, error) {
+	var oldestTime time.Time
+	var modTime time.Time
+	for _, inputPath := range inputPaths {
+		birthTime, fileModTime, err := fileTimes(inputPath)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+
+		if !birthTime.IsZero() && (oldestTime.IsZero() || birthTime.Before(oldestTime)) {
+			oldestTime = birthTime
+		}
+		if modTime.Before(fileModTime) {
+			modTime = fileModTime
+		}
+	}
+
+	if oldestTime.IsZero() {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to get oldest creation time")
+	}
+
+	return oldestTime, modTime, nil
+}
+
+// newCLILogger builds the logger used by the command line tool. Debug
+// records, including ffmpeg's own output, are only shown when verbose.
+func newCLILogger(w io.Writer, format string, verbose bool) (*slog.Logger, error) {
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelDebug
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text or json", format)
+	}
+}
+
+// version is the version of GoProConcat, set when building a release with
+// -ldflags "-X main.version=v1.2.0".
+var version = "dev"
+
+// Exit codes returned by run.
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitUsage   = 2
+	exitNoInput = 3 // no GoPro files were found among the inputs
+)
+
+// run executes the command line tool with args (excluding the program
+// name) and returns the process exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "split" {
+		return runSplit(args[1:], stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "info" {
+		return runInfo(args[1:], stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "analyze" {
+		return runAnalyze(args[1:], stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "list-schemes" {
+		return runListSchemes(args[1:], stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "verify" {
+		return runVerify(args[1:], stdout, stderr)
+	}
+
+	flags := flag.NewFlagSet("GoProConcat", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	showVersion := flags.Bool("version", false, "print the version of GoProConcat, what it was built with and the ffmpeg it found, and exit")
+	verbose := flags.Bool("v", false, "print the merge plan before merging and enable debug logging")
+	dryRun := flags.Bool("dry-run", false, "print the merge plan without merging")
+	jsonOutput := flags.Bool("json", false, "print the merge plan as JSON")
+	quietSuccess := flags.Bool("quiet-success", false, "print only the path of what was written on stdout, one per line, and everything else on stderr, e.g. for OUT=$(GoProConcat ...)")
+	reencode := flags.Bool("reencode", false, "re-encode the video stream instead of copying it")
+	hwaccel := flags.String("hwaccel", "", "hardware acceleration for -reencode (videotoolbox)")
+	segmented := flags.Bool("segmented", false, "remux each chapter separately first, so a failed merge resumes where it stopped")
+	verifyTelemetry := flags.Bool("verify-telemetry", false, "check that no gpmd telemetry packets were lost in the merge")
+	checkJoinsFlag := flags.Bool("check-joins", false, "report chapters whose audio and video lengths differ, which cause pops or drift at the joins")
+	joinThreshold := flags.Duration("join-threshold", defaultJoinThreshold, "difference between the audio and video length of a chapter -check-joins reports")
+	reportGaps := flags.Bool("report-gaps", false, "report time gaps between the end of a chapter and the start of the next, where the camera stopped recording")
+	gapThreshold := flags.Duration("gap-threshold", defaultGapThreshold, "gap between chapters -report-gaps reports")
+	noVerify := flags.Bool("no-verify", false, "skip checking that the output has the streams of the inputs and lasts as long as they do together")
+	verifyLevel := flags.String("verify", verifyBasic, "how the output is checked: basic, or deep to also compare the hash of every video and audio frame with the inputs, which reads them all again")
+	durationTolerance := flags.Duration("duration-tolerance", defaultDurationTolerance, "difference per join between the duration of the output and of the inputs that the duration check allows")
+	var destinations destinationList
+	flags.Var(&destinations, "output", "also write the merged file to this file or directory, by copying it after merging; can be repeated")
+	alsoOutput := flags.String("also-output", "", "also write the merged file to this file or directory, copied while the merge finishes the output and verified like it")
+	twoPass := flags.Bool("two-pass", false, "probe the output again after merging and check every stream against the inputs: codec, resolution, frame rate, audio format and telemetry")
+	telemetryTolerance := flags.Int("telemetry-tolerance", 0, "number of gpmd packets -verify-telemetry allows to differ")
+	faststart := flags.Bool("faststart", false, "move the moov atom to the front of the output for faster streaming playback")
+	streams := flags.String("streams", streamsAll, "streams to copy: all, or essential for video, audio and telemetry only")
+	var proxy proxyFlag
+	flags.Var(&proxy, "proxy", "also write a low-bitrate H.264 editing proxy next to the output, named like out_proxy.mp4: -proxy for 1080p, or -proxy=720p")
+	lut := flags.String("lut", "", "grade the video with this 3D .cube LUT while -reencode re-encodes it, e.g. for flat Protune footage")
+	burnTimestamp := flags.Bool("burn-timestamp", false, "burn the recording time into the video while -reencode re-encodes it, like a dashcam")
+	timestampPosition := flags.String("timestamp-position", positionBottomRight, "corner of -burn-timestamp: top-left, top-right, bottom-left or bottom-right")
+	timestampSize := flags.Int("timestamp-size", 0, "font size of -burn-timestamp in pixels (default a 24th of the video height)")
+	timestampFormat := flags.String("timestamp-format", defaultTimestampFormat, "strftime format of -burn-timestamp")
+	proxyLUT := flags.String("proxy-lut", "", "grade the -proxy with this 3D .cube LUT, e.g. a viewing LUT for editing")
+	checksum := flags.String("checksum", "", "write a checksum sidecar of the output, e.g. out.mp4.sha256, with this hash: sha256, md5 or xxh64")
+	movflags := flags.String("movflags", "", "extra movflags of MP4 and MOV outputs joined by +, e.g. frag_keyframe+empty_moov, or a preset: web, streaming or rtp")
+	backend := flags.String("backend", backendFFmpeg, "merge with ffmpeg, or native to concatenate identical MP4 chapters without it (experimental)")
+	tempDir := flags.String("temp-dir", "", "directory for scratch files (default the system temp directory)")
+	stableTempNames := flags.Bool("stable-temp-names", false, "name scratch files after the output and a hash of its path instead of randomly")
+	logFormat := flags.String("log-format", "text", "diagnostic log format: text or json")
+	videoCodec := flags.String("video-codec", "", "video codec (h264 or hevc) or encoder for -reencode (default h264)")
+	bitrate := flags.String("bitrate", "", "video bitrate for -reencode, e.g. 50M, instead of -crf")
+	crf := flags.Int("crf", defaultCRF, "quality of libx264/libx265 for -reencode, lower is better (1-51)")
+	preset := flags.String("preset", defaultPreset, "speed preset of libx264/libx265 for -reencode")
+	linkSingle := flags.Bool("link-single", false, "hard link a single input to the output instead of copying it")
+	loopRecording := flags.Bool("loop-recording", false, "order inputs with the same file and chapter number by time, for loop recordings")
+	first := flags.String("first", "", "input merged first, before the others in their usual order; its creation time becomes the one of the output")
+	orderBy := flags.String("input-order-by", orderByName, "order inputs by name (their GoPro file and chapter numbers), birthtime or modtime")
+	filenamePattern := flags.String("filename-pattern", "", "regular expression matching the upper-cased chapter names instead of the GoPro ones, with the named groups (?P<chapter>...) and (?P<file>...), and optionally (?P<prefix>...)")
+	subfolders := flags.Bool("subfolders", false, "merge the recording in every subfolder of the input directory into the output directory, named after the subfolder")
+	splitChapters := flags.Bool("split-chapters", false, "remux every input on its own into the output directory, named like 2024-06-01_GH0042_part2.mp4, instead of merging them")
+	keepGoing := flags.Bool("keep-going", false, "with -split-chapters or -subfolders, fail only the outputs that already exist instead of writing none")
+	listOnly := flags.String("list-only", "", "write the ffmpeg concat list of the inputs, in merge order, to this file and exit; all arguments are inputs")
+	fromList := flags.String("from-list", "", "merge the files of this ffmpeg concat list in its order, e.g. one written by -list-only; the only argument is the output")
+	embedSourceList := flags.Bool("embed-source-list", false, "record the input file names in the comment metadata of the output")
+	container := flags.String("container", "", "output container: mp4, mov or mkv (default from the output file extension)")
+	chapters := flags.Bool("chapters", false, "add a chapter marker where each input file begins")
+	printHiLightsFlag := flags.Bool("print-hilights", false, "list the HiLights of the merged file at their position in it")
+	timezone := flags.String("timezone", "", "IANA timezone of the creation time metadata, e.g. Europe/Paris (default local time)")
+	preMerge := flags.String("pre-merge", "", "shell command run before merging, {inputs} is replaced by the input files; a failure aborts the merge")
+	dropAudio := flags.Bool("drop-audio", false, "leave out the audio, to merge chapters of which only some have an audio track")
+	intro := flags.String("intro", "", "clip merged before the chapters, re-encoded to match them when needed")
+	outro := flags.String("outro", "", "clip merged after the chapters, re-encoded to match them when needed")
+	outputMode := flags.String("output-mode", "", "octal permissions of the output, e.g. 0644 (default from the umask)")
+	outputOwner := flags.String("output-owner", "", "owner of the output as user, user:group or :group, by name or ID")
+	flags.BoolVar(dropAudio, "no-audio", false, "same as -drop-audio")
+	normalizeAudio := flags.Bool("normalize-audio", false, "normalize the loudness of the audio to -loudness-target in two passes; re-encodes the audio to AAC, which is lossy, while video and telemetry are copied")
+	loudnessTarget := flags.Float64("loudness-target", defaultLoudnessTarget, "integrated loudness in LUFS -normalize-audio aims at")
+	resampleAudio := flags.Bool("resample-audio", false, "resample the audio of chapters recorded at another sample rate than the first one, re-encoding only their audio to AAC, instead of aborting")
+	rotate := flags.Int("rotate", 0, "turn the video 90, 180 or 270 degrees clockwise, for a camera mounted sideways or upside down, by setting its display rotation without re-encoding")
+	audioTrack := flags.Int("audio-track", 0, "copy only the N-th audio track of the inputs, counting from 1 (default all)")
+	noTelemetry := flags.Bool("no-telemetry", false, "leave out the GPMF telemetry, which includes the GPS track, e.g. for sharing")
+	noVendorMetadata := flags.Bool("no-vendor-metadata", false, "leave out the metadata keys of the camera, such as the firmware version, for a clean file")
+	requireTelemetry := flags.Bool("require-telemetry", false, "fail instead of leaving out the telemetry when the installed ffmpeg cannot copy it")
+	fixTimestamps := flags.Bool("fix-timestamps", false, "regenerate missing timestamps and shift negative ones, for damaged or recovered chapters")
+	ffmpegLogLevel := flags.String("loglevel", defaultFFmpegLogLevel, "log level of what ffmpeg prints that is shown, e.g. error, warning or info; its warnings are summarized at any level")
+	remoteTimeFlag := flags.String("remote-time", "", "recording time of http(s) inputs in RFC 3339, e.g. 2024-05-01T10:00:00+02:00 (default their Last-Modified time)")
+	start := flags.String("start", "", "drop the merged recording before this time, e.g. 00:01:12 or 1m12s")
+	end := flags.String("end", "", "drop the merged recording after this time, negative to count from the end, e.g. -00:00:30")
+	maxSize := flags.String("max-size", "", "split the output into numbered parts of at most this size, e.g. 3.9G for FAT32")
+	maxDuration := flags.Duration("max-duration", 0, "split the output into numbered parts of at most this duration, e.g. 1h")
+	strictTimes := flags.Bool("strict-times", false, "fail when the creation or modification time of the output cannot be set, instead of warning")
+	ignoreErrors := flags.Bool("ignore-errors", false, "salvage damaged inputs by skipping their corrupt parts, and report the duration lost")
+	finderCommentFlag := flags.Bool("finder-comment", false, "set a Finder comment on the output listing the chapters it was merged from (macOS only)")
+	copyXattrsFlag := flags.Bool("copy-xattrs", false, "copy the Finder tags and comment of the first chapter to the output")
+	keepPartial := flags.Bool("keep-partial", false, "keep the partial output of a failed merge, <output>"+partialSuffix+", for debugging")
+	maxOpenFiles := flags.Int("max-open-files", defaultMaxOpenFiles, "number of inputs checked at once before merging, lowered to what ulimit -n allows")
+	thumbnail := flags.String("thumbnail", "", "write a JPEG poster frame of the output to this file")
+	thumbnailAt := flags.Duration("thumbnail-at", time.Second, "position of the -thumbnail and -cover-art frame in the output")
+	manifest := flags.String("manifest", "", "write a text file listing where each input starts and ends in the output")
+	coverArt := flags.String("cover-art", "", "embed cover art: thm for the .THM thumbnail of the first chapter, or frame for a frame at -thumbnail-at")
+	progress := flags.Bool("progress", false, "show the progress of ffmpeg")
+	force := flags.Bool("force", false, "overwrite an existing output and the files written next to it instead of aborting")
+	allowMismatch := flags.Bool("allow-mismatch", false, "merge inputs that differ in format with stream copy anyway instead of aborting")
+	dedupeReport := flags.Bool("dedupe-report", false, "leave out inputs given more than once and list each with the input kept in its place, instead of aborting")
+	truncatedTailMode := flags.String("truncated-tail", "", "check the end of the final chapter for damage left by a dead battery, and trim the damaged end or skip the chapter: trim or skip")
+	skipBad := flags.Bool("skip-bad", false, "leave out damaged inputs, e.g. empty or unfinalized chapters, instead of aborting")
+	flags.BoolVar(skipBad, "skip-corrupt", false, "same as -skip-bad")
+	sinceLastRun := flags.Bool("since-last-run", false, "skip inputs already merged by a previous run into the output directory")
+	timelapse := flags.Bool("timelapse", false, "render GoPro time lapse photos (G0010001.JPG ...) among the inputs into a video, merged with the other inputs")
+	geotag := flags.String("geotag", "", "GPX track of a phone locating the output at its point nearest the creation time, for footage without GPS")
+	geotagOffset := flags.Duration("geotag-offset", 0, "how far the clock of the -geotag track is ahead of the camera clock, e.g. -90s when the camera runs 90 seconds fast")
+	geotagMaxGap := flags.Duration("geotag-max-gap", defaultGeotagMaxGap, "farthest the nearest -geotag point may be from the creation time")
+	metadataCSV := flags.String("metadata-csv", "", "CSV file of title, location and comment metadata by file_number, written into the output of the recording")
+	timelapseFPS := flags.String("timelapse-fps", defaultTimelapseRate, "photos per second of the video -timelapse renders, e.g. 30 or 30000/1001")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: GoProConcat [options] outputfile inputfile1 [inputfile2 ...]")
+		fmt.Fprintln(stderr, "       GoProConcat -list-only listfile [options] inputfile1 [inputfile2 ...]")
+		fmt.Fprintln(stderr, "       GoProConcat -from-list listfile [options] outputfile")
+		fmt.Fprintln(stderr, "       GoProConcat -split-chapters [options] outputdir inputfile1 [inputfile2 ...]")
+		fmt.Fprintln(stderr, "       GoProConcat -subfolders [options] outputdir inputdir")
+		fmt.Fprintln(stderr, "       GoProConcat split [options] inputfile outputdir")
+		fmt.Fprintln(stderr, "       GoProConcat info file1 [file2 ...]")
+		fmt.Fprintln(stderr, "       GoProConcat analyze [options] file1 [file2 ...]")
+		fmt.Fprintln(stderr, "       GoProConcat list-schemes")
+		fmt.Fprintln(stderr, "       GoProConcat verify file1 [file2 ...]")
+		fmt.Fprintln(stderr, "       GoProConcat -version")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if *showVersion {
+		printVersion(stdout, discardLogger)
+		return exitOK
+	}
+	if *quietSuccess && *jsonOutput {
+		fmt.Fprintln(stderr, "-quiet-success cannot be combined with -json, which prints to stdout too")
+		return exitUsage
+	}
+	// With -quiet-success, stdout only gets the paths written, every
+	// other message goes to stderr
+	paths := io.Discard
+	if *quietSuccess {
+		paths, stdout = stdout, stderr
+	}
+
+	if *listOnly != "" && *fromList != "" {
+		fmt.Fprintln(stderr, "-list-only cannot be combined with -from-list")
+		return exitUsage
+	}
+	switch {
+	case *listOnly != "" && flags.NArg() < 1,
+		*fromList != "" && flags.NArg() != 1,
+		*subfolders && flags.NArg() != 2,
+		*listOnly == "" && *fromList == "" && flags.NArg() < 2:
+		flags.Usage()
+		return exitUsage
+	}
+	if *listOnly != "" && *timelapse {
+		fmt.Fprintln(stderr, "-list-only cannot be combined with -timelapse, whose video is only rendered when merging")
+		return exitUsage
+	}
+	if *listOnly != "" && *truncatedTailMode != "" {
+		fmt.Fprintln(stderr, "-list-only cannot be combined with -truncated-tail, which only applies when merging")
+		return exitUsage
+	}
+	if err := validateTruncatedTail(*truncatedTailMode); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	if *truncatedTailMode == tailTrim && *outro != "" {
+		// The cut is taken from the end of the merge, which is the outro
+		fmt.Fprintln(stderr, "-truncated-tail trim cannot be combined with -outro, which would be cut instead of the final chapter")
+		return exitUsage
+	}
+	if *listOnly != "" && *checksum != "" {
+		fmt.Fprintln(stderr, "-list-only cannot be combined with -checksum, there is no output to hash")
+		return exitUsage
+	}
+	if *checksum != "" {
+		if err := validateChecksum(*checksum); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+
+	logger, err := newCLILogger(stderr, *logFormat, *verbose)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	opts := Options{
+		Logger:                 logger,
+		Reencode:               *reencode,
+		HWAccel:                *hwaccel,
+		Streams:                *streams,
+		Faststart:              *faststart,
+		Backend:                *backend,
+		Segmented:              *segmented,
+		VerifyTelemetry:        *verifyTelemetry,
+		TelemetryTolerance:     *telemetryTolerance,
+		TwoPass:                *twoPass,
+		Verify:                 !*noVerify,
+		VerifyFrames:           *verifyLevel == verifyDeep,
+		DurationTolerance:      *durationTolerance,
+		CheckJoins:             *checkJoinsFlag,
+		JoinThreshold:          *joinThreshold,
+		ReportGaps:             *reportGaps,
+		GapThreshold:           *gapThreshold,
+		TempDir:                *tempDir,
+		DeterministicTempNames: *stableTempNames,
+		Chapters:               *chapters,
+		Container:              *container,
+		EmbedSourceList:        *embedSourceList,
+		LoopRecording:          *loopRecording,
+		OrderBy:                *orderBy,
+		First:                  *first,
+		KeepOrder:              *fromList != "",
+		LinkSingle:             *linkSingle,
+		VideoCodec:             *videoCodec,
+		CRF:                    *crf,
+		Preset:                 *preset,
+		Bitrate:                *bitrate,
+		PreMerge:               *preMerge,
+		Force:                  *force,
+		AllowMismatch:          *allowMismatch,
+		DropAudio:              *dropAudio,
+		AudioTrack:             *audioTrack,
+		NoTelemetry:            *noTelemetry,
+		RequireTelemetry:       *requireTelemetry,
+		NoVendorMetadata:       *noVendorMetadata,
+		FixTimestamps:          *fixTimestamps,
+		IgnoreErrors:           *ignoreErrors,
+		KeepPartial:            *keepPartial,
+		FinderComment:          *finderCommentFlag,
+		StrictTimes:            *strictTimes,
+		MaxDuration:            *maxDuration,
+		AlsoOutput:             *alsoOutput,
+		MaxOpenFiles:           *maxOpenFiles,
+		FFmpegLogLevel:         *ffmpegLogLevel,
+		Thumbnail:              *thumbnail,
+		ThumbnailAt:            *thumbnailAt,
+		CoverArt:               *coverArt,
+		Manifest:               *manifest,
+		Intro:                  *intro,
+		Owner:                  *outputOwner,
+		Outro:                  *outro,
+		Proxy:                  string(proxy),
+		NormalizeAudio:         *normalizeAudio,
+		LoudnessTarget:         *loudnessTarget,
+		Rotate:                 *rotate,
+		LUT:                    *lut,
+		ProxyLUT:               *proxyLUT,
+		ResampleAudio:          *resampleAudio,
+		GeotagOffset:           *geotagOffset,
+		GeotagMaxGap:           *geotagMaxGap,
+		probes:                 newProbeCache(),
+	}
+	if *progress {
+		opts.ProgressFunc = printProgress(stderr)
+	} else if opts.VerifyFrames && isTerminal(stderr) {
+		// Hashing every frame takes a while, so its progress is shown anyway
+		printHashProgress := printProgress(stderr)
+		opts.ProgressFunc = func(p Progress) {
+			if p.Stage == stageHashInputs || p.Stage == stageHashOutput {
+				printHashProgress(p)
+			}
+		}
+	}
+	if *copyXattrsFlag {
+		opts.CopyXattrs = finderXattrs
+	}
+	if *metadataCSV != "" {
+		opts.Metadata, err = readMetadataCSV(*metadataCSV)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+	if *geotag == "" && (*geotagOffset != 0 || *geotagMaxGap != defaultGeotagMaxGap) {
+		fmt.Fprintln(stderr, "-geotag-offset and -geotag-max-gap only apply with -geotag")
+		return exitUsage
+	}
+	if *geotagMaxGap <= 0 {
+		fmt.Fprintln(stderr, "-geotag-max-gap must be positive")
+		return exitUsage
+	}
+	if *geotag != "" {
+		opts.Geotag, err = readGPX(*geotag)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+
+	if *timezone != "" {
+		opts.Location, err = time.LoadLocation(*timezone)
+		if err != nil {
+			fmt.Fprintf(stderr, "invalid timezone %q: %v\n", *timezone, err)
+			return exitUsage
+		}
+	}
+
+	if *filenamePattern != "" {
+		opts.FileNamePattern, err = compileFileNamePattern(*filenamePattern)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+
+	if *movflags != "" {
+		flags, err := parseMovflags(*movflags)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		// faststart is checked after merging, so it goes through its own option
+		for _, flag := range flags {
+			if flag == "faststart" {
+				opts.Faststart = true
+			} else {
+				opts.Movflags = append(opts.Movflags, flag)
+			}
+		}
+	}
+	overlay := TimestampOverlay{Position: *timestampPosition, FontSize: *timestampSize, Format: *timestampFormat}
+	if !*burnTimestamp && overlay != (TimestampOverlay{Position: positionBottomRight, Format: defaultTimestampFormat}) {
+		fmt.Fprintln(stderr, "-timestamp-position, -timestamp-size and -timestamp-format only apply with -burn-timestamp")
+		return exitUsage
+	}
+	if *burnTimestamp {
+		opts.BurnTimestamp = &overlay
+	}
+	var remoteTime time.Time
+	if *remoteTimeFlag != "" {
+		remoteTime, err = time.Parse(time.RFC3339, *remoteTimeFlag)
+		if err != nil {
+			fmt.Fprintf(stderr, "invalid -remote-time %q: %v\n", *remoteTimeFlag, err)
+			return exitUsage
+		}
+	}
+	if *start != "" {
+		opts.Start, err = parseTimestamp(*start)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+	if *end != "" {
+		opts.End, err = parseTimestamp(*end)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+	if *maxSize != "" {
+		opts.MaxSize, err = parseSize(*maxSize)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+	if *verifyLevel != verifyBasic && *verifyLevel != verifyDeep {
+		fmt.Fprintf(stderr, "invalid -verify %q: must be basic or deep\n", *verifyLevel)
+		return exitUsage
+	}
+	if opts.VerifyFrames && *noVerify {
+		fmt.Fprintln(stderr, "-verify deep cannot be combined with -no-verify")
+		return exitUsage
+	}
+	if len(destinations) > 0 && (opts.MaxSize > 0 || opts.MaxDuration > 0) {
+		fmt.Fprintln(stderr, "-output cannot be combined with -max-size or -max-duration")
+		return exitUsage
+	}
+	if _, err := parseFrameRate(*timelapseFPS); err != nil {
+		fmt.Fprintf(stderr, "invalid -timelapse-fps: %v\n", err)
+		return exitUsage
+	}
+	if *outputMode != "" {
+		opts.Mode, err = parseFileMode(*outputMode)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+	if opts.Owner != "" {
+		if _, _, err := lookupOwner(opts.Owner); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+
+	// Zero values stand for the defaults in Options, but not in the flags
+	for _, zero := range []struct {
+		set bool
+		err error
+	}{
+		{opts.CRF == 0, fmt.Errorf("invalid -crf 0: must be between 1 and 51")},
+		{opts.LoudnessTarget == 0, validateLoudnessTarget(0)},
+		{opts.FFmpegLogLevel == "", validateFFmpegLogLevel("")},
+		{opts.DurationTolerance == 0, fmt.Errorf("-duration-tolerance must be positive")},
+		{opts.JoinThreshold == 0, fmt.Errorf("-join-threshold must be positive")},
+		{opts.GapThreshold == 0, fmt.Errorf("-gap-threshold must be positive")},
+		{opts.MaxOpenFiles == 0, fmt.Errorf("-max-open-files must be at least 1")},
+	} {
+		if zero.set {
+			fmt.Fprintln(stderr, zero.err)
+			return exitUsage
+		}
+	}
+	if err := validateOptions(opts); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	for _, path := range []string{opts.LUT, opts.ProxyLUT} {
+		if path == "" {
+			continue
+		}
+		if err := checkCubeLUT(path); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+
+	if *splitChapters {
+		for _, conflict := range []struct {
+			flag string
+			set  bool
+		}{
+			{"-list-only", *listOnly != ""},
+			{"-output", len(destinations) > 0},
+			{"-also-output", opts.AlsoOutput != ""},
+			{"-intro", opts.Intro != ""},
+			{"-outro", opts.Outro != ""},
+			{"-start", opts.Start != 0},
+			{"-end", opts.End != 0},
+			{"-max-size", opts.MaxSize > 0},
+			{"-max-duration", opts.MaxDuration > 0},
+			{"-manifest", opts.Manifest != ""},
+			{"-thumbnail", opts.Thumbnail != ""},
+			{"-timelapse", *timelapse},
+			{"-since-last-run", *sinceLastRun},
+			{"-json", *jsonOutput},
+			{"-checksum", *checksum != ""},
+			{"-truncated-tail", *truncatedTailMode != ""},
+			{"-first", opts.First != ""},
+		} {
+			if conflict.set {
+				fmt.Fprintf(stderr, "-split-chapters cannot be combined with %s\n", conflict.flag)
+				return exitUsage
+			}
+		}
+	}
+	if *keepGoing && !*splitChapters && !*subfolders {
+		fmt.Fprintln(stderr, "-keep-going only applies to the several outputs of -split-chapters or -subfolders")
+		return exitUsage
+	}
+	if *subfolders {
+		for _, conflict := range []struct {
+			flag string
+			set  bool
+		}{
+			{"-list-only", *listOnly != ""},
+			{"-from-list", *fromList != ""},
+			{"-split-chapters", *splitChapters},
+			{"-output", len(destinations) > 0},
+			{"-also-output", opts.AlsoOutput != ""},
+			{"-start", opts.Start != 0},
+			{"-end", opts.End != 0},
+			{"-manifest", opts.Manifest != ""},
+			{"-thumbnail", opts.Thumbnail != ""},
+			{"-timelapse", *timelapse},
+			{"-since-last-run", *sinceLastRun},
+			{"-json", *jsonOutput},
+			{"-checksum", *checksum != ""},
+			{"-truncated-tail", *truncatedTailMode != ""},
+			{"-first", opts.First != ""},
+		} {
+			if conflict.set {
+				fmt.Fprintf(stderr, "-subfolders cannot be combined with %s\n", conflict.flag)
+				return exitUsage
+			}
+		}
+	}
+
+	outputPath, args := flags.Arg(0), flags.Args()[1:]
+	if *listOnly != "" {
+		// Nothing is merged to copy to the destinations
+		outputPath, args, destinations = *listOnly, flags.Args(), nil
+		opts.AlsoOutput = ""
+	}
+	if opts.AlsoOutput != "" && destinationPath(outputPath, opts.AlsoOutput) == filepath.Clean(outputPath) {
+		fmt.Fprintln(stderr, "-also-output must not be the output itself")
+		return exitUsage
+	}
+	// The outputs of -split-chapters and -subfolders are checked once they are named
+	if (!*dryRun || *listOnly != "") && !*splitChapters && !*subfolders {
+		checked := append([]string{outputPath}, destinations...)
+		if opts.AlsoOutput != "" {
+			checked = append(checked, opts.AlsoOutput)
+		}
+		for _, path := range checked {
+			if err := checkOutputNew(destinationPath(outputPath, path), *force); err != nil {
+				fmt.Fprintln(stderr, err)
+				return exitError
+			}
+		}
+		// The files written next to the output are refused the same way
+		var sidecars []string
+		if *listOnly == "" && opts.Thumbnail != "" {
+			sidecars = append(sidecars, opts.Thumbnail)
+		}
+		if *listOnly == "" && opts.Proxy != "" {
+			sidecars = append(sidecars, proxyPath(outputPath))
+		}
+		if *listOnly == "" && (opts.MaxSize > 0 || opts.MaxDuration > 0) {
+			sidecars = append(sidecars, existingParts(outputPath)...)
+		}
+		for _, path := range sidecars {
+			if err := checkOutputNew(path, *force); err != nil {
+				fmt.Fprintln(stderr, err)
+				return exitError
+			}
+		}
+	}
+	var inputPaths []string
+	if *fromList != "" {
+		inputPaths, err = readConcatList(*fromList)
+	} else if !*subfolders {
+		inputPaths, err = expandInputs(args, *timelapse, opts.fileNamePattern())
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		if errors.Is(err, errNoInputFiles) {
+			return exitNoInput
+		}
+		return exitError
+	}
+
+	if *listOnly != "" {
+		files, err := orderFiles(inputPaths, opts)
+		if err == nil {
+			err = writeConcatList(*listOnly, files)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+		fmt.Fprintf(stdout, "Concat list of %d file(s) written to %s\n", len(files), *listOnly)
+		fmt.Fprintln(paths, *listOnly)
+		return exitOK
+	}
+
+	err = checkRequirements()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	if opts.HWAccel != "" {
+		if !opts.Reencode {
+			fmt.Fprintln(stderr, "-hwaccel only applies when re-encoding. Please add -reencode")
+			return exitUsage
+		}
+		err = validateHWAccel(opts.HWAccel)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+	if opts.Reencode {
+		opts, err = checkEncoder(opts)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitError
+		}
+	}
+
+	if *subfolders {
+		jobs, skipped, err := planSubfolders(outputPath, args[0], opts)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			if errors.Is(err, errNoInputFiles) {
+				return exitNoInput
+			}
+			return exitError
+		}
+		for _, dir := range skipped {
+			fmt.Fprintf(stdout, "Skipping %s: no GoPro files\n", dir)
+		}
+		if *dryRun || *verbose {
+			printRecordingJobs(stdout, jobs)
+		}
+		if *dryRun {
+			return exitOK
+		}
+		// With -keep-going an existing output fails only its own job
+		for _, job := range jobs {
+			if err := checkOutputNew(job.Output, *force); err != nil && !*keepGoing {
+				fmt.Fprintln(stderr, err)
+				return exitError
+			}
+		}
+		if err := os.MkdirAll(outputPath, 0755); err != nil {
+			fmt.Fprintf(stderr, "Error creating output directory: %v\n", err)
+			return exitError
+		}
+		results := mergeSubfolders(jobs, remoteTime, opts)
+		if failed := printRecordingResults(stdout, stderr, results); failed > 0 {
+			fmt.Fprintf(stderr, "%d of %d recording(s) failed\n", failed, len(results))
+			return exitError
+		}
+		fmt.Fprintf(stdout, "%d recording(s) merged successfully\n", len(results))
+		for _, result := range results {
+			fmt.Fprintln(paths, result.Output)
+		}
+		return exitOK
+	}
+
+	inputPaths, duplicates := findDuplicates(inputPaths)
+	if len(duplicates) > 0 {
+		if !*dedupeReport {
+			printDuplicates(stderr, duplicates)
+			fmt.Fprintln(stderr, "Nothing was merged. Use -dedupe-report to merge without the duplicates")
+			return exitError
+		}
+		// A printed plan carries the report instead
+		if !*verbose && !*dryRun && !*jsonOutput {
+			printDuplicates(stdout, duplicates)
+		}
+	}
+
+	statePath := stateFilePath(outputPath)
+	if *sinceLastRun {
+		remaining, skipped, err := filterProcessed(statePath, inputPaths)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error reading previous runs: %v\n", err)
+			return exitError
+		}
+		for _, path := range skipped {
+			fmt.Fprintf(stdout, "Skipping already merged file: %s\n", path)
+		}
+		if len(remaining) == 0 {
+			fmt.Fprintln(stdout, "All input files were already merged by a previous run")
+			return exitOK
+		}
+		inputPaths = remaining
+	}
+
+	inputPaths, sequences, err := findImageSequences(inputPaths)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	if len(sequences) > 0 && !*timelapse {
+		fmt.Fprintf(stderr, "%s is a time lapse photo. Use -timelapse to render the photos into a video\n", sequences[0].Frames[0])
+		return exitUsage
+	}
+
+	if len(inputPaths) > manyInputs {
+		fmt.Fprintf(stderr, "WARNING: merging %d inputs, which are checked %d at a time (-max-open-files). -reencode would open all of them at once\n", len(inputPaths), opts.maxOpenFiles())
+	}
+	good, bad := preflightInputs(inputPaths, opts)
+	if len(bad) > 0 {
+		printBadInputs(stderr, bad)
+		if !*skipBad {
+			fmt.Fprintln(stderr, "Nothing was merged. Use -skip-bad to merge the other inputs without the damaged ones")
+			return exitError
+		}
+		if len(good) == 0 {
+			fmt.Fprintln(stderr, "No undamaged input is left to merge")
+			return exitNoInput
+		}
+		fmt.Fprintf(stderr, "WARNING: merging without %d damaged input(s) because of -skip-bad, the output has a gap where they were\n", len(bad))
+		inputPaths = good
+	}
+
+	if *truncatedTailMode != "" {
+		files, err := orderFiles(inputPaths, opts)
+		var tail *truncatedTail
+		if err == nil {
+			tail, err = checkTail(files[len(files)-1].Path, opts)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "Error checking the final chapter: %v\n", err)
+			return exitError
+		}
+		// Nothing is left to trim of a chapter damaged all along
+		if tail != nil && (*truncatedTailMode == tailSkip || tail.Valid == 0) {
+			fmt.Fprintf(stderr, "WARNING: leaving out the final chapter %s because of -truncated-tail, %s\n", tail.Path, tail.Problem)
+			// The inputs may be relative or directories, the ordered files are not
+			inputPaths = nil
+			for _, file := range files[:len(files)-1] {
+				inputPaths = append(inputPaths, file.Path)
+			}
+			if len(inputPaths) == 0 {
+				fmt.Fprintln(stderr, "No undamaged input is left to merge")
+				return exitNoInput
+			}
+		} else if tail != nil {
+			cut := tail.Duration - tail.Valid
+			fmt.Fprintf(stderr, "WARNING: trimming the last %s of the final chapter %s because of -truncated-tail, %s\n", cut.Round(time.Millisecond), tail.Path, tail.Problem)
+			// An end counted from the start stays where it was asked for
+			if opts.End <= 0 {
+				opts.End -= cut
+			}
+		}
+	}
+
+	// The photos of a time lapse are recorded as merged, not its video.
+	// The inputs left out above are not, so that the next run retries them.
+	mergedPaths := slices.Clone(inputPaths)
+	for _, sequence := range sequences {
+		mergedPaths = append(mergedPaths, sequence.Frames...)
+	}
+
+	settingDifferences := checkSettings(inputPaths, opts)
+
+	if len(sequences) > 0 {
+		dir, err := os.MkdirTemp(opts.TempDir, "timelapse-")
+		if err != nil {
+			fmt.Fprintf(stderr, "Error creating temp directory: %v\n", err)
+			return exitError
+		}
+		defer os.RemoveAll(dir)
+		var chapter *ProbeResult
+		if len(inputPaths) > 0 {
+			probe, err := opts.probe(inputPaths[0])
+			if err != nil {
+				fmt.Fprintf(stderr, "Error rendering time lapse: %v\n", err)
+				return exitError
+			}
+			chapter = &probe
+		}
+		videos, err := renderTimelapses(dir, sequences, chapter, *timelapseFPS, opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error rendering time lapse: %v\n", err)
+			return exitError
+		}
+		inputPaths = append(inputPaths, videos...)
+	}
+
+	if *splitChapters {
+		jobs, err := planChapters(outputPath, inputPaths, remoteTime, opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error planning chapters: %v\n", err)
+			return exitError
+		}
+		if *dryRun || *verbose {
+			printChapterJobs(stdout, jobs)
+		}
+		if *dryRun {
+			return exitOK
+		}
+		// With -keep-going an existing output fails only its own job
+		for _, job := range jobs {
+			if err := checkOutputNew(job.Output, *force); err != nil && !*keepGoing {
+				fmt.Fprintln(stderr, err)
+				return exitError
+			}
+		}
+		if err := os.MkdirAll(outputPath, 0755); err != nil {
+			fmt.Fprintf(stderr, "Error creating output directory: %v\n", err)
+			return exitError
+		}
+		results := remuxChapters(jobs, opts)
+		if failed := printChapterResults(stdout, stderr, results); failed > 0 {
+			fmt.Fprintf(stderr, "%d of %d chapter(s) failed\n", failed, len(results))
+			return exitError
+		}
+		fmt.Fprintf(stdout, "%d chapter(s) remuxed successfully\n", len(results))
+		for _, result := range results {
+			fmt.Fprintln(paths, result.Output)
+		}
+		return exitOK
+	}
+
+	creationTime, modTime, err := inputFileTimes(inputPaths, remoteTime)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error getting file times: %v\n", err)
+		return exitError
+	}
+	// The recording starts with the pinned chapter, even if another one
+	// claims to be older
+	if opts.First != "" {
+		files, err := orderFiles(inputPaths, opts)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		creationTime, _, err = inputFileTimes([]string{files[0].Path}, remoteTime)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error getting file times: %v\n", err)
+			return exitError
+		}
+	}
+
+	if *printHiLightsFlag {
+		files, err := orderFiles(inputPaths, opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error reading HiLights: %v\n", err)
+			return exitError
+		}
+		hilights, _, err := mergedHiLights(files, opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error reading HiLights: %v\n", err)
+			return exitError
+		}
+		printHiLights(stdout, hilights)
+	}
+
+	if *verbose || *dryRun || *jsonOutput {
+		plan, err := buildPlan(outputPath, inputPaths, creationTime, modTime, opts)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error building merge plan: %v\n", err)
+			return exitError
+		}
+		plan.Duplicates = duplicates
+		if *jsonOutput {
+			err = printPlanJSON(stdout, plan)
+		} else {
+			printPlan(stdout, plan)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "Error printing merge plan: %v\n", err)
+			return exitError
+		}
+		if *dryRun {
+			return exitOK
+		}
+	}
+
+	var loss string
+	if opts.IgnoreErrors {
+		opts.LossFunc = func(expected, actual time.Duration) {
+			loss = formatLoss(expected, actual)
+		}
+	}
+
+	var trim string
+	opts.TrimFunc = func(start, end time.Duration) {
+		trim = trimRange{Start: start, RequestedStart: opts.Start, End: end}.String()
+	}
+
+	var parts []Part
+	opts.PartsFunc = func(p []Part) {
+		parts = p
+	}
+
+	var durations string
+	report := mergeReport{Output: outputPath, SettingWarnings: settingDifferences, Rotation: opts.Rotate, LUT: opts.LUT, ProxyLUT: opts.ProxyLUT, BurnTimestamp: opts.BurnTimestamp}
+	opts.DurationFunc = func(expected, actual time.Duration) {
+		durations = formatDurationCheck(expected, actual)
+		report.ExpectedDuration, report.OutputDuration = expected.Seconds(), actual.Seconds()
+	}
+
+	var drifts []JoinDrift
+	joinsChecked := false
+	opts.JoinsFunc = func(d []JoinDrift) {
+		drifts, joinsChecked = d, true
+	}
+
+	var gaps []ChapterGap
+	gapsChecked := false
+	opts.GapsFunc = func(g []ChapterGap) {
+		gaps, gapsChecked = g, true
+	}
+
+	opts.LoudnessFunc = func(l Loudness) {
+		report.Loudness = &l
+	}
+
+	opts.GeotagFunc = func(m GeotagMatch) {
+		report.Geotag = &m
+	}
+
+	opts.FramesFunc = func(c FrameCheck) {
+		report.Frames = &c
+	}
+
+	var alsoOutputErr error
+	opts.AlsoOutputFunc = func(path string, err error) {
+		report.AlsoOutput, alsoOutputErr = path, err
+		if err != nil {
+			report.AlsoOutputError = err.Error()
+		}
+	}
+
+	var proxyWritten string
+	opts.ProxyFunc = func(path string) {
+		proxyWritten = path
+	}
+
+	var ffmpegWarnings []string
+	if !showsFFmpegWarnings(opts.FFmpegLogLevel) {
+		opts.Logger = hideFFmpegWarnings(opts.Logger)
+	}
+	opts.Logger = collectFFmpegWarnings(opts.Logger, &ffmpegWarnings)
+	err = mergeFiles(outputPath, inputPaths, creationTime, modTime, opts)
+	printFFmpegWarnings(stderr, ffmpegWarnings, inputPaths)
+	printSettingDifferences(stderr, settingDifferences)
+	var checksumErr error
+	if err == nil && *checksum != "" {
+		// mergeFiles has renamed the output into place by now
+		report.Checksums, checksumErr = writeChecksums(outputPath, parts, *checksum, stderr)
+	}
+	if *jsonOutput {
+		if err := printMergeReportJSON(stdout, report, inputPaths, ffmpegWarnings, err); err != nil {
+			fmt.Fprintf(stderr, "Error printing merge report: %v\n", err)
+			return exitError
+		}
+	}
+	if !opts.FixTimestamps && suggestFixTimestamps(ffmpegWarnings) {
+		fmt.Fprintln(stderr, "These warnings point at broken timestamps in the inputs, which can make the audio drift. Try merging again with -fix-timestamps")
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error merging files: %v\n", err)
+		return exitError
+	}
+	if checksumErr != nil {
+		fmt.Fprintf(stderr, "The output was written to %s, but its checksum failed: %v\n", outputPath, checksumErr)
+		return exitError
+	}
+
+	if *sinceLastRun {
+		err = recordProcessed(statePath, mergedPaths)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error recording merged files: %v\n", err)
+			return exitError
+		}
+	}
+
+	fmt.Fprintln(stdout, "Files merged successfully")
+	if trim != "" {
+		fmt.Fprintf(stdout, "Output trimmed to %s\n", trim)
+	}
+	if len(parts) > 0 {
+		fmt.Fprintf(stdout, "Output split into %d part(s):\n", len(parts))
+		for _, part := range parts {
+			fmt.Fprintf(stdout, "  %s  %s\n", filepath.Base(part.Path), formatOffset(part.Duration))
+		}
+	}
+	if report.Loudness != nil {
+		fmt.Fprintf(stdout, "Audio normalized to %s, re-encoded to AAC (lossy)\n", report.Loudness)
+	}
+	if opts.LUT != "" {
+		fmt.Fprintf(stdout, "Video graded with the LUT %s while re-encoding\n", opts.LUT)
+	}
+	if report.Geotag != nil {
+		fmt.Fprintf(stdout, "Geotagged at %s\n", report.Geotag)
+	}
+	if opts.BurnTimestamp != nil {
+		fmt.Fprintf(stdout, "Recording time burnt into the %s corner of the video\n", opts.BurnTimestamp.Position)
+	}
+	if opts.Rotate != 0 {
+		fmt.Fprintf(stdout, "Video rotated %d° clockwise in its display matrix, without re-encoding\n", opts.Rotate)
+	}
+	if proxyWritten != "" {
+		fmt.Fprintf(stdout, "Editing proxy written to %s\n", proxyWritten)
+		if opts.ProxyLUT != "" {
+			fmt.Fprintf(stdout, "Editing proxy graded with the LUT %s\n", opts.ProxyLUT)
+		}
+	}
+	for _, result := range report.Checksums {
+		fmt.Fprintf(stdout, "%s checksum written to %s\n", result.Algorithm, result.Sidecar)
+	}
+	if loss != "" {
+		fmt.Fprintf(stdout, "Errors in the inputs were ignored (-ignore-errors): %s\n", loss)
+	}
+	if durations != "" {
+		fmt.Fprintf(stdout, "Duration verified: %s\n", durations)
+	}
+	if report.Frames != nil {
+		fmt.Fprintf(stdout, "Frames verified: %d video and audio frames of the output match the inputs bit for bit\n", report.Frames.Frames)
+	}
+	if joinsChecked {
+		printJoinDrifts(stdout, drifts, opts.joinThreshold())
+	}
+	if gapsChecked {
+		printGaps(stdout, gaps, opts.gapThreshold(), opts.location())
+	}
+	if opts.NoTelemetry {
+		fmt.Fprintln(stdout, "Telemetry (GPMF data including GPS) was removed from the output")
+	}
+	if report.AlsoOutput != "" && alsoOutputErr == nil {
+		fmt.Fprintf(stdout, "Also written to %s\n", report.AlsoOutput)
+	}
+	if alsoOutputErr != nil {
+		fmt.Fprintf(stderr, "Error writing the second output %s: %v\n", report.AlsoOutput, alsoOutputErr)
+		fmt.Fprintf(stderr, "The output was written to %s, but not its second output\n", outputPath)
+	}
+	if len(destinations) > 0 {
+		results := copyToDestinations(outputPath, destinations, creationTime, modTime, opts)
+		if failed := printDestinations(stdout, stderr, results); failed > 0 {
+			fmt.Fprintf(stderr, "The output was written to %s, but %d of %d other destination(s) failed\n", outputPath, failed, len(results))
+			return exitError
+		}
+	}
+	if alsoOutputErr != nil {
+		return exitError
+	}
+	if len(parts) > 0 {
+		for _, part := range parts {
+			fmt.Fprintln(paths, part.Path)
+		}
+	} else {
+		fmt.Fprintln(paths, outputPath)
+	}
+	return exitOK
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
 }
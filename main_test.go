@@ -1,19 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/djherbis/times"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
 
 func createTestVideoFile(name string) (*os.File, error) {
+	return createTestVideoFileIn(os.TempDir(), name)
+}
+
+func createTestVideoFileIn(dir, name string) (*os.File, error) {
 	// Create a temporary file with a specific name format
-	tempDir := os.TempDir()
-	tempFilePath := tempDir + "/" + name + ".mp4"
+	tempFilePath := dir + "/" + name + ".mp4"
 	tempFile, err := os.Create(tempFilePath)
 	if err != nil {
 		return nil, err
@@ -103,7 +112,7 @@ func TestMergeFiles(t *testing.T) {
 	modTime := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
 
 	// Test mergeFiles function
-	err = mergeFiles(outputFile.Name(), inputPaths, creationTime, modTime)
+	err = mergeFiles(outputFile.Name(), inputPaths, creationTime, modTime, Options{})
 	if err != nil {
 		t.Errorf("mergeFiles() error: %v", err)
 	}
@@ -143,7 +152,7 @@ func TestDuplicateFiles(t *testing.T) {
 	modTime := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
 
 	// Test mergeFiles function with duplicate files
-	err = mergeFiles(outputFile.Name(), inputPaths, creationTime, modTime)
+	err = mergeFiles(outputFile.Name(), inputPaths, creationTime, modTime, Options{})
 	if err == nil {
 		t.Errorf("Expected error due to duplicate files, but got none")
 	} else if !strings.Contains(err.Error(), "duplicate file detected") {
@@ -172,7 +181,7 @@ func TestSingleFileMerge(t *testing.T) {
 	modTime := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
 
 	// Test mergeFiles function with a single file
-	err = mergeFiles(outputFile.Name(), inputPaths, creationTime, modTime)
+	err = mergeFiles(outputFile.Name(), inputPaths, creationTime, modTime, Options{})
 	if err != nil {
 		t.Errorf("mergeFiles() error: %v", err)
 	}
@@ -196,3 +205,505 @@ func TestSingleFileMerge(t *testing.T) {
 		t.Errorf("Expected output file modification time %v, got %v", inputInfo.ModTime(), outputInfo.ModTime())
 	}
 }
+
+func TestNeedsRemux(t *testing.T) {
+	copied := []Options{
+		{Container: containerMP4},
+		// Options that leave the output bytes as they are
+		{Container: containerMP4, LinkSingle: true, Mode: 0644, Proxy: proxy1080p, Thumbnail: "thumb.jpg", Streams: streamsAll},
+	}
+	for _, opts := range copied {
+		if needsRemux(opts) {
+			t.Errorf("Expected a single input to be copied with %+v", opts)
+		}
+	}
+
+	for name, opts := range map[string]Options{
+		"reencode":           {Reencode: true},
+		"container":          {Container: containerMOV},
+		"intro":              {Intro: "intro.mp4"},
+		"outro":              {Outro: "outro.mp4"},
+		"max-size":           {MaxSize: 4 << 30},
+		"max-duration":       {MaxDuration: time.Hour},
+		"start":              {Start: time.Minute},
+		"end":                {End: -time.Minute},
+		"streams":            {Streams: streamsEssential},
+		"no-telemetry":       {NoTelemetry: true},
+		"drop-audio":         {DropAudio: true},
+		"audio-track":        {AudioTrack: 2},
+		"normalize-audio":    {NormalizeAudio: true},
+		"faststart":          {Faststart: true},
+		"movflags":           {Movflags: []string{"frag_keyframe"}},
+		"chapters":           {Chapters: true},
+		"embed-source-list":  {EmbedSourceList: true},
+		"fix-timestamps":     {FixTimestamps: true},
+		"no-vendor-metadata": {NoVendorMetadata: true},
+		"metadata-csv":       {Metadata: map[int]RecordingMetadata{}},
+		"geotag":             {Geotag: []TrackPoint{{}}},
+		"rotate":             {Rotate: 90},
+		"lut":                {LUT: "protune.cube"},
+		"burn-timestamp":     {BurnTimestamp: &TimestampOverlay{}},
+		"split-chapters":     {remux: true},
+	} {
+		if opts.Container == "" {
+			opts.Container = containerMP4
+		}
+		if !needsRemux(opts) {
+			t.Errorf("Expected a single input to be remuxed with -%s", name)
+		}
+	}
+}
+
+func TestConcurrentMergeFiles(t *testing.T) {
+	// Run with -race to catch shared state between merges
+	const merges = 4
+
+	type mergeJob struct {
+		outputPath string
+		inputPaths []string
+		modTime    time.Time
+	}
+	jobs := make([]mergeJob, merges)
+	for i := range jobs {
+		dir := t.TempDir()
+		for chapter := 1; chapter <= 2; chapter++ {
+			inputFile, err := createTestVideoFileIn(dir, fmt.Sprintf("GH%02d%04d", chapter, i))
+			if err != nil {
+				t.Fatalf("Failed to create temp video file: %v", err)
+			}
+			inputFile.Close()
+			jobs[i].inputPaths = append(jobs[i].inputPaths, inputFile.Name())
+		}
+		jobs[i].outputPath = filepath.Join(dir, "merged.mp4")
+		jobs[i].modTime = time.Date(2021, time.January, i+1, 0, 0, 0, 0, time.UTC)
+	}
+
+	creationTime := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	errs := make([]error, merges)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job mergeJob) {
+			defer wg.Done()
+			errs[i] = mergeFiles(job.outputPath, job.inputPaths, creationTime, job.modTime, Options{})
+		}(i, job)
+	}
+	wg.Wait()
+
+	// Each output must exist with its own timestamps
+	for i, job := range jobs {
+		if errs[i] != nil {
+			t.Errorf("mergeFiles() error for merge %d: %v", i, errs[i])
+			continue
+		}
+
+		info, err := os.Stat(job.outputPath)
+		if err != nil {
+			t.Errorf("Failed to stat output file %s: %v", job.outputPath, err)
+			continue
+		}
+		if info.Size() == 0 {
+			t.Errorf("Expected non-empty output file %s", job.outputPath)
+		}
+		if !info.ModTime().Equal(job.modTime) {
+			t.Errorf("Expected modification time %v for %s, got %v", job.modTime, job.outputPath, info.ModTime())
+		}
+	}
+}
+
+func TestOutputIsInput(t *testing.T) {
+	// Create temporary input files for testing
+	tempFile1, err := createTestVideoFile("GH011234")
+	if err != nil {
+		t.Fatalf("Failed to create temp video file 1: %v", err)
+	}
+	defer os.Remove(tempFile1.Name())
+
+	tempFile2, err := createTestVideoFile("GH021234")
+	if err != nil {
+		t.Fatalf("Failed to create temp video file 2: %v", err)
+	}
+	defer os.Remove(tempFile2.Name())
+
+	originalInfo, err := os.Stat(tempFile2.Name())
+	if err != nil {
+		t.Fatalf("Failed to stat input file: %v", err)
+	}
+
+	inputPaths := []string{tempFile1.Name(), tempFile2.Name()}
+	creationTime := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	modTime := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	// Test mergeFiles function with the output pointing at an input
+	err = mergeFiles(tempFile2.Name(), inputPaths, creationTime, modTime, Options{})
+	if err == nil {
+		t.Errorf("Expected error due to output being an input, but got none")
+	} else if !strings.Contains(err.Error(), "is also an input file") {
+		t.Errorf("Expected error message to contain 'is also an input file', but got: %v", err)
+	}
+
+	// The input must be left untouched
+	info, err := os.Stat(tempFile2.Name())
+	if err != nil {
+		t.Fatalf("Failed to stat input file: %v", err)
+	}
+	if info.Size() != originalInfo.Size() || !info.ModTime().Equal(originalInfo.ModTime()) {
+		t.Errorf("Expected input file to be unchanged")
+	}
+
+	// The same applies to the single-file copy path, through a relative path
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	relPath, err := filepath.Rel(wd, tempFile1.Name())
+	if err != nil {
+		t.Fatalf("Failed to get relative path: %v", err)
+	}
+	err = mergeFiles(relPath, []string{tempFile1.Name()}, creationTime, modTime, Options{})
+	if err == nil || !strings.Contains(err.Error(), "is also an input file") {
+		t.Errorf("Expected error due to output being the single input, but got: %v", err)
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	// Too few arguments
+	code := run([]string{"merged.mp4"}, &stdout, &stderr)
+	if code != exitUsage {
+		t.Errorf("Expected exit code %d, got %d", exitUsage, code)
+	}
+	if !strings.Contains(stderr.String(), "Usage: GoProConcat") {
+		t.Errorf("Expected usage on stderr, got: %s", stderr.String())
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Expected no output on stdout, got: %s", stdout.String())
+	}
+
+	// Unknown flag
+	stderr.Reset()
+	code = run([]string{"-no-such-flag", "merged.mp4", "GH011234.MP4"}, &stdout, &stderr)
+	if code != exitUsage {
+		t.Errorf("Expected exit code %d for unknown flag, got %d", exitUsage, code)
+	}
+}
+
+func TestRunMissingFiles(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	dir := t.TempDir()
+
+	code := run([]string{filepath.Join(dir, "merged.mp4"), filepath.Join(dir, "GH011234.MP4"), filepath.Join(dir, "GH021234.MP4")}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("Expected exit code %d, got %d", exitError, code)
+	}
+	if !strings.Contains(stderr.String(), "failed to stat input file") {
+		t.Errorf("Expected missing file error on stderr, got: %s", stderr.String())
+	}
+	if strings.Contains(stdout.String(), "Files merged successfully") {
+		t.Errorf("Expected no success message, got: %s", stdout.String())
+	}
+}
+
+func TestRunMerge(t *testing.T) {
+	dir := t.TempDir()
+	tempFile1, err := createTestVideoFileIn(dir, "GH011234")
+	if err != nil {
+		t.Fatalf("Failed to create temp video file 1: %v", err)
+	}
+	tempFile1.Close()
+
+	tempFile2, err := createTestVideoFileIn(dir, "GH021234")
+	if err != nil {
+		t.Fatalf("Failed to create temp video file 2: %v", err)
+	}
+	tempFile2.Close()
+
+	outputPath := filepath.Join(dir, "merged.mp4")
+	var stdout, stderr bytes.Buffer
+	code := run([]string{outputPath, tempFile2.Name(), tempFile1.Name()}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("Expected exit code %d, got %d (stderr: %s)", exitOK, code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Files merged successfully") {
+		t.Errorf("Expected success message on stdout, got: %s", stdout.String())
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to stat output file: %v", err)
+	}
+	if info.Size() == 0 {
+		t.Errorf("Expected non-empty output file")
+	}
+}
+
+func TestMergeArgsFaststart(t *testing.T) {
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4"}
+
+	args := strings.Join(mergeArgs(spec, Options{Faststart: true}), " ")
+	if !strings.Contains(args, "-movflags +faststart") {
+		t.Errorf("Expected -movflags +faststart in command, got: %s", args)
+	}
+
+	args = strings.Join(mergeArgs(spec, Options{}), " ")
+	if strings.Contains(args, "faststart") {
+		t.Errorf("Expected no faststart by default, got: %s", args)
+	}
+}
+
+func TestMergeArgsTimezone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("timezone database not available: %v", err)
+	}
+	creationTime := time.Date(2024, time.May, 1, 12, 30, 0, 0, time.UTC)
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4", CreationTime: creationTime}
+
+	args := strings.Join(mergeArgs(spec, Options{Location: tokyo}), " ")
+	if !strings.Contains(args, "-metadata creation_time=2024-05-01T21:30:00+09:00") {
+		t.Errorf("Expected creation time in Asia/Tokyo, got: %s", args)
+	}
+	if !strings.Contains(args, "-metadata:s creation_time=2024-05-01T21:30:00+09:00") {
+		t.Errorf("Expected the creation time of every track, got: %s", args)
+	}
+
+	args = strings.Join(mergeArgs(spec, Options{Location: time.UTC}), " ")
+	if !strings.Contains(args, "-metadata creation_time=2024-05-01T12:30:00Z") {
+		t.Errorf("Expected creation time in UTC, got: %s", args)
+	}
+}
+
+func TestRunInvalidTimezone(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-timezone", "Mars/Olympus_Mons", "out.mp4", "GH011234.MP4"}, &stdout, &stderr)
+	if code != exitUsage {
+		t.Errorf("Expected exit code %d, got %d", exitUsage, code)
+	}
+	if !strings.Contains(stderr.String(), "invalid timezone") {
+		t.Errorf("Expected invalid timezone error, got: %s", stderr.String())
+	}
+}
+
+func TestRunEmptyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	// Files that are not GoPro chapters are ignored
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{filepath.Join(dir, "merged.mp4"), dir}, &stdout, &stderr)
+	if code != exitNoInput {
+		t.Errorf("Expected exit code %d, got %d", exitNoInput, code)
+	}
+	if !strings.Contains(stderr.String(), "no GoPro files found") {
+		t.Errorf("Expected no GoPro files error, got: %s", stderr.String())
+	}
+}
+
+func TestExpandInputs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"GH020042.MP4", "GH010042.mp4", "GOPR0042.JPG"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inputs, err := expandInputs([]string{dir, "GX011234.MP4"}, false, defaultFileNamePattern)
+	if err != nil {
+		t.Fatalf("expandInputs() error: %v", err)
+	}
+	expected := []string{filepath.Join(dir, "GH010042.mp4"), filepath.Join(dir, "GH020042.MP4"), "GX011234.MP4"}
+	if strings.Join(inputs, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, inputs)
+	}
+}
+
+func TestSourceListComment(t *testing.T) {
+	files, err := collectFiles([]string{"GH020001.MP4", "GH010001.MP4"}, defaultFileNamePattern)
+	if err != nil {
+		t.Fatalf("collectFiles() error: %v", err)
+	}
+	if got := sourceListComment(files); got != "merged from: GH010001.MP4, GH020001.MP4" {
+		t.Errorf("Unexpected comment %q", got)
+	}
+
+	// Long lists are cut short and say how many names are missing
+	var inputPaths []string
+	for chapter := 1; chapter <= 30; chapter++ {
+		inputPaths = append(inputPaths, formatFileName("GX", chapter, 1))
+	}
+	files, err = collectFiles(inputPaths, defaultFileNamePattern)
+	if err != nil {
+		t.Fatalf("collectFiles() error: %v", err)
+	}
+	comment := sourceListComment(files)
+	if len(comment) > maxSourceListLength {
+		t.Errorf("Expected at most %d characters, got %d: %q", maxSourceListLength, len(comment), comment)
+	}
+	if !strings.HasPrefix(comment, "merged from: GX010001.MP4, GX020001.MP4") || !strings.HasSuffix(comment, "GX160001.MP4 and 14 more") {
+		t.Errorf("Unexpected truncated comment %q", comment)
+	}
+
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4", Comment: sourceListComment(files[:2])}
+	args := mergeArgs(spec, Options{})
+	if indexOf(args, "comment=merged from: GX010001.MP4, GX020001.MP4") < 0 {
+		t.Errorf("Expected the source list comment in command, got: %v", args)
+	}
+}
+
+func TestLinkSingle(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "GH011234.MP4")
+	if err := os.WriteFile(inputPath, []byte("chapter"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+	creationTime := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	modTime := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	origRunCommand := runCommand
+	origHardLink := hardLink
+	defer func() {
+		runCommand = origRunCommand
+		hardLink = origHardLink
+	}()
+	var commands []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		commands = append(commands, cmd.Args[0])
+		return nil
+	}
+
+	err := mergeFiles(outputPath, []string{inputPath}, creationTime, modTime, Options{LinkSingle: true})
+	if err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	inputInfo, _ := os.Stat(inputPath)
+	outputInfo, err := os.Stat(outputPath)
+	if err != nil || !os.SameFile(inputInfo, outputInfo) {
+		t.Errorf("Expected the output to be a hard link to the input, got: %v", err)
+	}
+	// Changing the times of a link would change the input
+	if len(commands) != 0 || !outputInfo.ModTime().Equal(inputInfo.ModTime()) {
+		t.Errorf("Expected the link to keep the input times, ran %v", commands)
+	}
+
+	// A file named like the temporary link is left alone
+	stray := outputPath + ".link"
+	if err := os.WriteFile(stray, []byte("not ours"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(outputPath)
+	if err := mergeFiles(outputPath, []string{inputPath}, creationTime, modTime, Options{LinkSingle: true}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if data, err := os.ReadFile(stray); err != nil || string(data) != "not ours" {
+		t.Errorf("Expected %s to be kept, got %q: %v", stray, data, err)
+	}
+
+	// Other failures to link are errors, not a reason to copy
+	os.Remove(outputPath)
+	hardLink = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EACCES}
+	}
+	err = mergeFiles(outputPath, []string{inputPath}, creationTime, modTime, Options{LinkSingle: true})
+	if err == nil || !strings.Contains(err.Error(), "failed to link") {
+		t.Errorf("Expected the failure to link to be returned, got %v", err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no output after the failure, got %v", err)
+	}
+
+	// Across file systems the input is copied and the copy gets the times
+	os.Remove(outputPath)
+	hardLink = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	err = mergeFiles(outputPath, []string{inputPath}, creationTime, modTime, Options{LinkSingle: true})
+	if err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	outputInfo, err = os.Stat(outputPath)
+	if err != nil || os.SameFile(inputInfo, outputInfo) {
+		t.Fatalf("Expected a copy of the input, got: %v", err)
+	}
+	if !outputInfo.ModTime().Equal(modTime) {
+		t.Errorf("Expected modification time %v on the copy, got %v", modTime, outputInfo.ModTime())
+	}
+	if len(commands) != 1 || commands[0] != "SetFile" {
+		t.Errorf("Expected SetFile to stamp the copy, ran %v", commands)
+	}
+}
+
+func TestSetOutputTimesFailures(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "merged.mp4")
+	if err := os.WriteFile(outputPath, []byte("output"), 0644); err != nil {
+		t.Fatalf("Failed to create output file: %v", err)
+	}
+	creationTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	modTime := time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC)
+
+	origRunCommand := runCommand
+	origChangeTimes := changeTimes
+	defer func() {
+		runCommand = origRunCommand
+		changeTimes = origChangeTimes
+	}()
+
+	tests := []struct {
+		name         string
+		setFileFails bool
+		chtimesFails bool
+		strict       bool
+		wantErr      string
+		wantWarning  string
+		wantChtimes  bool
+	}{
+		{name: "both succeed", wantChtimes: true},
+		{name: "SetFile fails", setFileFails: true, wantWarning: "failed to set creation time", wantChtimes: true},
+		{name: "Chtimes fails", chtimesFails: true, wantWarning: "failed to set modification time"},
+		{name: "SetFile fails strictly", setFileFails: true, strict: true, wantErr: "failed to set creation time"},
+		{name: "Chtimes fails strictly", chtimesFails: true, strict: true, wantErr: "failed to set file times"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+				if tt.setFileFails {
+					return fmt.Errorf("exit status 1")
+				}
+				return nil
+			}
+			chtimesCalled := false
+			changeTimes = func(name string, atime, mtime time.Time) error {
+				chtimesCalled = true
+				if tt.chtimesFails {
+					return fmt.Errorf("operation not permitted")
+				}
+				return nil
+			}
+
+			var logs bytes.Buffer
+			opts := Options{StrictTimes: tt.strict, Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+			err := setOutputTimes(outputPath, creationTime, modTime, opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error %q, got: %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setOutputTimes() error: %v", err)
+			}
+			if tt.wantWarning != "" && !strings.Contains(logs.String(), "level=WARN msg=\""+tt.wantWarning) {
+				t.Errorf("Expected warning %q, got logs: %s", tt.wantWarning, logs.String())
+			}
+			if tt.wantWarning == "" && strings.Contains(logs.String(), "level=WARN") {
+				t.Errorf("Expected no warning, got logs: %s", logs.String())
+			}
+			if tt.wantChtimes && !chtimesCalled {
+				t.Errorf("Expected the file times to be set after SetFile")
+			}
+		})
+	}
+}
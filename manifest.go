@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// manifestChapters returns where each of files, whose durations are given,
+// lies in the merged output, titled with its path. With trim, the files are
+// moved into the range kept and the ones outside it dropped.
+func manifestChapters(files []FileInfo, durations []time.Duration, trim *trimRange) []chapterMark {
+	var chapters []chapterMark
+	var start time.Duration
+	for i, file := range files {
+		chapters = append(chapters, chapterMark{Start: start, End: start + durations[i], Title: file.Path})
+		start += durations[i]
+	}
+	if trim != nil {
+		chapters = trimChapters(chapters, *trim)
+	}
+	return chapters
+}
+
+// writeManifest lists chapters, one source file per line with its start
+// and end in the merged output.
+func writeManifest(w io.Writer, chapters []chapterMark) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Start\tEnd\tSource")
+	for _, chapter := range chapters {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", formatOffset(chapter.Start), formatOffset(chapter.End), chapter.Title)
+	}
+	return tw.Flush()
+}
+
+// writeManifestFile writes the manifest of chapters to opts.Manifest.
+func writeManifestFile(chapters []chapterMark, opts Options) error {
+	if opts.Manifest == "" {
+		return nil
+	}
+	opts.logger().Info("writing manifest", "manifest", opts.Manifest, "sources", len(chapters))
+	file, err := os.Create(opts.Manifest)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %v", err)
+	}
+	defer file.Close()
+	if err := writeManifest(file, chapters); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %v", opts.Manifest, err)
+	}
+	return file.Close()
+}
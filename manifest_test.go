@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifestChapters(t *testing.T) {
+	files := []FileInfo{{Path: "GH011234.MP4"}, {Path: "GH021234.MP4"}, {Path: "GH031234.MP4"}}
+	durations := []time.Duration{531200 * time.Millisecond, 531200 * time.Millisecond, 100500 * time.Millisecond}
+
+	var buf bytes.Buffer
+	if err := writeManifest(&buf, manifestChapters(files, durations, nil)); err != nil {
+		t.Fatalf("writeManifest() error: %v", err)
+	}
+	expected := [][]string{
+		{"Start", "End", "Source"},
+		{"00:00:00.000", "00:08:51.200", "GH011234.MP4"},
+		{"00:08:51.200", "00:17:42.400", "GH021234.MP4"},
+		{"00:17:42.400", "00:19:22.900", "GH031234.MP4"},
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got:\n%s", len(expected), buf.String())
+	}
+	for i, line := range lines {
+		if fields := strings.Fields(line); strings.Join(fields, " ") != strings.Join(expected[i], " ") {
+			t.Errorf("Line %d: expected %q, got %q", i+1, expected[i], fields)
+		}
+	}
+
+	// Trimming moves the files into the range kept and drops the first one
+	trim := &trimRange{Start: 9 * time.Minute, RequestedStart: 9 * time.Minute, End: 18 * time.Minute}
+	chapters := manifestChapters(files, durations, trim)
+	if len(chapters) != 2 || chapters[0].Title != "GH021234.MP4" || chapters[0].Start != 0 ||
+		chapters[0].End != 8*time.Minute+42400*time.Millisecond || chapters[1].End != 9*time.Minute {
+		t.Errorf("Unexpected trimmed manifest: %+v", chapters)
+	}
+}
+
+func TestWriteManifestFile(t *testing.T) {
+	manifestPath := filepath.Join(t.TempDir(), "out.txt")
+	chapters := []chapterMark{{Start: 0, End: time.Minute, Title: "GH011234.MP4"}}
+	if err := writeManifestFile(chapters, Options{Manifest: manifestPath}); err != nil {
+		t.Fatalf("writeManifestFile() error: %v", err)
+	}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil || !strings.Contains(string(data), "00:01:00.000  GH011234.MP4") {
+		t.Errorf("Expected the manifest to list GH011234.MP4, got %q: %v", data, err)
+	}
+}
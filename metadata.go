@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RecordingMetadata is the metadata written into the output of a
+// recording. Empty fields are left out.
+type RecordingMetadata struct {
+	Title    string
+	Location string
+	Comment  string
+}
+
+// metadataColumns maps the header names a metadata CSV may use, in lower
+// case, to the field they fill.
+var metadataColumns = map[string]string{
+	"file_number": "file_number",
+	"file":        "file_number",
+	"title":       "title",
+	"location":    "location",
+	"comment":     "comment",
+}
+
+// readMetadataCSV reads the metadata of recordings from the CSV file path,
+// keyed by file number. The first row names the columns: file_number
+// (or file), and any of title, location and comment. Other columns are
+// ignored, so a spreadsheet can be exported as it is.
+func readMetadataCSV(path string) (map[int]RecordingMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata CSV: %v", err)
+	}
+	defer f.Close()
+	metadata, err := parseMetadataCSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata CSV %s: %v", path, err)
+	}
+	return metadata, nil
+}
+
+func parseMetadataCSV(r io.Reader) (map[int]RecordingMetadata, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("no header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		if field, ok := metadataColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[field] = i
+		}
+	}
+	if _, ok := columns["file_number"]; !ok {
+		return nil, fmt.Errorf("no file_number column")
+	}
+
+	metadata := make(map[int]RecordingMetadata)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return metadata, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := func(field string) string {
+			i, ok := columns[field]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		if value("file_number") == "" {
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		fileNumber, err := strconv.Atoi(value("file_number"))
+		if err != nil || fileNumber < 0 {
+			return nil, fmt.Errorf("line %d: invalid file number %q", line, value("file_number"))
+		}
+		if _, ok := metadata[fileNumber]; ok {
+			return nil, fmt.Errorf("line %d: file number %d is listed twice", line, fileNumber)
+		}
+		metadata[fileNumber] = RecordingMetadata{
+			Title:    value("title"),
+			Location: value("location"),
+			Comment:  value("comment"),
+		}
+	}
+}
+
+// metadataArgs returns the ffmpeg arguments writing the title and location
+// of metadata. The comment is written with the other one, see outputArgs.
+func metadataArgs(metadata RecordingMetadata) []string {
+	var args []string
+	if metadata.Title != "" {
+		args = append(args, "-metadata", "title="+metadata.Title)
+	}
+	if metadata.Location != "" {
+		// location is the udta box of QuickTime, the key is the one Photos
+		// reads, written with use_metadata_tags
+		args = append(args, "-metadata", "location="+metadata.Location,
+			"-metadata", "com.apple.quicktime.location.ISO6709="+metadata.Location)
+	}
+	return args
+}
+
+// vendorMetadataKeys are the container metadata keys of GoPro recordings
+// checked to survive a merge, see checkVendorMetadata.
+var vendorMetadataKeys = []string{"firmware"}
+
+// checkVendorMetadata logs a warning for each of vendorMetadataKeys that
+// the first input has, in inputTags, but the output at outputPath lacks or
+// has with another value. ffmpeg carries the keys over only partially, so
+// a lost key does not fail the merge.
+func checkVendorMetadata(outputPath string, inputTags map[string]string, opts Options) {
+	logger := opts.logger()
+	probe, err := probeFile(outputPath)
+	if err != nil {
+		logger.Warn("cannot check the metadata of the output", "output", outputPath, "error", err)
+		return
+	}
+	for _, key := range vendorMetadataKeys {
+		value, ok := inputTags[key]
+		if !ok {
+			continue
+		}
+		if got := probe.Tags[key]; got != value {
+			logger.Warn("metadata key of the camera lost in the merge", "output", outputPath, "key", key, "input", value, "output_value", got)
+			continue
+		}
+		logger.Debug("metadata key of the camera kept", "output", outputPath, "key", key, "value", value)
+	}
+}
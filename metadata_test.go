@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMetadataCSV(t *testing.T) {
+	csv := `File_Number,Title,Location,Comment,Camera
+0042,Dolomites day 1,+46.4102+011.8440/,"Sella pass, rain",HERO11
+43,Dolomites day 2,,,HERO11
+,,,,spare row
+`
+	metadata, err := parseMetadataCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("parseMetadataCSV() error: %v", err)
+	}
+	if len(metadata) != 2 {
+		t.Fatalf("Expected 2 recordings, got %+v", metadata)
+	}
+	if got, want := metadata[42], (RecordingMetadata{Title: "Dolomites day 1", Location: "+46.4102+011.8440/", Comment: "Sella pass, rain"}); got != want {
+		t.Errorf("metadata[42] = %+v, want %+v", got, want)
+	}
+	if got := metadata[43]; got.Title != "Dolomites day 2" || got.Location != "" {
+		t.Errorf("Unexpected metadata[43] %+v", got)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"title,location\nDay 1,Sella\n",
+		"file_number,title\nday1,Day 1\n",
+		"file,title\n42,Day 1\n0042,Day 1 again\n",
+	} {
+		if _, err := parseMetadataCSV(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestMergeFilesMetadata(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+	csvPath := filepath.Join(dir, "trips.csv")
+	csv := "file_number,title,location,comment\n1234,Sella pass,+46.5083+011.7606/,First snow\n1235,Unrelated trip,,\n"
+	if err := os.WriteFile(csvPath, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := readMetadataCSV(csvPath)
+	if err != nil {
+		t.Fatalf("readMetadataCSV() error: %v", err)
+	}
+
+	probe := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return probe, nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	opts := Options{Metadata: metadata, EmbedSourceList: true}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	command := strings.Join(merge, " ")
+	for _, arg := range []string{
+		"-metadata title=Sella pass",
+		"-metadata location=+46.5083+011.7606/",
+		"-metadata comment=First snow\nmerged from: GH011234.MP4, GH021234.MP4",
+	} {
+		if !strings.Contains(command, arg) {
+			t.Errorf("Expected %q in the merge command, got: %s", arg, command)
+		}
+	}
+	if strings.Contains(command, "Unrelated trip") {
+		t.Errorf("Expected only the row of the recording to be used, got: %s", command)
+	}
+
+	// A recording without a row only gets a warning
+	var logs bytes.Buffer
+	opts = Options{Metadata: map[int]RecordingMetadata{1235: {Title: "Unrelated trip"}}, Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if command := strings.Join(merge, " "); strings.Contains(command, "title=") {
+		t.Errorf("Expected no title, got: %s", command)
+	}
+	if !strings.Contains(logs.String(), "the metadata CSV has no row for the recording") || !strings.Contains(logs.String(), "file_number=1234") {
+		t.Errorf("Expected a warning about the missing row, got: %s", logs.String())
+	}
+}
+
+func TestMergeFilesVendorMetadata(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	outputTags := map[string]string{"firmware": "H22.01.02.32.00", "major_brand": "mp41"}
+	probeFile = func(path string) (ProbeResult, error) {
+		result := hero
+		result.Duration = 60
+		result.Tags = map[string]string{"firmware": "H22.01.02.32.00"}
+		if path == partialPath(outputPath) {
+			result.Duration = 120
+			result.Tags = outputTags
+		}
+		return result, nil
+	}
+	var merge string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = strings.Join(cmd.Args, " ")
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	var logs bytes.Buffer
+	opts := Options{Verify: true, Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if !strings.Contains(merge, "-movflags +use_metadata_tags") || strings.Contains(merge, "-map_metadata") {
+		t.Errorf("Expected the metadata keys to be carried over, got: %s", merge)
+	}
+	if strings.Contains(logs.String(), "lost in the merge") {
+		t.Errorf("Expected the firmware key to be found in the output, got: %s", logs.String())
+	}
+
+	// A key ffmpeg did not carry over is reported, but does not fail the merge
+	outputTags = map[string]string{"major_brand": "mp41"}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if !strings.Contains(logs.String(), "metadata key of the camera lost in the merge") || !strings.Contains(logs.String(), "key=firmware") {
+		t.Errorf("Expected the lost firmware key to be reported, got: %s", logs.String())
+	}
+
+	logs.Reset()
+	opts.NoVendorMetadata = true
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if !strings.Contains(merge, "-map_metadata -1") || strings.Contains(merge, "use_metadata_tags") {
+		t.Errorf("Expected the metadata keys to be left out, got: %s", merge)
+	}
+	if strings.Contains(logs.String(), "lost in the merge") {
+		t.Errorf("Expected no check of the left out keys, got: %s", logs.String())
+	}
+}
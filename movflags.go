@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// movflagPresets are the sets of movflags -movflags accepts by name.
+var movflagPresets = map[string][]string{
+	// web starts playing before the whole file is downloaded
+	"web": {"faststart"},
+	// streaming writes a fragmented file that can be played while it is
+	// still being written or served in pieces
+	"streaming": {"frag_keyframe", "empty_moov", "default_base_moof"},
+	// rtp adds the hint tracks that RTP streaming servers and some
+	// players need
+	"rtp": {"rtphint"},
+}
+
+// knownMovflags are the flags of the ffmpeg mov muxer -movflags accepts.
+var knownMovflags = []string{
+	"rtphint", "empty_moov", "frag_keyframe", "frag_every_frame", "separate_moof",
+	"frag_custom", "isml", "faststart", "omit_tfhd_offset", "disable_chpl",
+	"default_base_moof", "dash", "cmaf", "frag_discont", "delay_moov", "global_sidx",
+	"skip_sidx", "write_colr", "prefer_icc", "write_gama", "use_metadata_tags",
+	"skip_trailer", "negative_cts_offsets",
+}
+
+// fragmentingMovflags write a fragmented file, whose moov is in front
+// already and has no sample index for faststart to move.
+var fragmentingMovflags = []string{"empty_moov", "frag_keyframe", "frag_every_frame", "frag_custom", "dash", "cmaf", "isml"}
+
+// parseMovflags parses a -movflags value, presets and flags of the mov
+// muxer joined by + or commas, e.g. web or frag_keyframe+empty_moov. It
+// returns the flags without their +, in order and without repeats.
+func parseMovflags(value string) ([]string, error) {
+	var flags []string
+	for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == '+' || r == ',' }) {
+		names := []string{name}
+		if preset, ok := movflagPresets[name]; ok {
+			names = preset
+		} else if !slices.Contains(knownMovflags, name) {
+			return nil, fmt.Errorf("invalid -movflags %q: %s is neither a movflag of ffmpeg nor one of the presets web, streaming and rtp", value, name)
+		}
+		for _, flag := range names {
+			if !slices.Contains(flags, flag) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	if len(flags) == 0 {
+		return nil, fmt.Errorf("invalid -movflags %q: no flags", value)
+	}
+	return flags, nil
+}
+
+// validateMovflags checks that movflags do not fragment an output that
+// faststart rewrites.
+func validateMovflags(movflags []string, faststart bool) error {
+	for _, flag := range movflags {
+		if faststart && slices.Contains(fragmentingMovflags, flag) {
+			return fmt.Errorf("-faststart cannot be combined with the movflag %s, a fragmented output starts with its moov already", flag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMovflags(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []string
+		err      string
+	}{
+		{"web", []string{"faststart"}, ""},
+		{"streaming", []string{"frag_keyframe", "empty_moov", "default_base_moof"}, ""},
+		{"+rtphint", []string{"rtphint"}, ""},
+		{"frag_keyframe+empty_moov,frag_keyframe", []string{"frag_keyframe", "empty_moov"}, ""},
+		{"rtp+web", []string{"rtphint", "faststart"}, ""},
+		{"faststart+frag_everything", nil, "frag_everything is neither a movflag"},
+		{"+", nil, "no flags"},
+	}
+	for _, test := range tests {
+		flags, err := parseMovflags(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v %v", test.value, test.err, flags, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(flags, test.expected) {
+			t.Errorf("%s: expected %v, got %v: %v", test.value, test.expected, flags, err)
+		}
+	}
+
+	if err := validateMovflags([]string{"frag_keyframe", "empty_moov"}, true); err == nil || !strings.Contains(err.Error(), "frag_keyframe") {
+		t.Errorf("Expected faststart to be refused with a fragmented output, got %v", err)
+	}
+	if err := validateMovflags([]string{"rtphint"}, true); err != nil {
+		t.Errorf("Expected rtphint to go with faststart, got %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-faststart", "-movflags", "streaming", "out.mp4", "GH011234.MP4"}, &stdout, &stderr); code != exitUsage {
+		t.Errorf("Expected exit code %d, got %d: %s", exitUsage, code, stderr.String())
+	}
+}
+
+func TestMergeArgsMovflags(t *testing.T) {
+	hero := loadProbeFixture(t, "hero_probe.json")
+	mapping := mapStreams(hero.Streams, streamsAll)
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4", MapArgs: mapping.Args}
+	flags, err := parseMovflags("streaming")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The telemetry keeps its gpmd tag in a fragmented output
+	args := strings.Join(mergeArgs(spec, Options{Container: containerMP4, Movflags: flags}), " ")
+	for _, expected := range []string{"-movflags +use_metadata_tags+frag_keyframe+empty_moov+default_base_moof", " gpmd "} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("Expected %q in the command, got: %s", expected, args)
+		}
+	}
+
+	// Flags set already are not repeated
+	args = strings.Join(mergeArgs(spec, Options{Container: containerMOV, Movflags: []string{"use_metadata_tags", "rtphint"}}), " ")
+	if !strings.Contains(args, "-movflags +use_metadata_tags+rtphint ") {
+		t.Errorf("Expected the movflags once each, got: %s", args)
+	}
+
+	args = strings.Join(mergeArgs(spec, Options{Container: containerMKV, Movflags: flags}), " ")
+	if strings.Contains(args, "-movflags") {
+		t.Errorf("Expected no movflags for Matroska, got: %s", args)
+	}
+	if err := mergeFiles("merged.mkv", []string{"GH011234.MP4"}, time.Now(), time.Now(), Options{Movflags: flags}); err == nil || !strings.Contains(err.Error(), "-movflags only applies") {
+		t.Errorf("Expected -movflags to be refused for Matroska, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// mp4Box is the location of an ISO BMFF box inside a file.
+type mp4Box struct {
+	Type       string
+	Offset     int64
+	HeaderSize int64
+	Size       int64
+}
+
+// PayloadOffset is where the box contents start.
+func (b mp4Box) PayloadOffset() int64 {
+	return b.Offset + b.HeaderSize
+}
+
+// End is the offset just past the box.
+func (b mp4Box) End() int64 {
+	return b.Offset + b.Size
+}
+
+// readBoxes lists the boxes stored between start and end.
+func readBoxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	header := make([]byte, 16)
+	for offset := start; offset+8 <= end; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return nil, fmt.Errorf("failed to read box header at %d: %v", offset, err)
+		}
+		box := mp4Box{
+			Type:       string(header[4:8]),
+			Offset:     offset,
+			HeaderSize: 8,
+			Size:       int64(binary.BigEndian.Uint32(header[:4])),
+		}
+		switch box.Size {
+		case 0:
+			// The box extends to the end of its parent
+			box.Size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, fmt.Errorf("failed to read box size at %d: %v", offset, err)
+			}
+			box.HeaderSize = 16
+			box.Size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if box.Size < box.HeaderSize || box.End() > end {
+			return nil, fmt.Errorf("invalid %q box size %d at offset %d", box.Type, box.Size, offset)
+		}
+		boxes = append(boxes, box)
+		offset = box.End()
+	}
+	return boxes, nil
+}
+
+// findBox follows path (e.g. "moov", "udta", "HMMT") from the top level of
+// a file of the given size. The bool result is false when a box is missing.
+func findBox(r io.ReaderAt, size int64, path ...string) (mp4Box, bool, error) {
+	box := mp4Box{Size: size}
+	for _, boxType := range path {
+		children, err := readBoxes(r, box.PayloadOffset(), box.End())
+		if err != nil {
+			return mp4Box{}, false, err
+		}
+		found := false
+		for _, child := range children {
+			if child.Type == boxType {
+				box = child
+				found = true
+				break
+			}
+		}
+		if !found {
+			return mp4Box{}, false, nil
+		}
+	}
+	return box, true, nil
+}
+
+func readPayload(r io.ReaderAt, box mp4Box) ([]byte, error) {
+	payload := make([]byte, box.Size-box.HeaderSize)
+	if _, err := r.ReadAt(payload, box.PayloadOffset()); err != nil {
+		return nil, fmt.Errorf("failed to read %q box: %v", box.Type, err)
+	}
+	return payload, nil
+}
+
+// readFileBox returns the payload of the box at path in the file at
+// filePath, or nil when the box does not exist.
+func readFileBox(filePath string, path ...string) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	box, found, err := findBox(file, info.Size(), path...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filePath, err)
+	}
+	if !found {
+		return nil, nil
+	}
+	return readPayload(file, box)
+}
+
+// verifyFaststart checks that the moov box of filePath precedes its mdat
+// box, so playback can start before the whole file is downloaded.
+func verifyFaststart(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	boxes, err := readBoxes(file, 0, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", filePath, err)
+	}
+	moovIndex, mdatIndex := -1, -1
+	for i, box := range boxes {
+		if box.Type == "moov" && moovIndex < 0 {
+			moovIndex = i
+		}
+		if box.Type == "mdat" && mdatIndex < 0 {
+			mdatIndex = i
+		}
+	}
+	if moovIndex < 0 {
+		return fmt.Errorf("no moov atom found in %s", filePath)
+	}
+	if mdatIndex >= 0 && mdatIndex < moovIndex {
+		return fmt.Errorf("moov atom of %s is not at the front of the file, faststart relocation failed (is the disk full?)", filePath)
+	}
+	return nil
+}
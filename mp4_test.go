@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyFaststart(t *testing.T) {
+	dir := t.TempDir()
+	ftyp := mp4BoxBytes("ftyp", []byte("isom\x00\x00\x02\x00isom"))
+	moov := mp4BoxBytes("moov", mp4BoxBytes("mvhd", make([]byte, 100)))
+	mdat := mp4BoxBytes("mdat", make([]byte, 1024))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"faststart.mp4", bytes.Join([][]byte{ftyp, moov, mdat}, nil), ""},
+		{"regular.mp4", bytes.Join([][]byte{ftyp, mdat, moov}, nil), "not at the front"},
+		{"truncated.mp4", bytes.Join([][]byte{ftyp, mdat}, nil), "no moov atom"},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, test.data, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+
+		err := verifyFaststart(path)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: verifyFaststart() error: %v", test.name, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: expected error containing %q, got: %v", test.name, test.wantErr, err)
+		}
+	}
+}
+
+func TestReadBoxesRejectsInvalidSize(t *testing.T) {
+	// A box claiming to be larger than the file
+	data := mp4BoxBytes("ftyp", []byte("isom"))
+	data[3] = 200
+
+	if _, err := readBoxes(bytes.NewReader(data), 0, int64(len(data))); err == nil {
+		t.Errorf("Expected error for box extending past the end of the file")
+	}
+}
@@ -0,0 +1,1019 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Backends for Options.Backend.
+const (
+	// backendFFmpeg merges with the concat demuxer of ffmpeg.
+	backendFFmpeg = "ffmpeg"
+	// backendNative concatenates the sample tables and media data of the
+	// chapters itself, see planNative.
+	backendNative = "native"
+)
+
+func validateBackend(backend string) error {
+	switch backend {
+	case "", backendFFmpeg, backendNative:
+		return nil
+	default:
+		return fmt.Errorf("invalid backend %q: must be %s or %s", backend, backendFFmpeg, backendNative)
+	}
+}
+
+// macEpoch is where the times in mvhd, tkhd and mdhd boxes count from.
+var macEpoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// nativeSampleTables lists the stbl children the native backend knows how
+// to concatenate. Chapters with any other one are merged by ffmpeg.
+var nativeSampleTables = map[string]bool{
+	"stsd": true, "stts": true, "ctts": true, "stss": true, "stsz": true,
+	"stsc": true, "stco": true, "co64": true, "sdtp": true,
+}
+
+// nativeChunk is a chunk of samples. Position is where its data starts in
+// the media data of the output, counting from the first byte of the mdat
+// payload.
+type nativeChunk struct {
+	Offset   int64
+	Samples  uint32
+	Size     int64
+	Position int64
+}
+
+// nativeTrack is a track with its sample tables expanded to one entry per
+// sample or chunk, which makes concatenating them straightforward.
+type nativeTrack struct {
+	// Trak is the complete trak box, whose other boxes are kept as they are.
+	Trak      []byte
+	Handler   string
+	Timescale uint32
+	// Description is the complete stsd box.
+	Description []byte
+	// MediaTime is where the single edit of the track starts, -1 when it
+	// has no edit list.
+	MediaTime int64
+
+	Deltas []uint32
+	Sizes  []uint32
+	// Composition holds the ctts offsets, nil without a ctts box, of which
+	// CompositionVersion is the version.
+	Composition        []uint32
+	CompositionVersion byte
+	// Sync holds the sync sample numbers counting from 1, nil without an
+	// stss box, in which case every sample is a sync sample.
+	Sync         []uint32
+	HasSync      bool
+	Dependencies []byte
+	Chunks       []nativeChunk
+}
+
+// duration is the length of the track in its timescale.
+func (t nativeTrack) duration() uint64 {
+	var duration uint64
+	for _, delta := range t.Deltas {
+		duration += uint64(delta)
+	}
+	return duration
+}
+
+// nativeChapter is an input file parsed for the native backend.
+type nativeChapter struct {
+	Path string
+	// Ftyp and Moov are the complete boxes.
+	Ftyp           []byte
+	Moov           []byte
+	MovieTimescale uint32
+	Tracks         []nativeTrack
+	// MediaData are the mdat boxes, copied in order into the output.
+	MediaData []mp4Box
+}
+
+// nativePlan is what the native backend writes: the boxes of the first
+// chapter with the tracks of all chapters concatenated, followed by their
+// media data.
+type nativePlan struct {
+	Chapters []nativeChapter
+	Tracks   []nativeTrack
+	// DataSize is the size of the mdat payload of the output.
+	DataSize int64
+}
+
+// nativeUnsupportedOption returns the flag of an option in opts that the
+// native backend cannot do, or an empty string.
+func nativeUnsupportedOption(opts Options) string {
+	switch {
+	case opts.Container != containerMP4:
+		return "-container " + opts.Container
+	case opts.Reencode:
+		return "-reencode"
+	case opts.Segmented:
+		return "-segmented"
+	case opts.Streams == streamsEssential:
+		return "-streams essential"
+	case opts.NoTelemetry:
+		return "-no-telemetry"
+	case opts.DropAudio:
+		return "-drop-audio"
+	case opts.AudioTrack > 0:
+		return "-audio-track"
+	case opts.Intro != "":
+		return "-intro"
+	case opts.Outro != "":
+		return "-outro"
+	case opts.Start != 0:
+		return "-start"
+	case opts.End != 0:
+		return "-end"
+	case opts.Chapters:
+		return "-chapters"
+	case opts.Metadata != nil:
+		return "-metadata-csv"
+	case opts.Geotag != nil:
+		return "-geotag"
+	case opts.EmbedSourceList:
+		return "-embed-source-list"
+	case opts.FixTimestamps:
+		return "-fix-timestamps"
+	case opts.IgnoreErrors:
+		return "-ignore-errors"
+	case len(opts.Movflags) > 0:
+		return "-movflags"
+	case opts.NormalizeAudio:
+		return "-normalize-audio"
+	case opts.ResampleAudio:
+		return "-resample-audio"
+	case opts.NoVendorMetadata:
+		return "-no-vendor-metadata"
+	case opts.Rotate != 0:
+		return "-rotate"
+	}
+	return ""
+}
+
+// planNative parses files, in merge order, for the native backend. It
+// returns an error, on which the merge falls back to ffmpeg, unless every
+// chapter has the same tracks with identical sample descriptions and
+// plain sample tables, and opts ask for nothing but concatenating them.
+//
+// Where the tracks of a chapter differ in length, the shorter ones are
+// padded at the join by lengthening their last sample, so every chapter
+// starts at the same time in all tracks as with the concat demuxer.
+func planNative(files []FileInfo, opts Options) (*nativePlan, error) {
+	if option := nativeUnsupportedOption(opts); option != "" {
+		return nil, fmt.Errorf("%s is not supported", option)
+	}
+
+	plan := &nativePlan{}
+	for i, file := range files {
+		if isRemote(file.Path) {
+			return nil, fmt.Errorf("%s: remote inputs are not supported", file.Path)
+		}
+		// ffmpeg adds the HiLights as chapters, the native backend cannot
+		if hilights, err := readHiLights(file.Path); err == nil && len(hilights) > 0 {
+			return nil, fmt.Errorf("%s: HiLight chapters are not supported", filepath.Base(file.Path))
+		}
+		chapter, err := parseNativeChapter(file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(file.Path), err)
+		}
+		if i > 0 {
+			if err := checkNativeChapter(plan.Chapters[0], chapter); err != nil {
+				return nil, fmt.Errorf("%s: %v", filepath.Base(file.Path), err)
+			}
+		}
+		plan.Chapters = append(plan.Chapters, chapter)
+	}
+
+	// The edit of the first chapter covers the merged track, which is fine
+	// for the reordering delay of video but would play the priming samples
+	// at the start of every other chapter
+	first := plan.Chapters[0]
+	for i, track := range first.Tracks {
+		if track.Handler == "soun" && track.MediaTime > 0 && len(plan.Chapters) > 1 {
+			return nil, fmt.Errorf("track %d: audio with priming samples is not supported", i+1)
+		}
+	}
+	plan.Tracks = make([]nativeTrack, len(first.Tracks))
+	for i, track := range first.Tracks {
+		plan.Tracks[i] = nativeTrack{
+			Trak:               track.Trak,
+			Handler:            track.Handler,
+			Timescale:          track.Timescale,
+			Description:        track.Description,
+			MediaTime:          track.MediaTime,
+			CompositionVersion: track.CompositionVersion,
+			HasSync:            track.HasSync,
+		}
+		if track.Composition != nil {
+			plan.Tracks[i].Composition = []uint32{}
+		}
+		if track.Dependencies != nil {
+			plan.Tracks[i].Dependencies = []byte{}
+		}
+	}
+	for c, chapter := range plan.Chapters {
+		// The next chapter starts after the longest track of this one
+		var seconds float64
+		for _, track := range chapter.Tracks {
+			seconds = math.Max(seconds, float64(track.duration())/float64(track.Timescale))
+		}
+		for i, track := range chapter.Tracks {
+			merged := &plan.Tracks[i]
+			samples := uint32(len(merged.Sizes))
+			merged.Deltas = append(merged.Deltas, track.Deltas...)
+			if end := uint64(math.Round(seconds * float64(track.Timescale))); c < len(plan.Chapters)-1 && len(track.Deltas) > 0 && end > track.duration() {
+				merged.Deltas[len(merged.Deltas)-1] += uint32(end - track.duration())
+			}
+			merged.Sizes = append(merged.Sizes, track.Sizes...)
+			merged.Composition = append(merged.Composition, track.Composition...)
+			for _, sample := range track.Sync {
+				merged.Sync = append(merged.Sync, samples+sample)
+			}
+			merged.Dependencies = append(merged.Dependencies, track.Dependencies...)
+			for _, chunk := range track.Chunks {
+				chunk.Position += plan.DataSize
+				merged.Chunks = append(merged.Chunks, chunk)
+			}
+		}
+		for _, box := range chapter.MediaData {
+			plan.DataSize += box.Size - box.HeaderSize
+		}
+	}
+
+	// Version 0 header boxes hold 32 bit durations
+	for _, track := range plan.Tracks {
+		if track.duration() > math.MaxUint32 {
+			return nil, fmt.Errorf("the %s track is too long for its header", track.Handler)
+		}
+		if len(track.Sizes) > math.MaxUint32 {
+			return nil, fmt.Errorf("the %s track has too many samples", track.Handler)
+		}
+	}
+	return plan, nil
+}
+
+// checkNativeChapter reports how chapter cannot be concatenated with first.
+func checkNativeChapter(first, chapter nativeChapter) error {
+	if len(chapter.Tracks) != len(first.Tracks) {
+		return fmt.Errorf("has %d tracks, the first chapter %d", len(chapter.Tracks), len(first.Tracks))
+	}
+	for i, track := range chapter.Tracks {
+		expected := first.Tracks[i]
+		switch {
+		case track.Handler != expected.Handler:
+			return fmt.Errorf("track %d is %s, in the first chapter %s", i+1, track.Handler, expected.Handler)
+		case track.Timescale != expected.Timescale:
+			return fmt.Errorf("track %d has timescale %d, in the first chapter %d", i+1, track.Timescale, expected.Timescale)
+		case !bytes.Equal(track.Description, expected.Description):
+			return fmt.Errorf("the sample description of track %d differs from the first chapter", i+1)
+		case track.MediaTime != expected.MediaTime:
+			return fmt.Errorf("the edit list of track %d differs from the first chapter", i+1)
+		case (track.Composition == nil) != (expected.Composition == nil) || track.CompositionVersion != expected.CompositionVersion:
+			return fmt.Errorf("the composition offsets of track %d differ from the first chapter", i+1)
+		case track.HasSync != expected.HasSync:
+			return fmt.Errorf("the sync samples of track %d differ from the first chapter", i+1)
+		case (track.Dependencies == nil) != (expected.Dependencies == nil):
+			return fmt.Errorf("the sample dependencies of track %d differ from the first chapter", i+1)
+		}
+	}
+	return nil
+}
+
+// boxOf returns the box stored in data, which holds all of it.
+func boxOf(data []byte) mp4Box {
+	box := mp4Box{Type: string(data[4:8]), HeaderSize: 8, Size: int64(len(data))}
+	if binary.BigEndian.Uint32(data[:4]) == 1 {
+		box.HeaderSize = 16
+	}
+	return box
+}
+
+// boxPayload returns the contents of the box stored in data.
+func boxPayload(data []byte) []byte {
+	return data[boxOf(data).HeaderSize:]
+}
+
+// subBoxes returns the children of the box stored in data, each as a
+// complete box.
+func subBoxes(data []byte) ([][]byte, error) {
+	boxes, err := childBoxes(data, boxOf(data))
+	if err != nil {
+		return nil, err
+	}
+	children := make([][]byte, len(boxes))
+	for i, box := range boxes {
+		children[i] = data[box.Offset:box.End()]
+	}
+	return children, nil
+}
+
+// subBox follows path from the box stored in data, returning nil when a
+// box is missing.
+func subBox(data []byte, path ...string) ([]byte, error) {
+	for _, boxType := range path {
+		children, err := subBoxes(data)
+		if err != nil {
+			return nil, err
+		}
+		data = nil
+		for _, child := range children {
+			if boxOf(child).Type == boxType {
+				data = child
+				break
+			}
+		}
+		if data == nil {
+			return nil, nil
+		}
+	}
+	return data, nil
+}
+
+// rebuildBox returns the box stored in data with every child replaced by
+// what edit returns for it.
+func rebuildBox(data []byte, edit func(child []byte) ([]byte, error)) ([]byte, error) {
+	children, err := subBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	var payload []byte
+	for _, child := range children {
+		child, err = edit(child)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, child...)
+	}
+	return append(mp4BoxHeader(boxOf(data).Type, len(payload)), payload...), nil
+}
+
+// parseNativeChapter reads the boxes of the MP4 file at path the native
+// backend needs.
+func parseNativeChapter(path string) (nativeChapter, error) {
+	chapter := nativeChapter{Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return chapter, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return chapter, err
+	}
+
+	boxes, err := readBoxes(file, 0, info.Size())
+	if err != nil {
+		return chapter, err
+	}
+	for _, box := range boxes {
+		switch box.Type {
+		case "ftyp", "moov":
+			data := make([]byte, box.Size)
+			if _, err := file.ReadAt(data, box.Offset); err != nil {
+				return chapter, fmt.Errorf("failed to read %q box: %v", box.Type, err)
+			}
+			if box.Type == "ftyp" {
+				chapter.Ftyp = data
+			} else {
+				chapter.Moov = data
+			}
+		case "mdat":
+			chapter.MediaData = append(chapter.MediaData, box)
+		}
+	}
+	if chapter.Ftyp == nil || chapter.Moov == nil {
+		return chapter, fmt.Errorf("not an MP4 file with ftyp and moov boxes")
+	}
+
+	mvhd, err := subBox(chapter.Moov, "mvhd")
+	if err != nil {
+		return chapter, err
+	}
+	if mvhd == nil {
+		return chapter, fmt.Errorf("no mvhd box")
+	}
+	chapter.MovieTimescale, err = headerTimescale(mvhd)
+	if err != nil {
+		return chapter, err
+	}
+
+	children, err := subBoxes(chapter.Moov)
+	if err != nil {
+		return chapter, err
+	}
+	for _, child := range children {
+		if boxOf(child).Type != "trak" {
+			continue
+		}
+		track, err := parseNativeTrack(child)
+		if err != nil {
+			return chapter, fmt.Errorf("track %d: %v", len(chapter.Tracks)+1, err)
+		}
+		chapter.Tracks = append(chapter.Tracks, track)
+	}
+
+	// Chunks are found in the mdat boxes copied one after the other
+	var base int64
+	starts := make([]int64, len(chapter.MediaData))
+	for i, box := range chapter.MediaData {
+		starts[i] = base
+		base += box.Size - box.HeaderSize
+	}
+	for t := range chapter.Tracks {
+		for c := range chapter.Tracks[t].Chunks {
+			chunk := &chapter.Tracks[t].Chunks[c]
+			found := false
+			for i, box := range chapter.MediaData {
+				if chunk.Offset >= box.PayloadOffset() && chunk.Offset+chunk.Size <= box.End() {
+					chunk.Position = starts[i] + chunk.Offset - box.PayloadOffset()
+					found = true
+					break
+				}
+			}
+			if !found {
+				return chapter, fmt.Errorf("track %d: chunk %d at offset %d is outside the media data", t+1, c+1, chunk.Offset)
+			}
+		}
+	}
+	return chapter, nil
+}
+
+// headerTimescale returns the timescale of an mvhd or mdhd box.
+func headerTimescale(data []byte) (uint32, error) {
+	payload := boxPayload(data)
+	at := 12
+	if len(payload) > 0 && payload[0] == 1 {
+		at = 20
+	}
+	if len(payload) < at+4 {
+		return 0, fmt.Errorf("invalid %s box", boxOf(data).Type)
+	}
+	return binary.BigEndian.Uint32(payload[at:]), nil
+}
+
+// parseNativeTrack reads the handler, timescale, edit list and sample
+// tables of the trak box stored in trak.
+func parseNativeTrack(trak []byte) (nativeTrack, error) {
+	track := nativeTrack{Trak: trak, MediaTime: -1}
+
+	hdlr, err := subBox(trak, "mdia", "hdlr")
+	if err != nil {
+		return track, err
+	}
+	if hdlr == nil || len(boxPayload(hdlr)) < 12 {
+		return track, fmt.Errorf("no handler")
+	}
+	track.Handler = string(boxPayload(hdlr)[8:12])
+
+	mdhd, err := subBox(trak, "mdia", "mdhd")
+	if err != nil {
+		return track, err
+	}
+	if mdhd == nil {
+		return track, fmt.Errorf("no mdhd box")
+	}
+	track.Timescale, err = headerTimescale(mdhd)
+	if err != nil {
+		return track, err
+	}
+	if track.Timescale == 0 {
+		return track, fmt.Errorf("timescale is zero")
+	}
+
+	elst, err := subBox(trak, "edts", "elst")
+	if err != nil {
+		return track, err
+	}
+	if elst != nil {
+		track.MediaTime, err = singleEdit(boxPayload(elst))
+		if err != nil {
+			return track, err
+		}
+	}
+
+	stbl, err := subBox(trak, "mdia", "minf", "stbl")
+	if err != nil {
+		return track, err
+	}
+	if stbl == nil {
+		return track, fmt.Errorf("no sample table")
+	}
+	return track, parseSampleTable(stbl, &track)
+}
+
+// singleEdit returns the media time of an edit list with a single edit at
+// normal speed, the only kind that stays right for the merged track.
+func singleEdit(payload []byte) (int64, error) {
+	entrySize := 12
+	if len(payload) > 0 && payload[0] == 1 {
+		entrySize = 20
+	}
+	entries, count, err := tableEntries(payload, entrySize)
+	if err != nil {
+		return 0, err
+	}
+	if count != 1 {
+		return 0, fmt.Errorf("edit list has %d edits", count)
+	}
+	var mediaTime int64
+	var rate uint32
+	if entrySize == 20 {
+		mediaTime = int64(binary.BigEndian.Uint64(entries[8:]))
+		rate = binary.BigEndian.Uint32(entries[16:])
+	} else {
+		mediaTime = int64(int32(binary.BigEndian.Uint32(entries[4:])))
+		rate = binary.BigEndian.Uint32(entries[8:])
+	}
+	if mediaTime < 0 || rate != 0x10000 {
+		return 0, fmt.Errorf("edit list has an empty or slowed down edit")
+	}
+	return mediaTime, nil
+}
+
+// tableEntries returns the entries of a full box table whose entry count
+// follows the version and flags, and how many there are.
+func tableEntries(payload []byte, entrySize int) ([]byte, int, error) {
+	if len(payload) < 8 {
+		return nil, 0, fmt.Errorf("table box too short")
+	}
+	count := int(binary.BigEndian.Uint32(payload[4:8]))
+	if count < 0 || uint64(count)*uint64(entrySize) > uint64(len(payload)-8) {
+		return nil, 0, fmt.Errorf("table box with %d entries too short", count)
+	}
+	return payload[8:], count, nil
+}
+
+// expandRuns expands the runs of (count, value) entries of an stts or
+// ctts box into a value per sample.
+func expandRuns(payload []byte) ([]uint32, error) {
+	entries, count, err := tableEntries(payload, 8)
+	if err != nil {
+		return nil, err
+	}
+	values := []uint32{}
+	for i := 0; i < count; i++ {
+		n := binary.BigEndian.Uint32(entries[i*8:])
+		value := binary.BigEndian.Uint32(entries[i*8+4:])
+		if uint64(len(values))+uint64(n) > math.MaxInt32 {
+			return nil, fmt.Errorf("too many samples")
+		}
+		for j := uint32(0); j < n; j++ {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// parseSampleTable expands the boxes of the stbl box stored in stbl into
+// track.
+func parseSampleTable(stbl []byte, track *nativeTrack) error {
+	children, err := subBoxes(stbl)
+	if err != nil {
+		return err
+	}
+	var stsc []byte
+	var offsets []int64
+	var dependencies []byte
+	for _, child := range children {
+		boxType := boxOf(child).Type
+		if !nativeSampleTables[boxType] {
+			return fmt.Errorf("unsupported %s box in the sample table", boxType)
+		}
+		payload := boxPayload(child)
+		switch boxType {
+		case "stsd":
+			if _, count, err := tableEntries(payload, 0); err != nil || count != 1 {
+				return fmt.Errorf("sample table needs exactly one sample description")
+			}
+			track.Description = child
+		case "stts":
+			track.Deltas, err = expandRuns(payload)
+		case "ctts":
+			track.Composition, err = expandRuns(payload)
+			if err == nil {
+				track.CompositionVersion = payload[0]
+			}
+		case "stss":
+			var entries []byte
+			var count int
+			entries, count, err = tableEntries(payload, 4)
+			track.Sync = []uint32{}
+			track.HasSync = true
+			for i := 0; i < count; i++ {
+				track.Sync = append(track.Sync, binary.BigEndian.Uint32(entries[i*4:]))
+			}
+		case "stsz":
+			if len(payload) < 12 {
+				return fmt.Errorf("invalid stsz box")
+			}
+			size := binary.BigEndian.Uint32(payload[4:8])
+			count := int(binary.BigEndian.Uint32(payload[8:12]))
+			if count < 0 || count > math.MaxInt32 || (size == 0 && uint64(count)*4 > uint64(len(payload)-12)) {
+				return fmt.Errorf("invalid stsz box")
+			}
+			track.Sizes = make([]uint32, count)
+			for i := range track.Sizes {
+				track.Sizes[i] = size
+				if size == 0 {
+					track.Sizes[i] = binary.BigEndian.Uint32(payload[12+i*4:])
+				}
+			}
+		case "stsc":
+			stsc = payload
+		case "stco", "co64":
+			entrySize := 4
+			if boxType == "co64" {
+				entrySize = 8
+			}
+			var entries []byte
+			var count int
+			entries, count, err = tableEntries(payload, entrySize)
+			offsets = make([]int64, count)
+			for i := 0; i < count && err == nil; i++ {
+				if entrySize == 8 {
+					offsets[i] = int64(binary.BigEndian.Uint64(entries[i*8:]))
+				} else {
+					offsets[i] = int64(binary.BigEndian.Uint32(entries[i*4:]))
+				}
+			}
+		case "sdtp":
+			if len(payload) < 4 {
+				return fmt.Errorf("invalid sdtp box")
+			}
+			dependencies = payload[4:]
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s box: %v", boxType, err)
+		}
+	}
+	if track.Description == nil || stsc == nil {
+		return fmt.Errorf("incomplete sample table")
+	}
+
+	samples := len(track.Sizes)
+	switch {
+	case len(track.Deltas) != samples:
+		return fmt.Errorf("%d sample durations for %d samples", len(track.Deltas), samples)
+	case track.Composition != nil && len(track.Composition) != samples:
+		return fmt.Errorf("%d composition offsets for %d samples", len(track.Composition), samples)
+	case dependencies != nil && len(dependencies) < samples:
+		return fmt.Errorf("%d sample dependencies for %d samples", len(dependencies), samples)
+	}
+	if dependencies != nil {
+		track.Dependencies = append([]byte{}, dependencies[:samples]...)
+	}
+	for _, sample := range track.Sync {
+		if sample < 1 || int(sample) > samples {
+			return fmt.Errorf("sync sample %d out of range", sample)
+		}
+	}
+
+	track.Chunks, err = expandChunks(stsc, offsets)
+	if err != nil {
+		return fmt.Errorf("invalid stsc box: %v", err)
+	}
+	sample := 0
+	for i := range track.Chunks {
+		chunk := &track.Chunks[i]
+		if sample+int(chunk.Samples) > samples {
+			return fmt.Errorf("chunks hold more than the %d samples", samples)
+		}
+		for _, size := range track.Sizes[sample : sample+int(chunk.Samples)] {
+			chunk.Size += int64(size)
+		}
+		sample += int(chunk.Samples)
+	}
+	if sample != samples {
+		return fmt.Errorf("chunks hold %d of the %d samples", sample, samples)
+	}
+	return nil
+}
+
+// expandChunks returns the chunks at offsets with their number of samples
+// from the stsc box payload.
+func expandChunks(stsc []byte, offsets []int64) ([]nativeChunk, error) {
+	entries, count, err := tableEntries(stsc, 12)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]nativeChunk, len(offsets))
+	for i := range chunks {
+		chunks[i].Offset = offsets[i]
+	}
+	next := uint32(1)
+	for i := 0; i < count; i++ {
+		first := binary.BigEndian.Uint32(entries[i*12:])
+		samples := binary.BigEndian.Uint32(entries[i*12+4:])
+		if binary.BigEndian.Uint32(entries[i*12+8:]) != 1 {
+			return nil, fmt.Errorf("chunk uses another sample description")
+		}
+		last := uint32(len(chunks))
+		if i+1 < count {
+			last = binary.BigEndian.Uint32(entries[(i+1)*12:]) - 1
+		}
+		if first != next || last > uint32(len(chunks)) || last+1 < first {
+			return nil, fmt.Errorf("chunk runs out of order")
+		}
+		for chunk := first; chunk <= last; chunk++ {
+			chunks[chunk-1].Samples = samples
+		}
+		next = last + 1
+	}
+	if int(next) != len(chunks)+1 {
+		return nil, fmt.Errorf("%d of %d chunks described", next-1, len(chunks))
+	}
+	return chunks, nil
+}
+
+// fullBox returns a full box of version with zero flags around payload.
+func fullBox(boxType string, version byte, payload []byte) []byte {
+	header := append(mp4BoxHeader(boxType, 4+len(payload)), version, 0, 0, 0)
+	return append(header, payload...)
+}
+
+// runsBox encodes values, one per sample, as the runs of an stts or ctts
+// box.
+func runsBox(boxType string, version byte, values []uint32) []byte {
+	var entries []byte
+	count := 0
+	for i := 0; i < len(values); {
+		j := i
+		for j < len(values) && values[j] == values[i] {
+			j++
+		}
+		entries = binary.BigEndian.AppendUint32(entries, uint32(j-i))
+		entries = binary.BigEndian.AppendUint32(entries, values[i])
+		count++
+		i = j
+	}
+	return fullBox(boxType, version, append(binary.BigEndian.AppendUint32(nil, uint32(count)), entries...))
+}
+
+// sampleTable returns the stbl box of track, with its chunks in the mdat
+// payload starting at dataStart.
+func (t nativeTrack) sampleTable(dataStart int64) []byte {
+	payload := append([]byte{}, t.Description...)
+	payload = append(payload, runsBox("stts", 0, t.Deltas)...)
+	if t.Composition != nil {
+		payload = append(payload, runsBox("ctts", t.CompositionVersion, t.Composition)...)
+	}
+	if t.HasSync {
+		stss := binary.BigEndian.AppendUint32(nil, uint32(len(t.Sync)))
+		for _, sample := range t.Sync {
+			stss = binary.BigEndian.AppendUint32(stss, sample)
+		}
+		payload = append(payload, fullBox("stss", 0, stss)...)
+	}
+
+	var stsc []byte
+	runs := 0
+	for i, chunk := range t.Chunks {
+		if i > 0 && chunk.Samples == t.Chunks[i-1].Samples {
+			continue
+		}
+		stsc = binary.BigEndian.AppendUint32(stsc, uint32(i+1))
+		stsc = binary.BigEndian.AppendUint32(stsc, chunk.Samples)
+		stsc = binary.BigEndian.AppendUint32(stsc, 1)
+		runs++
+	}
+	payload = append(payload, fullBox("stsc", 0, append(binary.BigEndian.AppendUint32(nil, uint32(runs)), stsc...))...)
+
+	constant := len(t.Sizes) > 0
+	for _, size := range t.Sizes {
+		constant = constant && size == t.Sizes[0]
+	}
+	var stsz []byte
+	if constant {
+		stsz = binary.BigEndian.AppendUint32(stsz, t.Sizes[0])
+		stsz = binary.BigEndian.AppendUint32(stsz, uint32(len(t.Sizes)))
+	} else {
+		stsz = binary.BigEndian.AppendUint32(stsz, 0)
+		stsz = binary.BigEndian.AppendUint32(stsz, uint32(len(t.Sizes)))
+		for _, size := range t.Sizes {
+			stsz = binary.BigEndian.AppendUint32(stsz, size)
+		}
+	}
+	payload = append(payload, fullBox("stsz", 0, stsz)...)
+
+	co64 := binary.BigEndian.AppendUint32(nil, uint32(len(t.Chunks)))
+	for _, chunk := range t.Chunks {
+		co64 = binary.BigEndian.AppendUint64(co64, uint64(dataStart+chunk.Position))
+	}
+	payload = append(payload, fullBox("co64", 0, co64)...)
+
+	if t.Dependencies != nil {
+		payload = append(payload, fullBox("sdtp", 0, t.Dependencies)...)
+	}
+	return append(mp4BoxHeader("stbl", len(payload)), payload...)
+}
+
+// setHeaderTimes returns a copy of the mvhd, tkhd or mdhd box stored in
+// data with its creation and modification time set to created and its
+// duration to duration.
+func setHeaderTimes(data []byte, created time.Time, duration uint64) ([]byte, error) {
+	data = append([]byte{}, data...)
+	payload := boxPayload(data)
+	// The timescale, or the track ID and a reserved field, come between
+	// the times and the duration
+	between := 4
+	if boxOf(data).Type == "tkhd" {
+		between = 8
+	}
+	seconds := uint64(0)
+	if created.After(macEpoch) {
+		seconds = uint64(created.Sub(macEpoch) / time.Second)
+	}
+	if len(payload) > 0 && payload[0] == 1 {
+		if len(payload) < 20+between+8 {
+			return nil, fmt.Errorf("invalid %s box", boxOf(data).Type)
+		}
+		binary.BigEndian.PutUint64(payload[4:], seconds)
+		binary.BigEndian.PutUint64(payload[12:], seconds)
+		binary.BigEndian.PutUint64(payload[20+between:], duration)
+		return data, nil
+	}
+	if len(payload) < 12+between+4 || duration > math.MaxUint32 || seconds > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid %s box", boxOf(data).Type)
+	}
+	binary.BigEndian.PutUint32(payload[4:], uint32(seconds))
+	binary.BigEndian.PutUint32(payload[8:], uint32(seconds))
+	binary.BigEndian.PutUint32(payload[12+between:], uint32(duration))
+	return data, nil
+}
+
+// editBox returns an edts box with a single edit of duration, in the movie
+// timescale, starting at mediaTime.
+func editBox(duration uint64, mediaTime int64) []byte {
+	elst := binary.BigEndian.AppendUint32(nil, 1)
+	version := byte(0)
+	if duration > math.MaxUint32 || mediaTime > math.MaxInt32 {
+		version = 1
+		elst = binary.BigEndian.AppendUint64(elst, duration)
+		elst = binary.BigEndian.AppendUint64(elst, uint64(mediaTime))
+	} else {
+		elst = binary.BigEndian.AppendUint32(elst, uint32(duration))
+		elst = binary.BigEndian.AppendUint32(elst, uint32(mediaTime))
+	}
+	elst = binary.BigEndian.AppendUint32(elst, 0x10000)
+	elst = fullBox("elst", version, elst)
+	return append(mp4BoxHeader("edts", len(elst)), elst...)
+}
+
+// movieDuration converts the duration of track to the movie timescale.
+func (t nativeTrack) movieDuration(movieTimescale uint32) uint64 {
+	return (t.duration()*uint64(movieTimescale) + uint64(t.Timescale)/2) / uint64(t.Timescale)
+}
+
+// moov returns the moov box of the output, whose media data starts at
+// dataStart. It is the moov box of the first chapter with the merged
+// tracks, the times set to creationTime, and hilights in its udta box.
+func (p *nativePlan) moov(dataStart int64, hilights []time.Duration, creationTime time.Time) ([]byte, error) {
+	first := p.Chapters[0]
+	var movieDuration uint64
+	for _, track := range p.Tracks {
+		movieDuration = max(movieDuration, track.movieDuration(first.MovieTimescale))
+	}
+
+	trak := 0
+	hasUserData := false
+	moov, err := rebuildBox(first.Moov, func(child []byte) ([]byte, error) {
+		switch boxOf(child).Type {
+		case "mvhd":
+			return setHeaderTimes(child, creationTime, movieDuration)
+		case "trak":
+			trak++
+			return p.Tracks[trak-1].trak(first.MovieTimescale, dataStart, creationTime)
+		case "udta":
+			hasUserData = true
+			return rebuildBox(child, func(box []byte) ([]byte, error) {
+				if skippedUserData[boxOf(box).Type] {
+					return nil, nil
+				}
+				return box, nil
+			})
+		}
+		return child, nil
+	})
+	if err != nil || len(hilights) == 0 {
+		return moov, err
+	}
+
+	// The HiLights of all chapters go at the end of udta
+	if !hasUserData {
+		moov = append(moov, mp4BoxHeader("udta", 0)...)
+		binary.BigEndian.PutUint32(moov, uint32(len(moov)))
+	}
+	return rebuildBox(moov, func(child []byte) ([]byte, error) {
+		if boxOf(child).Type != "udta" {
+			return child, nil
+		}
+		udta := append(append([]byte{}, child...), hiLightBox(hilights)...)
+		binary.BigEndian.PutUint32(udta, uint32(len(udta)))
+		return udta, nil
+	})
+}
+
+// trak returns the trak box of t with its header boxes updated and its
+// sample table rebuilt.
+func (t nativeTrack) trak(movieTimescale uint32, dataStart int64, creationTime time.Time) ([]byte, error) {
+	movieDuration := t.movieDuration(movieTimescale)
+	return rebuildBox(t.Trak, func(child []byte) ([]byte, error) {
+		switch boxOf(child).Type {
+		case "tkhd":
+			return setHeaderTimes(child, creationTime, movieDuration)
+		case "edts":
+			return editBox(movieDuration, t.MediaTime), nil
+		case "mdia":
+			return rebuildBox(child, func(child []byte) ([]byte, error) {
+				switch boxOf(child).Type {
+				case "mdhd":
+					return setHeaderTimes(child, creationTime, t.duration())
+				case "minf":
+					return rebuildBox(child, func(child []byte) ([]byte, error) {
+						if boxOf(child).Type == "stbl" {
+							return t.sampleTable(dataStart), nil
+						}
+						return child, nil
+					})
+				}
+				return child, nil
+			})
+		}
+		return child, nil
+	})
+}
+
+// writeNative writes the output of plan to outputPath: the ftyp box of the
+// first chapter, the merged moov box, which makes the output start
+// playing before it is fully read, and the media data of all chapters.
+func writeNative(outputPath string, plan *nativePlan, hilights []time.Duration, creationTime time.Time) error {
+	mdatHeader := mp4BoxHeader("mdat", int(plan.DataSize))
+	if plan.DataSize+8 > math.MaxUint32 {
+		mdatHeader = make([]byte, 16)
+		binary.BigEndian.PutUint32(mdatHeader, 1)
+		copy(mdatHeader[4:], "mdat")
+		binary.BigEndian.PutUint64(mdatHeader[8:], uint64(plan.DataSize+16))
+	}
+
+	// The chunk offsets are 64 bit, so the size of moov does not depend on them
+	ftyp := plan.Chapters[0].Ftyp
+	moov, err := plan.moov(0, hilights, creationTime)
+	if err != nil {
+		return err
+	}
+	moov, err = plan.moov(int64(len(ftyp)+len(moov)+len(mdatHeader)), hilights, creationTime)
+	if err != nil {
+		return err
+	}
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	err = writeNativeData(output, plan, ftyp, moov, mdatHeader)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+	}
+	return err
+}
+
+// writeNativeData writes the boxes and then the media data of every
+// chapter of plan to output.
+func writeNativeData(output io.Writer, plan *nativePlan, boxes ...[]byte) error {
+	w := bufio.NewWriterSize(output, 1<<20)
+	for _, box := range boxes {
+		if _, err := w.Write(box); err != nil {
+			return err
+		}
+	}
+	for _, chapter := range plan.Chapters {
+		input, err := os.Open(chapter.Path)
+		if err != nil {
+			return err
+		}
+		for _, box := range chapter.MediaData {
+			_, err = io.Copy(w, io.NewSectionReader(input, box.PayloadOffset(), box.Size-box.HeaderSize))
+			if err != nil {
+				break
+			}
+		}
+		input.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy the media data of %s: %v", chapter.Path, err)
+		}
+	}
+	return w.Flush()
+}
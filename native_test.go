@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// u32 encodes values as big endian 32 bit integers.
+func u32(values ...int) []byte {
+	var data []byte
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint32(data, uint32(value))
+	}
+	return data
+}
+
+// nativeFixture describes a synthetic chapter with a 60000/1001 fps video
+// track in chunks of two samples and a 48kHz audio track in one chunk.
+type nativeFixture struct {
+	Video, Audio int
+	// Entry is the sample entry of the video track, avc1 when empty.
+	Entry string
+	// AudioEdit, when set, is the media time of an edit list of the audio
+	// track.
+	AudioEdit int
+}
+
+// writeNativeFixture writes the chapter f describes to dir and returns its
+// path and the video and audio samples it holds.
+func writeNativeFixture(t *testing.T, dir, name string, f nativeFixture) (string, [][]byte, [][]byte) {
+	t.Helper()
+	if f.Entry == "" {
+		f.Entry = "avc1"
+	}
+	var video, audio [][]byte
+	for i := 0; i < f.Video; i++ {
+		video = append(video, []byte(fmt.Sprintf("%s video frame %d", name, i)))
+	}
+	for i := 0; i < f.Audio; i++ {
+		audio = append(audio, []byte(fmt.Sprintf("%s a%02d", name, i)))
+	}
+
+	ftyp := mp4BoxBytes("ftyp", []byte("mp41"), u32(0), []byte("mp41"))
+	base := len(ftyp) + 8
+	var media []byte
+	var videoOffsets, audioOffsets []int
+	for i := 0; i < len(video); i += 2 {
+		videoOffsets = append(videoOffsets, base+len(media))
+		media = append(media, bytes.Join(video[i:min(i+2, len(video))], nil)...)
+		if i == 0 {
+			audioOffsets = append(audioOffsets, base+len(media))
+			media = append(media, bytes.Join(audio, nil)...)
+		}
+	}
+
+	videoDuration, audioDuration := 1001*len(video), 1024*len(audio)
+	var audioEdit []byte
+	if f.AudioEdit > 0 {
+		audioEdit = mp4BoxBytes("edts", mp4BoxBytes("elst", u32(0, 1, audioDuration*1000/48000, f.AudioEdit, 0x10000)))
+	}
+	moov := mp4BoxBytes("moov",
+		mp4BoxBytes("mvhd", u32(0, 0, 0, 1000, videoDuration*1000/60000), make([]byte, 80)),
+		nativeTrackFixture(1, "vide", 60000, 1001, video, 2, videoOffsets, []int{1, 4}, f.Entry,
+			mp4BoxBytes("edts", mp4BoxBytes("elst", u32(0, 1, videoDuration*1000/60000, 0, 0x10000)))),
+		nativeTrackFixture(2, "soun", 48000, 1024, audio, len(audio), audioOffsets, nil, "mp4a", audioEdit),
+		cameraUserData())
+	path := writeFixture(t, dir, name, ftyp, mp4BoxBytes("mdat", media), moov)
+	return path, video, audio
+}
+
+// nativeTrackFixture returns a trak box of samples stored in chunks of
+// perChunk samples at offsets, with sync samples when sync is not nil.
+func nativeTrackFixture(id int, handler string, timescale, delta int, samples [][]byte, perChunk int, offsets, sync []int, entry string, edts []byte) []byte {
+	n := len(samples)
+	stsz := u32(0, 0, n)
+	for _, sample := range samples {
+		stsz = append(stsz, u32(len(sample))...)
+	}
+	stsc := u32(0, 1, 1, perChunk, 1)
+	if n%perChunk != 0 {
+		stsc = u32(0, 2, 1, perChunk, 1, len(offsets), n%perChunk, 1)
+	}
+	stbl := [][]byte{
+		mp4BoxBytes("stsd", u32(0, 1), mp4BoxBytes(entry, make([]byte, 16))),
+		mp4BoxBytes("stts", u32(0, 1, n, delta)),
+		mp4BoxBytes("stsz", stsz),
+		mp4BoxBytes("stsc", stsc),
+		mp4BoxBytes("stco", u32(0, len(offsets)), u32(offsets...)),
+	}
+	if sync != nil {
+		stbl = append(stbl, mp4BoxBytes("stss", u32(0, len(sync)), u32(sync...)))
+	}
+	return mp4BoxBytes("trak",
+		mp4BoxBytes("tkhd", u32(3, 0, 0, id, 0, n*delta*1000/timescale), make([]byte, 60)),
+		edts,
+		mp4BoxBytes("mdia",
+			mp4BoxBytes("mdhd", u32(0, 0, 0, timescale, n*delta, 0)),
+			mp4BoxBytes("hdlr", u32(0, 0), []byte(handler), make([]byte, 13)),
+			mp4BoxBytes("minf", mp4BoxBytes("stbl", stbl...))))
+}
+
+// nativeSamples reads the samples of track from the file at path.
+func nativeSamples(t *testing.T, path string, track nativeTrack) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples [][]byte
+	for _, chunk := range track.Chunks {
+		offset := chunk.Offset
+		for i := uint32(0); i < chunk.Samples; i++ {
+			size := int64(track.Sizes[len(samples)])
+			samples = append(samples, data[offset:offset+size])
+			offset += size
+		}
+	}
+	return samples
+}
+
+func TestNativeConcat(t *testing.T) {
+	dir := t.TempDir()
+	first, video1, audio1 := writeNativeFixture(t, dir, "GH010042.MP4", nativeFixture{Video: 6, Audio: 4})
+	second, video2, audio2 := writeNativeFixture(t, dir, "GH020042.MP4", nativeFixture{Video: 5, Audio: 4})
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	plan, err := planNative([]FileInfo{{Path: first}, {Path: second}}, Options{Container: containerMP4})
+	if err != nil {
+		t.Fatalf("planNative() error: %v", err)
+	}
+	creationTime := time.Date(2024, time.May, 1, 10, 0, 0, 0, time.UTC)
+	hilights := []time.Duration{1500 * time.Millisecond}
+	if err := writeNative(outputPath, plan, hilights, creationTime); err != nil {
+		t.Fatalf("writeNative() error: %v", err)
+	}
+
+	// The moov box goes before the media data
+	file, err := os.Open(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := file.Stat()
+	boxes, err := readBoxes(file, 0, info.Size())
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, box := range boxes {
+		types = append(types, box.Type)
+	}
+	if strings.Join(types, " ") != "ftyp moov mdat" {
+		t.Errorf("Expected ftyp, moov and mdat, got %v", types)
+	}
+
+	output, err := parseNativeChapter(outputPath)
+	if err != nil {
+		t.Fatalf("The output does not parse: %v", err)
+	}
+	if len(output.Tracks) != 2 {
+		t.Fatalf("Expected 2 tracks, got %d", len(output.Tracks))
+	}
+	videoTrack, audioTrack := output.Tracks[0], output.Tracks[1]
+
+	// Every sample is there in order
+	for _, c := range []struct {
+		track    nativeTrack
+		expected [][]byte
+	}{
+		{videoTrack, append(video1, video2...)},
+		{audioTrack, append(audio1, audio2...)},
+	} {
+		samples := nativeSamples(t, outputPath, c.track)
+		if len(samples) != len(c.expected) {
+			t.Errorf("Expected %d %s samples, got %d", len(c.expected), c.track.Handler, len(samples))
+			continue
+		}
+		for i := range samples {
+			if !bytes.Equal(samples[i], c.expected[i]) {
+				t.Errorf("%s sample %d is %q, expected %q", c.track.Handler, i, samples[i], c.expected[i])
+			}
+		}
+	}
+	if fmt.Sprint(videoTrack.Sync) != "[1 4 7 10]" {
+		t.Errorf("Expected the sync samples of the second chapter after the first, got %v", videoTrack.Sync)
+	}
+	if len(audioTrack.Sync) != 0 || audioTrack.HasSync {
+		t.Errorf("Expected no stss for audio, got %v", audioTrack.Sync)
+	}
+
+	// The audio of the first chapter, 4096 of 48000, is padded to its video, 6006 of 60000
+	if fmt.Sprint(audioTrack.Deltas) != "[1024 1024 1024 1733 1024 1024 1024 1024]" {
+		t.Errorf("Expected the last audio sample before the join to be padded, got %v", audioTrack.Deltas)
+	}
+	if videoTrack.duration() != 11*1001 || videoTrack.MediaTime != 0 || audioTrack.MediaTime != -1 {
+		t.Errorf("Unexpected video track %d %d or audio edit %d", videoTrack.duration(), videoTrack.MediaTime, audioTrack.MediaTime)
+	}
+	mvhd, err := subBox(output.Moov, "mvhd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := boxPayload(mvhd)
+	created := macEpoch.Add(time.Duration(binary.BigEndian.Uint32(payload[4:])) * time.Second)
+	if !created.Equal(creationTime) || binary.BigEndian.Uint32(payload[16:]) != 185 {
+		t.Errorf("Expected the movie to be created at %v and last 185ms, got %v and %d", creationTime, created, binary.BigEndian.Uint32(payload[16:]))
+	}
+
+	// The camera metadata is kept, with the HiLights of all chapters
+	camera, err := readCameraInfo(outputPath)
+	if err != nil || camera.Firmware != "H22.01.01.10.00" {
+		t.Errorf("Expected the firmware of the first chapter, got %+v (%v)", camera, err)
+	}
+	got, err := readHiLights(outputPath)
+	if err != nil || len(got) != 1 || got[0] != hilights[0] {
+		t.Errorf("Expected HiLights %v, got %v (%v)", hilights, got, err)
+	}
+}
+
+func TestPlanNativeRefuses(t *testing.T) {
+	dir := t.TempDir()
+	first, _, _ := writeNativeFixture(t, dir, "GH010042.MP4", nativeFixture{Video: 4, Audio: 2})
+	hevc, _, _ := writeNativeFixture(t, dir, "GH020042.MP4", nativeFixture{Video: 4, Audio: 2, Entry: "hvc1"})
+	primed, _, _ := writeNativeFixture(t, dir, "GH030042.MP4", nativeFixture{Video: 4, Audio: 2, AudioEdit: 1024})
+	primed2, _, _ := writeNativeFixture(t, dir, "GH040042.MP4", nativeFixture{Video: 4, Audio: 2, AudioEdit: 1024})
+	// A chapter with a HiLight, which ffmpeg makes a chapter marker of
+	plan, err := planNative([]FileInfo{{Path: first}}, Options{Container: containerMP4})
+	if err != nil {
+		t.Fatalf("planNative() error: %v", err)
+	}
+	tagged := filepath.Join(dir, "GH050042.MP4")
+	if err := writeNative(tagged, plan, []time.Duration{time.Second}, time.Now()); err != nil {
+		t.Fatalf("writeNative() error: %v", err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		paths  []string
+		opts   Options
+		reason string
+	}{
+		{"sample description", []string{first, hevc}, Options{Container: containerMP4}, "GH020042.MP4: the sample description of track 1 differs"},
+		{"priming", []string{primed, primed2}, Options{Container: containerMP4}, "audio with priming samples"},
+		{"option", []string{first, first}, Options{Container: containerMP4, Reencode: true}, "-reencode is not supported"},
+		{"container", []string{first, first}, Options{Container: containerMKV}, "-container mkv is not supported"},
+		{"resample", []string{first, first}, Options{Container: containerMP4, ResampleAudio: true}, "-resample-audio is not supported"},
+		{"vendor metadata", []string{first, first}, Options{Container: containerMP4, NoVendorMetadata: true}, "-no-vendor-metadata is not supported"},
+		{"hilights", []string{tagged, first}, Options{Container: containerMP4}, "GH050042.MP4: HiLight chapters are not supported"},
+		{"remote", []string{first, "https://example.com/GH020042.MP4"}, Options{Container: containerMP4}, "remote inputs"},
+	} {
+		var files []FileInfo
+		for _, path := range c.paths {
+			files = append(files, FileInfo{Path: path})
+		}
+		_, err := planNative(files, c.opts)
+		if err == nil || !strings.Contains(err.Error(), c.reason) {
+			t.Errorf("%s: expected an error about %q, got %v", c.name, c.reason, err)
+		}
+	}
+
+	// Sample tables with boxes it does not know
+	stbl := mp4BoxBytes("stbl",
+		mp4BoxBytes("stsd", u32(0, 1), mp4BoxBytes("mp4a", make([]byte, 16))),
+		mp4BoxBytes("sgpd", u32(0)))
+	if err := parseSampleTable(stbl, &nativeTrack{}); err == nil || !strings.Contains(err.Error(), "unsupported sgpd box") {
+		t.Errorf("Expected the sgpd box to be refused, got %v", err)
+	}
+}
+
+func TestMergeFilesNative(t *testing.T) {
+	dir := t.TempDir()
+	first, video1, _ := writeNativeFixture(t, dir, "GH010042.MP4", nativeFixture{Video: 6, Audio: 4})
+	second, video2, _ := writeNativeFixture(t, dir, "GH020042.MP4", nativeFixture{Video: 5, Audio: 4})
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probe := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		return probe, nil
+	}
+	var ffmpegRuns int
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		ffmpegRuns++
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	var logs bytes.Buffer
+	opts := Options{Backend: backendNative, Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	if err := mergeFiles(outputPath, []string{second, first}, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if ffmpegRuns != 0 {
+		t.Errorf("Expected no ffmpeg run, got %d", ffmpegRuns)
+	}
+	output, err := parseNativeChapter(outputPath)
+	if err != nil {
+		t.Fatalf("The output does not parse: %v", err)
+	}
+	if samples := nativeSamples(t, outputPath, output.Tracks[0]); len(samples) != len(video1)+len(video2) || !bytes.Equal(samples[0], video1[0]) {
+		t.Errorf("Expected the video of both chapters in order, got %q", samples)
+	}
+
+	// Chapters that differ are merged by ffmpeg
+	hevc, _, _ := writeNativeFixture(t, dir, "GH030042.MP4", nativeFixture{Video: 5, Audio: 4, Entry: "hvc1"})
+	if err := mergeFiles(outputPath, []string{first, hevc}, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if ffmpegRuns == 0 {
+		t.Error("Expected ffmpeg to merge chapters that differ")
+	}
+	if !strings.Contains(logs.String(), "merging with ffmpeg") || !strings.Contains(logs.String(), "sample description of track 1 differs") {
+		t.Errorf("Expected the fallback to be logged, got: %s", logs.String())
+	}
+}
+
+// framemd5 returns the hashes of the decoded frames of the file at path.
+func framemd5(t *testing.T, path string) []string {
+	t.Helper()
+	out, err := exec.Command("ffmpeg", "-nostdin", "-v", "error", "-i", path, "-map", "0:v", "-f", "framemd5", "-").Output()
+	if err != nil {
+		t.Fatalf("ffmpeg framemd5 of %s failed: %v", path, err)
+	}
+	var hashes []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		hashes = append(hashes, strings.TrimSpace(fields[len(fields)-1]))
+	}
+	return hashes
+}
+
+func TestNativeMatchesFFmpeg(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH010042", "GH020042"} {
+		inputFile, err := createTestVideoFileIn(dir, name)
+		if err != nil {
+			t.Fatalf("Failed to create temp video file: %v", err)
+		}
+		inputFile.Close()
+		inputPaths = append(inputPaths, inputFile.Name())
+	}
+
+	outputs := map[string]string{}
+	for _, backend := range []string{backendFFmpeg, backendNative} {
+		var logs bytes.Buffer
+		outputPath := filepath.Join(dir, backend+".mp4")
+		opts := Options{Backend: backend, Verify: true, Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+		if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+			t.Fatalf("mergeFiles() with the %s backend error: %v", backend, err)
+		}
+		if strings.Contains(logs.String(), "merging with ffmpeg") {
+			t.Fatalf("Expected the native backend to merge the chapters, got: %s", logs.String())
+		}
+		outputs[backend] = outputPath
+	}
+
+	expected, err := probeFile(outputs[backendFFmpeg])
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := probeFile(outputs[backendNative])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if differences := compareStreams(expected.Streams, actual.Streams); len(differences) > 0 {
+		t.Errorf("Expected the streams of the ffmpeg output, got: %v", differences)
+	}
+	expectedFrames, actualFrames := framemd5(t, outputs[backendFFmpeg]), framemd5(t, outputs[backendNative])
+	if len(expectedFrames) == 0 || strings.Join(actualFrames, " ") != strings.Join(expectedFrames, " ") {
+		t.Errorf("Expected the frames of the ffmpeg output %v, got %v", expectedFrames, actualFrames)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// defaultMaxOpenFiles is how many inputs preflight checks at once unless
+// Options.MaxOpenFiles says otherwise.
+const defaultMaxOpenFiles = 32
+
+// descriptorsPerCheck is how many descriptors checking one input may hold:
+// the input itself and the pipes of the ffprobe it runs.
+const descriptorsPerCheck = 4
+
+// reservedDescriptors are kept free for the standard streams, the logs and
+// the scratch files of the merge.
+const reservedDescriptors = 16
+
+// manyInputs is the input count above which run warns before merging.
+const manyInputs = 500
+
+// fileLimit is a variable so tests can replace the limit of open files of
+// the process.
+var fileLimit = softFileLimit
+
+// softFileLimit returns the soft limit of open files of the process, the
+// one ulimit -n shows, or zero when it is unknown.
+func softFileLimit() int {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	if limit.Cur > 1<<20 {
+		return 1 << 20
+	}
+	return int(limit.Cur)
+}
+
+// maxOpenFiles returns how many inputs may be open at once: opts.MaxOpenFiles,
+// or defaultMaxOpenFiles when it is zero, lowered to what the limit of
+// open files of the process allows.
+func (o Options) maxOpenFiles() int {
+	n := o.MaxOpenFiles
+	if n <= 0 {
+		n = defaultMaxOpenFiles
+	}
+	if limit := fileLimit(); limit > 0 {
+		allowed := (limit - reservedDescriptors) / descriptorsPerCheck
+		if n > allowed {
+			o.logger().Warn("lowering -max-open-files to the limit of open files", "max_open_files", n, "allowed", allowed, "ulimit", limit)
+			n = allowed
+		}
+	}
+	return max(n, 1)
+}
+
+// forEachInput calls fn with every index below n, running at most limit
+// calls at once, and returns when all of them have.
+func forEachInput(n, limit int, fn func(i int)) {
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// checkReencodeInputs fails a re-encoding merge of n inputs that ffmpeg
+// cannot open at once. Unlike the concat demuxer, which opens one input
+// after another, the concat filter opens every input before it starts.
+func checkReencodeInputs(n int) error {
+	limit := fileLimit()
+	if limit <= 0 || n+reservedDescriptors <= limit {
+		return nil
+	}
+	return fmt.Errorf("re-encoding opens all %d inputs at once, more than the limit of %d open files allows. Raise it with ulimit -n or merge the inputs in batches", n, limit)
+}
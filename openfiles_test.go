@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaxOpenFiles(t *testing.T) {
+	origFileLimit := fileLimit
+	defer func() { fileLimit = origFileLimit }()
+
+	tests := []struct {
+		name         string
+		maxOpenFiles int
+		limit        int
+		expected     int
+	}{
+		{"default", 0, 0, defaultMaxOpenFiles},
+		{"flag", 100, 10240, 100},
+		// ulimit -n 256 leaves (256-16)/4 = 60 inputs
+		{"lowered to ulimit", 100, 256, 60},
+		{"at least one", 8, 16, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fileLimit = func() int { return test.limit }
+			got := Options{MaxOpenFiles: test.maxOpenFiles}.maxOpenFiles()
+			if got != test.expected {
+				t.Errorf("Expected %d, got %d", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestCheckReencodeInputs(t *testing.T) {
+	origFileLimit := fileLimit
+	defer func() { fileLimit = origFileLimit }()
+	fileLimit = func() int { return 256 }
+
+	if err := checkReencodeInputs(240); err != nil {
+		t.Errorf("Expected 240 inputs to fit into ulimit 256, got %v", err)
+	}
+	err := checkReencodeInputs(241)
+	if err == nil || !strings.Contains(err.Error(), "ulimit -n") {
+		t.Errorf("Expected an error suggesting ulimit -n, got %v", err)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Options configures a merge. The zero value is ready to use.
+type Options struct {
+	// Logger receives diagnostic output, including ffmpeg's own output at
+	// debug level. Nil discards everything.
+	Logger *slog.Logger
+
+	// Reencode re-encodes the video stream instead of copying it.
+	Reencode bool
+	// HWAccel names the hardware acceleration used when re-encoding, e.g.
+	// "videotoolbox". Empty means software encoding.
+	HWAccel string
+
+	// VideoCodec overrides the encoder used when re-encoding, either an
+	// encoder name or codecH264 or codecHEVC. CRF and Preset configure
+	// software encoders, zero values mean defaultCRF and defaultPreset.
+	// VideoToolbox encoders map CRF to their own quality scale. Bitrate,
+	// e.g. "50M", replaces CRF for every encoder.
+	VideoCodec string
+	CRF        int
+	Preset     string
+	Bitrate    string
+
+	// Streams selects which input streams are copied, streamsAll (the
+	// default when empty) or streamsEssential.
+	Streams string
+
+	// Faststart moves the moov atom in front of the media data. ffmpeg
+	// does this in a second pass that temporarily needs as much free
+	// space as the output itself.
+	Faststart bool
+	// Movflags are further flags of the ffmpeg mov muxer for MP4 and MOV
+	// outputs, without their +, see parseMovflags. faststart goes through
+	// Faststart instead.
+	Movflags []string
+
+	// Backend is backendFFmpeg, the default when empty, or backendNative,
+	// which concatenates identical MP4 chapters without ffmpeg and falls
+	// back to it for anything else, see planNative.
+	Backend string
+
+	// Segmented remuxes every chapter into a segment directory next to
+	// the output before concatenating the segments. Segments completed by
+	// an earlier, failed run are reused.
+	Segmented bool
+
+	// VerifyTelemetry compares the number of gpmd packets in the output
+	// with the sum over the inputs after merging, allowing the counts to
+	// differ by TelemetryTolerance.
+	VerifyTelemetry    bool
+	TelemetryTolerance int
+
+	// TwoPass probes the output a second time after merging and checks
+	// that every stream expected from the inputs is there with the same
+	// codec, resolution, pixel format and frame rate, or audio codec,
+	// sample rate and channels, failing with the differences otherwise.
+	TwoPass bool
+
+	// CheckJoins compares the audio and video length of every chapter
+	// before merging. The ones differing by more than JoinThreshold, or
+	// defaultJoinThreshold when it is zero, are logged and, when JoinsFunc
+	// is set, passed to it.
+	CheckJoins    bool
+	JoinThreshold time.Duration
+	JoinsFunc     func([]JoinDrift)
+
+	// ReportGaps compares when every chapter started, by its birth time,
+	// with when the one before ended, see findGaps. The gaps longer than
+	// GapThreshold, or defaultGapThreshold when it is zero, are logged and,
+	// when GapsFunc is set, passed to it.
+	ReportGaps   bool
+	GapThreshold time.Duration
+	GapsFunc     func([]ChapterGap)
+
+	// TempDir holds the scratch files of a merge. Empty means the system
+	// temp directory.
+	TempDir string
+	// DeterministicTempNames names scratch files after the output instead
+	// of randomly, so they can be found and inspected when debugging. A
+	// hash of the absolute output path keeps outputs of the same name in
+	// different directories apart.
+	DeterministicTempNames bool
+
+	// Container is the output container, containerMP4, containerMOV or
+	// containerMKV. Empty means the one matching the output file extension.
+	Container string
+
+	// Chapters adds a chapter marker at the start of every input file,
+	// instead of the chapters made from HiLights.
+	Chapters bool
+
+	// EmbedSourceList writes the names of the input files into the
+	// comment metadata of the output.
+	EmbedSourceList bool
+
+	// Metadata holds the title, location and comment of recordings by file
+	// number. The output gets the ones of the file number of its first
+	// chapter, and a warning is logged when there are none. A single MP4
+	// input is remuxed instead of copied to write them.
+	Metadata map[int]RecordingMetadata
+
+	// Geotag is a GPS track, see readGPX, locating the output at its point
+	// nearest the creation time of the output plus GeotagOffset, how far
+	// the clock of the track is ahead of the one of the camera. A nearest
+	// point further than GeotagMaxGap, or defaultGeotagMaxGap when zero,
+	// fails the merge instead of guessing. A location from Metadata is
+	// kept over the track. GeotagFunc, when set, receives the match. Nil
+	// locates nothing.
+	Geotag       []TrackPoint
+	GeotagOffset time.Duration
+	GeotagMaxGap time.Duration
+	GeotagFunc   func(GeotagMatch)
+
+	// LoopRecording orders the inputs by time when their names are
+	// ambiguous, as loop recording reuses file numbers.
+	LoopRecording bool
+
+	// SortKey, when set, orders the inputs by the two keys it returns for
+	// them, the first one before the second, instead of by file and
+	// chapter number. It takes precedence over LoopRecording.
+	SortKey func(FileInfo) (int, int)
+
+	// OrderBy orders the inputs by orderByBirthTime or orderByModTime
+	// instead of by name, orderByName or empty. SortKey takes precedence.
+	OrderBy string
+
+	// KeepOrder merges the inputs in the order given, as read from a concat
+	// list, instead of ordering them. It takes precedence over the other
+	// orders.
+	KeepOrder bool
+
+	// First is the input merged first, whatever the order, for when
+	// damaged times put the wrong chapter first. The others follow it in
+	// their order. Empty leaves the order as it is.
+	First string
+
+	// LinkSingle hard links a single MP4 input to the output instead of
+	// copying it, falling back to a copy across file systems.
+	LinkSingle bool
+
+	// PreMerge is a shell command run before merging, with {inputs}
+	// replaced by the quoted input paths in merge order. The merge is
+	// aborted when it fails.
+	PreMerge string
+
+	// DropAudio leaves the audio out of the output, which is the only way
+	// to merge chapters of which only some have an audio track.
+	DropAudio bool
+	// NoTelemetry leaves out the GPMF telemetry and the other GoPro data
+	// streams, keeping the GPS track private.
+	NoTelemetry bool
+	// RequireTelemetry fails the merge when the installed ffmpeg is too old
+	// to copy the telemetry, see checkCopyUnknown, instead of leaving it out.
+	RequireTelemetry bool
+	// NoVendorMetadata leaves out the metadata keys of the inputs, such as
+	// the firmware version, which MP4 and MOV outputs otherwise carry over
+	// as QuickTime metadata. The udta box, see graftUserData, is still
+	// copied.
+	NoVendorMetadata bool
+	// AudioTrack, counting from 1, keeps only that audio stream of every
+	// input. Zero keeps all of them.
+	AudioTrack int
+
+	// Intro and Outro are clips merged before and after the chapters. A
+	// clip that differs from the chapters in format is re-encoded to
+	// theirs. The concat takes its streams from an intro, so with one the
+	// output has no telemetry or timecode.
+	Intro string
+	Outro string
+
+	// FixTimestamps regenerates missing timestamps and shifts negative
+	// ones, which damaged or recovered chapters have, see
+	// inputArgs and timestampOutputArgs.
+	FixTimestamps bool
+
+	// MaxSize, in bytes, and MaxDuration split the output into a numbered
+	// series of parts within them, see splitOutput. Zero means no limit.
+	// PartsFunc, when set, receives the parts.
+	MaxSize     int64
+	MaxDuration time.Duration
+	PartsFunc   func([]Part)
+
+	// AlsoOutput is a second file or existing directory the output is
+	// written to, copied while the merge finishes the output and moved
+	// into place with it, see startSecondOutput. A failed copy does not
+	// fail the merge, AlsoOutputFunc, when set, receives its path and
+	// error. Empty writes only the output.
+	AlsoOutput     string
+	AlsoOutputFunc func(path string, err error)
+
+	// Start and End trim the merged recording to the range between them.
+	// A negative End counts from the end, zero means no trimming. With
+	// stream copy the output starts at the keyframe at or before Start.
+	// TrimFunc, when set, receives the range kept.
+	Start    time.Duration
+	End      time.Duration
+	TrimFunc func(start, end time.Duration)
+
+	// MaxOpenFiles limits how many inputs are open at once while they are
+	// checked before merging. Zero means defaultMaxOpenFiles. It is lowered
+	// to what the limit of open files of the process allows.
+	MaxOpenFiles int
+
+	// StrictTimes fails the merge when the creation or modification time
+	// of the output cannot be set, instead of only logging a warning.
+	StrictTimes bool
+
+	// FFmpegLogLevel is the -loglevel of the ffmpeg commands, empty for
+	// defaultFFmpegLogLevel. Below the warning level, ffmpeg still runs at
+	// the warning level so its warnings reach Logger.
+	FFmpegLogLevel string
+
+	// Verify checks the output after merging, see verifyOutput: a merge
+	// fails when the output lacks streams of the inputs, or is shorter or
+	// longer than the inputs together by more than DurationTolerance per
+	// join, or defaultDurationTolerance when it is zero. DurationFunc, when
+	// set, receives the duration of the inputs and of the output. The
+	// duration is not checked with IgnoreErrors, which reports the duration
+	// lost through LossFunc instead.
+	Verify            bool
+	DurationTolerance time.Duration
+	DurationFunc      func(expected, actual time.Duration)
+
+	// VerifyFrames also compares the hash of every video and audio frame
+	// of the output with the one of the inputs, see verifyFrames, to prove
+	// the stream copy kept them bit for bit. It reads the inputs and the
+	// output once more, and does not apply to a merge that re-encodes or
+	// trims. FramesFunc, when set, receives the comparison.
+	VerifyFrames bool
+	FramesFunc   func(FrameCheck)
+
+	// KeepPartial keeps the partial output of a failed merge, see
+	// partialPath, for debugging instead of removing it.
+	KeepPartial bool
+
+	// IgnoreErrors makes ffmpeg skip the damaged parts of inputs instead
+	// of aborting the merge. LossFunc, when set, then receives the
+	// expected duration of the output and the duration it has.
+	IgnoreErrors bool
+	LossFunc     func(expected, actual time.Duration)
+
+	// ProgressFunc, when set, receives the progress of the ffmpeg runs of
+	// a merge, parsed from their -progress output.
+	ProgressFunc func(Progress)
+
+	// Thumbnail is a JPEG file written with the frame of the output at
+	// ThumbnailAt after merging. Empty means no thumbnail.
+	Thumbnail   string
+	ThumbnailAt time.Duration
+
+	// Manifest is a text file written after merging that lists where each
+	// input starts and ends in the output. Empty means none.
+	Manifest string
+
+	// CoverArt embeds cover art into the output, from coverArtTHM or
+	// coverArtFrame, see embedCoverArt. Empty means none.
+	CoverArt string
+
+	// CopyXattrs names the extended attributes, such as finderXattrs,
+	// copied from the first chapter to the output after merging. Nil
+	// copies none.
+	CopyXattrs []string
+	// FinderComment sets a Finder comment on the output listing the
+	// chapters it was merged from, see finderComment. It replaces a comment
+	// copied through CopyXattrs, and is ignored outside macOS.
+	FinderComment bool
+
+	// NormalizeAudio re-encodes the audio, which is lossy, normalized to
+	// the integrated loudness LoudnessTarget in LUFS, or
+	// defaultLoudnessTarget when it is zero, in two passes: the first
+	// measures the audio, the second applies the measurement while the
+	// video and data streams are copied. LoudnessFunc, when set, receives
+	// the measurement.
+	NormalizeAudio bool
+	LoudnessTarget float64
+	LoudnessFunc   func(Loudness)
+
+	// ResampleAudio resamples the audio of chapters recorded at another
+	// sample rate than the first one to its rate, re-encoding only their
+	// audio, instead of aborting the merge, see resampleChapters.
+	ResampleAudio bool
+
+	// Proxy writes a low-bitrate H.264 editing proxy of the output next to
+	// it after merging, of the size proxy1080p or proxy720p, see
+	// writeProxy. A proxy that fails only logs a warning. Empty means none.
+	// ProxyFunc, when set, receives the path of the proxy written.
+	Proxy     string
+	ProxyFunc func(path string)
+
+	// LUT is a 3D .cube LUT grading the video while it is re-encoded, for
+	// flat Protune footage; it needs Reencode. ProxyLUT grades the proxy
+	// of Proxy, which is encoded from the output, graded by LUT already.
+	// Empty means none.
+	LUT      string
+	ProxyLUT string
+
+	// BurnTimestamp burns the time of the recording into the video while
+	// it is re-encoded, starting at the creation time of the output; it
+	// needs Reencode. Nil burns nothing.
+	BurnTimestamp *TimestampOverlay
+
+	// Rotate turns the video by 90, 180 or 270 degrees clockwise for
+	// footage of a camera mounted sideways or upside down, by setting the
+	// display matrix of the output instead of re-encoding. Zero leaves
+	// the rotation of the inputs.
+	Rotate int
+
+	// Mode and Owner, as for lookupOwner, are applied to the output after
+	// merging. Zero values leave the mode from the umask and the owner
+	// running the merge.
+	Mode  os.FileMode
+	Owner string
+
+	// Force replaces the parts of an earlier split of the output, which
+	// are otherwise refused.
+	Force bool
+
+	// AllowMismatch merges inputs that differ in format with stream copy,
+	// which otherwise aborts the merge unless Reencode is set.
+	AllowMismatch bool
+
+	// Location is the timezone of the creation_time metadata and of the
+	// creation date shown by the Finder. Nil means local time.
+	Location *time.Location
+
+	// FileNamePattern matches the names of the chapters in upper case, see
+	// compileFileNamePattern. Nil means defaultFileNamePattern.
+	FileNamePattern *regexp.Regexp
+
+	// probes caches the input probe results. Nil probes every time.
+	probes *probeCache
+	// remux sends a single input through ffmpeg like several instead of
+	// copying it, see remuxChapters.
+	remux bool
+}
+
+func (o Options) logger() *slog.Logger {
+	if o.Logger == nil {
+		return discardLogger
+	}
+	return o.Logger
+}
+
+func (o Options) geotagMaxGap() time.Duration {
+	if o.GeotagMaxGap <= 0 {
+		return defaultGeotagMaxGap
+	}
+	return o.GeotagMaxGap
+}
+
+func (o Options) location() *time.Location {
+	if o.Location == nil {
+		return time.Local
+	}
+	return o.Location
+}
+
+func (o Options) fileNamePattern() *regexp.Regexp {
+	if o.FileNamePattern == nil {
+		return defaultFileNamePattern
+	}
+	return o.FileNamePattern
+}
+
+// createTempFile creates a scratch file for the merge into outputPath.
+// The caller removes it.
+func (o Options) createTempFile(outputPath, suffix string) (*os.File, error) {
+	if !o.DeterministicTempNames {
+		return os.CreateTemp(o.TempDir, "*"+suffix)
+	}
+
+	dir := o.TempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	absPath, err := filepath.Abs(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for %s: %v", outputPath, err)
+	}
+	sum := sha256.Sum256([]byte(absPath))
+	return os.Create(filepath.Join(dir, fmt.Sprintf("%s.%x%s", filepath.Base(outputPath), sum[:4], suffix)))
+}
+
+// validateOptions checks the values of o and the combinations of them a
+// merge cannot honour. Zero values stand for the defaults and are valid.
+// Checks that need the output path, e.g. its container, are left to
+// mergeFiles, and those of files such as LUTs to the caller.
+func validateOptions(o Options) error {
+	for _, err := range []error{
+		validateContainer(o.Container),
+		validateStreamSelection(o.Streams),
+		validateMovflags(o.Movflags, o.Faststart),
+		validateBackend(o.Backend),
+		validateOrderBy(o.OrderBy),
+		validateLoudnessTarget(o.loudnessTarget()),
+		validateRotation(o.Rotate),
+		validateCoverArt(o.CoverArt),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if o.FFmpegLogLevel != "" {
+		if err := validateFFmpegLogLevel(o.FFmpegLogLevel); err != nil {
+			return err
+		}
+	}
+	if o.BurnTimestamp != nil {
+		if err := validateTimestampOverlay(*o.BurnTimestamp); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case o.CRF < 0 || o.CRF > 51:
+		return fmt.Errorf("invalid -crf %d: must be between 1 and 51", o.CRF)
+	case o.AudioTrack < 0 || (o.AudioTrack > 0 && o.DropAudio):
+		return fmt.Errorf("-audio-track must be a track number from 1, and cannot be combined with -drop-audio")
+	case o.NormalizeAudio && (o.DropAudio || o.Reencode):
+		return fmt.Errorf("-normalize-audio cannot be combined with -drop-audio, which leaves no audio to normalize, or -reencode")
+	case o.ResampleAudio && (o.Reencode || o.Segmented):
+		return fmt.Errorf("-resample-audio cannot be combined with -reencode, which resamples the audio already, or -segmented")
+	case o.LUT != "" && !o.Reencode:
+		return fmt.Errorf("-lut only applies when re-encoding, stream copy cannot change the footage. Add -reencode, or use -proxy-lut to grade only the -proxy")
+	case o.ProxyLUT != "" && o.Proxy == "":
+		return fmt.Errorf("-proxy-lut only applies to the editing proxy. Please add -proxy")
+	case o.BurnTimestamp != nil && !o.Reencode:
+		return fmt.Errorf("-burn-timestamp only applies when re-encoding, stream copy cannot change the footage. Add -reencode")
+	case o.BurnTimestamp != nil && (o.Intro != "" || o.Outro != ""):
+		return fmt.Errorf("-burn-timestamp cannot be combined with -intro or -outro, which were not recorded with the chapters")
+	case o.Rotate != 0 && o.Reencode:
+		return fmt.Errorf("-rotate cannot be combined with -reencode, which turns the pixels by the rotation of the inputs instead")
+	case o.VerifyFrames && (o.Reencode || o.NormalizeAudio || o.ResampleAudio):
+		return fmt.Errorf("-verify deep cannot be combined with -reencode, -normalize-audio or -resample-audio, which change the frames")
+	case o.VerifyFrames && (o.Start != 0 || o.End != 0):
+		return fmt.Errorf("-verify deep cannot be combined with -start or -end, the frames of a trimmed output do not line up with the inputs")
+	case o.NoTelemetry && o.VerifyTelemetry:
+		return fmt.Errorf("-verify-telemetry cannot be combined with -no-telemetry")
+	case o.NoTelemetry && o.RequireTelemetry:
+		return fmt.Errorf("-require-telemetry cannot be combined with -no-telemetry")
+	case o.AlsoOutput != "" && (o.MaxSize > 0 || o.MaxDuration > 0):
+		return fmt.Errorf("-also-output cannot be combined with -max-size or -max-duration")
+	case o.Start < 0:
+		return fmt.Errorf("-start must not be negative")
+	case o.MaxDuration < 0:
+		return fmt.Errorf("-max-duration must not be negative")
+	case o.ThumbnailAt < 0:
+		return fmt.Errorf("-thumbnail-at must not be negative")
+	case o.DurationTolerance < 0:
+		return fmt.Errorf("-duration-tolerance must be positive")
+	case o.JoinThreshold < 0:
+		return fmt.Errorf("-join-threshold must be positive")
+	case o.GapThreshold < 0:
+		return fmt.Errorf("-gap-threshold must be positive")
+	case o.MaxOpenFiles < 0:
+		return fmt.Errorf("-max-open-files must be at least 1")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateTempFileDeterministic(t *testing.T) {
+	tempDir := t.TempDir()
+	opts := Options{TempDir: tempDir, DeterministicTempNames: true}
+
+	file, err := opts.createTempFile("/videos/merged.mp4", ".concat.txt")
+	if err != nil {
+		t.Fatalf("createTempFile() error: %v", err)
+	}
+	file.Close()
+
+	// The name carries a hash of the absolute output path
+	expected := filepath.Join(tempDir, "merged.mp4.91351c0a.concat.txt")
+	if file.Name() != expected {
+		t.Errorf("Expected temp file %s, got %s", expected, file.Name())
+	}
+	file, err = opts.createTempFile("/videos/merged.mp4", ".concat.txt")
+	if err != nil {
+		t.Fatalf("createTempFile() error: %v", err)
+	}
+	file.Close()
+	if file.Name() != expected {
+		t.Errorf("Expected the same output to get the same temp file %s, got %s", expected, file.Name())
+	}
+	// An output of the same name elsewhere does not share it
+	other, err := opts.createTempFile("/archive/merged.mp4", ".concat.txt")
+	if err != nil {
+		t.Fatalf("createTempFile() error: %v", err)
+	}
+	other.Close()
+	if other.Name() == expected || !strings.HasPrefix(filepath.Base(other.Name()), "merged.mp4.") || !strings.HasSuffix(other.Name(), ".concat.txt") {
+		t.Errorf("Expected another temp file than %s for /archive/merged.mp4, got %s", expected, other.Name())
+	}
+
+	// Random names are still the default
+	opts.DeterministicTempNames = false
+	file, err = opts.createTempFile("/videos/merged.mp4", ".concat.txt")
+	if err != nil {
+		t.Fatalf("createTempFile() error: %v", err)
+	}
+	file.Close()
+	if file.Name() == expected || filepath.Dir(file.Name()) != tempDir || !strings.HasSuffix(file.Name(), ".concat.txt") {
+		t.Errorf("Expected random temp file in %s, got %s", tempDir, file.Name())
+	}
+}
+
+func TestMergeFilesDeterministicTempCleanup(t *testing.T) {
+	dir := t.TempDir()
+	tempFile1, err := createTestVideoFileIn(dir, "GH011234")
+	if err != nil {
+		t.Fatalf("Failed to create temp video file 1: %v", err)
+	}
+	tempFile1.Close()
+
+	tempFile2, err := createTestVideoFileIn(dir, "GH021234")
+	if err != nil {
+		t.Fatalf("Failed to create temp video file 2: %v", err)
+	}
+	tempFile2.Close()
+
+	tempDir := t.TempDir()
+	opts := Options{TempDir: tempDir, DeterministicTempNames: true}
+	creationTime := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	modTime := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	err = mergeFiles(filepath.Join(dir, "merged.mp4"), []string{tempFile1.Name(), tempFile2.Name()}, creationTime, modTime, opts)
+	if err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+
+	// The scratch files must be gone after the merge
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to read temp dir: %v", err)
+	}
+	for _, entry := range entries {
+		t.Errorf("Expected temp dir to be empty, found %s", entry.Name())
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	overlay := &TimestampOverlay{Position: positionBottomRight, Format: defaultTimestampFormat}
+	for _, c := range []struct {
+		name  string
+		opts  Options
+		error string
+	}{
+		{"zero value", Options{}, ""},
+		{"reencode", Options{Reencode: true, CRF: 18, LUT: "flat.cube", BurnTimestamp: overlay}, ""},
+		{"crf", Options{CRF: 52}, "invalid -crf 52"},
+		{"container", Options{Container: "avi"}, `invalid container "avi"`},
+		{"loudness target", Options{LoudnessTarget: 3}, "invalid -loudness-target 3"},
+		{"log level", Options{FFmpegLogLevel: "loud"}, `invalid -loglevel "loud"`},
+		{"rotation", Options{Rotate: 45}, "invalid -rotate 45"},
+		{"overlay", Options{Reencode: true, BurnTimestamp: &TimestampOverlay{Position: "middle"}}, "invalid -timestamp-position"},
+		{"audio track", Options{AudioTrack: 2, DropAudio: true}, "-audio-track must be a track number"},
+		{"normalize audio", Options{NormalizeAudio: true, Reencode: true}, "-normalize-audio cannot be combined"},
+		{"resample audio", Options{ResampleAudio: true, Segmented: true}, "-resample-audio cannot be combined"},
+		{"lut", Options{LUT: "flat.cube"}, "-lut only applies when re-encoding"},
+		{"proxy lut", Options{ProxyLUT: "view.cube"}, "-proxy-lut only applies"},
+		{"burn timestamp", Options{BurnTimestamp: overlay}, "-burn-timestamp only applies when re-encoding"},
+		{"burn timestamp intro", Options{Reencode: true, BurnTimestamp: overlay, Intro: "intro.mp4"}, "-burn-timestamp cannot be combined"},
+		{"rotate", Options{Rotate: 90, Reencode: true}, "-rotate cannot be combined with -reencode"},
+		{"verify deep", Options{VerifyFrames: true, NormalizeAudio: true}, "-verify deep cannot be combined with -reencode"},
+		{"verify deep trim", Options{VerifyFrames: true, Start: time.Second}, "-verify deep cannot be combined with -start"},
+		{"telemetry", Options{NoTelemetry: true, RequireTelemetry: true}, "-require-telemetry cannot be combined"},
+		{"also output", Options{AlsoOutput: "backup.mp4", MaxDuration: time.Hour}, "-also-output cannot be combined"},
+		{"start", Options{Start: -time.Second}, "-start must not be negative"},
+		{"join threshold", Options{JoinThreshold: -time.Second}, "-join-threshold must be positive"},
+		{"max open files", Options{MaxOpenFiles: -1}, "-max-open-files must be at least 1"},
+	} {
+		err := validateOptions(c.opts)
+		if c.error == "" && err != nil {
+			t.Errorf("%s: expected the options to be valid, got %v", c.name, err)
+		}
+		if c.error != "" && (err == nil || !strings.Contains(err.Error(), c.error)) {
+			t.Errorf("%s: expected an error about %q, got %v", c.name, c.error, err)
+		}
+	}
+}
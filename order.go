@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Input orders for Options.OrderBy.
+const (
+	// orderByName orders by the file and chapter numbers in the names.
+	orderByName = "name"
+	// orderByBirthTime orders by creation time, or modification time
+	// where the file system does not record creation times.
+	orderByBirthTime = "birthtime"
+	// orderByModTime orders by modification time.
+	orderByModTime = "modtime"
+)
+
+func validateOrderBy(orderBy string) error {
+	switch orderBy {
+	case "", orderByName, orderByBirthTime, orderByModTime:
+		return nil
+	default:
+		return fmt.Errorf("invalid input order %q: must be %s, %s or %s", orderBy, orderByName, orderByBirthTime, orderByModTime)
+	}
+}
+
+// ambiguousNames reports whether two files share a file and chapter
+// number, as happens when loop recording reuses file numbers. Their names
+// then say nothing about which was recorded first.
+func ambiguousNames(files []FileInfo) bool {
+	type key struct{ fileNumber, chapterNumber int }
+	seen := make(map[key]bool)
+	for _, file := range files {
+		k := key{file.FileNumber, file.ChapterNumber}
+		if seen[k] {
+			return true
+		}
+		seen[k] = true
+	}
+	return false
+}
+
+// sortByTime orders files by birth time, or by modification time when the
+// file system does not record birth times or byModTime is set.
+func sortByTime(files []FileInfo, byModTime bool) error {
+	recorded := make([]time.Time, len(files))
+	for i, file := range files {
+		birthTime, modTime, err := fileTimes(file.Path)
+		if err != nil {
+			return err
+		}
+		recorded[i] = birthTime
+		if birthTime.IsZero() || byModTime {
+			recorded[i] = modTime
+		}
+	}
+
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return recorded[order[i]].Before(recorded[order[j]])
+	})
+	sorted := make([]FileInfo, len(files))
+	for i, index := range order {
+		sorted[i] = files[index]
+	}
+	copy(files, sorted)
+	return nil
+}
+
+// sortByKey orders files by the keys key returns for them, the first one
+// before the second. Files with the same keys keep the order of their
+// names.
+func sortByKey(files []FileInfo, key func(FileInfo) (int, int)) {
+	type sortKey struct{ major, minor int }
+	keys := make(map[string]sortKey, len(files))
+	for _, file := range files {
+		major, minor := key(file)
+		keys[file.Path] = sortKey{major, minor}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := keys[files[i].Path], keys[files[j].Path]
+		if a.major != b.major {
+			return a.major < b.major
+		}
+		return a.minor < b.minor
+	})
+}
+
+// orderFiles collects inputPaths in merge order. That is the order of
+// inputPaths with opts.KeepOrder, otherwise the order of their names
+// unless opts.SortKey or opts.OrderBy is set, or the names are ambiguous
+// and opts.LoopRecording is set, in which case the files are ordered by
+// time. opts.First then goes before the others.
+func orderFiles(inputPaths []string, opts Options) ([]FileInfo, error) {
+	files, err := sortFiles(inputPaths, opts)
+	if err != nil || opts.First == "" {
+		return files, err
+	}
+	return pinFirst(files, opts.First)
+}
+
+// pinFirst moves the input first, as given on the command line, to the
+// front of files, keeping the order of the others. A local first is found
+// by its path or as the same file, spelled in another case or through a
+// link.
+func pinFirst(files []FileInfo, first string) ([]FileInfo, error) {
+	path, err := filepath.Abs(first)
+	if isRemote(first) {
+		path, err = normalizeURL(first)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for %s: %v", first, err)
+	}
+	firstInfo, statErr := os.Stat(first)
+	i := slices.IndexFunc(files, func(file FileInfo) bool {
+		if file.Path == path {
+			return true
+		}
+		if statErr != nil || isRemote(first) || isRemote(file.Path) {
+			return false
+		}
+		info, err := os.Stat(file.Path)
+		return err == nil && os.SameFile(firstInfo, info)
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("-first %s is not one of the inputs", first)
+	}
+	pinned := append([]FileInfo{files[i]}, files[:i]...)
+	return append(pinned, files[i+1:]...), nil
+}
+
+func sortFiles(inputPaths []string, opts Options) ([]FileInfo, error) {
+	logger := opts.logger()
+
+	if opts.KeepOrder {
+		return inputFiles(inputPaths, opts.fileNamePattern())
+	}
+	files, err := collectFiles(inputPaths, opts.fileNamePattern())
+	if err != nil {
+		return nil, err
+	}
+	if opts.SortKey != nil {
+		sortByKey(files, opts.SortKey)
+		return files, nil
+	}
+	if opts.OrderBy == orderByBirthTime || opts.OrderBy == orderByModTime {
+		if err := sortByTime(files, opts.OrderBy == orderByModTime); err != nil {
+			return nil, err
+		}
+		return files, nil
+	}
+	if !ambiguousNames(files) {
+		return files, nil
+	}
+	if !opts.LoopRecording {
+		logger.Warn("several inputs have the same file and chapter number, their order may be wrong. Use -loop-recording to order them by time")
+		return files, nil
+	}
+
+	logger.Warn("file names are ambiguous, ordering inputs by time instead of by name")
+	if err := sortByTime(files, false); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
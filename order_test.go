@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrderFilesLoopRecording(t *testing.T) {
+	// Loop recording reused GH010001 in two card folders, the newer
+	// recording sorts first by path but was recorded last
+	base := time.Date(2024, time.June, 1, 10, 0, 0, 0, time.UTC)
+	recordings := []struct {
+		dir  string
+		time time.Time
+	}{
+		{"100GOPRO", base.Add(time.Hour)},
+		{"101GOPRO", base},
+	}
+	var inputPaths []string
+	for _, recording := range recordings {
+		dir := filepath.Join(t.TempDir(), recording.dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "GH010001.MP4")
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, recording.time, recording.time); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+
+	files, err := collectFiles(inputPaths, defaultFileNamePattern)
+	if err != nil {
+		t.Fatalf("collectFiles() error: %v", err)
+	}
+	if !ambiguousNames(files) {
+		t.Fatalf("Expected the names to be ambiguous")
+	}
+
+	files, err = orderFiles(inputPaths, Options{LoopRecording: true})
+	if err != nil {
+		t.Fatalf("orderFiles() error: %v", err)
+	}
+	if files[0].Path != inputPaths[1] || files[1].Path != inputPaths[0] {
+		t.Errorf("Expected the older recording first, got %s, %s", files[0].Path, files[1].Path)
+	}
+}
+
+func TestOrderFilesByName(t *testing.T) {
+	// Unambiguous names keep their order regardless of the file times
+	files, err := orderFiles([]string{"GH020001.MP4", "GH010001.MP4"}, Options{LoopRecording: true})
+	if err != nil {
+		t.Fatalf("orderFiles() error: %v", err)
+	}
+	if filepath.Base(files[0].Path) != "GH010001.MP4" {
+		t.Errorf("Expected name order, got %s first", files[0].Path)
+	}
+}
+
+func TestOrderFilesSortKey(t *testing.T) {
+	// Chapters first: every file's first chapter before any second chapter
+	byChapter := func(file FileInfo) (int, int) {
+		return file.ChapterNumber, file.FileNumber
+	}
+	inputPaths := []string{"GH010002.MP4", "GH020001.MP4", "GH010001.MP4", "GH020002.MP4"}
+	files, err := orderFiles(inputPaths, Options{SortKey: byChapter})
+	if err != nil {
+		t.Fatalf("orderFiles() error: %v", err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.Base(file.Path))
+	}
+	expected := []string{"GH010001.MP4", "GH010002.MP4", "GH020001.MP4", "GH020002.MP4"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+
+	// Duplicates are still rejected
+	if _, err := orderFiles([]string{"GH010001.MP4", "GH010001.MP4"}, Options{SortKey: byChapter}); err == nil {
+		t.Error("Expected an error for a duplicate input")
+	}
+}
+
+func TestOrderFilesOrderBy(t *testing.T) {
+	// The files are created in one order, modified in another and named in a third
+	dir := t.TempDir()
+	base := time.Date(2024, time.June, 1, 10, 0, 0, 0, time.UTC)
+	var inputPaths []string
+	for i, name := range []string{"GH020001.MP4", "GH010001.MP4", "GH010002.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := base.Add(-time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	byModTime := []string{"GH010002.MP4", "GH010001.MP4", "GH020001.MP4"}
+	// Where the file system records creation times, they are in the order
+	// the files were written
+	byBirthTime := byModTime
+	if birthTime, modTime, err := fileTimes(inputPaths[0]); err == nil && !birthTime.IsZero() && !birthTime.Equal(modTime) {
+		byBirthTime = []string{"GH020001.MP4", "GH010001.MP4", "GH010002.MP4"}
+	}
+
+	for _, c := range []struct {
+		orderBy  string
+		expected []string
+	}{
+		{"", []string{"GH010001.MP4", "GH020001.MP4", "GH010002.MP4"}},
+		{orderByName, []string{"GH010001.MP4", "GH020001.MP4", "GH010002.MP4"}},
+		{orderByModTime, byModTime},
+		{orderByBirthTime, byBirthTime},
+	} {
+		files, err := orderFiles(inputPaths, Options{OrderBy: c.orderBy})
+		if err != nil {
+			t.Fatalf("orderFiles() with %q error: %v", c.orderBy, err)
+		}
+		var names []string
+		for _, file := range files {
+			names = append(names, filepath.Base(file.Path))
+		}
+		if !reflect.DeepEqual(names, c.expected) {
+			t.Errorf("Ordered by %q, expected %v, got %v", c.orderBy, c.expected, names)
+		}
+	}
+
+	if err := validateOrderBy("size"); err == nil {
+		t.Error("Expected an error for an unknown order")
+	}
+}
+
+func TestOrderFilesFirst(t *testing.T) {
+	// Damaged times made GH020001 the oldest, it is pinned in front of
+	// the chapters that would go first by name
+	inputPaths := []string{"GH030001.MP4", "GH010001.MP4", "GH020001.MP4", "GH040001.MP4"}
+	for _, opts := range []Options{
+		{First: "GH020001.MP4"},
+		{First: "./GH020001.MP4", KeepOrder: true},
+	} {
+		files, err := orderFiles(inputPaths, opts)
+		if err != nil {
+			t.Fatalf("orderFiles() error: %v", err)
+		}
+		var names []string
+		for _, file := range files {
+			names = append(names, filepath.Base(file.Path))
+		}
+		expected := []string{"GH020001.MP4", "GH010001.MP4", "GH030001.MP4", "GH040001.MP4"}
+		if opts.KeepOrder {
+			expected = []string{"GH020001.MP4", "GH030001.MP4", "GH010001.MP4", "GH040001.MP4"}
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("With %+v, expected %v, got %v", opts, expected, names)
+		}
+	}
+
+	if _, err := orderFiles(inputPaths, Options{First: "GH050001.MP4"}); err == nil || !strings.Contains(err.Error(), "-first GH050001.MP4 is not one of the inputs") {
+		t.Errorf("Expected a first file that is not an input to be refused, got %v", err)
+	}
+
+	// The first file is found through a link to it as well
+	dir := t.TempDir()
+	var chapters []string
+	for _, name := range []string{"GH010001.MP4", "GH020001.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		chapters = append(chapters, path)
+	}
+	link := filepath.Join(t.TempDir(), "pinned.MP4")
+	if err := os.Symlink(chapters[1], link); err != nil {
+		t.Fatal(err)
+	}
+	files, err := orderFiles(chapters, Options{First: link})
+	if err != nil || files[0].Path != chapters[1] {
+		t.Errorf("Expected %s to be pinned through %s, got %+v: %v", chapters[1], link, files, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-split-chapters", "-first", "GH020001.MP4", "out", "GH010001.MP4", "GH020001.MP4"}
+	if code := run(args, &stdout, &stderr); code != exitUsage || !strings.Contains(stderr.String(), "cannot be combined with -first") {
+		t.Errorf("Expected -first to be refused with -split-chapters, got %d: %s", code, stderr.String())
+	}
+}
+
+func TestRunFirstCreationTime(t *testing.T) {
+	dir := t.TempDir()
+	chapter := bytes.Join([][]byte{
+		mp4BoxBytes("ftyp", []byte("isom\x00\x00\x02\x00isom")),
+		mp4BoxBytes("mdat", make([]byte, 1024)),
+		mp4BoxBytes("moov", mp4BoxBytes("mvhd", make([]byte, 100))),
+	}, nil)
+	var chapters []string
+	for _, name := range []string{"GH010001.MP4", "GH020001.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, chapter, 0644); err != nil {
+			t.Fatal(err)
+		}
+		chapters = append(chapters, path)
+	}
+	// Damaged times made GH010001 look older than the chapter pinned first
+	damaged := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(chapters[0], damaged, damaged); err != nil {
+		t.Fatal(err)
+	}
+	pinned, _, err := fileTimes(chapters[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest, _, err := getFileTimes(chapters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !oldest.Before(pinned) {
+		t.Fatalf("Expected %s to be the oldest, got %v and %v", chapters[0], oldest, pinned)
+	}
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		if strings.HasSuffix(path, partialSuffix) {
+			output := hero
+			output.Duration = 2 * hero.Duration
+			return output, nil
+		}
+		return hero, nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		if indexOf(cmd.Args, "concat") >= 0 {
+			merge = cmd.Args
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "merged.mp4")
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-timezone", "UTC", "-first", chapters[1], outputPath, dir}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Expected the merge to succeed, got %d: %s", code, stderr.String())
+	}
+	expected := "creation_time=" + pinned.UTC().Format(time.RFC3339)
+	if args := strings.Join(merge, " "); !strings.Contains(args, expected) {
+		t.Errorf("Expected the creation time of the pinned chapter, %s, got: %s", expected, args)
+	}
+}
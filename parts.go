@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Part is one file of an output split by Options.MaxSize or
+// Options.MaxDuration.
+type Part struct {
+	Path string
+	// Start is where the part begins in the merged recording.
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// partSizeMargin is the share of -max-size the segment time aims for, as
+// cuts land on the keyframe after it and the bitrate varies.
+const partSizeMargin = 0.95
+
+// maxPartAttempts limits how often splitting is retried with a shorter
+// segment time when a part still exceeds -max-size.
+const maxPartAttempts = 3
+
+// partsTolerance is how much the parts together may differ from the
+// duration of the inputs.
+const partsTolerance = time.Second
+
+// sizeUnits are the multipliers of the -max-size suffixes.
+var sizeUnits = map[string]float64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseSize parses a size in bytes with an optional K, M, G or T suffix
+// counting in powers of 1024, e.g. 3.9G.
+func parseSize(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	unit := ""
+	if s != "" && strings.ContainsAny(s[len(s)-1:], "KMGT") {
+		s, unit = s[:len(s)-1], s[len(s)-1:]
+	}
+	number, err := strconv.ParseFloat(s, 64)
+	if err != nil || number <= 0 || math.IsInf(number, 0) {
+		return 0, fmt.Errorf("invalid size %q: must be a positive number of bytes with an optional K, M, G or T suffix", value)
+	}
+	return int64(number * sizeUnits[unit]), nil
+}
+
+// formatSize formats size in bytes in the largest unit of parseSize it
+// reaches.
+func formatSize(size int64) string {
+	for _, unit := range []string{"T", "G", "M", "K"} {
+		if float64(size) >= sizeUnits[unit] {
+			return strconv.FormatFloat(float64(size)/sizeUnits[unit], 'f', 1, 64) + unit
+		}
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+// partPattern returns the segment muxer pattern naming the parts of
+// outputPath, e.g. out_part01.mp4 for out.mp4.
+func partPattern(outputPath string) string {
+	ext := filepath.Ext(outputPath)
+	base := strings.ReplaceAll(strings.TrimSuffix(outputPath, ext), "%", "%%")
+	return base + "_part%02d" + strings.ReplaceAll(ext, "%", "%%")
+}
+
+// existingParts returns the files in the directory of outputPath named
+// like its parts, e.g. out_part01.mp4, which splitting it would replace.
+func existingParts(outputPath string) []string {
+	ext := filepath.Ext(outputPath)
+	prefix := filepath.Base(strings.TrimSuffix(outputPath, ext)) + "_part"
+	entries, err := os.ReadDir(filepath.Dir(outputPath))
+	if err != nil {
+		return nil
+	}
+	var existing []string
+	for _, entry := range entries {
+		number, found := strings.CutPrefix(entry.Name(), prefix)
+		number, found2 := strings.CutSuffix(number, ext)
+		if !found || !found2 || len(number) < 2 {
+			continue
+		}
+		if strings.Trim(number, "0123456789") == "" {
+			existing = append(existing, filepath.Join(filepath.Dir(outputPath), entry.Name()))
+		}
+	}
+	return existing
+}
+
+// partLimits describes the limits of the parts of a split output.
+func partLimits(maxSize int64, maxDuration time.Duration) string {
+	var limits []string
+	if maxSize > 0 {
+		limits = append(limits, "at most "+formatSize(maxSize))
+	}
+	if maxDuration > 0 {
+		limits = append(limits, fmt.Sprintf("at most %s long", maxDuration))
+	}
+	return strings.Join(limits, " and ")
+}
+
+// partArgs builds the ffmpeg arguments cutting outputPath into parts of
+// segmentTime with stream copy, listing them in the CSV file listPath.
+func partArgs(outputPath string, segmentTime time.Duration, mapArgs []string, listPath string, opts Options) []string {
+	args := append(ffmpegArgs(opts.FFmpegLogLevel),
+		"-i", outputPath,
+		"-c", "copy")
+	args = append(args, mapArgs...)
+	return append(args,
+		"-f", "segment",
+		"-segment_time", strconv.FormatFloat(segmentTime.Seconds(), 'f', 3, 64),
+		"-segment_format", containerMuxers[opts.Container],
+		"-segment_start_number", "1",
+		"-segment_list", listPath,
+		"-segment_list_type", "csv",
+		"-reset_timestamps", "1",
+		partPattern(outputPath))
+}
+
+// readPartList reads the parts from the CSV segment list at listPath,
+// whose entries are relative to dir.
+func readPartList(listPath, dir string) ([]Part, error) {
+	file, err := os.Open(listPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segment list: %v", err)
+	}
+	var parts []Part
+	for _, record := range records {
+		if len(record) != 3 {
+			return nil, fmt.Errorf("invalid segment list entry %q", strings.Join(record, ","))
+		}
+		start, err1 := strconv.ParseFloat(record[1], 64)
+		end, err2 := strconv.ParseFloat(record[2], 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid segment list entry %q", strings.Join(record, ","))
+		}
+		parts = append(parts, Part{
+			Path:     filepath.Join(dir, record[0]),
+			Start:    time.Duration(start * float64(time.Second)),
+			Duration: time.Duration((end - start) * float64(time.Second)),
+		})
+	}
+	return parts, nil
+}
+
+// partSegmentTime returns the segment time that keeps parts of an output
+// of size bytes and duration within opts.MaxSize and opts.MaxDuration.
+func partSegmentTime(size int64, duration time.Duration, opts Options) time.Duration {
+	// One part longer than the output holds all of it
+	segmentTime := duration + time.Second
+	if opts.MaxDuration > 0 && opts.MaxDuration < segmentTime {
+		segmentTime = opts.MaxDuration
+	}
+	if opts.MaxSize > 0 && size > opts.MaxSize {
+		bySize := time.Duration(float64(duration) * float64(opts.MaxSize) / float64(size) * partSizeMargin)
+		if bySize < segmentTime {
+			segmentTime = bySize
+		}
+	}
+	return segmentTime
+}
+
+// splitOutput replaces the merged outputPath with a numbered series of
+// parts within opts.MaxSize and opts.MaxDuration, cut on keyframes with
+// stream copy. Each part gets the file times of the recording offset by
+// where it starts. expected is the duration of the inputs, which the parts
+// must add up to.
+func splitOutput(outputPath string, expected time.Duration, creationTime, modTime time.Time, opts Options) ([]Part, error) {
+	logger := opts.logger()
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	probe, err := probeFile(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Duration(probe.Duration * float64(time.Second))
+	streams := probe.Streams
+	if !isMP4Family(opts.Container) {
+		streams = withoutDataStreams(streams)
+	}
+	mapping := mapStreams(streams, streamsAll)
+
+	listFile, err := opts.createTempFile(outputPath, ".parts.csv")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	listFile.Close()
+	defer os.Remove(listFile.Name())
+
+	// ffmpeg without -y would refuse the parts of an earlier split
+	for _, part := range existingParts(outputPath) {
+		if err := checkOutputNew(part, opts.Force); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(part); err != nil {
+			return nil, fmt.Errorf("failed to replace part %s: %v", part, err)
+		}
+	}
+
+	segmentTime := partSegmentTime(info.Size(), duration, opts)
+	var parts []Part
+	for attempt := 1; ; attempt++ {
+		logger.Info("splitting output into parts", "output", outputPath, "segment_time", segmentTime)
+		cmd := ffmpegCommand(partArgs(outputPath, segmentTime, mapping.Args, listFile.Name(), opts)...)
+		if err := runCommand(logger, cmd); err != nil {
+			return nil, fmt.Errorf("failed to split %s into parts: %v", outputPath, err)
+		}
+		parts, err = readPartList(listFile.Name(), filepath.Dir(outputPath))
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 0 {
+			return nil, fmt.Errorf("ffmpeg wrote no parts of %s", outputPath)
+		}
+
+		// Keyframes far apart or a bitrate peak can still overshoot the size
+		largest, err := largestPart(parts)
+		if err != nil {
+			return nil, err
+		}
+		if opts.MaxSize == 0 || largest <= opts.MaxSize {
+			break
+		}
+		if attempt == maxPartAttempts {
+			return nil, fmt.Errorf("a part of %s is %s, more than -max-size %s. The keyframes may be too far apart", outputPath, formatSize(largest), formatSize(opts.MaxSize))
+		}
+		logger.Warn("a part exceeds -max-size, splitting again with shorter parts", "size", largest, "max_size", opts.MaxSize)
+		for _, part := range parts {
+			os.Remove(part.Path)
+		}
+		segmentTime = time.Duration(float64(segmentTime) * float64(opts.MaxSize) / float64(largest) * partSizeMargin)
+	}
+
+	if err := verifyParts(parts, expected, opts); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(outputPath); err != nil {
+		return nil, fmt.Errorf("failed to remove %s after splitting it: %v", outputPath, err)
+	}
+
+	for i, part := range parts {
+		if err := setOutputPermissions(part.Path, opts); err != nil {
+			return nil, err
+		}
+		// Each part is stamped like a recording starting where it starts
+		partCreation := creationTime.Add(part.Start)
+		partMod := partCreation.Add(part.Duration)
+		if i == len(parts)-1 {
+			partMod = modTime
+		}
+		if err := setOutputTimes(part.Path, partCreation, partMod, opts); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// largestPart returns the size of the largest of parts.
+func largestPart(parts []Part) (int64, error) {
+	var largest int64
+	for _, part := range parts {
+		info, err := os.Stat(part.Path)
+		if err != nil {
+			return 0, fmt.Errorf("missing part %s: %v", part.Path, err)
+		}
+		if info.Size() > largest {
+			largest = info.Size()
+		}
+	}
+	return largest, nil
+}
+
+// verifyParts checks that the durations of parts, as ffprobe measures
+// them, add up to expected. With -ignore-errors the difference is only
+// logged, as damaged inputs make the output shorter.
+func verifyParts(parts []Part, expected time.Duration, opts Options) error {
+	var total time.Duration
+	for i, part := range parts {
+		probe, err := probeFile(part.Path)
+		if err != nil {
+			return err
+		}
+		parts[i].Duration = time.Duration(probe.Duration * float64(time.Second))
+		total += parts[i].Duration
+	}
+	diff := total - expected
+	if diff.Abs() <= partsTolerance {
+		return nil
+	}
+	if opts.IgnoreErrors {
+		opts.logger().Warn("the parts differ in duration from the inputs", "parts", total, "inputs", expected)
+		return nil
+	}
+	return fmt.Errorf("the %d parts last %s together, but the inputs %s", len(parts), total, expected)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"1000", 1000},
+		{"512K", 512 << 10},
+		{"3.9G", 4187593113},
+		{"2gb", 2 << 30},
+	}
+	for _, tt := range tests {
+		if got, err := parseSize(tt.value); err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+	if got := formatSize(4187593113); got != "3.9G" {
+		t.Errorf("formatSize() = %q, want 3.9G", got)
+	}
+	for _, value := range []string{"", "G", "-1G", "3.9X"} {
+		if _, err := parseSize(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestPartSegmentTime(t *testing.T) {
+	// 10 GiB over 30 minutes into 4 GiB parts
+	size, duration := int64(10<<30), 30*time.Minute
+	if got, want := partSegmentTime(size, duration, Options{MaxSize: 4 << 30}), 684*time.Second; got != want {
+		t.Errorf("Expected segments of %v for the size, got %v", want, got)
+	}
+	if got := partSegmentTime(size, duration, Options{MaxSize: 4 << 30, MaxDuration: 5 * time.Minute}); got != 5*time.Minute {
+		t.Errorf("Expected the shorter duration limit to win, got %v", got)
+	}
+	// An output within the limits stays in one part
+	if got := partSegmentTime(size, duration, Options{MaxSize: 20 << 30}); got <= duration {
+		t.Errorf("Expected one part for an output within the size, got segments of %v", got)
+	}
+}
+
+func TestMergeFilesMaxDuration(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	durations := map[string]float64{
+		"merged.mp4":        120,
+		"merged_part01.mp4": 50,
+		"merged_part02.mp4": 50,
+		"merged_part03.mp4": 20,
+	}
+	probeFile = func(path string) (ProbeResult, error) {
+		result := hero
+		result.Duration = 60
+		if duration, ok := durations[filepath.Base(path)]; ok {
+			result.Duration = duration
+		}
+		return result, nil
+	}
+	var segment []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		listIndex := indexOf(cmd.Args, "-segment_list")
+		if listIndex < 0 {
+			return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+		}
+		// The segment muxer writes the parts and lists them
+		segment = cmd.Args
+		list := "merged_part01.mp4,0.000000,50.050000\nmerged_part02.mp4,50.050000,100.100000\nmerged_part03.mp4,100.100000,120.000000\n"
+		for i := 1; i <= 3; i++ {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("merged_part%02d.mp4", i)), []byte("part"), 0644); err != nil {
+				return err
+			}
+		}
+		return os.WriteFile(cmd.Args[listIndex+1], []byte(list), 0644)
+	}
+
+	creationTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	modTime := creationTime.Add(2 * time.Minute)
+	var parts []Part
+	opts := Options{
+		MaxDuration: 50 * time.Second,
+		PartsFunc: func(p []Part) {
+			parts = p
+		},
+	}
+	if err := mergeFiles(outputPath, inputPaths, creationTime, modTime, opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	command := strings.Join(segment, " ")
+	if !strings.Contains(command, "-i "+outputPath+" -c copy") || !strings.Contains(command, "-f segment -segment_time 50.000 -segment_format mp4") {
+		t.Errorf("Expected the output to be cut into 50s parts with stream copy, got: %s", command)
+	}
+	if !strings.HasSuffix(command, filepath.Join(dir, "merged_part%02d.mp4")) {
+		t.Errorf("Expected numbered parts next to the output, got: %s", command)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the merged file to be replaced by its parts, got: %v", err)
+	}
+
+	if len(parts) != 3 || parts[1].Start != 50050*time.Millisecond || parts[2].Duration != 20*time.Second {
+		t.Fatalf("Unexpected parts %+v", parts)
+	}
+	// Each part is stamped as starting where it starts in the recording
+	info, err := os.Stat(parts[1].Path)
+	if err != nil {
+		t.Fatalf("Missing part: %v", err)
+	}
+	if want := creationTime.Add(parts[1].Start + parts[1].Duration); !info.ModTime().Equal(want) {
+		t.Errorf("Expected the second part to be modified at %v, got %v", want, info.ModTime())
+	}
+	if info, _ := os.Stat(parts[2].Path); !info.ModTime().Equal(modTime) {
+		t.Errorf("Expected the last part to keep the modification time %v, got %v", modTime, info.ModTime())
+	}
+
+	// The parts of this split are only replaced with -force
+	err = mergeFiles(outputPath, inputPaths, creationTime, modTime, opts)
+	if err == nil || !strings.Contains(err.Error(), parts[0].Path+" already exists. Use -force") {
+		t.Errorf("Expected the existing parts to be refused, got: %v", err)
+	}
+	opts.Force = true
+
+	// Parts that do not add up to the inputs fail the merge
+	durations["merged_part03.mp4"] = 10
+	err = mergeFiles(outputPath, inputPaths, creationTime, modTime, opts)
+	if err == nil || !strings.Contains(err.Error(), "the 3 parts last 1m50s together, but the inputs 2m0s") {
+		t.Errorf("Expected the missing duration to be reported, got: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// parseFileMode parses an octal file mode such as 0644 or 640.
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q: must be octal permissions such as 0644", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupOwner resolves an owner given as user, user:group or :group, by
+// name or numeric ID. A part that is left out is -1, which os.Chown leaves
+// unchanged.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+	uid, gid := -1, -1
+	if userName != "" {
+		id := userName
+		if _, err := strconv.Atoi(userName); err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid owner %q: %v", owner, err)
+			}
+			id = u.Uid
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+	if groupName != "" {
+		id := groupName
+		if _, err := strconv.Atoi(groupName); err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid owner %q: %v", owner, err)
+			}
+			id = g.Gid
+		}
+		gid, _ = strconv.Atoi(id)
+	}
+	if uid < 0 && gid < 0 {
+		return 0, 0, fmt.Errorf("invalid owner %q: must be user, user:group or :group", owner)
+	}
+	return uid, gid, nil
+}
+
+// setOutputPermissions applies opts.Mode and opts.Owner to outputPath.
+// Without them the output keeps the mode ffmpeg created it with, which
+// follows the umask.
+func setOutputPermissions(outputPath string, opts Options) error {
+	if opts.Mode != 0 {
+		if err := os.Chmod(outputPath, opts.Mode); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %v", outputPath, err)
+		}
+	}
+	if opts.Owner != "" {
+		uid, gid, err := lookupOwner(opts.Owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(outputPath, uid, gid); err != nil {
+			return fmt.Errorf("failed to set owner of %s: %v", outputPath, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseFileMode(t *testing.T) {
+	for input, expected := range map[string]os.FileMode{"0644": 0644, "640": 0640, "0755": 0755} {
+		mode, err := parseFileMode(input)
+		if err != nil || mode != expected {
+			t.Errorf("parseFileMode(%q) = %o, %v, expected %o", input, mode, err, expected)
+		}
+	}
+	for _, input := range []string{"", "0", "0999", "rw-r--r--", "10644"} {
+		if _, err := parseFileMode(input); err == nil {
+			t.Errorf("Expected an error for mode %q", input)
+		}
+	}
+}
+
+func TestLookupOwner(t *testing.T) {
+	uid, gid, err := lookupOwner("501:20")
+	if err != nil || uid != 501 || gid != 20 {
+		t.Errorf("lookupOwner(501:20) = %d, %d, %v", uid, gid, err)
+	}
+	uid, gid, err = lookupOwner(":20")
+	if err != nil || uid != -1 || gid != 20 {
+		t.Errorf("lookupOwner(:20) = %d, %d, %v", uid, gid, err)
+	}
+	for _, owner := range []string{":", "no-such-user-goproconcat"} {
+		if _, _, err := lookupOwner(owner); err == nil {
+			t.Errorf("Expected an error for owner %q", owner)
+		}
+	}
+}
+
+func TestMergeFilesOutputPermissions(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	// A file created like the output shows the mode the umask gives
+	reference := filepath.Join(dir, "reference")
+	if err := os.WriteFile(reference, nil, 0666); err != nil {
+		t.Fatalf("Failed to create reference file: %v", err)
+	}
+	info, err := os.Stat(reference)
+	if err != nil {
+		t.Fatalf("Failed to stat reference file: %v", err)
+	}
+	umaskMode := info.Mode().Perm()
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		output := cmd.Args[len(cmd.Args)-1]
+		os.Remove(output)
+		return os.WriteFile(output, []byte("output"), 0666)
+	}
+
+	owner := strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid())
+	tests := []struct {
+		name     string
+		inputs   []string
+		opts     Options
+		expected os.FileMode
+	}{
+		{"merge with umask", inputPaths, Options{}, umaskMode},
+		{"merge with mode", inputPaths, Options{Mode: 0640, Owner: owner}, 0640},
+		// The single input must not be linked, or its mode would change too
+		{"single input with mode", inputPaths[:1], Options{Mode: 0600, LinkSingle: true}, 0600},
+	}
+	for _, test := range tests {
+		outputPath := filepath.Join(dir, "merged.mp4")
+		os.Remove(outputPath)
+		if err := mergeFiles(outputPath, test.inputs, time.Now(), time.Now(), test.opts); err != nil {
+			t.Fatalf("%s: mergeFiles() error: %v", test.name, err)
+		}
+		info, err := os.Stat(outputPath)
+		if err != nil {
+			t.Fatalf("%s: failed to stat output: %v", test.name, err)
+		}
+		if info.Mode().Perm() != test.expected {
+			t.Errorf("%s: expected mode %o, got %o", test.name, test.expected, info.Mode().Perm())
+		}
+	}
+
+	info, err = os.Stat(inputPaths[0])
+	if err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Expected the input to keep mode 644, got %v, %v", info.Mode().Perm(), err)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Plan struct {
+	Output       string     `json:"output"`
+	Container    string     `json:"container"`
+	Files        []FileInfo `json:"files"`
+	CreationTime time.Time  `json:"creation_time"`
+	ModTime      time.Time  `json:"mod_time"`
+	Faststart    bool       `json:"faststart"`
+	Camera       cameraInfo `json:"camera"`
+	// Movflags are the movflags set with -movflags besides faststart.
+	Movflags []string `json:"movflags,omitempty"`
+	// Chapters are the chapter markers at the file boundaries, set with
+	// Options.Chapters.
+	Chapters []chapterMark `json:"chapters,omitempty"`
+	// Mismatches are the ways in which inputs differ from the first one.
+	Mismatches []inputMismatch `json:"mismatches,omitempty"`
+	// Resample are the chapters whose audio -resample-audio resamples to
+	// the rate of the first one.
+	Resample []inputMismatch `json:"resample,omitempty"`
+	// Reencode is set when the inputs differ and -reencode turns them
+	// into the format of the first one.
+	Reencode *encodeSettings `json:"reencode,omitempty"`
+	// DropAudio is set when -drop-audio leaves out the audio.
+	DropAudio bool `json:"drop_audio,omitempty"`
+	// AudioTrack is the only audio track copied, counting from 1.
+	AudioTrack int `json:"audio_track,omitempty"`
+	// Loudness is the target in LUFS of -normalize-audio, which re-encodes
+	// the audio. Zero when the audio is copied.
+	Loudness float64 `json:"loudness,omitempty"`
+	// Rotation is the clockwise display rotation set by -rotate, in
+	// degrees.
+	Rotation int `json:"rotation,omitempty"`
+	// LUT is the .cube file grading the video while it is re-encoded.
+	LUT string `json:"lut,omitempty"`
+	// BurnTimestamp is the timestamp burnt into the re-encoded video.
+	BurnTimestamp *TimestampOverlay `json:"burn_timestamp,omitempty"`
+	// Geotag is the point of the -geotag track locating the output.
+	Geotag *GeotagMatch `json:"geotag,omitempty"`
+	// NoTelemetry is set when -no-telemetry removes the telemetry.
+	NoTelemetry bool `json:"no_telemetry,omitempty"`
+	// Trim is the range of the inputs kept by -start and -end.
+	Trim *trimRange `json:"trim,omitempty"`
+	// MaxSize and MaxDuration are the limits of the parts the output is
+	// split into, zero when it is not split.
+	MaxSize     int64         `json:"max_size,omitempty"`
+	MaxDuration time.Duration `json:"max_duration,omitempty"`
+	// EstimatedSize, in bytes, and EstimatedDuration, in seconds, are what
+	// the output should come to, see estimateOutput. EstimatedSize is zero
+	// when it is not known.
+	EstimatedSize     int64   `json:"estimated_size,omitempty"`
+	EstimatedDuration float64 `json:"estimated_duration"`
+	// IgnoreErrors is set when -ignore-errors skips damaged parts of the
+	// inputs.
+	IgnoreErrors bool `json:"ignore_errors,omitempty"`
+	// Streams are the input streams the output gets, in output order.
+	Streams []StreamInfo `json:"streams,omitempty"`
+	// AllowMismatch is set when the inputs differ and -allow-mismatch
+	// merges them anyway.
+	AllowMismatch bool `json:"allow_mismatch,omitempty"`
+	// Duplicates are the inputs given more than once that -dedupe-report
+	// left out.
+	Duplicates []duplicateGroup `json:"duplicates,omitempty"`
+}
+
+func buildPlan(outputPath string, inputPaths []string, creationTime, modTime time.Time, opts Options) (Plan, error) {
+	logger := opts.logger()
+
+	container, err := outputContainer(outputPath, opts.Container)
+	if err != nil {
+		return Plan{}, err
+	}
+	files, err := orderFiles(inputPaths, opts)
+	if err != nil {
+		return Plan{}, err
+	}
+	// The chapters are files[first:last], between the intro and outro
+	intro, outro := clipFiles(opts)
+	first, last := len(intro), len(intro)+len(files)
+	files = append(append(intro, files...), outro...)
+
+	durations := make([]time.Duration, len(files))
+	probes := make([]ProbeResult, len(files))
+	for i := range files {
+		start := time.Now()
+		result, err := opts.probe(files[i].Path)
+		if err != nil {
+			return Plan{}, err
+		}
+		probes[i] = result
+		files[i].HasTelemetry = result.HasTelemetry()
+		durations[i] = time.Duration(result.Duration * float64(time.Second))
+		logger.Debug("probed input", "path", files[i].Path, "streams", len(result.Streams), "telemetry", files[i].HasTelemetry, "duration", time.Since(start))
+	}
+
+	var camera cameraInfo
+	if last > first {
+		camera, err = readCameraInfo(files[first].Path)
+		if err != nil {
+			logger.Debug("failed to read camera metadata", "path", files[first].Path, "error", err)
+		}
+	}
+
+	var chapters []chapterMark
+	if opts.Chapters {
+		chapters = fileChapters(files, durations)
+	}
+	trim, err := resolveTrim(files, durations, !opts.Reencode, opts)
+	if err != nil {
+		return Plan{}, err
+	}
+	if trim != nil {
+		chapters = trimChapters(chapters, *trim)
+		creationTime = creationTime.Add(trim.Start)
+	}
+
+	if err := selectStreams(files[first:last], probes[first:last], opts); err != nil {
+		return Plan{}, err
+	}
+	mismatches := checkConsistency(files[first:last], probes[first:last])
+	var resample []inputMismatch
+	if opts.ResampleAudio && !opts.Reencode {
+		resample, mismatches = splitSampleRates(mismatches)
+	}
+	var reencode *encodeSettings
+	if len(mismatches) > 0 && opts.Reencode && !hasAudioMismatch(mismatches) {
+		target := reencodeTarget(probes[first:last], opts)
+		reencode = &target
+	}
+
+	// The output gets the streams of the first chapter, as in mergeFiles
+	var streams []StreamInfo
+	if last > first {
+		chapter := probes[first]
+		if len(intro) > 0 || !isMP4Family(container) {
+			chapter.Streams = withoutDataStreams(chapter.Streams)
+		}
+		mapping := mapStreams(chapter.Streams, opts.Streams)
+		streams = mapping.Streams
+		if reencode != nil {
+			streams = reencodedStreams(chapter, *reencode, mapping.Telemetry)
+		}
+	}
+	size, duration := estimateOutput(files, durations, trim, opts)
+
+	var geotag *GeotagMatch
+	if opts.Geotag != nil {
+		match, err := nearestTrackPoint(opts.Geotag, creationTime.Add(opts.GeotagOffset), opts.geotagMaxGap())
+		if err != nil {
+			return Plan{}, err
+		}
+		geotag = &match
+	}
+
+	var loudness float64
+	if opts.NormalizeAudio {
+		loudness = opts.loudnessTarget()
+	}
+
+	return Plan{
+		Output:        outputPath,
+		Container:     container,
+		Files:         files,
+		CreationTime:  creationTime.In(opts.location()),
+		ModTime:       modTime.In(opts.location()),
+		Faststart:     opts.Faststart,
+		Movflags:      opts.Movflags,
+		Camera:        camera,
+		Chapters:      chapters,
+		Mismatches:    mismatches,
+		Resample:      resample,
+		Reencode:      reencode,
+		DropAudio:     opts.DropAudio,
+		AudioTrack:    opts.AudioTrack,
+		Loudness:      loudness,
+		Rotation:      opts.Rotate,
+		LUT:           opts.LUT,
+		NoTelemetry:   opts.NoTelemetry,
+		IgnoreErrors:  opts.IgnoreErrors,
+		Trim:          trim,
+		MaxSize:       opts.MaxSize,
+		MaxDuration:   opts.MaxDuration,
+		Streams:       streams,
+		AllowMismatch: len(mismatches) > 0 && reencode == nil && opts.AllowMismatch,
+
+		BurnTimestamp:     opts.BurnTimestamp,
+		Geotag:            geotag,
+		EstimatedSize:     size,
+		EstimatedDuration: duration.Seconds(),
+	}, nil
+}
+
+// estimateOutput estimates the size and duration of the merge of files,
+// which last durations. Stream copy writes the inputs as they are, so the
+// output is as large as they are together, or the share of it a trim
+// keeps. The size is unknown, zero, when the video is re-encoded or an
+// input cannot be stat'ed.
+func estimateOutput(files []FileInfo, durations []time.Duration, trim *trimRange, opts Options) (int64, time.Duration) {
+	var total time.Duration
+	for _, duration := range durations {
+		total += duration
+	}
+	duration := total
+	if trim != nil {
+		duration = trim.Duration()
+	}
+	if opts.Reencode {
+		return 0, duration
+	}
+
+	var size int64
+	for _, file := range files {
+		fileSize, err := inputSize(file.Path)
+		if err != nil {
+			opts.logger().Debug("cannot estimate the output size", "path", file.Path, "error", err)
+			return 0, duration
+		}
+		size += fileSize
+	}
+	if trim != nil && total > 0 {
+		size = int64(float64(size) * duration.Seconds() / total.Seconds())
+	}
+	return size, duration
+}
+
+// inputSize is the size of the local or remote input path.
+func inputSize(path string) (int64, error) {
+	if isRemote(path) {
+		size, _, err := remoteStat(path)
+		return size, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// missingTelemetry returns the inputs that have no gpmd stream.
+func (p Plan) missingTelemetry() []FileInfo {
+	var missing []FileInfo
+	for _, file := range p.Files {
+		if !file.HasTelemetry && file.Role == "" {
+			missing = append(missing, file)
+		}
+	}
+	return missing
+}
+
+func printPlan(w io.Writer, plan Plan) {
+	fmt.Fprintf(w, "Output: %s\n", plan.Output)
+	fmt.Fprintf(w, "Container: %s\n", plan.Container)
+	fmt.Fprintf(w, "Creation time: %s\n", plan.CreationTime.Format(time.RFC3339))
+	fmt.Fprintf(w, "Modification time: %s\n", plan.ModTime.Format(time.RFC3339))
+	fmt.Fprintf(w, "Faststart: %s\n", yesNo(plan.Faststart))
+	if len(plan.Movflags) > 0 {
+		fmt.Fprintf(w, "Movflags: %s\n", strings.Join(plan.Movflags, "+"))
+	}
+	if plan.DropAudio {
+		fmt.Fprintln(w, "Audio: dropped")
+	}
+	if plan.NoTelemetry {
+		fmt.Fprintln(w, "Telemetry: removed")
+	}
+	if plan.Trim != nil {
+		fmt.Fprintf(w, "Trim: %s\n", plan.Trim)
+	}
+	if plan.MaxSize > 0 || plan.MaxDuration > 0 {
+		fmt.Fprintf(w, "Split: into parts like %s, %s\n", filepath.Base(fmt.Sprintf(partPattern(plan.Output), 1)), partLimits(plan.MaxSize, plan.MaxDuration))
+	}
+	estimate := formatOffset(time.Duration(plan.EstimatedDuration * float64(time.Second)))
+	if plan.EstimatedSize > 0 {
+		estimate = formatSize(plan.EstimatedSize) + ", " + estimate
+	}
+	fmt.Fprintf(w, "Estimated output: %s\n", estimate)
+	if plan.IgnoreErrors {
+		fmt.Fprintln(w, "Errors: ignored, damaged parts of the inputs are dropped")
+	}
+	if plan.AudioTrack > 0 {
+		fmt.Fprintf(w, "Audio: track %d\n", plan.AudioTrack)
+	}
+	if plan.Loudness != 0 {
+		fmt.Fprintf(w, "Audio: normalized to %.1f LUFS, re-encoded to AAC (lossy)\n", plan.Loudness)
+	}
+	if plan.LUT != "" {
+		fmt.Fprintf(w, "LUT: %s, grading the re-encoded video\n", plan.LUT)
+	}
+	if plan.BurnTimestamp != nil {
+		fmt.Fprintf(w, "Timestamp: burnt into the %s corner as %s, from %s\n",
+			plan.BurnTimestamp.Position, plan.BurnTimestamp.Format, plan.CreationTime.Format(time.RFC3339))
+	}
+	if plan.Geotag != nil {
+		fmt.Fprintf(w, "Location: %s\n", plan.Geotag)
+	}
+	if plan.Rotation != 0 {
+		fmt.Fprintf(w, "Rotation: %d° clockwise, set in the display matrix without re-encoding\n", plan.Rotation)
+	}
+	if camera := plan.Camera.String(); camera != "" {
+		fmt.Fprintf(w, "Camera: %s\n", camera)
+	}
+	if len(plan.Duplicates) > 0 {
+		printDuplicates(w, plan.Duplicates)
+	}
+	fmt.Fprintln(w, "Inputs:")
+	for i, file := range plan.Files {
+		if file.Role != "" {
+			fmt.Fprintf(w, "  %d. %s (%s)\n", i+1, filepath.Base(file.Path), file.Role)
+			continue
+		}
+		fmt.Fprintf(w, "  %d. %s (file %04d, chapter %02d, telemetry: %s)\n",
+			i+1, filepath.Base(file.Path), file.FileNumber, file.ChapterNumber, yesNo(file.HasTelemetry))
+	}
+
+	if len(plan.Streams) > 0 {
+		fmt.Fprintln(w, "Output streams:")
+		for i, stream := range plan.Streams {
+			fmt.Fprintf(w, "  %d: %s\n", i, streamLabel(stream))
+		}
+	}
+
+	if len(plan.Chapters) > 0 {
+		fmt.Fprintln(w, "Chapters:")
+		for _, chapter := range plan.Chapters {
+			fmt.Fprintf(w, "  %s %s\n", formatOffset(chapter.Start), chapter.Title)
+		}
+	}
+
+	if len(plan.Mismatches) > 0 {
+		fmt.Fprintln(w, "Mismatches:")
+		writeMismatchTable(w, plan.Mismatches)
+	}
+	for _, m := range plan.Resample {
+		fmt.Fprintf(w, "Resample: audio of %s from %s to %s Hz, re-encoded to AAC (lossy)\n", filepath.Base(m.Path), m.Actual, m.Expected)
+	}
+	switch {
+	case hasAudioMismatch(plan.Mismatches):
+		fmt.Fprintln(w, "Error: only some inputs have an audio track, the merge will be aborted. Use -drop-audio to merge them without audio")
+	case plan.Reencode != nil:
+		fmt.Fprintf(w, "Re-encode: %s, because the inputs differ\n", plan.Reencode)
+	case len(plan.Mismatches) > 0 && plan.AllowMismatch:
+		fmt.Fprintln(w, "Warning: the inputs differ, the merged file may be broken")
+	case onlySampleRates(plan.Mismatches):
+		fmt.Fprintln(w, "Error: the audio sample rates of the inputs differ, the merge will be aborted. Use -resample-audio to resample their audio, or -reencode to re-encode them")
+	case len(plan.Mismatches) > 0:
+		fmt.Fprintln(w, "Error: the inputs differ, the merge will be aborted. Use -reencode to re-encode them, or -allow-mismatch to merge them anyway")
+	}
+
+	if missing := plan.missingTelemetry(); !plan.NoTelemetry && len(missing) > 0 && len(missing) < len(plan.Files) {
+		fmt.Fprintf(w, "Warning: %d of %d inputs have no telemetry (gpmd) stream\n", len(missing), len(plan.Files))
+	}
+}
+
+func printPlanJSON(w io.Writer, plan Plan) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
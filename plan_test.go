@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildPlanTelemetryPresence(t *testing.T) {
+	// Stub ffprobe so that only the first chapter carries a gpmd stream
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		result := ProbeResult{Streams: []StreamInfo{{Index: 0, CodecType: "video", CodecName: "h264"}}}
+		if filepath.Base(path) == "GH011234.MP4" {
+			result.Streams = append(result.Streams, StreamInfo{Index: 1, CodecType: "data", CodecTagString: "gpmd"})
+		}
+		return result, nil
+	}
+
+	inputPaths := []string{"GH021234.MP4", "GH011234.MP4"}
+	creationTime := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	modTime := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	plan, err := buildPlan("merged.mp4", inputPaths, creationTime, modTime, Options{})
+	if err != nil {
+		t.Fatalf("buildPlan() error: %v", err)
+	}
+
+	if len(plan.Files) != 2 {
+		t.Fatalf("Expected 2 files in plan, got %d", len(plan.Files))
+	}
+	if !plan.Files[0].HasTelemetry {
+		t.Errorf("Expected telemetry for %s", plan.Files[0].Path)
+	}
+	if plan.Files[1].HasTelemetry {
+		t.Errorf("Expected no telemetry for %s", plan.Files[1].Path)
+	}
+
+	// Check the text output marks each input and warns about the missing stream
+	var text bytes.Buffer
+	printPlan(&text, plan)
+	if !strings.Contains(text.String(), "GH011234.MP4 (file 1234, chapter 01, telemetry: yes)") {
+		t.Errorf("Expected telemetry presence in plan output, got:\n%s", text.String())
+	}
+	if !strings.Contains(text.String(), "GH021234.MP4 (file 1234, chapter 02, telemetry: no)") {
+		t.Errorf("Expected telemetry absence in plan output, got:\n%s", text.String())
+	}
+	if !strings.Contains(text.String(), "Faststart: no\n") {
+		t.Errorf("Expected faststart state in plan output, got:\n%s", text.String())
+	}
+	if !strings.Contains(text.String(), "1 of 2 inputs have no telemetry") {
+		t.Errorf("Expected telemetry warning in plan output, got:\n%s", text.String())
+	}
+
+	// Check the JSON output carries the same flags
+	var buf bytes.Buffer
+	if err := printPlanJSON(&buf, plan); err != nil {
+		t.Fatalf("printPlanJSON() error: %v", err)
+	}
+	var decoded Plan
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode plan JSON: %v", err)
+	}
+	if !decoded.Files[0].HasTelemetry || decoded.Files[1].HasTelemetry {
+		t.Errorf("Unexpected telemetry flags in JSON plan: %s", buf.String())
+	}
+}
+
+func TestBuildPlanChapters(t *testing.T) {
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		return ProbeResult{Duration: 530.5}, nil
+	}
+
+	inputPaths := []string{"GH030042.MP4", "GH010042.MP4", "GH020042.MP4"}
+	plan, err := buildPlan("merged.mp4", inputPaths, time.Time{}, time.Time{}, Options{Chapters: true})
+	if err != nil {
+		t.Fatalf("buildPlan() error: %v", err)
+	}
+
+	if len(plan.Chapters) != 3 {
+		t.Fatalf("Expected 3 chapters, got %v", plan.Chapters)
+	}
+	last := plan.Chapters[2]
+	if last.Start != 1061*time.Second || last.End != 1591500*time.Millisecond || last.Title != "Chapter 3 – GH030042" {
+		t.Errorf("Unexpected last chapter %+v", last)
+	}
+
+	var text bytes.Buffer
+	printPlan(&text, plan)
+	if !strings.Contains(text.String(), "  00:08:50.500 Chapter 2 – GH020042\n") {
+		t.Errorf("Expected chapters in plan output, got:\n%s", text.String())
+	}
+
+	var buf bytes.Buffer
+	if err := printPlanJSON(&buf, plan); err != nil {
+		t.Fatalf("printPlanJSON() error: %v", err)
+	}
+	var decoded struct {
+		Chapters []struct {
+			Start float64 `json:"start"`
+			End   float64 `json:"end"`
+			Title string  `json:"title"`
+		} `json:"chapters"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode plan JSON: %v", err)
+	}
+	if len(decoded.Chapters) != 3 || decoded.Chapters[1].Start != 530.5 || decoded.Chapters[1].Title != "Chapter 2 – GH020042" {
+		t.Errorf("Unexpected chapters in JSON plan: %s", buf.String())
+	}
+
+	// Without -chapters the plan has none
+	plan, err = buildPlan("merged.mp4", inputPaths, time.Time{}, time.Time{}, Options{})
+	if err != nil || len(plan.Chapters) != 0 {
+		t.Errorf("Expected no chapters by default, got %v, %v", plan.Chapters, err)
+	}
+}
+
+func TestBuildPlanAudioTrack(t *testing.T) {
+	hero := loadProbeFixture(t, "hero_probe.json")
+	// A second, raw audio track after the first one
+	raw := StreamInfo{Index: 5, CodecType: "audio", CodecName: "pcm_s24le", SampleRate: "48000", Channels: 2}
+	withRaw := hero
+	withRaw.Streams = append(append([]StreamInfo(nil), hero.Streams...), raw)
+
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		return withRaw, nil
+	}
+
+	inputPaths := []string{"GH010042.MP4", "GH020042.MP4"}
+	plan, err := buildPlan("merged.mp4", inputPaths, time.Time{}, time.Time{}, Options{AudioTrack: 2, Streams: streamsEssential})
+	if err != nil {
+		t.Fatalf("buildPlan() error: %v", err)
+	}
+	var text bytes.Buffer
+	printPlan(&text, plan)
+	expected := "Audio: track 2\n"
+	layout := "Output streams:\n  0: video stream h264\n  1: data stream gpmd\n  2: audio stream pcm_s24le\n"
+	if !strings.Contains(text.String(), expected) || !strings.Contains(text.String(), layout) {
+		t.Errorf("Expected %q and %q in plan output, got:\n%s", expected, layout, text.String())
+	}
+
+	// Without audio the telemetry moves up
+	plan, err = buildPlan("merged.mp4", inputPaths, time.Time{}, time.Time{}, Options{DropAudio: true, Streams: streamsEssential})
+	if err != nil {
+		t.Fatalf("buildPlan() error: %v", err)
+	}
+	text.Reset()
+	printPlan(&text, plan)
+	if layout := "Output streams:\n  0: video stream h264\n  1: data stream gpmd\n"; !strings.Contains(text.String(), layout) {
+		t.Errorf("Expected %q in plan output, got:\n%s", layout, text.String())
+	}
+
+	if _, err := buildPlan("merged.mp4", inputPaths, time.Time{}, time.Time{}, Options{AudioTrack: 3}); err == nil {
+		t.Errorf("Expected an error for a missing audio track")
+	}
+}
+
+func TestBuildPlanEstimate(t *testing.T) {
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+
+	dir := t.TempDir()
+	var inputPaths []string
+	var totalSize int64
+	for i, name := range []string{"GH010042.MP4", "GH020042.MP4", "GH030042.MP4"} {
+		path := filepath.Join(dir, name)
+		data := bytes.Repeat([]byte{'x'}, 1000*(i+1))
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+		totalSize += int64(len(data))
+	}
+
+	plan, err := buildPlan(filepath.Join(dir, "merged.mp4"), inputPaths, time.Time{}, time.Time{}, Options{})
+	if err != nil {
+		t.Fatalf("buildPlan() error: %v", err)
+	}
+	if plan.EstimatedSize != totalSize || plan.EstimatedDuration != 3*hero.Duration {
+		t.Errorf("Expected an estimate of %d bytes and %gs, got %d bytes and %gs", totalSize, 3*hero.Duration, plan.EstimatedSize, plan.EstimatedDuration)
+	}
+	var text bytes.Buffer
+	printPlan(&text, plan)
+	if expected := "Estimated output: 5.9K, 00:26:31.590\n"; !strings.Contains(text.String(), expected) {
+		t.Errorf("Expected %q in plan output, got:\n%s", expected, text.String())
+	}
+
+	// The size of a re-encode depends on the encoder
+	plan, err = buildPlan(filepath.Join(dir, "merged.mp4"), inputPaths, time.Time{}, time.Time{}, Options{Reencode: true})
+	if err != nil {
+		t.Fatalf("buildPlan() error: %v", err)
+	}
+	if plan.EstimatedSize != 0 || plan.EstimatedDuration != 3*hero.Duration {
+		t.Errorf("Expected only a duration estimate when re-encoding, got %d bytes and %gs", plan.EstimatedSize, plan.EstimatedDuration)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// badInput is an input that preflight found unusable.
+type badInput struct {
+	Path    string
+	Problem string
+}
+
+// checkInput checks that the chapter at path is complete enough to merge:
+// it has data, a moov atom, a video stream and a duration. A camera that
+// loses power while recording leaves a chapter failing these checks.
+func checkInput(path string, opts Options) error {
+	if isRemote(path) {
+		return checkProbe(path, opts)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot be read: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot be read: %v", err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("is empty")
+	}
+
+	// A truncated mdat box claims more data than the file has
+	boxes, err := readBoxes(file, 0, info.Size())
+	if err != nil {
+		return fmt.Errorf("is truncated: %v", err)
+	}
+	hasMoov := false
+	for _, box := range boxes {
+		if box.Type == "moov" {
+			hasMoov = true
+			break
+		}
+	}
+	if !hasMoov {
+		return fmt.Errorf("has no moov atom, the recording was not finalized")
+	}
+
+	return checkProbe(path, opts)
+}
+
+// checkProbe checks that ffprobe finds a video stream and a duration in
+// the input path.
+func checkProbe(path string, opts Options) error {
+	probe, err := opts.probe(path)
+	if err != nil {
+		return fmt.Errorf("cannot be opened by ffprobe: %v", err)
+	}
+	if _, ok := probe.firstStream("video"); !ok {
+		return fmt.Errorf("has no video stream")
+	}
+	if probe.Duration <= 0 || math.IsNaN(probe.Duration) || math.IsInf(probe.Duration, 0) {
+		return fmt.Errorf("has no valid duration (%v)", probe.Duration)
+	}
+	return nil
+}
+
+// preflightInputs checks every input before any work is done and returns
+// the good ones, in their order, and the bad ones. The inputs are checked
+// in parallel, with at most opts.maxOpenFiles of them open at once.
+func preflightInputs(inputPaths []string, opts Options) ([]string, []badInput) {
+	problems := make([]error, len(inputPaths))
+	forEachInput(len(inputPaths), opts.maxOpenFiles(), func(i int) {
+		problems[i] = checkInput(inputPaths[i], opts)
+	})
+
+	var good []string
+	var bad []badInput
+	for i, path := range inputPaths {
+		if problems[i] != nil {
+			bad = append(bad, badInput{Path: path, Problem: problems[i].Error()})
+			continue
+		}
+		good = append(good, path)
+	}
+	return good, bad
+}
+
+// printBadInputs lists the inputs that failed preflight.
+func printBadInputs(w io.Writer, bad []badInput) {
+	fmt.Fprintf(w, "%d input(s) are damaged:\n", len(bad))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, input := range bad {
+		fmt.Fprintf(tw, "  %s\t%s\n", filepath.Base(input.Path), input.Problem)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "A chapter cut short by a dead battery or a full card can usually be repaired by the camera itself: put the card back into the GoPro and turn it on to let it repair the file.")
+}
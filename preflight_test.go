@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPreflightInputs(t *testing.T) {
+	dir := t.TempDir()
+	ftyp := mp4BoxBytes("ftyp", []byte("isom\x00\x00\x02\x00isom"))
+	moov := mp4BoxBytes("moov", mp4BoxBytes("mvhd", make([]byte, 100)))
+	mdat := mp4BoxBytes("mdat", make([]byte, 1024))
+	complete := bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		result := hero
+		switch filepath.Base(path) {
+		case "GH051234.MP4":
+			return ProbeResult{}, fmt.Errorf("moov atom not found")
+		case "GH061234.MP4":
+			result.Streams = hero.Streams[1:]
+		case "GH071234.MP4":
+			result.Duration = 0
+		}
+		return result, nil
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		problem string
+	}{
+		{"GH011234.MP4", complete, ""},
+		{"GH021234.MP4", nil, "is empty"},
+		// The camera died before writing the moov atom
+		{"GH031234.MP4", bytes.Join([][]byte{ftyp, mdat}, nil), "has no moov atom"},
+		{"GH041234.MP4", bytes.Join([][]byte{ftyp, mdat[:512]}, nil), "is truncated"},
+		{"GH051234.MP4", complete, "cannot be opened by ffprobe"},
+		{"GH061234.MP4", complete, "has no video stream"},
+		{"GH071234.MP4", complete, "has no valid duration"},
+	}
+	var inputPaths []string
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, test.data, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	inputPaths = append(inputPaths, filepath.Join(dir, "GH081234.MP4"))
+
+	good, bad := preflightInputs(inputPaths, Options{probes: newProbeCache()})
+	if len(good) != 1 || good[0] != inputPaths[0] {
+		t.Errorf("Expected only %s to pass, got %v", inputPaths[0], good)
+	}
+	if len(bad) != len(tests) {
+		t.Fatalf("Expected %d bad inputs, got %+v", len(tests), bad)
+	}
+	for i, test := range tests[1:] {
+		if bad[i].Path != inputPaths[i+1] || !strings.HasPrefix(bad[i].Problem, test.problem) {
+			t.Errorf("%s: expected problem %q, got %+v", test.name, test.problem, bad[i])
+		}
+	}
+	if !strings.HasPrefix(bad[len(bad)-1].Problem, "cannot be read") {
+		t.Errorf("Expected the missing input to be reported, got %+v", bad[len(bad)-1])
+	}
+
+	var out bytes.Buffer
+	printBadInputs(&out, bad[:1])
+	if !strings.Contains(out.String(), "1 input(s) are damaged:\n  GH021234.MP4  is empty\n") || !strings.Contains(out.String(), "repair") {
+		t.Errorf("Unexpected report of bad inputs: %s", out.String())
+	}
+}
+
+func TestPreflightInputsManyInputs(t *testing.T) {
+	dir := t.TempDir()
+	ftyp := mp4BoxBytes("ftyp", []byte("isom\x00\x00\x02\x00isom"))
+	moov := mp4BoxBytes("moov", mp4BoxBytes("mvhd", make([]byte, 100)))
+	var inputPaths []string
+	for i := 1; i <= 1000; i++ {
+		inputPaths = append(inputPaths, writeFixture(t, dir, fmt.Sprintf("GH%02d%04d.MP4", i%100, i/100), ftyp, moov))
+	}
+
+	// The stub counts the inputs being checked at once, as ffprobe would run
+	var mu sync.Mutex
+	open, maxOpen := 0, 0
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		mu.Lock()
+		open++
+		maxOpen = max(maxOpen, open)
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		open--
+		mu.Unlock()
+		return hero, nil
+	}
+
+	good, bad := preflightInputs(inputPaths, Options{MaxOpenFiles: 8, probes: newProbeCache()})
+	if len(bad) != 0 {
+		t.Fatalf("Expected no bad inputs, got %d, first %+v", len(bad), bad[0])
+	}
+	if !reflect.DeepEqual(good, inputPaths) {
+		t.Errorf("Expected all %d inputs in order, got %d", len(inputPaths), len(good))
+	}
+	if maxOpen > 8 {
+		t.Errorf("Expected at most 8 inputs checked at once, got %d", maxOpen)
+	}
+}
+
+func TestRunSkipCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"GH011234", "GH031234"} {
+		file, err := createTestVideoFileIn(dir, name)
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		file.Close()
+	}
+	// A chapter ffprobe cannot open, as read from a corrupt card
+	corrupt := filepath.Join(dir, "GH021234.mp4")
+	if err := os.WriteFile(corrupt, bytes.Repeat([]byte{0xff}, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{outputPath, dir}, &stdout, &stderr)
+	if code != exitError || !strings.Contains(stderr.String(), "Nothing was merged") {
+		t.Errorf("Expected the merge to be refused without -skip-corrupt, got code %d: %s", code, stderr.String())
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no output, got %v", err)
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	code = run([]string{"-skip-corrupt", outputPath, dir}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("Expected exit code %d, got %d (stderr: %s)", exitOK, code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "1 input(s) are damaged:\n  GH021234.mp4  ") || !strings.Contains(stderr.String(), "merging without 1 damaged input(s)") {
+		t.Errorf("Expected the corrupt input to be reported as skipped, got: %s", stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Files merged successfully") {
+		t.Errorf("Expected success message on stdout, got: %s", stdout.String())
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type StreamInfo struct {
+	Index          int               `json:"index"`
+	CodecType      string            `json:"codec_type"`
+	CodecName      string            `json:"codec_name"`
+	CodecTagString string            `json:"codec_tag_string"`
+	Width          int               `json:"width"`
+	Height         int               `json:"height"`
+	PixFmt         string            `json:"pix_fmt"`
+	ColorPrimaries string            `json:"color_primaries"`
+	ColorTransfer  string            `json:"color_transfer"`
+	ColorSpace     string            `json:"color_space"`
+	ColorRange     string            `json:"color_range"`
+	FrameRate      string            `json:"r_frame_rate"`
+	SampleRate     string            `json:"sample_rate"`
+	Channels       int               `json:"channels"`
+	ChannelLayout  string            `json:"channel_layout"`
+	Duration       string            `json:"duration"`
+	Tags           map[string]string `json:"tags"`
+	SideData       []sideData        `json:"side_data_list,omitempty"`
+}
+
+// sideData is an entry of the side data of a stream, such as the display
+// matrix, of which ffprobe prints the rotation counterclockwise.
+type sideData struct {
+	Type     string  `json:"side_data_type"`
+	Rotation float64 `json:"rotation,omitempty"`
+}
+
+// tag looks up a tag ignoring case, since Matroska stores tag names in
+// upper case.
+func (s StreamInfo) tag(name string) string {
+	if value, ok := s.Tags[name]; ok {
+		return value
+	}
+	for key, value := range s.Tags {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// durationSeconds returns the stream duration. MP4 has it in the stream
+// header, Matroska only in a DURATION tag such as "00:08:50.500000000".
+func (s StreamInfo) durationSeconds() (float64, bool) {
+	if duration, err := strconv.ParseFloat(s.Duration, 64); err == nil {
+		return duration, true
+	}
+	var hours, minutes int
+	var seconds float64
+	if _, err := fmt.Sscanf(s.tag("DURATION"), "%d:%d:%f", &hours, &minutes, &seconds); err == nil {
+		return float64(hours*3600+minutes*60) + seconds, true
+	}
+	return 0, false
+}
+
+type ProbeResult struct {
+	Streams  []StreamInfo
+	Duration float64
+	// Tags are the container level metadata tags.
+	Tags map[string]string
+}
+
+// probeFile is a variable so tests can replace ffprobe with canned results.
+var probeFile = ffprobeFile
+
+func ffprobeFile(path string) (ProbeResult, error) {
+	cmd := exec.Command(
+		"ffprobe",
+		"-v", "error",
+		"-show_streams",
+		"-show_format",
+		"-of", "json",
+		path)
+	out, err := cmd.Output()
+	if err != nil {
+		return ProbeResult{}, fmt.Errorf("ffprobe failed for %s: %v", path, err)
+	}
+	return parseProbeOutput(out)
+}
+
+// probeCache keeps the probe results of the inputs, so planning, merging
+// and verifying a merge probe each input only once.
+type probeCache struct {
+	mu      sync.Mutex
+	results map[string]ProbeResult
+}
+
+func newProbeCache() *probeCache {
+	return &probeCache{results: make(map[string]ProbeResult)}
+}
+
+// probe returns the probe result of the input path, from the cache of
+// opts when it has one.
+func (o Options) probe(path string) (ProbeResult, error) {
+	cache := o.probes
+	if cache == nil {
+		return probeFile(path)
+	}
+	cache.mu.Lock()
+	result, ok := cache.results[path]
+	cache.mu.Unlock()
+	if ok {
+		return result, nil
+	}
+	// Not holding the lock while ffprobe runs lets inputs be probed in parallel
+	result, err := probeFile(path)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	cache.mu.Lock()
+	cache.results[path] = result
+	cache.mu.Unlock()
+	return result, nil
+}
+
+// probeFiles probes every file.
+func probeFiles(files []FileInfo, opts Options) ([]ProbeResult, error) {
+	probes := make([]ProbeResult, len(files))
+	for i, file := range files {
+		probe, err := opts.probe(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		probes[i] = probe
+	}
+	return probes, nil
+}
+
+func parseProbeOutput(data []byte) (ProbeResult, error) {
+	var raw struct {
+		Streams []StreamInfo `json:"streams"`
+		Format  struct {
+			Duration string            `json:"duration"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return ProbeResult{}, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+
+	result := ProbeResult{Streams: raw.Streams, Tags: raw.Format.Tags}
+	if raw.Format.Duration != "" {
+		duration, err := strconv.ParseFloat(raw.Format.Duration, 64)
+		if err != nil {
+			return ProbeResult{}, fmt.Errorf("invalid duration %q in ffprobe output: %v", raw.Format.Duration, err)
+		}
+		result.Duration = duration
+		return result, nil
+	}
+
+	// Without a container duration, fall back to the longest stream
+	for _, stream := range raw.Streams {
+		if duration, ok := stream.durationSeconds(); ok && duration > result.Duration {
+			result.Duration = duration
+		}
+	}
+	return result, nil
+}
+
+// firstStream returns the first stream of codecType, e.g. "video".
+func (r ProbeResult) firstStream(codecType string) (StreamInfo, bool) {
+	for _, stream := range r.Streams {
+		if stream.CodecType == codecType {
+			return stream, true
+		}
+	}
+	return StreamInfo{}, false
+}
+
+// isTelemetry reports whether the stream carries GoPro GPMF telemetry.
+func (s StreamInfo) isTelemetry() bool {
+	if s.CodecType != "data" {
+		return false
+	}
+	return s.CodecTagString == "gpmd" || strings.Contains(s.tag("handler_name"), "GoPro MET")
+}
+
+func (r ProbeResult) HasTelemetry() bool {
+	for _, stream := range r.Streams {
+		if stream.isTelemetry() {
+			return true
+		}
+	}
+	return false
+}
+
+// Timecode returns the starting timecode of the input, preferring the
+// tmcd track and falling back to a timecode tag on any other stream.
+func (r ProbeResult) Timecode() string {
+	for _, stream := range r.Streams {
+		if stream.CodecTagString == "tmcd" && stream.tag("timecode") != "" {
+			return stream.tag("timecode")
+		}
+	}
+	for _, stream := range r.Streams {
+		if stream.tag("timecode") != "" {
+			return stream.tag("timecode")
+		}
+	}
+	return ""
+}
+
+// timecodeArgs makes the muxer write a fresh tmcd track starting at the
+// first chapter's timecode. The concat demuxer cannot carry the original
+// tmcd track, which holds a single sample for the whole file anyway.
+// Matroska has no timecode track and only keeps the tag.
+func timecodeArgs(timecode, container string) []string {
+	if timecode == "" {
+		return nil
+	}
+	args := []string{"-metadata:s:v:0", "timecode=" + timecode}
+	if container != containerMKV {
+		args = append(args, "-write_tmcd", "1")
+	}
+	return args
+}
+
+// verifyTimecode checks that outputPath has a timecode track starting at
+// timecode.
+func verifyTimecode(outputPath, timecode string) error {
+	probe, err := probeFile(outputPath)
+	if err != nil {
+		return err
+	}
+	if got := probe.Timecode(); got != timecode {
+		if got == "" {
+			return fmt.Errorf("merged file %s has no timecode track, expected one starting at %s", outputPath, timecode)
+		}
+		return fmt.Errorf("merged file %s has timecode %s, expected %s", outputPath, got, timecode)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProbeOutput(t *testing.T) {
+	data := []byte(`{
+		"streams": [
+			{"index": 0, "codec_type": "video", "codec_name": "h264", "codec_tag_string": "avc1"},
+			{"index": 1, "codec_type": "audio", "codec_name": "aac", "codec_tag_string": "mp4a"},
+			{"index": 2, "codec_type": "data", "codec_tag_string": "tmcd", "tags": {"handler_name": "GoPro TCD"}},
+			{"index": 3, "codec_type": "data", "codec_tag_string": "gpmd", "tags": {"handler_name": "GoPro MET"}}
+		],
+		"format": {"duration": "12.345000"}
+	}`)
+
+	result, err := parseProbeOutput(data)
+	if err != nil {
+		t.Fatalf("parseProbeOutput() error: %v", err)
+	}
+
+	if len(result.Streams) != 4 {
+		t.Errorf("Expected 4 streams, got %d", len(result.Streams))
+	}
+	if result.Duration != 12.345 {
+		t.Errorf("Expected duration 12.345, got %v", result.Duration)
+	}
+	if !result.HasTelemetry() {
+		t.Errorf("Expected telemetry to be detected")
+	}
+}
+
+func TestParseProbeOutputWithoutTelemetry(t *testing.T) {
+	data := []byte(`{"streams": [{"index": 0, "codec_type": "video", "codec_name": "h264"}], "format": {}}`)
+
+	result, err := parseProbeOutput(data)
+	if err != nil {
+		t.Fatalf("parseProbeOutput() error: %v", err)
+	}
+
+	if result.HasTelemetry() {
+		t.Errorf("Expected no telemetry to be detected")
+	}
+}
+
+func loadProbeFixture(t *testing.T, name string) ProbeResult {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("Failed to read fixture %s: %v", name, err)
+	}
+	result, err := parseProbeOutput(data)
+	if err != nil {
+		t.Fatalf("parseProbeOutput() error for %s: %v", name, err)
+	}
+	return result
+}
+
+func TestTimecode(t *testing.T) {
+	result := loadProbeFixture(t, "hero_probe.json")
+	if timecode := result.Timecode(); timecode != "14:32:07:12" {
+		t.Errorf("Expected timecode 14:32:07:12, got %q", timecode)
+	}
+
+	args := strings.Join(timecodeArgs(result.Timecode(), containerMP4), " ")
+	if args != "-metadata:s:v:0 timecode=14:32:07:12 -write_tmcd 1" {
+		t.Errorf("Unexpected timecode arguments: %s", args)
+	}
+
+	// Files without a timecode track get no timecode arguments
+	result = loadProbeFixture(t, "no_telemetry_probe.json")
+	if result.Timecode() != "" || timecodeArgs(result.Timecode(), containerMP4) != nil {
+		t.Errorf("Expected no timecode for %v", result.Streams)
+	}
+}
+
+func TestVerifyTimecode(t *testing.T) {
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+
+	// Output without a tmcd track
+	probeFile = func(path string) (ProbeResult, error) {
+		return ProbeResult{Streams: []StreamInfo{{Index: 0, CodecType: "video"}}}, nil
+	}
+	if err := verifyTimecode("merged.mp4", "14:32:07:12"); err == nil {
+		t.Errorf("Expected error for output without timecode track")
+	}
+
+	// Output with the rebuilt tmcd track
+	probeFile = func(path string) (ProbeResult, error) {
+		return ProbeResult{Streams: []StreamInfo{
+			{Index: 0, CodecType: "video", Tags: map[string]string{"timecode": "14:32:07:12"}},
+			{Index: 1, CodecType: "data", CodecTagString: "tmcd", Tags: map[string]string{"timecode": "14:32:07:12"}},
+		}}, nil
+	}
+	if err := verifyTimecode("merged.mp4", "14:32:07:12"); err != nil {
+		t.Errorf("verifyTimecode() error: %v", err)
+	}
+}
+
+func TestParseProbeOutputMatroskaDuration(t *testing.T) {
+	// Matroska streams carry their duration in a tag and may lack a container duration
+	data := []byte(`{"streams": [
+		{"index": 0, "codec_type": "video", "tags": {"DURATION": "00:08:50.500000000"}},
+		{"index": 1, "codec_type": "audio", "tags": {"DURATION": "00:08:50.480000000"}}
+	], "format": {}}`)
+	result, err := parseProbeOutput(data)
+	if err != nil {
+		t.Fatalf("parseProbeOutput() error: %v", err)
+	}
+	if result.Duration != 530.5 {
+		t.Errorf("Expected duration 530.5, got %v", result.Duration)
+	}
+}
+
+func TestParseProbeOutputFormatTags(t *testing.T) {
+	data := []byte(`{"streams": [], "format": {"duration": "12.0", "tags": {"comment": "merged from: GH010001.MP4, GH020001.MP4"}}}`)
+	result, err := parseProbeOutput(data)
+	if err != nil {
+		t.Fatalf("parseProbeOutput() error: %v", err)
+	}
+	for _, name := range []string{"GH010001.MP4", "GH020001.MP4"} {
+		if !strings.Contains(result.Tags["comment"], name) {
+			t.Errorf("Expected comment tag to contain %s, got %q", name, result.Tags["comment"])
+		}
+	}
+}
+
+func TestMergeFilesProbesInputsOnce(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probed := make(map[string]int)
+	probeFile = func(path string) (ProbeResult, error) {
+		probed[path]++
+		return hero, nil
+	}
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	// The plan and the merge share the probe results
+	opts := Options{Chapters: true, probes: newProbeCache()}
+	if _, err := buildPlan(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("buildPlan() error: %v", err)
+	}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	for _, path := range inputPaths {
+		if probed[path] != 1 {
+			t.Errorf("Expected %s to be probed once, got %d", filepath.Base(path), probed[path])
+		}
+	}
+}
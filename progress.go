@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stages of a merge reported in Progress.
+const (
+	// stageSegment is the remux of one chapter with Options.Segmented.
+	stageSegment = "segment"
+	// stageMerge is the ffmpeg run writing the output.
+	stageMerge = "merge"
+	// stageHashInputs and stageHashOutput are the ffmpeg runs hashing the
+	// frames of the inputs and of the output with Options.VerifyFrames.
+	stageHashInputs = "hashing inputs"
+	stageHashOutput = "hashing output"
+)
+
+// Progress reports how far an ffmpeg run of a merge has come.
+type Progress struct {
+	Stage string
+	// Percent goes from 0 to 100 over the run.
+	Percent float64
+	// Current is the position reached in the output of the run, out of
+	// its expected duration Total.
+	Current time.Duration
+	Total   time.Duration
+}
+
+// progressWriter parses the key=value blocks ffmpeg writes with
+// -progress and reports each block to fn.
+type progressWriter struct {
+	stage   string
+	total   time.Duration
+	fn      func(Progress)
+	buf     bytes.Buffer
+	current time.Duration
+}
+
+func newProgressWriter(stage string, total time.Duration, fn func(Progress)) *progressWriter {
+	return &progressWriter{stage: stage, total: total, fn: fn}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		w.parseLine(strings.TrimSpace(line))
+	}
+}
+
+func (w *progressWriter) parseLine(line string) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return
+	}
+	switch key {
+	case "out_time_us":
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			w.current = time.Duration(us) * time.Microsecond
+		}
+	case "progress":
+		// Each block ends with progress=continue, the last one with progress=end
+		if value == "end" && w.total > 0 {
+			w.current = w.total
+		}
+		w.fn(Progress{Stage: w.stage, Percent: w.percent(), Current: w.current, Total: w.total})
+	}
+}
+
+func (w *progressWriter) percent() float64 {
+	if w.total <= 0 {
+		return 0
+	}
+	return min(100, 100*float64(w.current)/float64(w.total))
+}
+
+// progressArgs makes ffmpeg write its progress to stdout for a
+// progressWriter when opts has a ProgressFunc.
+func progressArgs(opts Options) []string {
+	if opts.ProgressFunc == nil {
+		return nil
+	}
+	return []string{"-progress", "pipe:1"}
+}
+
+// printProgress is the ProgressFunc of the command line, which rewrites a
+// single status line.
+func printProgress(w io.Writer) func(Progress) {
+	return func(p Progress) {
+		fmt.Fprintf(w, "\r%s: %5.1f%% (%s of %s)", p.Stage, p.Percent, formatOffset(p.Current), formatOffset(p.Total))
+		if p.Percent >= 100 {
+			fmt.Fprintln(w)
+		}
+	}
+}
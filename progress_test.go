@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syntheticProgress is ffmpeg -progress output over 10 seconds of output.
+const syntheticProgress = `frame=120
+fps=0.00
+out_time_us=2000000
+out_time=00:00:02.000000
+progress=continue
+frame=300
+out_time_us=N/A
+progress=continue
+frame=420
+out_time_us=7000000
+progress=continue
+frame=600
+out_time_us=9980000
+progress=end
+`
+
+func TestProgressWriter(t *testing.T) {
+	var events []Progress
+	w := newProgressWriter(stageMerge, 10*time.Second, func(p Progress) {
+		events = append(events, p)
+	})
+	// Blocks are split at arbitrary points between writes
+	for _, chunk := range []string{syntheticProgress[:25], syntheticProgress[25:80], syntheticProgress[80:]} {
+		w.Write([]byte(chunk))
+	}
+
+	expected := []float64{20, 20, 70, 100}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d progress events, got %+v", len(expected), events)
+	}
+	for i, event := range events {
+		if event.Percent != expected[i] || event.Stage != stageMerge || event.Total != 10*time.Second {
+			t.Errorf("Event %d: expected %v%%, got %+v", i, expected[i], event)
+		}
+		if i > 0 && event.Percent < events[i-1].Percent {
+			t.Errorf("Expected increasing percentages, got %v after %v", event.Percent, events[i-1].Percent)
+		}
+	}
+	if events[2].Current != 7*time.Second {
+		t.Errorf("Expected the current time 7s, got %v", events[2].Current)
+	}
+
+	var line bytes.Buffer
+	printProgress(&line)(events[3])
+	if line.String() != "\rmerge: 100.0% (00:00:10.000 of 00:00:10.000)\n" {
+		t.Errorf("Unexpected progress line %q", line.String())
+	}
+}
+
+func TestMergeFilesProgress(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	hero.Duration = 5
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		cmd.Stdout.Write([]byte(syntheticProgress))
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	var events []Progress
+	opts := Options{ProgressFunc: func(p Progress) { events = append(events, p) }}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if !strings.HasPrefix(strings.Join(merge, " "), "ffmpeg -nostdin -progress pipe:1 ") {
+		t.Errorf("Expected ffmpeg to report its progress, got: %s", strings.Join(merge, " "))
+	}
+	// The two chapters last 10 seconds together
+	if len(events) != 4 || events[2].Percent != 70 || events[2].Total != 10*time.Second {
+		t.Errorf("Unexpected progress events %+v", events)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Sizes of the editing proxy of -proxy.
+const (
+	proxy1080p = "1080p"
+	proxy720p  = "720p"
+)
+
+// proxyBitrates are the video bitrates of the proxies, low enough to edit
+// smoothly on a laptop and still judge focus and framing.
+var proxyBitrates = map[string]string{
+	proxy1080p: "8M",
+	proxy720p:  "4M",
+}
+
+// proxyFlag is the value of -proxy, which is a size or, given without one,
+// proxy1080p.
+type proxyFlag string
+
+func (p *proxyFlag) String() string {
+	return string(*p)
+}
+
+func (p *proxyFlag) Set(value string) error {
+	switch value {
+	case "true":
+		*p = proxy1080p
+	case "false":
+		*p = ""
+	case proxy1080p, proxy720p:
+		*p = proxyFlag(value)
+	default:
+		return fmt.Errorf("must be 1080p or 720p")
+	}
+	return nil
+}
+
+// IsBoolFlag lets -proxy be given without a size.
+func (p *proxyFlag) IsBoolFlag() bool {
+	return true
+}
+
+// proxyPath is the proxy of outputPath, out_proxy.mp4 for out.mp4 or
+// out.mkv alike, as every editor takes MP4.
+func proxyPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "_proxy.mp4"
+}
+
+// proxyEncoder is the VideoToolbox H.264 encoder when the installed ffmpeg
+// has it, libx264 otherwise.
+func proxyEncoder() string {
+	encoder := hwaccelEncoders["videotoolbox"][codecH264]
+	if encoders, err := listEncoders(); err == nil && slices.Contains(encoders, encoder) {
+		return encoder
+	}
+	return softwareCodecEncoders[codecH264]
+}
+
+// proxyArgs builds the ffmpeg arguments encoding outputPath into an H.264
+// proxy of size at proxyPath, graded with the LUT at lut unless it is
+// empty. Timestamps and metadata are kept, so the proxy lines up with the
+// output when an editor relinks it; only video taller than the proxy is
+// scaled down.
+func proxyArgs(outputPath, proxyPath, size, encoder, lut, logLevel string) []string {
+	height := strings.TrimSuffix(size, "p")
+	filter := "scale=-2:'min(ih," + height + ")'"
+	if lut != "" {
+		filter = lutFilter(lut) + "," + filter
+	}
+	args := append(ffmpegArgs(logLevel),
+		"-i", outputPath,
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-map_metadata", "0",
+		"-vf", filter,
+		"-c:v", encoder,
+		"-b:v", proxyBitrates[size],
+	)
+	if softwareEncoders[encoder] {
+		args = append(args, "-preset", "veryfast")
+	}
+	return append(args,
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-b:a", "128k",
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		proxyPath,
+	)
+}
+
+// writeProxy encodes the merged outputPath into the editing proxy of
+// opts.Proxy next to it, stamped with creationTime and modTime like the
+// output. The proxy is a convenience, so a failure only logs a warning
+// and leaves no proxy.
+func writeProxy(outputPath string, creationTime, modTime time.Time, opts Options) {
+	if opts.Proxy == "" {
+		return
+	}
+	logger := opts.logger()
+	proxy := proxyPath(outputPath)
+	partial := partialPath(proxy)
+	defer removePartial(partial, opts)
+
+	encoder := proxyEncoder()
+	logger.Info("writing editing proxy", "proxy", proxy, "size", opts.Proxy, "encoder", encoder, "lut", opts.ProxyLUT)
+	start := time.Now()
+	// A partial proxy left by an earlier run is scratch, ffmpeg would refuse it
+	os.Remove(partial)
+	cmd := ffmpegCommand(proxyArgs(outputPath, partial, opts.Proxy, encoder, opts.ProxyLUT, opts.FFmpegLogLevel)...)
+	err := runCommand(logger, cmd)
+	if err == nil {
+		err = checkProxyDuration(outputPath, partial)
+	}
+	if err == nil {
+		// Times that cannot be set are only a warning here, whatever
+		// StrictTimes says for the output
+		timesOpts := opts
+		timesOpts.StrictTimes = false
+		err = setOutputTimes(partial, creationTime, modTime, timesOpts)
+	}
+	if err == nil {
+		err = renamePartial(partial, proxy)
+	}
+	if err != nil {
+		logger.Warn("failed to write the editing proxy, the output is fine", "proxy", proxy, "error", err)
+		return
+	}
+	logger.Info("editing proxy written", "proxy", proxy, "duration", time.Since(start))
+	if opts.ProxyFunc != nil {
+		opts.ProxyFunc(proxy)
+	}
+}
+
+// checkProxyDuration makes sure the proxy lasts as long as the output, so
+// that edits made on it land where they should.
+func checkProxyDuration(outputPath, proxyPath string) error {
+	output, err := probeFile(outputPath)
+	if err != nil {
+		return err
+	}
+	proxy, err := probeFile(proxyPath)
+	if err != nil {
+		return err
+	}
+	diff := time.Duration((proxy.Duration - output.Duration) * float64(time.Second)).Abs()
+	if diff > defaultDurationTolerance {
+		return fmt.Errorf("the proxy lasts %.3fs instead of %.3fs", proxy.Duration, output.Duration)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyFlag(t *testing.T) {
+	for args, expected := range map[string]string{
+		"":             "",
+		"-proxy":       proxy1080p,
+		"-proxy=720p":  proxy720p,
+		"-proxy=1080p": proxy1080p,
+		"-proxy=false": "",
+	} {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		var proxy proxyFlag
+		flags.Var(&proxy, "proxy", "")
+		if err := flags.Parse(strings.Fields(args + " out.mp4")); err != nil {
+			t.Errorf("%q: %v", args, err)
+			continue
+		}
+		if string(proxy) != expected || flags.Arg(0) != "out.mp4" {
+			t.Errorf("%q: expected %q, got %q with arguments %v", args, expected, proxy, flags.Args())
+		}
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	var proxy proxyFlag
+	flags.Var(&proxy, "proxy", "")
+	if err := flags.Parse([]string{"-proxy=4k"}); err == nil {
+		t.Error("Expected an unknown size to be refused")
+	}
+}
+
+func TestProxyArgs(t *testing.T) {
+	if path := proxyPath("/trip/merged.mkv"); path != "/trip/merged_proxy.mp4" {
+		t.Errorf("Expected /trip/merged_proxy.mp4, got %s", path)
+	}
+
+	args := strings.Join(proxyArgs("merged.mp4", "merged_proxy.mp4", proxy720p, "h264_videotoolbox", "", ""), " ")
+	for _, expected := range []string{"-i merged.mp4", "-map_metadata 0", "scale=-2:'min(ih,720)'", "-c:v h264_videotoolbox -b:v 4M", "-f mp4 merged_proxy.mp4"} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("Expected %q in the command, got: %s", expected, args)
+		}
+	}
+	if strings.Contains(args, "-preset") {
+		t.Errorf("Expected no -preset for VideoToolbox, got: %s", args)
+	}
+	args = strings.Join(proxyArgs("merged.mp4", "merged_proxy.mp4", proxy1080p, "libx264", "", ""), " ")
+	if !strings.Contains(args, "-c:v libx264 -b:v 8M -preset veryfast") {
+		t.Errorf("Expected the libx264 settings, got: %s", args)
+	}
+}
+
+func TestWriteProxy(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH010042.MP4", "GH020042.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+	proxy := filepath.Join(dir, "merged_proxy.mp4")
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	origListEncoders := listEncoders
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+		listEncoders = origListEncoders
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	listEncoders = func() ([]string, error) {
+		return []string{"libx264", "h264_videotoolbox"}, nil
+	}
+	var proxyCommand []string
+	proxyFails := false
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		output := cmd.Args[len(cmd.Args)-1]
+		if strings.Contains(output, "_proxy") {
+			proxyCommand = cmd.Args
+			if proxyFails {
+				return errors.New("exit status 1")
+			}
+		}
+		return os.WriteFile(output, []byte("encoded"), 0644)
+	}
+
+	recorded := time.Date(2024, time.June, 1, 10, 0, 0, 0, time.UTC)
+	var written string
+	opts := Options{Proxy: proxy1080p, ProxyFunc: func(path string) { written = path }}
+	if err := mergeFiles(outputPath, inputPaths, recorded, recorded.Add(time.Hour), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if written != proxy {
+		t.Errorf("Expected the proxy %s, got %q", proxy, written)
+	}
+	if args := strings.Join(proxyCommand, " "); !strings.Contains(args, "-i "+outputPath) || !strings.Contains(args, "h264_videotoolbox") {
+		t.Errorf("Expected the output to be encoded with VideoToolbox, got: %s", args)
+	}
+	info, err := os.Stat(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(recorded.Add(time.Hour)) {
+		t.Errorf("Expected the proxy to get the times of the output, got %v", info.ModTime())
+	}
+
+	// A failed proxy leaves the merge successful and no proxy behind
+	if err := os.Remove(proxy); err != nil {
+		t.Fatal(err)
+	}
+	proxyFails, written = true, ""
+	if err := mergeFiles(outputPath, inputPaths, recorded, recorded, opts); err != nil {
+		t.Fatalf("Expected the merge to succeed without its proxy, got %v", err)
+	}
+	if written != "" {
+		t.Errorf("Expected no proxy to be reported, got %s", written)
+	}
+	for _, path := range []string{proxy, partialPath(proxy)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected no %s, got %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunQuietSuccess(t *testing.T) {
+	dir := t.TempDir()
+	first, err := createTestVideoFileIn(dir, "GH011234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	second, err := createTestVideoFileIn(dir, "GH021234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+
+	outputPath := filepath.Join(dir, "merged.mp4")
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-quiet-success", "-v", outputPath, second.Name(), first.Name()}, &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("Expected exit code %d, got %d (stderr: %s)", exitOK, code, stderr.String())
+	}
+	if stdout.String() != outputPath+"\n" {
+		t.Errorf("Expected only the output path on stdout, got %q", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Files merged successfully") {
+		t.Errorf("Expected the summary on stderr, got: %s", stderr.String())
+	}
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Errorf("Expected the output to be written: %v", err)
+	}
+}
+
+func TestRunQuietSuccessListOnly(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("chapter"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listPath := filepath.Join(t.TempDir(), "trip.txt")
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-quiet-success", "-list-only", listPath, dir}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Expected -list-only to succeed, got %d: %s", code, stderr.String())
+	}
+	if stdout.String() != listPath+"\n" {
+		t.Errorf("Expected only the list path on stdout, got %q", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Concat list of 2 file(s) written") {
+		t.Errorf("Expected the message on stderr, got: %s", stderr.String())
+	}
+}
+
+func TestRunQuietSuccessFailure(t *testing.T) {
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-quiet-success", filepath.Join(dir, "merged.mp4"), filepath.Join(dir, "GH011234.MP4")}, &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("Expected exit code %d, got %d", exitError, code)
+	}
+	if stdout.Len() != 0 || stderr.Len() == 0 {
+		t.Errorf("Expected the error on stderr only, got stdout %q and stderr %q", stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	if code := run([]string{"-quiet-success", "-json", "out.mp4", "GH011234.MP4"}, &stdout, &stderr); code != exitUsage {
+		t.Errorf("Expected -quiet-success with -json to be refused, got %d", code)
+	}
+	if stdout.Len() != 0 || !strings.Contains(stderr.String(), "cannot be combined with -json") {
+		t.Errorf("Expected the refusal on stderr only, got stdout %q and stderr %q", stdout.String(), stderr.String())
+	}
+}
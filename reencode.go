@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Software encoder defaults for re-encoding.
+const (
+	defaultCRF    = 20
+	defaultPreset = "medium"
+)
+
+// softwareEncoders take the -crf and -preset options.
+var softwareEncoders = map[string]bool{
+	"libx264": true,
+	"libx265": true,
+}
+
+// encodeSettings describe the output of a re-encoding merge.
+type encodeSettings struct {
+	VideoCodec string `json:"video_codec"`
+	CRF        int    `json:"crf,omitempty"`
+	Preset     string `json:"preset,omitempty"`
+	Bitrate    string `json:"bitrate,omitempty"`
+	// Quality is the -q:v of the VideoToolbox encoders.
+	Quality   int    `json:"quality,omitempty"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	FrameRate string `json:"frame_rate"`
+	PixFmt    string `json:"pix_fmt"`
+	// Audio is false when some input has no audio to concatenate.
+	Audio      bool   `json:"audio"`
+	SampleRate string `json:"sample_rate,omitempty"`
+	Channels   int    `json:"channels,omitempty"`
+	// AudioTrack is the audio stream of each input to use, from 0.
+	AudioTrack int `json:"-"`
+}
+
+func (e encodeSettings) String() string {
+	s := e.VideoCodec
+	switch {
+	case e.Bitrate != "":
+		s += fmt.Sprintf(" (bitrate %s)", e.Bitrate)
+	case softwareEncoders[e.VideoCodec]:
+		s += fmt.Sprintf(" (crf %d, preset %s)", e.CRF, e.Preset)
+	case e.Quality != 0:
+		s += fmt.Sprintf(" (quality %d)", e.Quality)
+	}
+	s += fmt.Sprintf(" at %dx%d, %s fps", e.Width, e.Height, e.FrameRate)
+	if e.Audio {
+		s += fmt.Sprintf(", aac %s Hz", e.SampleRate)
+	} else {
+		s += ", no audio"
+	}
+	return s
+}
+
+// encoder returns the video encoder settings used when re-encoding. The
+// encoder is VideoCodec when it names one, otherwise the encoder of the
+// codec VideoCodec names matching HWAccel. A Bitrate replaces the CRF.
+func (o Options) encoder() encodeSettings {
+	settings := encodeSettings{VideoCodec: o.VideoCodec, Bitrate: o.Bitrate}
+	if _, ok := softwareCodecEncoders[o.VideoCodec]; ok || o.VideoCodec == "" {
+		settings.VideoCodec = videoEncoder(o.HWAccel, o.VideoCodec)
+	}
+	if settings.Bitrate != "" {
+		return settings
+	}
+	if _, ok := hardwareEncoderCodec(settings.VideoCodec); ok {
+		crf := o.CRF
+		if crf == 0 {
+			crf = defaultCRF
+		}
+		settings.Quality = videoToolboxQuality(crf)
+	}
+	if softwareEncoders[settings.VideoCodec] {
+		settings.CRF, settings.Preset = o.CRF, o.Preset
+		if settings.CRF == 0 {
+			settings.CRF = defaultCRF
+		}
+		if settings.Preset == "" {
+			settings.Preset = defaultPreset
+		}
+	}
+	return settings
+}
+
+// encoderArgs selects and configures the video encoder.
+func encoderArgs(opts Options) []string {
+	settings := opts.encoder()
+	args := []string{"-c:v", settings.VideoCodec}
+	switch {
+	case settings.Bitrate != "":
+		args = append(args, "-b:v", settings.Bitrate)
+	case softwareEncoders[settings.VideoCodec]:
+		args = append(args, "-crf", strconv.Itoa(settings.CRF), "-preset", settings.Preset)
+	case settings.Quality != 0:
+		args = append(args, "-q:v", strconv.Itoa(settings.Quality))
+	}
+	return args
+}
+
+// reencodeTarget returns the settings that turn every input into the
+// format of the first one. probes holds the probe result of each input.
+func reencodeTarget(probes []ProbeResult, opts Options) encodeSettings {
+	settings := opts.encoder()
+	first := probes[0]
+	if video, ok := first.firstStream("video"); ok {
+		settings.Width, settings.Height = video.Width, video.Height
+		settings.FrameRate, settings.PixFmt = video.FrameRate, video.PixFmt
+	}
+
+	audio, ok := first.firstStream("audio")
+	settings.Audio = ok
+	for _, probe := range probes {
+		if _, ok := probe.firstStream("audio"); !ok {
+			settings.Audio = false
+		}
+	}
+	if settings.Audio {
+		settings.SampleRate, settings.Channels = audio.SampleRate, audio.Channels
+	}
+	if opts.AudioTrack > 0 {
+		settings.AudioTrack = opts.AudioTrack - 1
+	}
+	return settings
+}
+
+// concatFilter builds a filter graph that scales, pads and resamples count
+// inputs to target and concatenates them into [v] and, with audio, [a].
+func concatFilter(count int, target encodeSettings) string {
+	var graph []string
+	var concatInputs strings.Builder
+	for i := 0; i < count; i++ {
+		video := fmt.Sprintf("[%d:v:0]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1",
+			i, target.Width, target.Height, target.Width, target.Height)
+		if target.FrameRate != "" {
+			video += ",fps=" + target.FrameRate
+		}
+		if target.PixFmt != "" {
+			video += ",format=" + target.PixFmt
+		}
+		graph = append(graph, fmt.Sprintf("%s[v%d]", video, i))
+		fmt.Fprintf(&concatInputs, "[v%d]", i)
+
+		if target.Audio {
+			graph = append(graph, fmt.Sprintf("[%d:a:%d]aresample=%s,aformat=channel_layouts=%dc[a%d]",
+				i, target.AudioTrack, target.SampleRate, target.Channels, i))
+			fmt.Fprintf(&concatInputs, "[a%d]", i)
+		}
+	}
+
+	audioCount, outputs := 0, "[v]"
+	if target.Audio {
+		audioCount, outputs = 1, "[v][a]"
+	}
+	graph = append(graph, fmt.Sprintf("%sconcat=n=%d:v=1:a=%d%s", concatInputs.String(), count, audioCount, outputs))
+	return strings.Join(graph, ";")
+}
+
+// videoFilters are the filters of the video of spec re-encoding it: the
+// LUT of opts grading it, then the timestamp burnt into it.
+func videoFilters(spec mergeSpec, opts Options) []string {
+	var filters []string
+	if opts.LUT != "" {
+		filters = append(filters, lutFilter(opts.LUT))
+	}
+	if opts.BurnTimestamp != nil {
+		filters = append(filters, timestampFilter(*opts.BurnTimestamp, spec.CreationTime, opts.location()))
+	}
+	return filters
+}
+
+// reencodeArgs builds the ffmpeg arguments of a merge that decodes every
+// input and concatenates them with a filter graph, for inputs that differ
+// too much for the concat demuxer. The telemetry stream telemetryIndex of
+// the concat list is copied alongside unless it is negative.
+func reencodeArgs(spec mergeSpec, inputPaths []string, target encodeSettings, telemetryIndex int, opts Options) []string {
+	args := ffmpegArgs(opts.FFmpegLogLevel)
+	for _, path := range inputPaths {
+		if opts.HWAccel != "" {
+			args = append(args, "-hwaccel", opts.HWAccel)
+		}
+		args = append(args, inputArgs(opts)...)
+		args = append(args, "-i", path)
+	}
+	nextInput := len(inputPaths)
+	telemetryInput := -1
+	if telemetryIndex >= 0 {
+		// Data streams cannot pass through filters, the concat demuxer supplies them instead
+		telemetryInput = nextInput
+		nextInput++
+		args = append(args, inputArgs(opts)...)
+		args = append(args, concatInputArgs(spec.ListPath, spec.Remote)...)
+	}
+	if spec.ChaptersPath != "" {
+		args = append(args, "-i", spec.ChaptersPath, "-map_chapters", strconv.Itoa(nextInput))
+	}
+
+	graph, video := concatFilter(len(inputPaths), target), "[v]"
+	if filters := videoFilters(spec, opts); len(filters) > 0 {
+		graph += ";[v]" + strings.Join(filters, ",") + "[graded]"
+		video = "[graded]"
+	}
+	args = append(args, "-filter_complex", graph, "-map", video)
+	if target.Audio {
+		args = append(args, "-map", "[a]")
+	}
+	if telemetryInput >= 0 {
+		// The telemetry lands after the video and the audio, its tag goes
+		// to that output stream like in mapStreams
+		output := 1
+		if target.Audio {
+			output++
+		}
+		args = append(args,
+			"-map", fmt.Sprintf("%d:%d", telemetryInput, telemetryIndex),
+			"-c:d", "copy",
+			fmt.Sprintf("-tag:%d", output), "gpmd")
+	}
+	args = append(args, encoderArgs(opts)...)
+	if target.Audio {
+		args = append(args, "-c:a", "aac")
+	}
+	args = append(args, timestampOutputArgs(opts)...)
+	args = append(args, trimOutputArgs(spec.Trim, true)...)
+	args = append(args, "-y")
+	args = append(args, spec.MapArgs...)
+	return append(args, outputArgs(spec, opts)...)
+}
+
+// reencodedStreams returns the streams of probe, the first input, that a
+// re-encoding merge to target keeps, in the format target gives them.
+func reencodedStreams(probe ProbeResult, target encodeSettings, telemetry bool) []StreamInfo {
+	var streams []StreamInfo
+	if video, ok := probe.firstStream("video"); ok {
+		if codec := encoderCodec(target.VideoCodec); codec != "" {
+			video.CodecName = codec
+		}
+		if target.Width > 0 {
+			video.Width, video.Height = target.Width, target.Height
+		}
+		if target.PixFmt != "" {
+			video.PixFmt = target.PixFmt
+		}
+		if target.FrameRate != "" {
+			video.FrameRate = target.FrameRate
+		}
+		streams = append(streams, video)
+	}
+	if audio, ok := probe.firstStream("audio"); ok && target.Audio {
+		audio.CodecName = "aac"
+		if target.SampleRate != "" {
+			audio.SampleRate, audio.Channels = target.SampleRate, target.Channels
+		}
+		streams = append(streams, audio)
+	}
+	for _, stream := range probe.Streams {
+		if telemetry && stream.isTelemetry() {
+			streams = append(streams, stream)
+			break
+		}
+	}
+	return streams
+}
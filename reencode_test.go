@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConcatFilter(t *testing.T) {
+	target := encodeSettings{Width: 1920, Height: 1080, FrameRate: "60000/1001", PixFmt: "yuvj420p", Audio: true, SampleRate: "48000", Channels: 2}
+	expected := "[0:v:0]scale=1920:1080:force_original_aspect_ratio=decrease,pad=1920:1080:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=60000/1001,format=yuvj420p[v0];" +
+		"[0:a:0]aresample=48000,aformat=channel_layouts=2c[a0];" +
+		"[1:v:0]scale=1920:1080:force_original_aspect_ratio=decrease,pad=1920:1080:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=60000/1001,format=yuvj420p[v1];" +
+		"[1:a:0]aresample=48000,aformat=channel_layouts=2c[a1];" +
+		"[v0][a0][v1][a1]concat=n=2:v=1:a=1[v][a]"
+	if got := concatFilter(2, target); got != expected {
+		t.Errorf("Expected filter\n%s\ngot\n%s", expected, got)
+	}
+
+	target.Audio = false
+	if got := concatFilter(2, target); !strings.HasSuffix(got, "[v0][v1]concat=n=2:v=1:a=0[v]") || strings.Contains(got, "aresample") {
+		t.Errorf("Expected a video only filter, got %s", got)
+	}
+}
+
+func TestEncoderArgs(t *testing.T) {
+	if got := strings.Join(encoderArgs(Options{}), " "); got != "-c:v libx264 -crf 20 -preset medium" {
+		t.Errorf("Unexpected default encoder arguments: %s", got)
+	}
+	if got := strings.Join(encoderArgs(Options{VideoCodec: "libx265", CRF: 24, Preset: "slow"}), " "); got != "-c:v libx265 -crf 24 -preset slow" {
+		t.Errorf("Unexpected libx265 encoder arguments: %s", got)
+	}
+	// VideoToolbox has a quality scale instead of a CRF
+	if got := strings.Join(encoderArgs(Options{HWAccel: "videotoolbox", CRF: 24}), " "); got != "-c:v h264_videotoolbox -q:v 55" {
+		t.Errorf("Unexpected VideoToolbox encoder arguments: %s", got)
+	}
+}
+
+// stubMismatchedInputs makes the second chapter 720p while the first one
+// is 1080p, and returns the inputs and the ffmpeg commands that ran.
+func stubMismatchedInputs(t *testing.T, dir string) ([]string, *[][]string) {
+	t.Helper()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	small := loadProbeFixture(t, "hero_probe.json")
+	small.Streams = append([]StreamInfo(nil), small.Streams...)
+	small.Streams[0].Width, small.Streams[0].Height = 1280, 720
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	t.Cleanup(func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	})
+	probeFile = func(path string) (ProbeResult, error) {
+		if path == inputPaths[1] {
+			return small, nil
+		}
+		return hero, nil
+	}
+
+	var commands [][]string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		commands = append(commands, cmd.Args)
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+	return inputPaths, &commands
+}
+
+func TestMergeFilesReencodeFallback(t *testing.T) {
+	dir := t.TempDir()
+	inputPaths, commands := stubMismatchedInputs(t, dir)
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{Reencode: true, Streams: streamsEssential})
+	if err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if len(*commands) != 1 {
+		t.Fatalf("Expected one ffmpeg run, got %v", *commands)
+	}
+
+	command := strings.Join((*commands)[0], " ")
+	for _, expected := range []string{
+		"-i " + inputPaths[0] + " -i " + inputPaths[1] + " -f concat",
+		"-filter_complex [0:v:0]scale=1920:1080:",
+		"-map [v] -map [a] -map 2:3 -c:d copy -tag:2 gpmd",
+		"-c:v libx264 -crf 20 -preset medium -c:a aac",
+		"-write_tmcd 1",
+	} {
+		if !strings.Contains(command, expected) {
+			t.Errorf("Expected %q in command, got: %s", expected, command)
+		}
+	}
+
+	// The output has the format of the first chapter, in which -two-pass
+	// expects it
+	err = mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{Reencode: true, Streams: streamsEssential, TwoPass: true})
+	if err != nil {
+		t.Errorf("Expected the re-encoded output to pass -two-pass, got %v", err)
+	}
+
+	// Without -reencode the merge is aborted before writing anything
+	*commands = nil
+	err = mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{Streams: streamsEssential})
+	var mismatch *mismatchError
+	if !errors.As(err, &mismatch) || len(*commands) != 0 {
+		t.Fatalf("Expected the mismatch to abort the merge, got %v and commands %v", err, *commands)
+	}
+	expected := "inputs differ from GH011234.MP4, concatenating them with stream copy would produce a broken file:\n" +
+		"  FILE          PARAMETER   EXPECTED   ACTUAL\n" +
+		"  GH021234.MP4  resolution  1920x1080  1280x720\n" +
+		"Use -reencode to re-encode them to the format of the first chapter, or -allow-mismatch to merge them anyway"
+	if err.Error() != expected {
+		t.Errorf("Expected error\n%s\ngot\n%s", expected, err)
+	}
+
+	// -force only overwrites, it does not merge them
+	err = mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{Streams: streamsEssential, Force: true})
+	if !errors.As(err, &mismatch) || len(*commands) != 0 {
+		t.Fatalf("Expected -force to leave the mismatch to abort the merge, got %v and commands %v", err, *commands)
+	}
+
+	// -allow-mismatch copies them anyway, with a warning
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	err = mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{Logger: logger, Streams: streamsEssential, AllowMismatch: true})
+	if err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if command := strings.Join((*commands)[0], " "); strings.Contains(command, "-filter_complex") {
+		t.Errorf("Expected stream copy without -reencode, got: %s", command)
+	}
+	if !strings.Contains(logs.String(), "param=resolution expected=1920x1080 actual=1280x720") {
+		t.Errorf("Expected the resolution mismatch to be logged, got:\n%s", logs.String())
+	}
+}
+
+func TestBuildPlanReencode(t *testing.T) {
+	dir := t.TempDir()
+	inputPaths, _ := stubMismatchedInputs(t, dir)
+
+	plan, err := buildPlan("merged.mp4", inputPaths, time.Time{}, time.Time{}, Options{Reencode: true})
+	if err != nil {
+		t.Fatalf("buildPlan() error: %v", err)
+	}
+	if len(plan.Mismatches) != 1 || plan.Reencode == nil {
+		t.Fatalf("Expected one mismatch and re-encode settings, got %+v, %+v", plan.Mismatches, plan.Reencode)
+	}
+
+	var text bytes.Buffer
+	printPlan(&text, plan)
+	for _, expected := range []string{
+		"Mismatches:\n  FILE          PARAMETER   EXPECTED   ACTUAL\n  GH021234.MP4  resolution  1920x1080  1280x720\n",
+		"Re-encode: libx264 (crf 20, preset medium) at 1920x1080, 60000/1001 fps, aac 48000 Hz, because the inputs differ\n",
+	} {
+		if !strings.Contains(text.String(), expected) {
+			t.Errorf("Expected %q in plan output, got:\n%s", expected, text.String())
+		}
+	}
+}
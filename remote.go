@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// remoteProtocols are the protocols ffmpeg may use for the inputs listed
+// in a concat list. The concat demuxer only opens local files by default.
+const remoteProtocols = "file,http,https,tcp,tls,crypto"
+
+// remoteTimeout limits the request for the times of a remote input.
+const remoteTimeout = 30 * time.Second
+
+// isRemote reports whether the input path is an http or https URL.
+func isRemote(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// hasRemote reports whether any of paths is remote.
+func hasRemote(paths []string) bool {
+	for _, path := range paths {
+		if isRemote(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeURL returns the form of rawURL used to detect duplicates: the
+// scheme and host are case-insensitive and the default port is implied.
+func normalizeURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid input URL %s", rawURL)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = u.Hostname()
+	}
+	return u.String(), nil
+}
+
+// concatInputArgs are the arguments reading the concat list listPath,
+// allowing remote inputs in it when remote is set.
+func concatInputArgs(listPath string, remote bool) []string {
+	var args []string
+	if remote {
+		args = append(args, "-protocol_whitelist", remoteProtocols)
+	}
+	return append(args, "-f", "concat", "-safe", "0", "-i", listPath)
+}
+
+// remoteStat returns the size and modification time of the remote input
+// rawURL from the headers of a HEAD request. The time is zero when the
+// server sends no Last-Modified header.
+func remoteStat(rawURL string) (int64, time.Time, error) {
+	client := &http.Client{Timeout: remoteTimeout}
+	resp, err := client.Head(rawURL)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to reach input %s: %v", rawURL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, fmt.Errorf("failed to reach input %s: %s", rawURL, resp.Status)
+	}
+
+	var modTime time.Time
+	if header := resp.Header.Get("Last-Modified"); header != "" {
+		modTime, err = http.ParseTime(header)
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("invalid Last-Modified header %q for %s: %v", header, rawURL, err)
+		}
+	}
+	return resp.ContentLength, modTime, nil
+}
+
+// remoteFileTimes stands in for fileTimes with a remote input. Servers
+// have no birth time, so the Last-Modified time serves as both.
+func remoteFileTimes(rawURL string) (time.Time, time.Time, error) {
+	_, modTime, err := remoteStat(rawURL)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if modTime.IsZero() {
+		return time.Time{}, time.Time{}, fmt.Errorf("input %s has no Last-Modified time. Use -remote-time to give its recording time", rawURL)
+	}
+	return modTime, modTime, nil
+}
+
+// inputFileTimes is getFileTimes with remoteTime, when set, as the time of
+// every remote input instead of the one its server reports.
+func inputFileTimes(inputPaths []string, remoteTime time.Time) (time.Time, time.Time, error) {
+	if remoteTime.IsZero() {
+		return getFileTimes(inputPaths)
+	}
+	var local []string
+	for _, path := range inputPaths {
+		if !isRemote(path) {
+			local = append(local, path)
+		}
+	}
+	creationTime, modTime := remoteTime, remoteTime
+	if len(local) > 0 {
+		localCreation, localMod, err := getFileTimes(local)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		if localCreation.Before(creationTime) {
+			creationTime = localCreation
+		}
+		if localMod.After(modTime) {
+			modTime = localMod
+		}
+	}
+	return creationTime, modTime, nil
+}
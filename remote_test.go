@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveChapters serves names with recorded as their modification time.
+func serveChapters(t *testing.T, recorded time.Time, names ...string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	for _, name := range names {
+		content := []byte("chapter " + name)
+		mux.HandleFunc("/footage/"+name, func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, name, recorded, bytes.NewReader(content))
+		})
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRemoteInputTimes(t *testing.T) {
+	recorded := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	server := serveChapters(t, recorded, "GH011234.MP4")
+	url := server.URL + "/footage/GH011234.MP4"
+
+	birthTime, modTime, err := fileTimes(url)
+	if err != nil {
+		t.Fatalf("fileTimes() error: %v", err)
+	}
+	if !birthTime.Equal(recorded) || !modTime.Equal(recorded) {
+		t.Errorf("Expected the Last-Modified time %v, got %v and %v", recorded, birthTime, modTime)
+	}
+	input, err := fingerprintInput(url)
+	if err != nil || input.Size != int64(len("chapter GH011234.MP4")) || !input.ModTime.Equal(recorded) {
+		t.Errorf("Unexpected fingerprint %+v: %v", input, err)
+	}
+	if _, _, err := fileTimes(server.URL + "/footage/GH021234.MP4"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected a missing remote input to be reported, got: %v", err)
+	}
+
+	// A given time replaces the one of the server
+	given := recorded.Add(-time.Hour)
+	creationTime, _, err := inputFileTimes([]string{url}, given)
+	if err != nil || !creationTime.Equal(given) {
+		t.Errorf("Expected the creation time %v, got %v: %v", given, creationTime, err)
+	}
+}
+
+func TestCollectFilesRemoteDuplicates(t *testing.T) {
+	_, err := collectFiles([]string{
+		"http://nas.local/footage/GH011234.MP4",
+		"HTTP://NAS.local:80/footage/GH011234.MP4",
+	}, defaultFileNamePattern)
+	if err == nil || !strings.Contains(err.Error(), "duplicate file detected: http://nas.local/footage/GH011234.MP4") {
+		t.Errorf("Expected the same URL to be detected as a duplicate, got: %v", err)
+	}
+}
+
+func TestMergeFilesRemote(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "GH011234.MP4")
+	if err := os.WriteFile(localPath, []byte("chapter GH011234.MP4"), 0644); err != nil {
+		t.Fatalf("Failed to create input file: %v", err)
+	}
+	server := serveChapters(t, time.Now(), "GH021234.MP4")
+	url := server.URL + "/footage/GH021234.MP4"
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	var merge []string
+	var list []byte
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		list, _ = os.ReadFile(cmd.Args[indexOf(cmd.Args, "concat")+4])
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	if err := mergeFiles(outputPath, []string{url, localPath}, time.Now(), time.Now(), Options{}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if command := strings.Join(merge, " "); !strings.Contains(command, "-protocol_whitelist "+remoteProtocols+" -f concat -safe 0 -i ") {
+		t.Errorf("Expected remote protocols to be allowed in the concat list, got: %s", command)
+	}
+	if want := "file '" + localPath + "'\nfile '" + url + "'\n"; string(list) != want {
+		t.Errorf("Expected concat list %q, got %q", want, list)
+	}
+
+	// Local inputs keep the concat demuxer to local files
+	secondPath := filepath.Join(dir, "GH021234.MP4")
+	if err := os.WriteFile(secondPath, []byte("chapter GH021234.MP4"), 0644); err != nil {
+		t.Fatalf("Failed to create input file: %v", err)
+	}
+	if err := mergeFiles(outputPath, []string{localPath, secondPath}, time.Now(), time.Now(), Options{}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if command := strings.Join(merge, " "); strings.Contains(command, "-protocol_whitelist") {
+		t.Errorf("Expected no protocol whitelist for local inputs, got: %s", command)
+	}
+}
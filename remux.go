@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// chapterJob is a chapter that -split-chapters remuxes on its own into
+// Output, which gets the times of the chapter.
+type chapterJob struct {
+	File         FileInfo
+	Output       string
+	CreationTime time.Time
+	ModTime      time.Time
+}
+
+// chapterResult is the outcome of remuxing one chapter. Duration is the
+// one of the output when it was verified, Err is nil when the remux
+// succeeded.
+type chapterResult struct {
+	Input    string
+	Output   string
+	Duration time.Duration
+	Err      error
+}
+
+// chapterOutputName names the remuxed file of a chapter after the day it
+// was recorded, its file number and its chapter number, e.g.
+// 2024-06-01_GH0042_part2.mp4.
+func chapterOutputName(file FileInfo, creationTime time.Time, container string, opts Options) string {
+	day := creationTime.In(opts.location()).Format("2006-01-02")
+	return fmt.Sprintf("%s_%s%04d_part%d.%s", day, file.Prefix, file.FileNumber, file.ChapterNumber, container)
+}
+
+// planChapters orders inputPaths and names the file in outputDir each of
+// them is remuxed into. Every chapter keeps its own times, remote ones
+// those of remoteTime unless it is zero, as for inputFileTimes.
+func planChapters(outputDir string, inputPaths []string, remoteTime time.Time, opts Options) ([]chapterJob, error) {
+	files, err := orderFiles(inputPaths, opts)
+	if err != nil {
+		return nil, err
+	}
+	container := opts.Container
+	if container == "" {
+		container = containerMP4
+	}
+
+	var jobs []chapterJob
+	used := make(map[string]bool)
+	for i, file := range files {
+		creationTime, modTime, err := inputFileTimes([]string{file.Path}, remoteTime)
+		if err != nil {
+			return nil, err
+		}
+		// Loop recordings can have several inputs with the same name
+		name := chapterOutputName(file, creationTime, container, opts)
+		if used[name] {
+			name = fmt.Sprintf("%d_%s", i+1, name)
+		}
+		used[name] = true
+		jobs = append(jobs, chapterJob{
+			File:         file,
+			Output:       filepath.Join(outputDir, name),
+			CreationTime: creationTime,
+			ModTime:      modTime,
+		})
+	}
+	return jobs, nil
+}
+
+// remuxChapters remuxes every chapter of jobs on its own, through the
+// pipeline of mergeFiles with a single input, so each output is stamped
+// and verified like a merge. A failed chapter does not stop the others,
+// nor does an output that already exists without opts.Force.
+func remuxChapters(jobs []chapterJob, opts Options) []chapterResult {
+	logger := opts.logger()
+	opts.remux = true
+	if opts.probes == nil {
+		opts.probes = newProbeCache()
+	}
+
+	var results []chapterResult
+	for _, job := range jobs {
+		result := chapterResult{Input: job.File.Path, Output: job.Output}
+		chapterOpts := opts
+		chapterOpts.DurationFunc = func(expected, actual time.Duration) {
+			result.Duration = actual
+		}
+		logger.Info("remuxing chapter", "input", job.File.Path, "output", job.Output)
+		result.Err = checkOutputNew(job.Output, opts.Force)
+		if result.Err == nil {
+			result.Err = mergeFiles(job.Output, []string{job.File.Path}, job.CreationTime, job.ModTime, chapterOpts)
+		}
+		if result.Err != nil {
+			logger.Warn("failed to remux chapter", "input", job.File.Path, "error", result.Err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// printChapterJobs lists the file each chapter would be remuxed into.
+func printChapterJobs(w io.Writer, jobs []chapterJob) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INPUT\tOUTPUT\tCREATED")
+	for _, job := range jobs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", filepath.Base(job.File.Path), job.Output, job.CreationTime.Format(time.RFC3339))
+	}
+	tw.Flush()
+}
+
+// printChapterResults prints a table of the remuxed chapters, and the
+// chapters that failed with their error. It returns the number of
+// failures.
+func printChapterResults(stdout, stderr io.Writer, results []chapterResult) int {
+	failed := 0
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INPUT\tOUTPUT\tDURATION\tRESULT")
+	for _, result := range results {
+		duration, status := "-", "ok"
+		if result.Duration > 0 {
+			duration, status = formatOffset(result.Duration), "verified"
+		}
+		if result.Err != nil {
+			status = "FAILED"
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", filepath.Base(result.Input), filepath.Base(result.Output), duration, status)
+	}
+	tw.Flush()
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Fprintf(stderr, "Error remuxing %s: %v\n", result.Input, result.Err)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChapterOutputName(t *testing.T) {
+	file := FileInfo{Prefix: "GH", FileNumber: 42, ChapterNumber: 2}
+	// Recorded early in the morning in Tokyo, still the day before in UTC
+	tokyo := time.FixedZone("JST", 9*3600)
+	recorded := time.Date(2024, time.June, 1, 1, 30, 0, 0, tokyo)
+	if name := chapterOutputName(file, recorded, containerMP4, Options{Location: tokyo}); name != "2024-06-01_GH0042_part2.mp4" {
+		t.Errorf("Expected 2024-06-01_GH0042_part2.mp4, got %s", name)
+	}
+	if name := chapterOutputName(file, recorded, containerMOV, Options{Location: time.UTC}); name != "2024-05-31_GH0042_part2.mov" {
+		t.Errorf("Expected 2024-05-31_GH0042_part2.mov, got %s", name)
+	}
+}
+
+func TestRemuxChapters(t *testing.T) {
+	dir := t.TempDir()
+	outputDir := filepath.Join(dir, "chapters")
+	recorded := []time.Time{
+		time.Date(2024, time.June, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(2024, time.June, 1, 10, 8, 51, 0, time.UTC),
+	}
+	var inputPaths []string
+	for i, name := range []string{"GH020042.MP4", "GH010042.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := recorded[1-i]
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	var merges [][]string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merges = append(merges, cmd.Args)
+		output := cmd.Args[len(cmd.Args)-1]
+		// The second chapter fails, which does not stop the first one
+		if strings.Contains(output, "part2") {
+			return errors.New("exit status 1")
+		}
+		return os.WriteFile(output, []byte("remuxed"), 0644)
+	}
+
+	opts := Options{Location: time.UTC, Verify: true}
+	jobs, err := planChapters(outputDir, inputPaths, time.Time{}, opts)
+	if err != nil {
+		t.Fatalf("planChapters() error: %v", err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("Expected a job per chapter, got %+v", jobs)
+	}
+	for i, job := range jobs {
+		if job.File.ChapterNumber != i+1 {
+			t.Errorf("Expected chapter %d at %d, got %+v", i+1, i, job.File)
+		}
+		// Without birth times the modification time stands in
+		if !job.CreationTime.Equal(recorded[i]) && !job.ModTime.Equal(recorded[i]) {
+			t.Errorf("Expected chapter %d to keep its own times, got %v %v", i+1, job.CreationTime, job.ModTime)
+		}
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	results := remuxChapters(jobs, opts)
+	if len(merges) != 2 {
+		t.Fatalf("Expected an ffmpeg run per chapter, got %v", merges)
+	}
+	for i, merge := range merges {
+		args := strings.Join(merge, " ")
+		creationTime := "creation_time=" + jobs[i].CreationTime.UTC().Format(time.RFC3339)
+		if !strings.Contains(args, creationTime) || !strings.Contains(args, "-f concat") {
+			t.Errorf("Expected chapter %d to be remuxed and stamped with %s, got: %s", i+1, creationTime, args)
+		}
+	}
+
+	first := filepath.Join(outputDir, chapterOutputName(jobs[0].File, jobs[0].CreationTime, containerMP4, opts))
+	if data, err := os.ReadFile(first); err != nil || string(data) != "remuxed" {
+		t.Errorf("Expected the first chapter at %s, got %q (%v)", first, data, err)
+	}
+	if results[0].Err != nil || results[0].Duration != 530530*time.Millisecond || results[1].Err == nil {
+		t.Errorf("Expected only the second chapter to fail, got %+v", results)
+	}
+	if _, err := os.Stat(jobs[1].Output); !os.IsNotExist(err) {
+		t.Errorf("Expected no output for the failed chapter, got %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if failed := printChapterResults(&stdout, &stderr, results); failed != 1 {
+		t.Errorf("Expected 1 failure, got %d", failed)
+	}
+	if !strings.Contains(stdout.String(), "GH010042.MP4  "+filepath.Base(first)+"  00:08:50.530  verified\n") ||
+		!strings.Contains(stdout.String(), "  FAILED\n") {
+		t.Errorf("Unexpected summary table:\n%s", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Error remuxing "+jobs[1].File.Path) {
+		t.Errorf("Expected the failed chapter to be reported, got: %s", stderr.String())
+	}
+
+	// With -keep-going run leaves the existing first chapter to fail on its own
+	merges = nil
+	results = remuxChapters(jobs, opts)
+	if len(merges) != 1 || results[0].Err == nil || !strings.Contains(results[0].Err.Error(), "already exists") || results[1].Err == nil {
+		t.Errorf("Expected only the new chapter to be remuxed, got %+v and %v", results, merges)
+	}
+	if data, _ := os.ReadFile(first); string(data) != "remuxed" {
+		t.Errorf("Expected the existing chapter to be untouched, got %q", data)
+	}
+}
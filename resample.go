@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// resampleArgs builds the ffmpeg arguments remuxing inputPath into
+// outputPath with the streams of mapping, as for a segment. The audio is
+// resampled to sampleRate and re-encoded to AAC, or copied when
+// sampleRate is empty.
+func resampleArgs(inputPath, outputPath, sampleRate, timecode string, mapping streamMapping, opts Options) []string {
+	args := ffmpegArgs(opts.FFmpegLogLevel)
+	args = append(args, inputArgs(opts)...)
+	args = append(args, "-i", inputPath, "-c", "copy")
+	if sampleRate != "" {
+		args = append(args, "-c:a", "aac", "-b:a", aacBitrate, "-ar", sampleRate)
+	}
+	args = append(args, timestampOutputArgs(opts)...)
+	args = append(args, "-y")
+	args = append(args, mapping.Args...)
+	args = append(args, timecodeArgs(timecode, containerMP4)...)
+	return append(args, "-f", "mp4", outputPath)
+}
+
+// resampleChapters remuxes every chapter of files into a temporary file
+// with the streams of mapping. The audio of the chapters of mismatches,
+// whose sample rate differs from the one of the first chapter, is
+// resampled to it; stream copy would play it too fast or too slow and
+// drift from the video. Every chapter is remuxed, not only those, so that
+// all have the same streams for the concat demuxer. It returns the
+// remuxed chapters in order and a function removing them.
+func resampleChapters(outputPath string, files []FileInfo, mismatches []inputMismatch, mapping streamMapping, opts Options) ([]string, func(), error) {
+	logger := opts.logger()
+	resampled := make(map[string]inputMismatch)
+	for _, m := range mismatches {
+		resampled[m.Path] = m
+	}
+
+	var paths []string
+	remove := func() {
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}
+	for i, file := range files {
+		probe, err := opts.probe(file.Path)
+		if err != nil {
+			remove()
+			return nil, nil, err
+		}
+		remuxed, err := opts.createTempFile(outputPath, fmt.Sprintf(".chapter%d.mp4", i+1))
+		if err != nil {
+			remove()
+			return nil, nil, fmt.Errorf("failed to create temp file: %v", err)
+		}
+		remuxed.Close()
+		paths = append(paths, remuxed.Name())
+
+		m, ok := resampled[file.Path]
+		if ok {
+			logger.Info("resampling the audio of chapter, which is re-encoded (lossy)", "input", file.Path, "from", m.Actual, "to", m.Expected)
+		} else {
+			logger.Debug("remuxing chapter to merge it with resampled ones", "input", file.Path)
+		}
+		cmd := ffmpegCommand(resampleArgs(file.Path, remuxed.Name(), m.Expected, probe.Timecode(), mapping, opts)...)
+		if err := runCommand(logger, cmd); err != nil {
+			remove()
+			return nil, nil, fmt.Errorf("failed to remux %s to resample its audio: %v", file.Path, err)
+		}
+	}
+	return paths, remove, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeResampleAudio(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH010042.MP4", "GH020042.MP4", "GH030042.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	// The second chapter was recorded at 44.1 kHz
+	mixed := hero
+	mixed.Streams = append([]StreamInfo(nil), hero.Streams...)
+	mixed.Streams[1].SampleRate = "44100"
+	probeFile = func(path string) (ProbeResult, error) {
+		if filepath.Base(path) == "GH020042.MP4" {
+			return mixed, nil
+		}
+		return hero, nil
+	}
+	var commands [][]string
+	var list string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		commands = append(commands, cmd.Args)
+		if i := indexOf(cmd.Args, "concat"); i >= 0 {
+			data, err := os.ReadFile(cmd.Args[i+4])
+			if err != nil {
+				return err
+			}
+			list = string(data)
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	// Stream copy would drift, the merge points at -resample-audio
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{})
+	var mismatch *mismatchError
+	if !errors.As(err, &mismatch) || !strings.Contains(err.Error(), "Use -resample-audio") || len(commands) != 0 {
+		t.Fatalf("Expected the sample rates to abort the merge, got %v and commands %v", err, commands)
+	}
+
+	tempDir := t.TempDir()
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{ResampleAudio: true, TempDir: tempDir}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if len(commands) != 4 {
+		t.Fatalf("Expected every chapter to be remuxed before the merge, got %d commands: %v", len(commands), commands)
+	}
+	for i, path := range inputPaths {
+		command := strings.Join(commands[i], " ")
+		if !strings.Contains(command, "-i "+path+" -c copy") {
+			t.Errorf("Expected chapter %d to be remuxed, got: %s", i+1, command)
+		}
+		resampled := strings.Contains(command, "-c:a aac -b:a 256k -ar 48000")
+		if resampled != (i == 1) {
+			t.Errorf("Expected only the audio of the 44.1 kHz chapter to be resampled, got: %s", command)
+		}
+	}
+	// The merge joins the remuxed chapters with stream copy
+	if strings.Contains(list, dir) || strings.Count(list, "file ") != 3 {
+		t.Errorf("Expected the concat list to hold the remuxed chapters, got:\n%s", list)
+	}
+	if merge := strings.Join(commands[3], " "); !strings.Contains(merge, "-c copy") || strings.Contains(merge, "-c:a aac") {
+		t.Errorf("Expected the merge to copy every stream, got: %s", merge)
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Errorf("Expected the remuxed chapters to be removed, got %d files", len(entries))
+	}
+
+	plan, err := buildPlan(outputPath, inputPaths, time.Now(), time.Now(), Options{ResampleAudio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	printPlan(&out, plan)
+	if len(plan.Mismatches) != 0 || !strings.Contains(out.String(), "Resample: audio of GH020042.MP4 from 44100 to 48000 Hz") {
+		t.Errorf("Expected the plan to list the resampled chapter, got:\n%s", out.String())
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-resample-audio", "-reencode", "out.mp4", "GH011234.MP4"}, &stdout, &stderr); code != exitUsage {
+		t.Errorf("Expected exit code %d, got %d: %s", exitUsage, code, stderr.String())
+	}
+}
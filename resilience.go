@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// inputArgs are the options placed before each ffmpeg input. With
+// -fix-timestamps, +genpts fills in the presentation timestamps missing
+// from damaged or recovered chapters from their decoding timestamps. With
+// -ignore-errors, the demuxer drops corrupt packets and the decoders carry
+// on past bitstream errors instead of failing the merge.
+func inputArgs(opts Options) []string {
+	var args, fflags []string
+	if opts.IgnoreErrors {
+		args = append(args, "-err_detect", "ignore_err")
+	}
+	if opts.FixTimestamps {
+		fflags = append(fflags, "+genpts")
+	}
+	if opts.IgnoreErrors {
+		fflags = append(fflags, "+discardcorrupt")
+	}
+	// A second -fflags would replace the first one
+	if len(fflags) > 0 {
+		args = append(args, "-fflags", strings.Join(fflags, ""))
+	}
+	return args
+}
+
+// checkDurationLoss compares the duration of the output merged with
+// -ignore-errors to expected, the sum of the input durations, and reports
+// the difference through the logger and opts.LossFunc. A shorter output is
+// what salvaging damaged inputs costs, so it does not fail the merge.
+func checkDurationLoss(outputPath string, expected time.Duration, opts Options) error {
+	probe, err := probeFile(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to measure the output duration: %v", err)
+	}
+	actual := time.Duration(probe.Duration * float64(time.Second))
+	// Up to a second is rounding of the durations at the joins
+	if lost := expected - actual; lost > time.Second {
+		opts.logger().Warn("damaged parts of the inputs were dropped", "output", outputPath, "expected", expected, "actual", actual, "lost", lost)
+	}
+	if opts.LossFunc != nil {
+		opts.LossFunc(expected, actual)
+	}
+	return nil
+}
+
+// formatLoss describes the duration an -ignore-errors merge lost.
+func formatLoss(expected, actual time.Duration) string {
+	lost := (expected - actual).Round(time.Millisecond)
+	if lost <= 0 {
+		return fmt.Sprintf("no duration was lost (%s)", actual.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("%s of %s was lost (%.1f%%)", lost, expected.Round(time.Millisecond), 100*lost.Seconds()/expected.Seconds())
+}
+
+// defaultDurationTolerance is how much the duration of the output may
+// differ from the sum of the input durations per join, for the rounding of
+// the last frame or audio packet of each input.
+const defaultDurationTolerance = 500 * time.Millisecond
+
+// incompleteSuffix marks an output that failed verification.
+const incompleteSuffix = ".incomplete"
+
+// partialSuffix marks an output that is still being written, see
+// partialPath.
+const partialSuffix = ".goproconcat-tmp"
+
+// partialPath is where the merge into outputPath is written and checked
+// before renamePartial moves it into place. It is in the same directory,
+// so the rename is atomic and a failed merge never leaves a file at
+// outputPath that could be taken for a finished one.
+func partialPath(outputPath string) string {
+	return outputPath + partialSuffix
+}
+
+// renamePartial moves the finished partial output to outputPath.
+func renamePartial(partial, outputPath string) error {
+	if err := os.Rename(partial, outputPath); err != nil {
+		return fmt.Errorf("failed to move the merged file into place: %v", err)
+	}
+	return nil
+}
+
+// removePartial removes what is left of a failed merge at partial, unless
+// opts.KeepPartial keeps it for debugging. After a successful merge there
+// is nothing left.
+func removePartial(partial string, opts Options) {
+	if _, err := os.Lstat(partial); err != nil {
+		return
+	}
+	if opts.KeepPartial {
+		opts.logger().Warn("keeping the partial output of the failed merge", "partial", partial)
+		return
+	}
+	os.Remove(partial)
+}
+
+// durationTolerance returns opts.DurationTolerance, or
+// defaultDurationTolerance when it is zero.
+func (o Options) durationTolerance() time.Duration {
+	if o.DurationTolerance == 0 {
+		return defaultDurationTolerance
+	}
+	return o.DurationTolerance
+}
+
+// verifyOutput checks partial, the merge into outputPath of inputs files,
+// once ffmpeg succeeded, which it also does after silently dropping a
+// stream or a chunk of the inputs. It probes the output once for all
+// checks: that it has the streams of inventory, see checkInventory, and,
+// unless opts.IgnoreErrors reports the duration lost instead, that it
+// lasts as long as expected, see checkDuration. An output failing them is
+// kept as outputPath with incompleteSuffix, so it is not taken for a good
+// merge. Last, its tracks must have been created at creationTime, see
+// checkTrackTimes.
+func verifyOutput(partial, outputPath string, inventory []StreamInfo, creationTime time.Time, expected time.Duration, inputs int, opts Options) error {
+	probe, err := probeFile(partial)
+	if err != nil {
+		return fmt.Errorf("failed to probe the output to verify it: %v", err)
+	}
+	err = checkInventory(outputPath, inventory, probe.Streams)
+	if err == nil && !opts.IgnoreErrors {
+		err = checkDuration(outputPath, probe, expected, inputs, opts)
+	}
+	if err != nil {
+		return keepIncomplete(partial, outputPath, err)
+	}
+	return checkTrackTimes(outputPath, probe, creationTime)
+}
+
+// keepIncomplete keeps partial, which failed verification with err, as
+// outputPath with incompleteSuffix and returns err saying so.
+func keepIncomplete(partial, outputPath string, err error) error {
+	if renameErr := os.Rename(partial, outputPath+incompleteSuffix); renameErr != nil {
+		return fmt.Errorf("%v. Failed to mark it as incomplete: %v", err, renameErr)
+	}
+	return fmt.Errorf("%v. It was kept as %s", err, outputPath+incompleteSuffix)
+}
+
+// checkTrackTimes checks that every track of probe, the probe result of
+// outputPath, with a creation_time tag was created at creationTime, to
+// the second, as some tools read the time of a track instead of the one
+// of the container.
+func checkTrackTimes(outputPath string, probe ProbeResult, creationTime time.Time) error {
+	for _, stream := range probe.Streams {
+		value := stream.tag("creation_time")
+		if value == "" {
+			continue
+		}
+		trackTime, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return fmt.Errorf("invalid creation_time %q of stream %d of merged file %s: %v", value, stream.Index, outputPath, err)
+		}
+		if !trackTime.Truncate(time.Second).Equal(creationTime.Truncate(time.Second)) {
+			return fmt.Errorf("%s of merged file %s was created at %s instead of %s",
+				streamKind(stream), outputPath, trackTime.Format(time.RFC3339), creationTime.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// checkDuration compares the duration of probe, the probe result of
+// outputPath merged from inputs files, to expected, the sum of their
+// durations, and passes both to opts.DurationFunc. An output off by more
+// than the tolerance of each join is missing a chunk, or has one twice.
+func checkDuration(outputPath string, probe ProbeResult, expected time.Duration, inputs int, opts Options) error {
+	actual := time.Duration(probe.Duration * float64(time.Second))
+	if opts.DurationFunc != nil {
+		opts.DurationFunc(expected, actual)
+	}
+
+	joins := inputs - 1
+	if joins < 1 {
+		joins = 1
+	}
+	tolerance := time.Duration(joins) * opts.durationTolerance()
+	difference := actual - expected
+	if difference <= tolerance && -difference <= tolerance {
+		opts.logger().Info("verified output duration", "output", outputPath, "expected", expected, "actual", actual)
+		return nil
+	}
+
+	what := "missing"
+	if difference > 0 {
+		what = "more than"
+	}
+	return fmt.Errorf("merged file %s lasts %s, but the inputs last %s together: %s %s (tolerance %s)",
+		outputPath, actual.Round(time.Millisecond), expected.Round(time.Millisecond), what, difference.Abs().Round(time.Millisecond), tolerance)
+}
+
+// formatDurationCheck describes the durations checkDuration compared.
+func formatDurationCheck(expected, actual time.Duration) string {
+	return fmt.Sprintf("output %s, inputs %s", actual.Round(time.Millisecond), expected.Round(time.Millisecond))
+}
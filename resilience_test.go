@@ -0,0 +1,308 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInputArgs(t *testing.T) {
+	tests := []struct {
+		opts Options
+		want string
+	}{
+		{Options{}, ""},
+		{Options{FixTimestamps: true}, "-fflags +genpts"},
+		{Options{IgnoreErrors: true}, "-err_detect ignore_err -fflags +discardcorrupt"},
+		{Options{FixTimestamps: true, IgnoreErrors: true}, "-err_detect ignore_err -fflags +genpts+discardcorrupt"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(inputArgs(tt.opts), " "); got != tt.want {
+			t.Errorf("inputArgs(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestMergeFilesIgnoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	// The damaged tail of the second chapter is missing from the output
+	probeFile = func(path string) (ProbeResult, error) {
+		result := hero
+		result.Duration = 60
+		if path == partialPath(outputPath) {
+			result.Duration = 105
+		}
+		return result, nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	var expected, actual time.Duration
+	// The loss is reported instead of failing the duration check
+	opts := Options{
+		IgnoreErrors: true,
+		Verify:       true,
+		LossFunc: func(e, a time.Duration) {
+			expected, actual = e, a
+		},
+	}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if command := strings.Join(merge, " "); !strings.Contains(command, "-err_detect ignore_err -fflags +discardcorrupt -f concat") {
+		t.Errorf("Expected error resilience input options, got: %s", command)
+	}
+	if expected != 2*time.Minute || actual != 105*time.Second {
+		t.Errorf("Expected a loss of 15s from 2m, got expected %v and actual %v", expected, actual)
+	}
+	if got, want := formatLoss(expected, actual), "15s of 2m0s was lost (12.5%)"; got != want {
+		t.Errorf("formatLoss() = %q, want %q", got, want)
+	}
+}
+
+func TestMergeFilesVerifyDuration(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	outputDuration := 119.6
+	probeFile = func(path string) (ProbeResult, error) {
+		result := hero
+		result.Duration = 60
+		if path == partialPath(outputPath) {
+			result.Duration = outputDuration
+		}
+		return result, nil
+	}
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	var expected, actual time.Duration
+	opts := Options{
+		Verify: true,
+		DurationFunc: func(e, a time.Duration) {
+			expected, actual = e, a
+		},
+	}
+	// Within the tolerance of the one join
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if expected != 2*time.Minute || actual != 119600*time.Millisecond {
+		t.Errorf("Expected the durations 2m and 1m59.6s, got %v and %v", expected, actual)
+	}
+	if got := formatDurationCheck(expected, actual); got != "output 1m59.6s, inputs 2m0s" {
+		t.Errorf("Unexpected summary %q", got)
+	}
+
+	// ffmpeg succeeded, but a chunk is missing
+	outputDuration = 105
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts)
+	if err == nil || !strings.Contains(err.Error(), "lasts 1m45s, but the inputs last 2m0s together: missing 15s (tolerance 500ms)") {
+		t.Fatalf("Expected the missing chunk to fail the merge, got %v", err)
+	}
+	// The output of the first merge is left alone
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Errorf("Expected the earlier output to be kept, got %v", err)
+	}
+	if _, err := os.Stat(outputPath + incompleteSuffix); err != nil {
+		t.Errorf("Expected the incomplete output to be kept: %v", err)
+	}
+	if _, err := os.Stat(partialPath(outputPath)); !os.IsNotExist(err) {
+		t.Errorf("Expected no partial output to be left, got %v", err)
+	}
+
+	// A higher tolerance lets it pass
+	opts.DurationTolerance = 20 * time.Second
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Errorf("Expected the tolerance to allow the difference, got %v", err)
+	}
+}
+
+func TestMergeFilesTrackTimes(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+	creationTime := time.Date(2024, time.May, 1, 12, 30, 0, 0, time.UTC)
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	// The audio track keeps the time of the merge
+	audioTime := "2024-05-01T12:30:00.000000Z"
+	probeFile = func(path string) (ProbeResult, error) {
+		result := hero
+		result.Duration = 60
+		if path == partialPath(outputPath) {
+			result.Duration = 120
+			result.Streams = append([]StreamInfo(nil), hero.Streams...)
+			result.Streams[0].Tags = map[string]string{"creation_time": "2024-05-01T12:30:00.000000Z"}
+			result.Streams[1].Tags = map[string]string{"creation_time": audioTime}
+		}
+		return result, nil
+	}
+	var merge string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = strings.Join(cmd.Args, " ")
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	opts := Options{Verify: true, Location: time.UTC}
+	if err := mergeFiles(outputPath, inputPaths, creationTime, creationTime, opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if !strings.Contains(merge, "-metadata creation_time=2024-05-01T12:30:00Z -metadata:s creation_time=2024-05-01T12:30:00Z") {
+		t.Errorf("Expected the creation time of the container and the tracks, got: %s", merge)
+	}
+
+	audioTime = "2026-10-16T09:00:00.000000Z"
+	err := mergeFiles(outputPath, inputPaths, creationTime, creationTime, opts)
+	if err == nil || !strings.Contains(err.Error(), "audio stream of merged file "+outputPath+" was created at 2026-10-16T09:00:00Z instead of 2024-05-01T12:30:00Z") {
+		t.Errorf("Expected the audio track time to fail the merge, got %v", err)
+	}
+}
+
+func TestMergeFilesPartialOutput(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+	partial := partialPath(outputPath)
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	origChangeTimes := changeTimes
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+		changeTimes = origChangeTimes
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	// ffmpeg is interrupted after writing part of the output
+	fail := true
+	var written string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		written = cmd.Args[len(cmd.Args)-1]
+		if err := os.WriteFile(written, []byte("output"), 0644); err != nil {
+			return err
+		}
+		if fail {
+			return os.ErrClosed
+		}
+		return nil
+	}
+	var stamped []string
+	changeTimes = func(path string, atime, mtime time.Time) error {
+		stamped = append(stamped, path)
+		return nil
+	}
+
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{}); err == nil {
+		t.Fatal("Expected the merge to fail")
+	}
+	if written != partial {
+		t.Errorf("Expected ffmpeg to write %s, got %s", partial, written)
+	}
+	for _, path := range []string{outputPath, partial} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected no file at %s after the failed merge, got %v", path, err)
+		}
+	}
+
+	// Kept for debugging
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{KeepPartial: true}); err == nil {
+		t.Fatal("Expected the merge to fail")
+	}
+	if _, err := os.Stat(partial); err != nil {
+		t.Errorf("Expected the partial output to be kept: %v", err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no output after the failed merge, got %v", err)
+	}
+
+	// The finished output is stamped before it is moved into place
+	fail = false
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if len(stamped) != 1 || stamped[0] != partial {
+		t.Errorf("Expected the times of the partial output to be set, got %v", stamped)
+	}
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Errorf("Expected the output: %v", err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial output to be renamed, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// rotations are the values of -rotate, in degrees clockwise.
+var rotations = []int{90, 180, 270}
+
+func validateRotation(degrees int) error {
+	if degrees != 0 && !slices.Contains(rotations, degrees) {
+		return fmt.Errorf("invalid -rotate %d: must be 90, 180 or 270", degrees)
+	}
+	return nil
+}
+
+// rotateInputArgs set the display rotation of the video of the concat
+// input, which stream copy writes into the display matrix of the output
+// track: players turn the video, its pixels are left as they are. ffmpeg
+// counts the angle counterclockwise.
+func rotateInputArgs(degrees int) []string {
+	if degrees == 0 {
+		return nil
+	}
+	return []string{"-display_rotation:v:0", strconv.Itoa((360 - degrees) % 360)}
+}
+
+// rotation is the clockwise rotation in degrees of the display matrix of
+// the stream, 0 without one.
+func (s StreamInfo) rotation() int {
+	for _, data := range s.SideData {
+		if data.Type == "Display Matrix" {
+			degrees := -int(math.Round(data.Rotation)) % 360
+			return (degrees + 360) % 360
+		}
+	}
+	return 0
+}
+
+// verifyRotation checks that the video stream of outputPath is displayed
+// turned by degrees clockwise, as -rotate asked.
+func verifyRotation(outputPath string, degrees int) error {
+	probe, err := probeFile(outputPath)
+	if err != nil {
+		return err
+	}
+	video, ok := probe.firstStream("video")
+	if !ok {
+		return fmt.Errorf("merged file %s has no video stream", outputPath)
+	}
+	if got := video.rotation(); got != degrees {
+		return fmt.Errorf("merged file %s is displayed rotated by %d° instead of %d°, the installed ffmpeg may be too old for -rotate", outputPath, got, degrees)
+	}
+	return nil
+}
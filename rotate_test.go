@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamRotation(t *testing.T) {
+	probe, err := parseProbeOutput([]byte(`{"streams": [{"index": 0, "codec_type": "video",
+		"side_data_list": [{"side_data_type": "Display Matrix", "displaymatrix": "...", "rotation": -90}]}],
+		"format": {"duration": "10.0"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ffprobe counts counterclockwise
+	if got := probe.Streams[0].rotation(); got != 90 {
+		t.Errorf("Expected a rotation of 90° clockwise, got %d", got)
+	}
+	for degrees, ffprobe := range map[int]float64{0: 0, 180: 180, 270: 90} {
+		stream := StreamInfo{SideData: []sideData{{Type: "Display Matrix", Rotation: ffprobe}}}
+		if got := stream.rotation(); got != degrees {
+			t.Errorf("Expected %d° for an ffprobe rotation of %g, got %d", degrees, ffprobe, got)
+		}
+	}
+	if got := (StreamInfo{}).rotation(); got != 0 {
+		t.Errorf("Expected no rotation without a display matrix, got %d", got)
+	}
+}
+
+func TestMergeRotate(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH010042.MP4", "GH020042.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	// The output carries the rotation ffmpeg was asked for
+	outputRotation := 0.0
+	probeFile = func(path string) (ProbeResult, error) {
+		if !strings.HasSuffix(path, partialSuffix) {
+			return hero, nil
+		}
+		output := hero
+		output.Streams = append([]StreamInfo(nil), hero.Streams...)
+		output.Streams[0].SideData = []sideData{{Type: "Display Matrix", Rotation: outputRotation}}
+		return output, nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		if i := indexOf(cmd.Args, "-display_rotation:v:0"); i >= 0 && cmd.Args[i+1] == "180" {
+			outputRotation = -180
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{Rotate: 180}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	// An input option, before the concat list, with the video copied
+	command := strings.Join(merge, " ")
+	if !strings.Contains(command, "-display_rotation:v:0 180 -f concat") || !strings.Contains(command, "-c copy") {
+		t.Errorf("Expected the display rotation to be set on the concat input, got: %s", command)
+	}
+
+	// An ffmpeg that ignores the option fails the merge
+	os.Remove(outputPath)
+	outputRotation = 0
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{Rotate: 90})
+	if err == nil || !strings.Contains(err.Error(), "rotated by 0° instead of 90°") {
+		t.Errorf("Expected the missing rotation to fail the merge, got %v", err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no output without the rotation, got %v", err)
+	}
+
+	// A single chapter is remuxed instead of copied, to set it
+	merge = nil
+	if err := mergeFiles(outputPath, inputPaths[:1], time.Now(), time.Now(), Options{Rotate: 180}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if indexOf(merge, "-display_rotation:v:0") < 0 {
+		t.Errorf("Expected a single chapter to be remuxed with the rotation, got: %v", merge)
+	}
+
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{Rotate: 90, Reencode: true}); err == nil || !strings.Contains(err.Error(), "-reencode") {
+		t.Errorf("Expected -reencode to be refused, got %v", err)
+	}
+	if option := nativeUnsupportedOption(Options{Container: containerMP4, Rotate: 90}); option != "-rotate" {
+		t.Errorf("Expected the native backend to leave -rotate to ffmpeg, got %q", option)
+	}
+}
+
+func TestRunRotateInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-rotate", "45", "out.mp4", "GH011234.MP4"},
+		{"-rotate", "90", "-reencode", "out.mp4", "GH011234.MP4"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := run(args, &stdout, &stderr); code != exitUsage || !strings.Contains(stderr.String(), "-rotate") {
+			t.Errorf("Expected %v to be refused, got %d: %s", args, code, stderr.String())
+		}
+	}
+}
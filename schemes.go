@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// namingScheme is a way GoPro cameras name the chapters of a recording:
+// the prefix, a two digit chapter number and a four digit file number.
+type namingScheme struct {
+	Name        string
+	Prefix      string
+	Description string
+}
+
+// namingSchemes are the chapter names GoProConcat recognizes.
+var namingSchemes = []namingScheme{
+	{Name: "avc", Prefix: "GH", Description: "H.264 (AVC) recordings"},
+	{Name: "hevc", Prefix: "GX", Description: "H.265 (HEVC) recordings"},
+}
+
+// schemePrefixes returns the prefixes of namingSchemes.
+func schemePrefixes() []string {
+	prefixes := make([]string, len(namingSchemes))
+	for i, scheme := range namingSchemes {
+		prefixes[i] = scheme.Prefix
+	}
+	return prefixes
+}
+
+// knownPrefix reports whether prefix belongs to one of namingSchemes.
+func knownPrefix(prefix string) bool {
+	for _, scheme := range namingSchemes {
+		if scheme.Prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultFileNamePattern matches the chapter names of every naming
+// scheme, in upper case. Its named groups capture the prefix, the chapter
+// number and the file number. -filename-pattern replaces it through
+// Options.FileNamePattern.
+var defaultFileNamePattern = regexp.MustCompile(`(?P<prefix>` + strings.Join(schemePrefixes(), "|") + `)(?P<chapter>\d{2})(?P<file>\d{4})\.(?i:mp4)`)
+
+// compileFileNamePattern compiles a replacement for defaultFileNamePattern, which
+// must have the named groups chapter and file, and may have prefix.
+func compileFileNamePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -filename-pattern: %v", err)
+	}
+	for _, group := range []string{"chapter", "file"} {
+		if re.SubexpIndex(group) < 0 {
+			return nil, fmt.Errorf("invalid -filename-pattern %q: it has no named group (?P<%s>...)", pattern, group)
+		}
+	}
+	return re, nil
+}
+
+// printSchemes lists the naming schemes with an example chapter name each.
+func printSchemes(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCHEME\tEXAMPLE\tDESCRIPTION")
+	for _, scheme := range namingSchemes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", scheme.Name, formatFileName(scheme.Prefix, 1, 1234), scheme.Description)
+	}
+	tw.Flush()
+}
+
+// runListSchemes implements the list-schemes subcommand and returns the
+// process exit code.
+func runListSchemes(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("list-schemes", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: GoProConcat list-schemes")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	printSchemes(stdout)
+	return exitOK
+}
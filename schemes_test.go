@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListSchemes(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"list-schemes"}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Expected exit code %d, got %d: %s", exitOK, code, stderr.String())
+	}
+	lines := strings.Split(stdout.String(), "\n")
+	for _, want := range []string{"avc GH011234.MP4", "hevc GX011234.MP4"} {
+		found := false
+		for _, line := range lines {
+			found = found || strings.HasPrefix(strings.Join(strings.Fields(line), " "), want)
+		}
+		if !found {
+			t.Errorf("Expected %q in the scheme list, got:\n%s", want, stdout.String())
+		}
+	}
+
+	// Every example is a name the scheme recognizes
+	for _, scheme := range namingSchemes {
+		info, err := parseFileName(formatFileName(scheme.Prefix, 1, 1234), defaultFileNamePattern)
+		if err != nil || info.Prefix != scheme.Prefix {
+			t.Errorf("Expected the %s example to parse, got %+v: %v", scheme.Name, info, err)
+		}
+	}
+
+	if code := run([]string{"list-schemes", "extra"}, &stdout, &stderr); code != exitUsage {
+		t.Errorf("Expected exit code %d for an extra argument, got %d", exitUsage, code)
+	}
+}
+
+func TestFileNamePattern(t *testing.T) {
+	pattern, err := compileFileNamePattern(`^(?P<prefix>DASH|CAM)_(?P<file>\d+)_(?P<chapter>\d+)\.MP4$`)
+	if err != nil {
+		t.Fatalf("compileFileNamePattern() error: %v", err)
+	}
+	files, err := collectFiles([]string{"/trip/cam_7_10.mp4", "/trip/CAM_7_2.MP4", "/trip/DASH_3_1.MP4"}, pattern)
+	if err != nil {
+		t.Fatalf("collectFiles() error: %v", err)
+	}
+	expected := []FileInfo{
+		{Path: "/trip/DASH_3_1.MP4", Prefix: "DASH", FileNumber: 3, ChapterNumber: 1},
+		{Path: "/trip/CAM_7_2.MP4", Prefix: "CAM", FileNumber: 7, ChapterNumber: 2},
+		{Path: "/trip/cam_7_10.mp4", Prefix: "CAM", FileNumber: 7, ChapterNumber: 10},
+	}
+	for i, file := range files {
+		if file != expected[i] {
+			t.Errorf("Expected %+v at %d, got %+v", expected[i], i, file)
+		}
+	}
+	if _, err := parseFileName("GH010001.MP4", pattern); err == nil {
+		t.Error("Expected the GoPro names to be replaced by the pattern")
+	}
+
+	// Without a prefix group the prefix is empty
+	pattern, err = compileFileNamePattern(`VID(?P<file>\d{4})-(?P<chapter>\d{2})`)
+	if err != nil {
+		t.Fatalf("compileFileNamePattern() error: %v", err)
+	}
+	if info, err := parseFileName("vid0042-03.mov", pattern); err != nil || info.Prefix != "" || info.FileNumber != 42 || info.ChapterNumber != 3 {
+		t.Errorf("Expected file 42 chapter 3 without prefix, got %+v: %v", info, err)
+	}
+
+	for pattern, expected := range map[string]string{
+		`GH(\d{2})(?P<file>\d{4})`:             "no named group (?P<chapter>...)",
+		`GH(?P<chapter>\d{2})(\d{4})`:          "no named group (?P<file>...)",
+		`GH(?P<chapter>\d{2}(?P<file>\d{4})`:   "invalid -filename-pattern: error parsing regexp",
+		`(?P<chapter>\w+)_(?P<file>\w+)\.MP4$`: "",
+	} {
+		_, err := compileFileNamePattern(pattern)
+		if expected == "" && err != nil || expected != "" && (err == nil || !strings.Contains(err.Error(), expected)) {
+			t.Errorf("Expected %q for %s, got %v", expected, pattern, err)
+		}
+	}
+
+	// Groups that capture more than digits are refused per file
+	pattern, _ = compileFileNamePattern(`(?P<chapter>\w+)_(?P<file>\w+)\.MP4$`)
+	if _, err := parseFileName("INTRO_A.MP4", pattern); err == nil || !strings.Contains(err.Error(), "invalid chapter number") {
+		t.Errorf("Expected a non-numeric chapter to be refused, got %v", err)
+	}
+
+	// Directories are expanded with the pattern of the call only
+	dir := t.TempDir()
+	for _, name := range []string{"CAM_7_1.MP4", "GH011234.MP4"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pattern, _ = compileFileNamePattern(`^CAM_(?P<file>\d+)_(?P<chapter>\d+)\.MP4$`)
+	if inputs, err := expandInputs([]string{dir}, false, pattern); err != nil || len(inputs) != 1 || filepath.Base(inputs[0]) != "CAM_7_1.MP4" {
+		t.Errorf("Expected only CAM_7_1.MP4 with the pattern, got %q: %v", inputs, err)
+	}
+	if inputs, err := expandInputs([]string{dir}, false, defaultFileNamePattern); err != nil || len(inputs) != 1 || filepath.Base(inputs[0]) != "GH011234.MP4" {
+		t.Errorf("Expected only GH011234.MP4 without it, got %q: %v", inputs, err)
+	}
+
+	// and a run with -filename-pattern leaves the GoPro names to the next
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	var stdout, stderr bytes.Buffer
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"-filename-pattern", `^CAM_(?P<file>\d+)_(?P<chapter>\d+)\.MP4$`}, "CAM_7_1.MP4"},
+		{nil, "GH011234.MP4"},
+	} {
+		listPath := filepath.Join(t.TempDir(), "list.txt")
+		args := append(test.args, "-list-only", listPath, dir)
+		if code := run(args, &stdout, &stderr); code != exitOK {
+			t.Fatalf("Expected %q to succeed, got %d: %s", args, code, stderr.String())
+		}
+		if list, err := os.ReadFile(listPath); err != nil || string(list) != "file '"+filepath.Join(dir, test.expected)+"'\n" {
+			t.Errorf("Expected only %s in the list of %q, got %q: %v", test.expected, args, list, err)
+		}
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	if code := run([]string{"-filename-pattern", `CAM(?P<file>\d+)`, "out.mp4", "CAM1.MP4"}, &stdout, &stderr); code != exitUsage || !strings.Contains(stderr.String(), "(?P<chapter>...)") {
+		t.Errorf("Expected an invalid pattern to be a usage error, got %d: %s", code, stderr.String())
+	}
+}
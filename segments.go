@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// segmentDir is where -segmented keeps the remuxed chapters of outputPath
+// until the merge succeeds. It lives next to the output so it survives
+// reboots and stays on the same volume.
+func segmentDir(outputPath string) string {
+	return outputPath + ".segments"
+}
+
+// segmentDone reports whether segmentPath was completed from the current
+// version of input by an earlier run.
+func segmentDone(segmentPath string, input processedInput) bool {
+	data, err := os.ReadFile(segmentPath + ".done")
+	if err != nil {
+		return false
+	}
+	var done processedInput
+	if err := json.Unmarshal(data, &done); err != nil {
+		return false
+	}
+	if _, err := os.Stat(segmentPath); err != nil {
+		return false
+	}
+	return done.Path == input.Path && done.Size == input.Size && done.ModTime.Equal(input.ModTime)
+}
+
+func markSegmentDone(segmentPath string, input processedInput) error {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(segmentPath+".done", data, 0644)
+}
+
+// remuxSegments remuxes each of files into the segment directory of
+// outputPath with the streams selected by mapping, skipping segments
+// finished by an earlier run, and returns the segment paths in order.
+func remuxSegments(outputPath string, files []FileInfo, mapping streamMapping, opts Options) ([]string, error) {
+	logger := opts.logger()
+
+	dir := segmentDir(outputPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create segment directory %s: %v", dir, err)
+	}
+
+	var segments []string
+	used := make(map[string]bool)
+	for i, file := range files {
+		// Loop recordings can have several inputs with the same name
+		name := filepath.Base(file.Path)
+		if used[name] {
+			name = fmt.Sprintf("%d_%s", i+1, name)
+		}
+		used[name] = true
+		segmentPath := filepath.Join(dir, name)
+		segments = append(segments, segmentPath)
+
+		input, err := fingerprintInput(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		if segmentDone(segmentPath, input) {
+			logger.Info("reusing segment from previous run", "input", file.Path, "segment", segmentPath)
+			continue
+		}
+
+		// Each chapter keeps its own timecode so the first segment carries the start of the recording
+		probe, err := opts.probe(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		args := ffmpegArgs(opts.FFmpegLogLevel)
+		args = append(args, inputArgs(opts)...)
+		args = append(args, "-i", file.Path, "-c", "copy")
+		args = append(args, timestampOutputArgs(opts)...)
+		args = append(args, "-y")
+		args = append(args, mapping.Args...)
+		args = append(args, timecodeArgs(probe.Timecode(), containerMP4)...)
+		args = append(args, "-f", "mp4", segmentPath)
+
+		logger.Info("remuxing segment", "input", file.Path, "segment", segmentPath)
+		cmd := ffmpegCommand(append(progressArgs(opts), args...)...)
+		if opts.ProgressFunc != nil {
+			total := time.Duration(probe.Duration * float64(time.Second))
+			cmd.Stdout = newProgressWriter(stageSegment, total, opts.ProgressFunc)
+		}
+		err = runCommand(logger, cmd)
+		if err != nil {
+			return nil, fmt.Errorf("ffmpeg command failed for segment %s: %v. Rerun with -segmented to resume", segmentPath, err)
+		}
+		if err := markSegmentDone(segmentPath, input); err != nil {
+			return nil, fmt.Errorf("failed to record segment %s: %v", segmentPath, err)
+		}
+	}
+	return segments, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSegmentedMergeResumes(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4", "GH031234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return ProbeResult{Streams: []StreamInfo{{Index: 0, CodecType: "video", CodecName: "h264"}}, Duration: 1}, nil
+	}
+
+	// The stub ffmpeg writes its output file and fails on a chosen output
+	var ran []string
+	failOn := filepath.Join(segmentDir(outputPath), "GH031234.MP4")
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		output := cmd.Args[len(cmd.Args)-1]
+		ran = append(ran, output)
+		if output == failOn {
+			return errors.New("exit status 1")
+		}
+		return os.WriteFile(output, []byte("remuxed"), 0644)
+	}
+
+	creationTime := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	modTime := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	opts := Options{Segmented: true}
+
+	// First run fails on the third segment
+	err := mergeFiles(outputPath, inputPaths, creationTime, modTime, opts)
+	if err == nil {
+		t.Fatalf("Expected the first run to fail")
+	}
+	if len(ran) != 3 {
+		t.Fatalf("Expected 3 ffmpeg runs before the failure, got %v", ran)
+	}
+
+	// Second run only remuxes the missing segment, then concatenates
+	ran = nil
+	failOn = ""
+	err = mergeFiles(outputPath, inputPaths, creationTime, modTime, opts)
+	if err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	expected := []string{filepath.Join(segmentDir(outputPath), "GH031234.MP4"), partialPath(outputPath)}
+	if len(ran) != len(expected) || ran[0] != expected[0] || ran[1] != expected[1] {
+		t.Errorf("Expected ffmpeg runs %v, got %v", expected, ran)
+	}
+
+	// The segments are removed once the merge succeeded
+	if _, err := os.Stat(segmentDir(outputPath)); !os.IsNotExist(err) {
+		t.Errorf("Expected segment directory to be removed, got: %v", err)
+	}
+}
+
+func TestSegmentDoneDetectsChangedInput(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "GH011234.MP4")
+	segmentPath := filepath.Join(dir, "segment.mp4")
+	for _, path := range []string{inputPath, segmentPath} {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	input, err := fingerprintInput(inputPath)
+	if err != nil {
+		t.Fatalf("fingerprintInput() error: %v", err)
+	}
+	if segmentDone(segmentPath, input) {
+		t.Errorf("Expected segment without marker to be incomplete")
+	}
+	if err := markSegmentDone(segmentPath, input); err != nil {
+		t.Fatalf("markSegmentDone() error: %v", err)
+	}
+	if !segmentDone(segmentPath, input) {
+		t.Errorf("Expected marked segment to be complete")
+	}
+
+	// A re-copied input invalidates the segment
+	input.Size++
+	if segmentDone(segmentPath, input) {
+		t.Errorf("Expected segment of a changed input to be redone")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// gpmfSettings maps the GPMF keys of the udta box holding camera settings
+// to the name they are reported under.
+var gpmfSettings = []struct {
+	Key  string
+	Name string
+}{
+	{"VFOV", "field of view"},
+	{"PRTN", "Protune"},
+}
+
+// bitDepthPattern matches the bit depth in pixel format names such as
+// yuv420p10le or p010le. Formats without one have 8 bits.
+var bitDepthPattern = regexp.MustCompile(`p(\d+)(le|be)?$`)
+
+// bitDepth returns the bits per component of pixFmt, empty when unknown.
+func bitDepth(pixFmt string) string {
+	if pixFmt == "" {
+		return ""
+	}
+	if m := bitDepthPattern.FindStringSubmatch(pixFmt); m != nil {
+		depth, _ := strconv.Atoi(m[1])
+		return strconv.Itoa(depth)
+	}
+	return "8"
+}
+
+// cameraSettings lists the settings of the recording at path, with probe
+// result probe, that chapters of one recording share. Unlike concatParams
+// they do not keep stream copy from working, but a chapter recorded with
+// other settings is likely from another recording. A setting that cannot
+// be read has an empty value.
+func cameraSettings(path string, probe ProbeResult) []streamParam {
+	var settings []streamParam
+	video, _ := probe.firstStream("video")
+	audio, _ := probe.firstStream("audio")
+	settings = append(settings,
+		streamParam{"frame rate", video.FrameRate},
+		streamParam{"bit depth", bitDepth(video.PixFmt)},
+		streamParam{"audio layout", audio.ChannelLayout})
+
+	var gpmf []byte
+	if !isRemote(path) {
+		gpmf, _ = readFileBox(path, "moov", "udta", "GPMF")
+	}
+	for _, setting := range gpmfSettings {
+		settings = append(settings, streamParam{setting.Name, findGPMFString(gpmf, setting.Key)})
+	}
+	return settings
+}
+
+// checkSettings compares the camera settings, see cameraSettings, of every
+// input with the first one in merge order, and logs a warning for each
+// difference. It does not stop the merge. Settings unknown for either
+// input are not compared.
+func checkSettings(inputPaths []string, opts Options) []inputMismatch {
+	// The merge warns about the order itself
+	quiet := opts
+	quiet.Logger = nil
+	files, err := orderFiles(inputPaths, quiet)
+	if err != nil || len(files) < 2 {
+		return nil
+	}
+	probes, err := probeFiles(files, opts)
+	if err != nil {
+		return nil
+	}
+	logger := opts.logger()
+	expected := cameraSettings(files[0].Path, probes[0])
+	var differences []inputMismatch
+	for i := 1; i < len(files); i++ {
+		for j, setting := range cameraSettings(files[i].Path, probes[i]) {
+			if setting.Value == "" || expected[j].Value == "" || setting.Value == expected[j].Value {
+				continue
+			}
+			difference := inputMismatch{Path: files[i].Path, Param: setting.Name, Expected: expected[j].Value, Actual: setting.Value}
+			logger.Warn("chapter recorded with different camera settings", "input", difference.Path, "setting", difference.Param, "expected", difference.Expected, "actual", difference.Actual)
+			differences = append(differences, difference)
+		}
+	}
+	return differences
+}
+
+// printSettingDifferences lists the differences checkSettings found.
+func printSettingDifferences(w io.Writer, differences []inputMismatch) {
+	if len(differences) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d camera setting(s) differ from the first chapter, check that these chapters belong to the same recording:\n", len(differences))
+	writeMismatchTable(w, differences)
+}
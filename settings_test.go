@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func settingsUserData(fov, protune string) []byte {
+	return mp4BoxBytes("moov", mp4BoxBytes("udta",
+		mp4BoxBytes("GPMF", gpmfNest("DEVC", gpmfString("MINF", "HERO11 Black"), gpmfString("VFOV", fov), gpmfString("PRTN", protune)))))
+}
+
+func TestCheckSettings(t *testing.T) {
+	dir := t.TempDir()
+	inputPaths := []string{
+		// Given out of order, the first chapter is the one compared against
+		writeFixture(t, dir, "GH021234.MP4", settingsUserData("W", "Y")),
+		writeFixture(t, dir, "GH011234.MP4", settingsUserData("W", "Y")),
+		writeFixture(t, dir, "GH031234.MP4", settingsUserData("L", "Y")),
+	}
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	hero.Streams = append([]StreamInfo(nil), hero.Streams...)
+	hero.Streams[1].ChannelLayout = "stereo"
+	tenBit := hero
+	tenBit.Streams = append([]StreamInfo(nil), hero.Streams...)
+	tenBit.Streams[0].PixFmt = "yuv420p10le"
+	mono := hero
+	mono.Streams = append([]StreamInfo(nil), hero.Streams...)
+	mono.Streams[1].ChannelLayout = "mono"
+
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+	probeFile = func(path string) (ProbeResult, error) {
+		switch {
+		case strings.HasSuffix(path, "GH021234.MP4"):
+			return tenBit, nil
+		case strings.HasSuffix(path, "GH031234.MP4"):
+			return mono, nil
+		}
+		return hero, nil
+	}
+
+	var logs bytes.Buffer
+	differences := checkSettings(inputPaths, Options{Logger: slog.New(slog.NewJSONHandler(&logs, nil))})
+	expected := []string{
+		"GH021234.MP4: bit depth is 10, expected 8",
+		"GH031234.MP4: audio layout is mono, expected stereo",
+		"GH031234.MP4: field of view is L, expected W",
+	}
+	if len(differences) != len(expected) {
+		t.Fatalf("Expected %d differences, got %v", len(expected), differences)
+	}
+	for i, difference := range differences {
+		if difference.String() != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], difference.String())
+		}
+	}
+	// One JSON log record per difference
+	if got := strings.Count(logs.String(), `"msg":"chapter recorded with different camera settings"`); got != len(expected) {
+		t.Errorf("Expected a log record per difference, got:\n%s", logs.String())
+	}
+
+	var summary bytes.Buffer
+	printSettingDifferences(&summary, differences)
+	if !strings.Contains(summary.String(), "3 camera setting(s) differ from the first chapter") || !strings.Contains(summary.String(), "GH031234.MP4  field of view  W         L") {
+		t.Errorf("Unexpected summary:\n%s", summary.String())
+	}
+
+	var report bytes.Buffer
+	if err := printMergeReportJSON(&report, mergeReport{Output: "merged.mp4", SettingWarnings: differences}, inputPaths, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		SettingWarnings []inputMismatch `json:"setting_warnings"`
+	}
+	if err := json.Unmarshal(report.Bytes(), &parsed); err != nil || len(parsed.SettingWarnings) != len(expected) || parsed.SettingWarnings[2].Param != "field of view" {
+		t.Errorf("Expected the differences in the report, got %s (%v)", report.String(), err)
+	}
+}
+
+func TestBitDepth(t *testing.T) {
+	for pixFmt, expected := range map[string]string{"yuvj420p": "8", "yuv420p10le": "10", "p010le": "10", "": ""} {
+		if got := bitDepth(pixFmt); got != expected {
+			t.Errorf("bitDepth(%q) = %q, want %q", pixFmt, got, expected)
+		}
+	}
+}
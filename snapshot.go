@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// inputSnapshot is the size and modification time of an input before the
+// merge, to notice when it is still being written, e.g. by a copy from the
+// card that has not finished.
+type inputSnapshot struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// snapshotInputs records the size and modification time of paths. Remote
+// inputs are left out, their size is not known without downloading them.
+func snapshotInputs(paths []string) ([]inputSnapshot, error) {
+	var snapshots []inputSnapshot
+	for _, path := range paths {
+		if isRemote(path) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat input: %v", err)
+		}
+		snapshots = append(snapshots, inputSnapshot{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return snapshots, nil
+}
+
+// checkInputsUnchanged stats the inputs of snapshots again and fails for
+// the first one that changed since, as ffmpeg may have merged only part of
+// it.
+func checkInputsUnchanged(snapshots []inputSnapshot) error {
+	for _, snapshot := range snapshots {
+		info, err := os.Stat(snapshot.Path)
+		if err != nil {
+			return fmt.Errorf("input %s disappeared during the merge: %v", snapshot.Path, err)
+		}
+		if info.Size() != snapshot.Size {
+			return fmt.Errorf("input %s changed during the merge, from %s to %s, the output may be missing its end. Merge again once it is written completely", snapshot.Path, formatSize(snapshot.Size), formatSize(info.Size()))
+		}
+		if !info.ModTime().Equal(snapshot.ModTime) {
+			return fmt.Errorf("input %s was modified during the merge, at %s, the output may not match it. Merge again once it is written completely", snapshot.Path, info.ModTime().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckInputsUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "GH010042.MP4")
+	if err := os.WriteFile(path, []byte("chapter"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := snapshotInputs([]string{path, "https://example.com/GH020042.MP4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Errorf("Expected the remote input to be left out, got %v", snapshots)
+	}
+	if err := checkInputsUnchanged(snapshots); err != nil {
+		t.Errorf("Expected an unchanged input to pass, got %v", err)
+	}
+
+	// Touched, but not grown
+	later := snapshots[0].ModTime.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkInputsUnchanged(snapshots); err == nil || !strings.Contains(err.Error(), "GH010042.MP4 was modified during the merge") {
+		t.Errorf("Expected the modified input to fail, got %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkInputsUnchanged(snapshots); err == nil || !strings.Contains(err.Error(), "disappeared") {
+		t.Errorf("Expected the removed input to fail, got %v", err)
+	}
+}
+
+func TestMergeFilesInputGrowing(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH010042.MP4", "GH020042.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	// The copy from the card is still writing the last chapter
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		f, err := os.OpenFile(inputPaths[1], os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		f.WriteString(" continued")
+		f.Close()
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{})
+	if err == nil || !strings.Contains(err.Error(), "input "+inputPaths[1]+" changed during the merge") {
+		t.Errorf("Expected the growing input to fail the merge, got %v", err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no output, got %v", err)
+	}
+}
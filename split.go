@@ -0,0 +1,231 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxChapters is the highest chapter number the two-digit GoPro naming can express.
+const maxChapters = 99
+
+type SplitOptions struct {
+	Prefix     string
+	FileNumber int
+	// SegmentTime splits the input every SegmentTime. It is ignored when
+	// SplitPoints is set.
+	SegmentTime time.Duration
+	// SplitPoints are the offsets at which a new chapter starts.
+	SplitPoints []time.Duration
+	// Force overwrites the chapters already in the output directory.
+	Force bool
+}
+
+// chapterCount is how many chapters splitting a file lasting duration
+// with s writes at most. A segment time cuts at the first keyframe after
+// each multiple of it, which never adds a chapter.
+func chapterCount(duration time.Duration, s SplitOptions) int {
+	if len(s.SplitPoints) > 0 {
+		return len(s.SplitPoints) + 1
+	}
+	if s.SegmentTime <= 0 {
+		return 0
+	}
+	return int((duration + s.SegmentTime - 1) / s.SegmentTime)
+}
+
+// chapterPattern returns the ffmpeg segment muxer output pattern producing
+// GoPro chapter names such as GH011234.MP4, GH021234.MP4, ...
+func chapterPattern(outputDir string, s SplitOptions) string {
+	name := fmt.Sprintf("%s%%02d%04d.MP4", s.Prefix, s.FileNumber)
+	return filepath.Join(strings.ReplaceAll(outputDir, "%", "%%"), name)
+}
+
+func splitArgs(inputPath, outputDir string, s SplitOptions, mapArgs []string) ([]string, error) {
+	if !knownPrefix(s.Prefix) {
+		return nil, fmt.Errorf("invalid prefix %q: must be one of %s", s.Prefix, strings.Join(schemePrefixes(), ", "))
+	}
+	if s.FileNumber < 0 || s.FileNumber > 9999 {
+		return nil, fmt.Errorf("invalid file number %d: must be between 0 and 9999", s.FileNumber)
+	}
+
+	args := append(ffmpegArgs(""),
+		"-i", inputPath,
+		"-c", "copy",
+	)
+	args = append(args, mapArgs...)
+	args = append(args, "-f", "segment")
+
+	switch {
+	case len(s.SplitPoints) > 0:
+		if len(s.SplitPoints) >= maxChapters {
+			return nil, fmt.Errorf("too many split points: at most %d chapters are supported", maxChapters)
+		}
+		var times []string
+		for i, point := range s.SplitPoints {
+			if point <= 0 || (i > 0 && point <= s.SplitPoints[i-1]) {
+				return nil, fmt.Errorf("split points must be positive and increasing")
+			}
+			times = append(times, strconv.FormatFloat(point.Seconds(), 'f', -1, 64))
+		}
+		args = append(args, "-segment_times", strings.Join(times, ","))
+	case s.SegmentTime > 0:
+		args = append(args, "-segment_time", strconv.FormatFloat(s.SegmentTime.Seconds(), 'f', -1, 64))
+	default:
+		return nil, fmt.Errorf("either a segment time or split points are required")
+	}
+
+	args = append(args,
+		"-segment_format", "mp4",
+		"-segment_start_number", "1",
+		"-reset_timestamps", "1",
+		chapterPattern(outputDir, s))
+	return args, nil
+}
+
+// splitFile cuts inputPath into GoPro-style chapters in outputDir and
+// returns the paths of the chapters it wrote. Cuts land on the nearest
+// keyframe because the streams are copied, not re-encoded. It refuses to
+// write a chapter over the input, or over an existing file unless
+// s.Force is set.
+func splitFile(inputPath, outputDir string, s SplitOptions, opts Options) ([]string, error) {
+	logger := opts.logger()
+
+	probe, err := probeFile(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	mapping := mapStreams(probe.Streams, streamsAll)
+	if !mapping.Telemetry {
+		logger.Warn("no telemetry stream found, the chapters will not contain GPMF data", "input", inputPath)
+	}
+
+	args, err := splitArgs(inputPath, outputDir, s, mapping.Args)
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Duration(probe.Duration * float64(time.Second))
+	if count := chapterCount(duration, s); count > maxChapters {
+		return nil, fmt.Errorf("splitting %s every %s would make %d chapters: at most %d are supported", inputPath, s.SegmentTime, count, maxChapters)
+	}
+	for chapter := 1; chapter <= chapterCount(duration, s); chapter++ {
+		path := filepath.Join(outputDir, formatFileName(s.Prefix, chapter, s.FileNumber))
+		if err := checkOutputNotInput(path, []string{inputPath}); err != nil {
+			return nil, err
+		}
+		if err := checkOutputNew(path, s.Force); err != nil {
+			return nil, err
+		}
+		// ffmpeg without -y would refuse a chapter -force replaces
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to replace %s: %v", path, err)
+		}
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory %s: %v", outputDir, err)
+	}
+
+	logger.Info("splitting file", "input", inputPath, "output_dir", outputDir)
+	err = runCommand(logger, ffmpegCommand(args...))
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg command failed: %v", err)
+	}
+
+	var chapters []string
+	for chapter := 1; chapter <= maxChapters; chapter++ {
+		path := filepath.Join(outputDir, formatFileName(s.Prefix, chapter, s.FileNumber))
+		if _, err := os.Stat(path); err != nil {
+			break
+		}
+		chapters = append(chapters, path)
+	}
+	return chapters, nil
+}
+
+func parseSplitPoints(value string) ([]time.Duration, error) {
+	var points []time.Duration
+	for _, field := range strings.Split(value, ",") {
+		point, err := time.ParseDuration(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid split point %q: %v", field, err)
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// runSplit implements the split subcommand and returns the process exit code.
+func runSplit(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("split", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	segmentTime := flags.Duration("segment-time", 0, "length of each chapter, e.g. 10m")
+	at := flags.String("at", "", "comma separated offsets where chapters start, e.g. 10m,25m30s")
+	prefix := flags.String("prefix", "", "chapter name prefix, GH or GX (default taken from the input name, or GH)")
+	fileNumber := flags.Int("file-number", -1, "four digit file number (default taken from the input name, or 1)")
+	force := flags.Bool("force", false, "overwrite chapters already in the output directory")
+	verbose := flags.Bool("v", false, "enable debug logging")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: GoProConcat split [options] inputfile outputdir")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if flags.NArg() != 2 || (*segmentTime == 0 && *at == "") {
+		flags.Usage()
+		return exitUsage
+	}
+	inputPath := flags.Arg(0)
+	outputDir := flags.Arg(1)
+
+	logger, err := newCLILogger(stderr, "text", *verbose)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	s := SplitOptions{Prefix: "GH", FileNumber: 1, SegmentTime: *segmentTime, Force: *force}
+	if info, err := parseFileName(inputPath, defaultFileNamePattern); err == nil {
+		s.Prefix = info.Prefix
+		s.FileNumber = info.FileNumber
+	}
+	if *prefix != "" {
+		s.Prefix = strings.ToUpper(*prefix)
+	}
+	if *fileNumber >= 0 {
+		s.FileNumber = *fileNumber
+	}
+	if *at != "" {
+		s.SplitPoints, err = parseSplitPoints(*at)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+
+	err = checkRequirements()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+
+	chapters, err := splitFile(inputPath, outputDir, s, Options{Logger: logger})
+	if err != nil {
+		fmt.Fprintf(stderr, "Error splitting file: %v\n", err)
+		return exitError
+	}
+	for _, chapter := range chapters {
+		fmt.Fprintln(stdout, chapter)
+	}
+	fmt.Fprintf(stdout, "File split into %d chapters\n", len(chapters))
+	return exitOK
+}
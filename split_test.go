@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	s := SplitOptions{Prefix: "GX", FileNumber: 42, SplitPoints: []time.Duration{10 * time.Minute, 15 * time.Minute}}
+
+	mapArgs := mapStreams(loadProbeFixture(t, "hero_probe.json").Streams, streamsAll).Args
+	args, err := splitArgs("merged.mp4", "out", s, mapArgs)
+	if err != nil {
+		t.Fatalf("splitArgs() error: %v", err)
+	}
+
+	command := strings.Join(args, " ")
+	if !strings.Contains(command, "-segment_times 600,900") {
+		t.Errorf("Expected split points in command, got: %s", command)
+	}
+	if !strings.HasSuffix(command, filepath.Join("out", "GX%02d0042.MP4")) {
+		t.Errorf("Expected GoPro chapter pattern as output, got: %s", command)
+	}
+	if !strings.Contains(command, "-map 0:3 -tag:2 gpmd") {
+		t.Errorf("Expected telemetry to be preserved, got: %s", command)
+	}
+
+	// Split points must be increasing
+	s.SplitPoints = []time.Duration{time.Minute, time.Minute}
+	if _, err := splitArgs("merged.mp4", "out", s, mapArgs); err == nil {
+		t.Errorf("Expected error for non-increasing split points")
+	}
+}
+
+func TestSplitFile(t *testing.T) {
+	// Create a 2 second video with a keyframe every half second so it can be cut at 1s
+	inputPath := filepath.Join(t.TempDir(), "merged.mp4")
+	cmd := exec.Command("ffmpeg", "-y", "-f", "lavfi", "-i", "testsrc=duration=2:size=1280x720:rate=30", "-c:v", "libx264", "-g", "15", inputPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to create test video: %v", err)
+	}
+
+	outputDir := t.TempDir()
+	s := SplitOptions{Prefix: "GH", FileNumber: 1234, SegmentTime: time.Second}
+
+	chapters, err := splitFile(inputPath, outputDir, s, Options{})
+	if err != nil {
+		t.Fatalf("splitFile() error: %v", err)
+	}
+
+	expected := []string{
+		filepath.Join(outputDir, "GH011234.MP4"),
+		filepath.Join(outputDir, "GH021234.MP4"),
+	}
+	if strings.Join(chapters, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected chapters %v, got %v", expected, chapters)
+	}
+
+	// The chapters must be mergeable again in GoPro order
+	files, err := collectFiles([]string{chapters[1], chapters[0]}, defaultFileNamePattern)
+	if err != nil {
+		t.Fatalf("collectFiles() error: %v", err)
+	}
+	if files[0].ChapterNumber != 1 || files[1].ChapterNumber != 2 {
+		t.Errorf("Expected chapters to sort as 1, 2, got %d, %d", files[0].ChapterNumber, files[1].ChapterNumber)
+	}
+}
+
+func TestSplitFileRefusesOverwrite(t *testing.T) {
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	var runs int
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		runs++
+		return nil
+	}
+
+	// Chapter 1 of GH011234.MP4 split next to it is its own name
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "GH011234.MP4")
+	if err := os.WriteFile(inputPath, []byte("recording"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := SplitOptions{Prefix: "GH", FileNumber: 1234, SegmentTime: 5 * time.Minute, Force: true}
+	if _, err := splitFile(inputPath, dir, s, Options{}); err == nil || !strings.Contains(err.Error(), "is also an input file") {
+		t.Errorf("Expected a chapter over the input to be refused, got %v", err)
+	}
+
+	// An existing chapter is only overwritten with Force
+	outputDir := t.TempDir()
+	existing := filepath.Join(outputDir, "GH021234.MP4")
+	if err := os.WriteFile(existing, []byte("earlier split"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.Force = false
+	if _, err := splitFile(inputPath, outputDir, s, Options{}); err == nil || !strings.Contains(err.Error(), existing+" already exists") {
+		t.Errorf("Expected the existing chapter to be refused, got %v", err)
+	}
+	// The fixture lasts 530.53s, the two chapters of -at 1m are within it
+	s.SplitPoints = []time.Duration{time.Minute}
+	s.SegmentTime = 0
+	if _, err := splitFile(inputPath, outputDir, s, Options{}); err == nil {
+		t.Errorf("Expected the existing second chapter to be refused with split points")
+	}
+	if runs != 0 {
+		t.Errorf("Expected ffmpeg not to run, ran it %d time(s)", runs)
+	}
+	s.Force = true
+	if _, err := splitFile(inputPath, outputDir, s, Options{}); err != nil || runs != 1 {
+		t.Errorf("Expected -force to split over the existing chapter, got %v after %d run(s)", err, runs)
+	}
+
+	// More chapters than the names can number are refused up front
+	s = SplitOptions{Prefix: "GH", FileNumber: 1234, SegmentTime: 5 * time.Second}
+	if _, err := splitFile(inputPath, t.TempDir(), s, Options{}); err == nil || !strings.Contains(err.Error(), "would make 107 chapters") {
+		t.Errorf("Expected more than %d chapters to be refused, got %v", maxChapters, err)
+	}
+}
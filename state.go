@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateFileName is the file, kept next to the outputs, that remembers
+// which inputs were merged by previous runs.
+const stateFileName = ".goproconcat-state.json"
+
+type processedInput struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+type runState struct {
+	Processed []processedInput `json:"processed"`
+}
+
+func stateFilePath(outputPath string) string {
+	return filepath.Join(filepath.Dir(outputPath), stateFileName)
+}
+
+func loadState(statePath string) (runState, error) {
+	var state runState
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read state file %s: %v", statePath, err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse state file %s: %v", statePath, err)
+	}
+	return state, nil
+}
+
+func saveState(statePath string, state runState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state file: %v", err)
+	}
+
+	// Write next to the final path and rename so an interrupted run never leaves a truncated state file
+	tempPath := statePath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file %s: %v", tempPath, err)
+	}
+	if err := os.Rename(tempPath, statePath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write state file %s: %v", statePath, err)
+	}
+	return nil
+}
+
+// fingerprintInput identifies an input by absolute path, size and
+// modification time, which is enough to notice a re-copied file without
+// hashing gigabytes of video.
+func fingerprintInput(inputPath string) (processedInput, error) {
+	if isRemote(inputPath) {
+		size, modTime, err := remoteStat(inputPath)
+		if err != nil {
+			return processedInput{}, err
+		}
+		return processedInput{Path: inputPath, Size: size, ModTime: modTime}, nil
+	}
+	absPath, err := filepath.Abs(inputPath)
+	if err != nil {
+		return processedInput{}, fmt.Errorf("failed to get absolute path for %s: %v", inputPath, err)
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return processedInput{}, fmt.Errorf("failed to stat input file %s: %v", inputPath, err)
+	}
+	return processedInput{
+		Path:    absPath,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (s runState) contains(input processedInput) bool {
+	for _, processed := range s.Processed {
+		if processed.Path == input.Path && processed.Size == input.Size && processed.ModTime.Equal(input.ModTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterProcessed splits inputPaths into those not yet merged and those
+// recorded as merged in the state file.
+func filterProcessed(statePath string, inputPaths []string) (remaining, skipped []string, err error) {
+	state, err := loadState(statePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, inputPath := range inputPaths {
+		input, err := fingerprintInput(inputPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if state.contains(input) {
+			skipped = append(skipped, inputPath)
+		} else {
+			remaining = append(remaining, inputPath)
+		}
+	}
+	return remaining, skipped, nil
+}
+
+func recordProcessed(statePath string, inputPaths []string) error {
+	state, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+
+	for _, inputPath := range inputPaths {
+		input, err := fingerprintInput(inputPath)
+		if err != nil {
+			return err
+		}
+		if !state.contains(input) {
+			state.Processed = append(state.Processed, input)
+		}
+	}
+	return saveState(statePath, state)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSinceLastRunSkipsProcessedFiles(t *testing.T) {
+	dir := t.TempDir()
+	inputPath1 := filepath.Join(dir, "GH011234.MP4")
+	inputPath2 := filepath.Join(dir, "GH021234.MP4")
+	for _, path := range []string{inputPath1, inputPath2} {
+		if err := os.WriteFile(path, []byte("dummy"), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+	}
+	statePath := stateFilePath(filepath.Join(dir, "merged.mp4"))
+
+	// First run: nothing has been merged yet
+	remaining, skipped, err := filterProcessed(statePath, []string{inputPath1})
+	if err != nil {
+		t.Fatalf("filterProcessed() error: %v", err)
+	}
+	if len(remaining) != 1 || len(skipped) != 0 {
+		t.Fatalf("Expected 1 remaining and 0 skipped files, got %v and %v", remaining, skipped)
+	}
+	if err := recordProcessed(statePath, remaining); err != nil {
+		t.Fatalf("recordProcessed() error: %v", err)
+	}
+
+	// Second run: the first input was merged, the second one is new
+	remaining, skipped, err = filterProcessed(statePath, []string{inputPath1, inputPath2})
+	if err != nil {
+		t.Fatalf("filterProcessed() error: %v", err)
+	}
+	if len(skipped) != 1 || skipped[0] != inputPath1 {
+		t.Errorf("Expected %s to be skipped, got %v", inputPath1, skipped)
+	}
+	if len(remaining) != 1 || remaining[0] != inputPath2 {
+		t.Errorf("Expected %s to remain, got %v", inputPath2, remaining)
+	}
+
+	// A file replaced with different contents is treated as new
+	if err := os.WriteFile(inputPath1, []byte("re-copied from card"), 0644); err != nil {
+		t.Fatalf("Failed to rewrite input file: %v", err)
+	}
+	remaining, _, err = filterProcessed(statePath, []string{inputPath1})
+	if err != nil {
+		t.Fatalf("filterProcessed() error: %v", err)
+	}
+	if len(remaining) != 1 {
+		t.Errorf("Expected modified file to be processed again, got %v", remaining)
+	}
+}
+
+func TestRunSinceLastRunSkipBad(t *testing.T) {
+	dir := t.TempDir()
+	chapter := bytes.Join([][]byte{
+		mp4BoxBytes("ftyp", []byte("isom\x00\x00\x02\x00isom")),
+		mp4BoxBytes("mdat", make([]byte, 1024)),
+		mp4BoxBytes("moov", mp4BoxBytes("mvhd", make([]byte, 100))),
+	}, nil)
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4", "GH031234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, chapter, 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	// The second chapter was cut short while it was being copied
+	damaged := inputPaths[1]
+	if err := os.WriteFile(damaged, chapter[:len(chapter)-50], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		if strings.HasSuffix(path, partialSuffix) {
+			output := hero
+			output.Duration = 2 * hero.Duration
+			return output, nil
+		}
+		return hero, nil
+	}
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	outputPath := filepath.Join(dir, "merged.mp4")
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-since-last-run", "-skip-bad", outputPath, dir}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Expected the merge to succeed, got %d: %s", code, stderr.String())
+	}
+
+	// The skipped chapter is left to the next run
+	remaining, skipped, err := filterProcessed(stateFilePath(outputPath), inputPaths)
+	if err != nil {
+		t.Fatalf("filterProcessed() error: %v", err)
+	}
+	if len(remaining) != 1 || remaining[0] != damaged {
+		t.Errorf("Expected only %s to be left for the next run, got %v", damaged, remaining)
+	}
+	if len(skipped) != 2 {
+		t.Errorf("Expected the two merged chapters to be recorded, got %v", skipped)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Stream selections for Options.Streams.
+const (
+	// streamsAll copies every stream of the input.
+	streamsAll = "all"
+	// streamsEssential copies only video, audio and GPMF telemetry.
+	streamsEssential = "essential"
+)
+
+func validateStreamSelection(selection string) error {
+	switch selection {
+	case "", streamsAll, streamsEssential:
+		return nil
+	default:
+		return fmt.Errorf("invalid stream selection %q: must be %s or %s", selection, streamsAll, streamsEssential)
+	}
+}
+
+// streamMapping is the set of input streams copied to the output.
+type streamMapping struct {
+	// Args are the -map and -tag arguments for ffmpeg.
+	Args []string
+	// Streams are the mapped input streams in output order.
+	Streams []StreamInfo
+	// Telemetry reports whether a GPMF telemetry stream is mapped.
+	Telemetry bool
+}
+
+// isFourCC reports whether tag is a printable four character code, as
+// opposed to ffprobe's "[0][0][0][0]" notation for missing tags.
+func isFourCC(tag string) bool {
+	if len(tag) != 4 {
+		return false
+	}
+	for _, c := range tag {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// mapStreams selects the streams of an input described by streams. The
+// tmcd track is never mapped because the muxer rebuilds it, see
+// timecodeArgs. Data streams keep their codec tag at whatever output index
+// they land on, so GoPro tools still recognise the gpmd telemetry.
+func mapStreams(streams []StreamInfo, selection string) streamMapping {
+	var m streamMapping
+	for _, stream := range streams {
+		telemetry := stream.isTelemetry()
+		switch {
+		case stream.CodecTagString == "tmcd":
+			continue
+		case selection == streamsEssential:
+			if stream.CodecType != "video" && stream.CodecType != "audio" && (!telemetry || m.Telemetry) {
+				continue
+			}
+		}
+
+		m.Args = append(m.Args, "-map", fmt.Sprintf("0:%d", stream.Index))
+		tag := stream.CodecTagString
+		if telemetry {
+			tag = "gpmd"
+		}
+		if stream.CodecType == "data" && isFourCC(tag) {
+			m.Args = append(m.Args, fmt.Sprintf("-tag:%d", len(m.Streams)), tag)
+		}
+		m.Streams = append(m.Streams, stream)
+		m.Telemetry = m.Telemetry || telemetry
+	}
+	m.Args = append(m.Args, "-copy_unknown")
+	return m
+}
+
+// copyUnknownSupported asks ffmpeg only once, as every merge of a run,
+// e.g. each chapter of -split-chapters, needs the answer. It is a variable
+// so tests can simulate older ffmpeg builds.
+var copyUnknownSupported = sync.OnceValues(ffmpegSupportsCopyUnknown)
+
+// ffmpegSupportsCopyUnknown reports whether the installed ffmpeg has the
+// -copy_unknown option, which copying the GoPro data streams needs.
+func ffmpegSupportsCopyUnknown() (bool, error) {
+	out, err := ffmpegCommand("-hide_banner", "-h", "full").Output()
+	if err != nil {
+		return false, fmt.Errorf("failed to list ffmpeg options: %v", err)
+	}
+	return hasFFmpegOption(string(out), "copy_unknown"), nil
+}
+
+// hasFFmpegOption reports whether the output of ffmpeg -h full documents
+// the option name, on a line of its own starting with -name.
+func hasFFmpegOption(help, name string) bool {
+	for _, line := range strings.Split(help, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "-"+name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCopyUnknown returns streams unchanged when the installed ffmpeg
+// supports -copy_unknown, and true. Older builds reject it, and fail on
+// the tagged data streams without it, so for them the data streams are
+// dropped with a warning and false is returned, unless opts.RequireTelemetry
+// makes that an error. When the support cannot be determined, ffmpeg is
+// assumed to have it.
+func checkCopyUnknown(streams []StreamInfo, opts Options) ([]StreamInfo, bool, error) {
+	logger := opts.logger()
+	supported, err := copyUnknownSupported()
+	if err != nil {
+		logger.Debug("cannot tell whether ffmpeg supports -copy_unknown, assuming it does", "error", err)
+		return streams, true, nil
+	}
+	if supported {
+		return streams, true, nil
+	}
+	kept := withoutDataStreams(streams)
+	if len(kept) == len(streams) {
+		logger.Info("the installed ffmpeg does not support -copy_unknown, merging without it")
+		return streams, false, nil
+	}
+	if opts.RequireTelemetry {
+		return nil, false, fmt.Errorf("the installed ffmpeg does not support -copy_unknown, which copying the telemetry needs: update ffmpeg, or merge without -require-telemetry to leave the telemetry out")
+	}
+	logger.Warn("the installed ffmpeg does not support -copy_unknown, the output will not contain telemetry or the other GoPro data streams")
+	return kept, false, nil
+}
+
+// withoutCopyUnknown removes -copy_unknown from the mapping arguments, for
+// ffmpeg builds without it.
+func withoutCopyUnknown(args []string) []string {
+	var kept []string
+	for _, arg := range args {
+		if arg != "-copy_unknown" {
+			kept = append(kept, arg)
+		}
+	}
+	return kept
+}
+
+// withoutAudioStreams drops the audio streams, for -drop-audio.
+func withoutAudioStreams(streams []StreamInfo) []StreamInfo {
+	var kept []StreamInfo
+	for _, stream := range streams {
+		if stream.CodecType != "audio" {
+			kept = append(kept, stream)
+		}
+	}
+	return kept
+}
+
+// withAudioTrack keeps only the track-th audio stream, counting from 1.
+func withAudioTrack(streams []StreamInfo, track int) ([]StreamInfo, error) {
+	var kept []StreamInfo
+	audio := 0
+	for _, stream := range streams {
+		if stream.CodecType == "audio" {
+			audio++
+			if audio != track {
+				continue
+			}
+		}
+		kept = append(kept, stream)
+	}
+	if audio < track {
+		return nil, fmt.Errorf("audio track %d does not exist, there are %d", track, audio)
+	}
+	return kept, nil
+}
+
+// withoutTelemetryStreams drops the GPMF telemetry and the other GoPro
+// data streams, for -no-telemetry. The tmcd track only holds the start
+// timecode and is kept.
+func withoutTelemetryStreams(streams []StreamInfo) []StreamInfo {
+	var kept []StreamInfo
+	for _, stream := range streams {
+		if stream.CodecType != "data" || stream.CodecTagString == "tmcd" {
+			kept = append(kept, stream)
+		}
+	}
+	return kept
+}
+
+// verifyNoTelemetry checks that outputPath has no data streams besides
+// the timecode track.
+func verifyNoTelemetry(outputPath string) error {
+	probe, err := probeFile(outputPath)
+	if err != nil {
+		return err
+	}
+	var found []string
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "data" && stream.CodecTagString != "tmcd" {
+			found = append(found, streamKind(stream))
+		}
+	}
+	if len(found) > 0 {
+		return fmt.Errorf("merged file %s still contains %s despite -no-telemetry", outputPath, strings.Join(found, ", "))
+	}
+	return nil
+}
+
+// selectStreams applies Options.DropAudio, Options.AudioTrack and
+// Options.NoTelemetry to the probe results of files.
+func selectStreams(files []FileInfo, probes []ProbeResult, opts Options) error {
+	for i := range probes {
+		if opts.NoTelemetry {
+			probes[i].Streams = withoutTelemetryStreams(probes[i].Streams)
+		}
+		switch {
+		case opts.DropAudio:
+			probes[i].Streams = withoutAudioStreams(probes[i].Streams)
+		case opts.AudioTrack > 0:
+			streams, err := withAudioTrack(probes[i].Streams, opts.AudioTrack)
+			if err != nil {
+				return fmt.Errorf("%s: %v", files[i].Path, err)
+			}
+			probes[i].Streams = streams
+		}
+	}
+	return nil
+}
+
+// streamLabel describes a stream in the merge plan.
+func streamLabel(stream StreamInfo) string {
+	if stream.CodecType == "data" {
+		return streamKind(stream)
+	}
+	return fmt.Sprintf("%s stream %s", stream.CodecType, stream.CodecName)
+}
+
+// streamKind identifies a stream for comparing inputs against outputs.
+// Data streams are told apart by codec tag; other streams only by type,
+// since re-encoding may change their codec.
+func streamKind(stream StreamInfo) string {
+	if stream.CodecType == "data" {
+		tag := stream.CodecTagString
+		if stream.isTelemetry() {
+			tag = "gpmd"
+		}
+		return "data stream " + tag
+	}
+	return stream.CodecType + " stream"
+}
+
+// missingStreams returns a description of each expected stream that has
+// no counterpart in actual.
+func missingStreams(expected, actual []StreamInfo) []string {
+	available := make(map[string]int)
+	for _, stream := range actual {
+		available[streamKind(stream)]++
+	}
+
+	var missing []string
+	for _, stream := range expected {
+		kind := streamKind(stream)
+		if available[kind] > 0 {
+			available[kind]--
+			continue
+		}
+		missing = append(missing, kind)
+	}
+	return missing
+}
+
+// verifyStreams checks that outputPath contains every stream in expected.
+func verifyStreams(outputPath string, expected []StreamInfo) error {
+	probe, err := probeFile(outputPath)
+	if err != nil {
+		return err
+	}
+	if missing := missingStreams(expected, probe.Streams); len(missing) > 0 {
+		return fmt.Errorf("merged file %s is missing %s present in the input (expected %d streams, found %d)",
+			outputPath, strings.Join(missing, ", "), len(expected), len(probe.Streams))
+	}
+	return nil
+}
+
+// checkInventory compares actual, the streams of the merged outputPath,
+// with inventory, the streams the inputs were merged into. For every kind
+// of stream in inventory, told apart by codec type and tag as by
+// streamKind, the output must have as many streams as the inputs, since
+// ffmpeg drops a stream it cannot copy without failing. Kinds only the
+// output has, such as the chapter track of MP4, are not counted.
+func checkInventory(outputPath string, inventory, actual []StreamInfo) error {
+	expected := make(map[string]int)
+	var kinds []string
+	for _, stream := range inventory {
+		kind := streamKind(stream)
+		if expected[kind] == 0 {
+			kinds = append(kinds, kind)
+		}
+		expected[kind]++
+	}
+	found := make(map[string]int)
+	for _, stream := range actual {
+		found[streamKind(stream)]++
+	}
+
+	var differences []string
+	for _, kind := range kinds {
+		switch {
+		case found[kind] == 0:
+			differences = append(differences, fmt.Sprintf("output missing %s present in inputs", kind))
+		case found[kind] != expected[kind]:
+			differences = append(differences, fmt.Sprintf("output has %d %s(s) where the inputs have %d", found[kind], kind, expected[kind]))
+		}
+	}
+	if len(differences) > 0 {
+		return fmt.Errorf("merged file %s does not have the streams of the inputs: %s", outputPath, strings.Join(differences, "; "))
+	}
+	return nil
+}
+
+// streamParams returns the parameters of stream that must survive the
+// merge. Data streams have none besides their kind. A parameter ffprobe
+// does not report has an empty value.
+func streamParams(stream StreamInfo) []streamParam {
+	switch stream.CodecType {
+	case "video":
+		resolution := ""
+		if stream.Width > 0 {
+			resolution = fmt.Sprintf("%dx%d", stream.Width, stream.Height)
+		}
+		return []streamParam{
+			{"codec", stream.CodecName},
+			{"resolution", resolution},
+			{"pixel format", stream.PixFmt},
+			{"frame rate", stream.FrameRate},
+		}
+	case "audio":
+		channels := ""
+		if stream.Channels > 0 {
+			channels = strconv.Itoa(stream.Channels)
+		}
+		return []streamParam{
+			{"codec", stream.CodecName},
+			{"sample rate", stream.SampleRate},
+			{"channels", channels},
+		}
+	}
+	return nil
+}
+
+// compareStreams returns a line for each stream of expected that actual
+// lacks, and for each parameter in which it differs from its counterpart
+// in actual, the stream of the same kind at the same position among the
+// streams of that kind. Streams of actual that are not expected, such as
+// cover art, are ignored.
+func compareStreams(expected, actual []StreamInfo) []string {
+	byKind := make(map[string][]StreamInfo)
+	for _, stream := range actual {
+		kind := streamKind(stream)
+		byKind[kind] = append(byKind[kind], stream)
+	}
+
+	var diffs []string
+	used := make(map[string]int)
+	for _, stream := range expected {
+		kind := streamKind(stream)
+		position := used[kind]
+		used[kind]++
+		if position >= len(byKind[kind]) {
+			diffs = append(diffs, fmt.Sprintf("%s (input #%d): missing", streamLabel(stream), stream.Index))
+			continue
+		}
+		counterpart := byKind[kind][position]
+		got := streamParams(counterpart)
+		for i, param := range streamParams(stream) {
+			if param.Value != "" && param.Value != got[i].Value {
+				diffs = append(diffs, fmt.Sprintf("%s (output #%d): %s %s instead of %s",
+					streamLabel(stream), counterpart.Index, param.Name, orUnknown(got[i].Value), param.Value))
+			}
+		}
+	}
+	return diffs
+}
+
+// verifyStreamParams probes outputPath again and checks that it has every
+// stream in expected with the parameters expected.
+func verifyStreamParams(outputPath string, expected []StreamInfo) error {
+	probe, err := probeFile(outputPath)
+	if err != nil {
+		return err
+	}
+	diffs := compareStreams(expected, probe.Streams)
+	if len(diffs) > 0 {
+		return fmt.Errorf("merged file %s does not match the inputs:\n  %s", outputPath, strings.Join(diffs, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMapStreams(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		selection string
+		expected  string
+		telemetry bool
+	}{
+		// Everything but the tmcd track, which the muxer rebuilds
+		{"hero_probe.json", streamsAll, "-map 0:0 -map 0:1 -map 0:3 -tag:2 gpmd -map 0:4 -tag:3 fdsc -copy_unknown", true},
+		// The reduced selection also leaves out the SOS stream
+		{"hero_probe.json", streamsEssential, "-map 0:0 -map 0:1 -map 0:3 -tag:2 gpmd -copy_unknown", true},
+		// Without audio the telemetry lands on output stream 1
+		{"hero_no_audio_probe.json", streamsAll, "-map 0:0 -map 0:2 -tag:1 gpmd -copy_unknown", true},
+		// No data stream at all: nothing is tagged
+		{"no_telemetry_probe.json", streamsAll, "-map 0:0 -map 0:1 -copy_unknown", false},
+	}
+
+	for _, test := range tests {
+		mapping := mapStreams(loadProbeFixture(t, test.fixture).Streams, test.selection)
+		if strings.Join(mapping.Args, " ") != test.expected {
+			t.Errorf("%s (%s): expected %q, got %q", test.fixture, test.selection, test.expected, strings.Join(mapping.Args, " "))
+		}
+		if mapping.Telemetry != test.telemetry {
+			t.Errorf("%s (%s): expected telemetry %v, got %v", test.fixture, test.selection, test.telemetry, mapping.Telemetry)
+		}
+	}
+}
+
+func TestMapStreamsTelemetryIndex(t *testing.T) {
+	// A second audio track, e.g. from a Media Mod, moves the telemetry to
+	// output stream 3
+	streams := []StreamInfo{
+		{Index: 0, CodecType: "video", CodecName: "h264"},
+		{Index: 1, CodecType: "audio", CodecName: "aac"},
+		{Index: 2, CodecType: "audio", CodecName: "aac"},
+		{Index: 3, CodecType: "data", CodecTagString: "tmcd"},
+		{Index: 4, CodecType: "data", CodecTagString: "gpmd"},
+		{Index: 5, CodecType: "data", CodecTagString: "fdsc"},
+	}
+	expected := "-map 0:0 -map 0:1 -map 0:2 -map 0:4 -tag:3 gpmd -map 0:5 -tag:4 fdsc -copy_unknown"
+	if args := strings.Join(mapStreams(streams, streamsAll).Args, " "); args != expected {
+		t.Errorf("Expected %q, got %q", expected, args)
+	}
+	// The essential selection keeps both audio tracks
+	expected = "-map 0:0 -map 0:1 -map 0:2 -map 0:4 -tag:3 gpmd -copy_unknown"
+	if args := strings.Join(mapStreams(streams, streamsEssential).Args, " "); args != expected {
+		t.Errorf("Expected %q, got %q", expected, args)
+	}
+
+	// Re-encoding without audio puts the telemetry right after the video
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4"}
+	args := strings.Join(reencodeArgs(spec, []string{"GH010042.MP4", "GH020042.MP4"}, encodeSettings{VideoCodec: "libx264", Width: 1920, Height: 1080, FrameRate: "30000/1001"}, 4, Options{}), " ")
+	if !strings.Contains(args, "-map [v] -map 2:4 -c:d copy -tag:1 gpmd") {
+		t.Errorf("Expected the telemetry tagged as output stream 1, got: %s", args)
+	}
+}
+
+func TestVerifyStreams(t *testing.T) {
+	input := loadProbeFixture(t, "hero_probe.json")
+	mapping := mapStreams(input.Streams, streamsAll)
+
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+
+	// ffmpeg silently dropped the SOS stream
+	probeFile = func(path string) (ProbeResult, error) {
+		return ProbeResult{Streams: []StreamInfo{
+			{Index: 0, CodecType: "video", CodecName: "h264"},
+			{Index: 1, CodecType: "audio", CodecName: "aac"},
+			{Index: 2, CodecType: "data", CodecTagString: "gpmd"},
+			{Index: 3, CodecType: "data", CodecTagString: "tmcd"},
+		}}, nil
+	}
+	err := verifyStreams("merged.mp4", mapping.Streams)
+	if err == nil {
+		t.Fatalf("Expected error for missing stream")
+	}
+	if !strings.Contains(err.Error(), "missing data stream fdsc") {
+		t.Errorf("Expected error to name the missing stream, got: %v", err)
+	}
+
+	// Everything arrived
+	probeFile = func(path string) (ProbeResult, error) {
+		return input, nil
+	}
+	if err := verifyStreams("merged.mp4", mapping.Streams); err != nil {
+		t.Errorf("verifyStreams() error: %v", err)
+	}
+}
+
+func TestVerifyStreamParams(t *testing.T) {
+	input := loadProbeFixture(t, "hero_probe.json")
+	expected := mapStreams(input.Streams, streamsAll).Streams
+
+	origProbeFile := probeFile
+	defer func() { probeFile = origProbeFile }()
+
+	// An output scaled up, downmixed to mono and without telemetry, with
+	// cover art that is not compared
+	output := ProbeResult{Streams: []StreamInfo{
+		{Index: 0, CodecType: "video", CodecName: "h264", Width: 3840, Height: 2160, PixFmt: "yuvj420p", FrameRate: "60000/1001"},
+		{Index: 1, CodecType: "audio", CodecName: "aac", SampleRate: "48000", Channels: 1},
+		{Index: 2, CodecType: "data", CodecTagString: "tmcd"},
+		{Index: 3, CodecType: "data", CodecTagString: "fdsc"},
+		{Index: 4, CodecType: "video", CodecName: "mjpeg", Width: 320, Height: 240},
+	}}
+	probeFile = func(path string) (ProbeResult, error) {
+		return output, nil
+	}
+	err := verifyStreamParams("merged.mp4", expected)
+	if err == nil {
+		t.Fatal("Expected the differences to fail verification")
+	}
+	for _, diff := range []string{
+		"\n  video stream h264 (output #0): resolution 3840x2160 instead of 1920x1080",
+		"\n  audio stream aac (output #1): channels 1 instead of 2",
+		"\n  data stream gpmd (input #3): missing",
+	} {
+		if !strings.Contains(err.Error(), diff) {
+			t.Errorf("Expected %q in the error, got: %v", diff, err)
+		}
+	}
+	if got := len(compareStreams(expected, output.Streams)); got != 3 {
+		t.Errorf("Expected 3 differences, got %d", got)
+	}
+
+	// The inputs themselves match
+	if diffs := compareStreams(expected, input.Streams); len(diffs) > 0 {
+		t.Errorf("Expected no differences, got %q", diffs)
+	}
+}
+
+func TestWithAudioTrack(t *testing.T) {
+	streams := []StreamInfo{
+		{Index: 0, CodecType: "video"},
+		{Index: 1, CodecType: "audio", CodecName: "aac"},
+		{Index: 2, CodecType: "audio", CodecName: "pcm_s24le"},
+		{Index: 3, CodecType: "data", CodecTagString: "gpmd"},
+	}
+	kept, err := withAudioTrack(streams, 2)
+	if err != nil {
+		t.Fatalf("withAudioTrack() error: %v", err)
+	}
+	// The telemetry is tagged at its new output index
+	m := mapStreams(kept, streamsAll)
+	if got := strings.Join(m.Args, " "); got != "-map 0:0 -map 0:2 -map 0:3 -tag:2 gpmd -copy_unknown" {
+		t.Errorf("Unexpected mapping for audio track 2: %s", got)
+	}
+
+	if _, err := withAudioTrack(streams, 3); err == nil || !strings.Contains(err.Error(), "there are 2") {
+		t.Errorf("Expected an error for a missing audio track, got: %v", err)
+	}
+}
+
+func TestHasFFmpegOption(t *testing.T) {
+	help := `Advanced per-stream options:
+-copy_unknown        Copy unknown stream types
+-map_chapters input_file_index  set chapters mapping
+`
+	if !hasFFmpegOption(help, "copy_unknown") {
+		t.Error("Expected -copy_unknown to be found")
+	}
+	if hasFFmpegOption(help, "copy") || hasFFmpegOption("Copy unknown stream types", "copy_unknown") {
+		t.Error("Expected only whole option names to match")
+	}
+}
+
+func TestMergeFilesWithoutCopyUnknown(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	probe := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	origCopyUnknownSupported := copyUnknownSupported
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+		copyUnknownSupported = origCopyUnknownSupported
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		return probe, nil
+	}
+	copyUnknownSupported = func() (bool, error) {
+		return false, nil
+	}
+	// An ffmpeg from before -copy_unknown rejects it, and the data streams
+	// without it
+	var command string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		command = strings.Join(cmd.Args, " ")
+		if strings.Contains(command, "-copy_unknown") {
+			return fmt.Errorf("Unrecognized option 'copy_unknown'")
+		}
+		if strings.Contains(command, "-tag:") {
+			return fmt.Errorf("Could not find tag for codec none in stream #2")
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{}); err != nil {
+		t.Fatalf("Expected the merge to fall back to leaving out the telemetry, got %v", err)
+	}
+	if !strings.Contains(command, "-map 0:0 -map 0:1 ") || strings.Contains(command, "-map 0:3") {
+		t.Errorf("Expected only the video and audio to be mapped, got: %s", command)
+	}
+
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{RequireTelemetry: true})
+	if err == nil || !strings.Contains(err.Error(), "does not support -copy_unknown") {
+		t.Errorf("Expected -require-telemetry to fail the merge, got %v", err)
+	}
+}
+
+func TestCheckInventory(t *testing.T) {
+	inventory := loadProbeFixture(t, "hero_probe.json").Streams
+	if err := checkInventory("merged.mp4", inventory, inventory); err != nil {
+		t.Errorf("Expected the same streams to pass, got %v", err)
+	}
+
+	// A chapter track only the output has does not count
+	chapters := StreamInfo{Index: 5, CodecType: "data", CodecTagString: "text"}
+	if err := checkInventory("merged.mp4", inventory, append(append([]StreamInfo(nil), inventory...), chapters)); err != nil {
+		t.Errorf("Expected a stream of another kind to be ignored, got %v", err)
+	}
+
+	// gpmd dropped, and the audio twice
+	var actual []StreamInfo
+	for _, stream := range inventory {
+		if stream.CodecTagString != "gpmd" {
+			actual = append(actual, stream)
+		}
+		if stream.CodecType == "audio" {
+			actual = append(actual, stream)
+		}
+	}
+	err := checkInventory("merged.mp4", inventory, actual)
+	if err == nil {
+		t.Fatal("Expected the differences to fail the check")
+	}
+	for _, difference := range []string{"output missing data stream gpmd present in inputs", "output has 2 audio stream(s) where the inputs have 1"} {
+		if !strings.Contains(err.Error(), difference) {
+			t.Errorf("Expected %q, got %v", difference, err)
+		}
+	}
+}
+
+func TestMergeFilesVerifyInventory(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	// ffmpeg succeeds, but drops the timecode track
+	probeFile = func(path string) (ProbeResult, error) {
+		result := hero
+		result.Duration = 60
+		if path == partialPath(outputPath) {
+			result.Duration = 120
+			result.Streams = nil
+			for _, stream := range hero.Streams {
+				if stream.CodecTagString != "tmcd" {
+					result.Streams = append(result.Streams, stream)
+				}
+			}
+		}
+		return result, nil
+	}
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{Verify: true})
+	if err == nil || !strings.Contains(err.Error(), "output missing data stream tmcd present in inputs") {
+		t.Fatalf("Expected the missing timecode track to fail the merge, got %v", err)
+	}
+	if _, err := os.Stat(outputPath + incompleteSuffix); err != nil {
+		t.Errorf("Expected the output to be kept as incomplete: %v", err)
+	}
+
+	// Without Verify the timecode track is still checked on its own
+	err = mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), Options{})
+	if err == nil || !strings.Contains(err.Error(), "has no timecode track") {
+		t.Errorf("Expected the timecode check to fail, got %v", err)
+	}
+}
+
+func TestMergeFilesAudioTrackSingleInput(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "GH011234.MP4")
+	if err := os.WriteFile(inputPath, []byte("chapter"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	raw := StreamInfo{Index: 5, CodecType: "audio", CodecName: "pcm_s24le", SampleRate: "48000", Channels: 2}
+	withRaw := hero
+	withRaw.Streams = append(append([]StreamInfo(nil), hero.Streams...), raw)
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		if path == partialPath(outputPath) {
+			return ProbeResult{Streams: append([]StreamInfo{hero.Streams[0], raw}, hero.Streams[2:]...)}, nil
+		}
+		return withRaw, nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	// A single input is remuxed with the track selected instead of copied with all of them
+	if err := mergeFiles(outputPath, []string{inputPath}, time.Now(), time.Now(), Options{AudioTrack: 2}); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if command := strings.Join(merge, " "); !strings.Contains(command, "-map 0:0 -map 0:3 -tag:1 gpmd -map 0:4 -tag:2 fdsc -map 0:5 -copy_unknown") {
+		t.Errorf("Expected only audio track 2 to be mapped, got: %s", command)
+	}
+}
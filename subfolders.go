@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// recordingJob is a subfolder holding one recording that -subfolders
+// merges into Output.
+type recordingJob struct {
+	Dir    string
+	Inputs []string
+	Output string
+}
+
+// recordingResult is the outcome of merging one subfolder. Duration is
+// the one of the output when it was verified, Err is nil when the merge
+// succeeded.
+type recordingResult struct {
+	Dir      string
+	Output   string
+	Inputs   int
+	Duration time.Duration
+	Err      error
+}
+
+// planSubfolders treats every immediate subdirectory of root as one
+// recording, as offload tools lay them out, and names its output in
+// outputDir after the subdirectory, e.g. trip/day1 into day1.mp4.
+// Subdirectories without GoPro files are returned as skipped.
+func planSubfolders(outputDir, root string, opts Options) (jobs []recordingJob, skipped []string, err error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read directory %s: %v", root, err)
+	}
+	container := opts.Container
+	if container == "" {
+		container = containerMP4
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		inputs, err := expandInputs([]string{dir}, false, opts.fileNamePattern())
+		if errors.Is(err, errNoInputFiles) {
+			skipped = append(skipped, dir)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		jobs = append(jobs, recordingJob{
+			Dir:    dir,
+			Inputs: inputs,
+			Output: filepath.Join(outputDir, entry.Name()+"."+container),
+		})
+	}
+	if len(jobs) == 0 {
+		return nil, skipped, fmt.Errorf("%w in the subfolders of %s", errNoInputFiles, root)
+	}
+	return jobs, skipped, nil
+}
+
+// mergeSubfolders merges the recording of every job into its output, each
+// stamped with the times of its own chapters. A failed recording does not
+// stop the others, nor does an output that already exists without
+// opts.Force.
+func mergeSubfolders(jobs []recordingJob, remoteTime time.Time, opts Options) []recordingResult {
+	logger := opts.logger()
+	if opts.probes == nil {
+		opts.probes = newProbeCache()
+	}
+
+	var results []recordingResult
+	for _, job := range jobs {
+		result := recordingResult{Dir: job.Dir, Output: job.Output, Inputs: len(job.Inputs)}
+		recordingOpts := opts
+		recordingOpts.DurationFunc = func(expected, actual time.Duration) {
+			result.Duration = actual
+		}
+		logger.Info("merging subfolder", "dir", job.Dir, "output", job.Output, "inputs", len(job.Inputs))
+		err := checkOutputNew(job.Output, opts.Force)
+		var creationTime, modTime time.Time
+		if err == nil {
+			creationTime, modTime, err = inputFileTimes(job.Inputs, remoteTime)
+		}
+		if err == nil {
+			err = mergeFiles(job.Output, job.Inputs, creationTime, modTime, recordingOpts)
+		}
+		if err != nil {
+			logger.Warn("failed to merge subfolder", "dir", job.Dir, "error", err)
+			result.Err = err
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// printRecordingJobs lists the output each subfolder would be merged into.
+func printRecordingJobs(w io.Writer, jobs []recordingJob) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FOLDER\tINPUTS\tOUTPUT")
+	for _, job := range jobs {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", filepath.Base(job.Dir), len(job.Inputs), job.Output)
+	}
+	tw.Flush()
+}
+
+// printRecordingResults prints a table of the merged subfolders, and the
+// subfolders that failed with their error. It returns the number of
+// failures.
+func printRecordingResults(stdout, stderr io.Writer, results []recordingResult) int {
+	failed := 0
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FOLDER\tINPUTS\tOUTPUT\tDURATION\tRESULT")
+	for _, result := range results {
+		duration, status := "-", "ok"
+		if result.Duration > 0 {
+			duration, status = formatOffset(result.Duration), "verified"
+		}
+		if result.Err != nil {
+			status = "FAILED"
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", filepath.Base(result.Dir), result.Inputs, filepath.Base(result.Output), duration, status)
+	}
+	tw.Flush()
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Fprintf(stderr, "Error merging %s: %v\n", result.Dir, result.Err)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRecordingTree creates root with a subfolder per recording holding
+// the named chapters.
+func writeRecordingTree(t *testing.T, root string, tree map[string][]string) {
+	t.Helper()
+	for dir, names := range tree {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(root, dir, name), []byte("chapter "+name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestMergeSubfolders(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "trip")
+	outputDir := filepath.Join(dir, "merged")
+	writeRecordingTree(t, root, map[string][]string{
+		"day1":   {"GH010042.MP4", "GH020042.MP4"},
+		"day2":   {"GX010043.MP4", "notes.txt"},
+		"broken": {"GH010044.MP4", "GH020044.MP4"},
+		"photos": {"GOPR0045.JPG"},
+	})
+	// Files directly in the root belong to no recording
+	if err := os.WriteFile(filepath.Join(root, "GH010046.MP4"), []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, skipped, err := planSubfolders(outputDir, root, Options{})
+	if err != nil {
+		t.Fatalf("planSubfolders() error: %v", err)
+	}
+	if len(skipped) != 1 || filepath.Base(skipped[0]) != "photos" {
+		t.Errorf("Expected the photos to be skipped, got %v", skipped)
+	}
+	expected := map[string]int{"broken": 2, "day1": 2, "day2": 1}
+	if len(jobs) != len(expected) {
+		t.Fatalf("Expected a job per recording, got %+v", jobs)
+	}
+	for _, job := range jobs {
+		name := filepath.Base(job.Dir)
+		if len(job.Inputs) != expected[name] {
+			t.Errorf("%s: expected %d inputs, got %v", name, expected[name], job.Inputs)
+		}
+		if job.Output != filepath.Join(outputDir, name+".mp4") {
+			t.Errorf("%s: expected the output to be named after the subfolder, got %s", name, job.Output)
+		}
+	}
+
+	if _, _, err := planSubfolders(outputDir, filepath.Join(root, "photos"), Options{}); !errors.Is(err, errNoInputFiles) {
+		t.Errorf("Expected a tree without recordings to fail, got %v", err)
+	}
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	merged := make(map[string][]string)
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		output := cmd.Args[len(cmd.Args)-1]
+		list, err := os.ReadFile(cmd.Args[indexOf(cmd.Args, "concat")+4])
+		if err != nil {
+			return err
+		}
+		merged[output] = strings.Split(strings.TrimSpace(string(list)), "\n")
+		// One recording fails, which does not stop the others
+		if strings.Contains(output, "broken") {
+			return errors.New("exit status 1")
+		}
+		return os.WriteFile(output, []byte("merged"), 0644)
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// With -keep-going run leaves an existing output to fail on its own
+	day2 := filepath.Join(outputDir, "day2.mp4")
+	if err := os.WriteFile(day2, []byte("earlier merge"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	results := mergeSubfolders(jobs, time.Time{}, Options{})
+	for _, result := range results {
+		name := filepath.Base(result.Dir)
+		_, statErr := os.Stat(result.Output)
+		if name == "broken" {
+			if result.Err == nil || statErr == nil {
+				t.Errorf("Expected the broken recording to fail without an output, got %v", result.Err)
+			}
+			continue
+		}
+		if name == "day2" {
+			if result.Err == nil || !strings.Contains(result.Err.Error(), "already exists") || merged[partialPath(day2)] != nil {
+				t.Errorf("Expected the existing day2 output to fail without merging, got %v", result.Err)
+			}
+			continue
+		}
+		if result.Err != nil || statErr != nil {
+			t.Errorf("%s: expected a merged output, got %v, %v", name, result.Err, statErr)
+		}
+	}
+	if list := merged[partialPath(filepath.Join(outputDir, "day1.mp4"))]; len(list) != 2 || !strings.Contains(list[0], "GH010042.MP4") || !strings.Contains(list[1], "GH020042.MP4") {
+		t.Errorf("Expected day1 to merge its two chapters in order, got %v", list)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if failed := printRecordingResults(&stdout, &stderr, results); failed != 2 {
+		t.Errorf("Expected 2 failures, got %d", failed)
+	}
+	if !strings.Contains(stderr.String(), "Error merging "+filepath.Join(root, "broken")) {
+		t.Errorf("Expected the error of the broken recording, got: %s", stderr.String())
+	}
+}
+
+func TestRunSubfoldersUsage(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "trip")
+	writeRecordingTree(t, root, map[string][]string{"day1": {"GH010042.MP4"}})
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-subfolders", "-checksum", "sha256", filepath.Join(dir, "merged"), root}, &stdout, &stderr); code != exitUsage {
+		t.Errorf("Expected -checksum to be refused, got %d: %s", code, stderr.String())
+	}
+	if code := run([]string{"-subfolders", filepath.Join(dir, "merged"), root, "extra"}, &stdout, &stderr); code != exitUsage {
+		t.Errorf("Expected a single input directory, got %d", code)
+	}
+	stderr.Reset()
+	if code := run([]string{"-keep-going", filepath.Join(dir, "merged.mp4"), root}, &stdout, &stderr); code != exitUsage || !strings.Contains(stderr.String(), "-keep-going") {
+		t.Errorf("Expected -keep-going without several outputs to be refused, got %d: %s", code, stderr.String())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Values of -truncated-tail, what to do with a final chapter whose end is
+// damaged.
+const (
+	tailTrim = "trim"
+	tailSkip = "skip"
+)
+
+// tailWindow is how much of the end of the final chapter is decoded to
+// look for damage, and what trimming drops when it finds some.
+const tailWindow = 10 * time.Second
+
+// tailStreamTolerance is how far apart the video and the audio of a
+// chapter may end before its tail counts as truncated. A finished chapter
+// ends them within a frame or two.
+const tailStreamTolerance = time.Second
+
+func validateTruncatedTail(mode string) error {
+	switch mode {
+	case "", tailTrim, tailSkip:
+		return nil
+	}
+	return fmt.Errorf("invalid -truncated-tail %q: must be trim or skip", mode)
+}
+
+// truncatedTail is a chapter of which only the first Valid of Duration is
+// intact.
+type truncatedTail struct {
+	Path     string
+	Duration time.Duration
+	Valid    time.Duration
+	Problem  string
+}
+
+// tailArgs builds the ffmpeg arguments decoding the video of the last
+// tailWindow of path, which prints only errors. They do not start with
+// ffmpegArgs, which would let the warnings through.
+func tailArgs(path string) []string {
+	return []string{"-hide_banner", "-nostats", "-loglevel", "error",
+		"-sseof", fmt.Sprintf("-%g", tailWindow.Seconds()),
+		"-i", path,
+		"-map", "0:v:0",
+		"-f", "null", "-",
+	}
+}
+
+// checkTail looks for the damage a camera losing power leaves at the end
+// of a chapter that was still finalized: video and audio that end apart,
+// or errors decoding its last tailWindow. It returns nil for an intact
+// chapter.
+func checkTail(path string, opts Options) (*truncatedTail, error) {
+	probe, err := opts.probe(path)
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Duration(probe.Duration * float64(time.Second))
+
+	video, hasVideo := probe.firstStream("video")
+	audio, hasAudio := probe.firstStream("audio")
+	videoEnd, videoOK := video.durationSeconds()
+	audioEnd, audioOK := audio.durationSeconds()
+	if hasVideo && hasAudio && videoOK && audioOK {
+		shorter := time.Duration(min(videoEnd, audioEnd) * float64(time.Second))
+		if apart := time.Duration((videoEnd - audioEnd) * float64(time.Second)).Abs(); apart > tailStreamTolerance {
+			return &truncatedTail{
+				Path:     path,
+				Duration: duration,
+				Valid:    shorter,
+				Problem:  fmt.Sprintf("its video and audio end %s apart", apart.Round(time.Millisecond)),
+			}, nil
+		}
+	}
+
+	if isRemote(path) {
+		return nil, nil
+	}
+	var stderr bytes.Buffer
+	cmd := ffmpegCommand(tailArgs(path)...)
+	cmd.Stderr = &stderr
+	err = runCommand(opts.logger(), cmd)
+	if err == nil && strings.TrimSpace(stderr.String()) == "" {
+		return nil, nil
+	}
+	problem, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+	if problem == "" {
+		problem = err.Error()
+	}
+	return &truncatedTail{
+		Path:     path,
+		Duration: duration,
+		Valid:    max(duration-tailWindow, 0),
+		Problem:  fmt.Sprintf("its last %s fails to decode: %s", tailWindow, problem),
+	}, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckTail(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH010042.MP4", "GH020042.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	last := inputPaths[1]
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	// The battery died in the last chapter: its video stops 3s before the audio
+	truncated := hero
+	truncated.Streams = append([]StreamInfo(nil), hero.Streams...)
+	truncated.Streams[0].Duration = "100.000000"
+	truncated.Streams[1].Duration = "103.000000"
+	truncated.Duration = 103
+	probeFile = func(path string) (ProbeResult, error) {
+		if path == last {
+			return truncated, nil
+		}
+		return hero, nil
+	}
+	decodeErrors := ""
+	var decode, merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		if cmd.Args[len(cmd.Args)-1] == "-" {
+			decode = cmd.Args
+			_, err := io.WriteString(cmd.Stderr, decodeErrors)
+			return err
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	tail, err := checkTail(last, Options{})
+	if err != nil {
+		t.Fatalf("checkTail() error: %v", err)
+	}
+	if tail == nil || tail.Valid != 100*time.Second || !strings.Contains(tail.Problem, "video and audio end 3s apart") {
+		t.Fatalf("Expected the truncated chapter to be valid up to its video end, got %+v", tail)
+	}
+
+	// Trimming ends the merge where the damage starts
+	opts := Options{End: -(tail.Duration - tail.Valid)}
+	if err := mergeFiles(filepath.Join(dir, "merged.mp4"), inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if args := strings.Join(merge, " "); !strings.Contains(args, "-t 630.530000") {
+		t.Errorf("Expected the merge to end 3s before the inputs do, got: %s", args)
+	}
+
+	// Errors decoding the end of an intact looking chapter
+	probeFile = func(path string) (ProbeResult, error) {
+		return hero, nil
+	}
+	decodeErrors = "[h264 @ 0x7f8] error while decoding MB 12 40, bytestream -5\n[h264 @ 0x7f8] concealing 1200 DC errors\n"
+	tail, err = checkTail(last, Options{})
+	if err != nil {
+		t.Fatalf("checkTail() error: %v", err)
+	}
+	if tail == nil || tail.Valid != tail.Duration-tailWindow || !strings.Contains(tail.Problem, "error while decoding MB 12 40") {
+		t.Errorf("Expected the decoding errors to mark the last %s as damaged, got %+v", tailWindow, tail)
+	}
+	// Every line printed counts as damage, so ffmpeg keeps its warnings
+	if args := strings.Join(decode, " "); !strings.Contains(args, "-loglevel error ") {
+		t.Errorf("Expected the tail to be decoded at the error level, got: %s", args)
+	}
+
+	decodeErrors = ""
+	if tail, err := checkTail(last, Options{}); err != nil || tail != nil {
+		t.Errorf("Expected an intact chapter to pass, got %+v, %v", tail, err)
+	}
+}
+
+func TestRunTruncatedTailInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-truncated-tail", "repair", "out.mp4", "GH011234.MP4"},
+		{"-truncated-tail", "skip", "-split-chapters", "out", "GH011234.MP4"},
+		{"-truncated-tail", "trim", "-outro", "outro.mp4", "out.mp4", "GH011234.MP4"},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := run(args, &stdout, &stderr); code != exitUsage || !strings.Contains(stderr.String(), "-truncated-tail") {
+			t.Errorf("Expected %v to be refused, got %d: %s", args, code, stderr.String())
+		}
+	}
+}
+
+func TestRunTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	// Finalized chapters pass the checks of -skip-bad
+	chapter := bytes.Join([][]byte{
+		mp4BoxBytes("ftyp", []byte("isom\x00\x00\x02\x00isom")),
+		mp4BoxBytes("mdat", make([]byte, 1024)),
+		mp4BoxBytes("moov", mp4BoxBytes("mvhd", make([]byte, 100))),
+	}, nil)
+	for _, name := range []string{"GH010042.MP4", "GH020042.MP4", "GH030042.MP4"} {
+		if err := os.WriteFile(filepath.Join(dir, name), chapter, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	hero := loadProbeFixture(t, "hero_probe.json")
+	// The video of the final chapter stops 3s before its audio
+	truncated := hero
+	truncated.Streams = append([]StreamInfo(nil), hero.Streams...)
+	truncated.Streams[0].Duration = "100.000000"
+	truncated.Streams[1].Duration = "103.000000"
+	truncated.Duration = 103
+	var output ProbeResult
+	probeFile = func(path string) (ProbeResult, error) {
+		if strings.HasSuffix(path, partialSuffix) {
+			return output, nil
+		}
+		if filepath.Base(path) == "GH030042.MP4" {
+			return truncated, nil
+		}
+		return hero, nil
+	}
+	var merge []string
+	var list string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" || cmd.Args[len(cmd.Args)-1] == "-" {
+			return nil
+		}
+		if i := indexOf(cmd.Args, "concat"); i >= 0 {
+			data, err := os.ReadFile(cmd.Args[i+4])
+			if err != nil {
+				return err
+			}
+			merge, list = cmd.Args, string(data)
+		}
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	// The inputs are a directory and relative paths, the final chapter an
+	// absolute path
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	output = hero
+	output.Duration = 2 * hero.Duration
+	for _, inputs := range [][]string{{dir}, {"GH030042.MP4", "GH020042.MP4", "GH010042.MP4"}} {
+		merge, list = nil, ""
+		outputPath := filepath.Join(t.TempDir(), "skipped.mp4")
+		var stdout, stderr bytes.Buffer
+		if code := run(append([]string{"-truncated-tail", "skip", outputPath}, inputs...), &stdout, &stderr); code != exitOK {
+			t.Fatalf("Expected -truncated-tail skip of %q to succeed, got %d: %s", inputs, code, stderr.String())
+		}
+		if !strings.Contains(stderr.String(), "leaving out the final chapter "+filepath.Join(dir, "GH030042.MP4")) {
+			t.Errorf("Expected a warning about the skipped chapter, got: %s", stderr.String())
+		}
+		if !strings.Contains(list, "GH010042.MP4") || !strings.Contains(list, "GH020042.MP4") || strings.Contains(list, "GH030042.MP4") {
+			t.Errorf("Expected the chapters of %q but the final one to be merged, got:\n%s", inputs, list)
+		}
+	}
+
+	merge, list = nil, ""
+	output.Duration = 2*hero.Duration + 100
+	outputPath := filepath.Join(t.TempDir(), "trimmed.mp4")
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-truncated-tail", "trim", outputPath, dir}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Expected -truncated-tail trim to succeed, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "trimming the last 3s of the final chapter") {
+		t.Errorf("Expected a warning about the trimmed chapter, got: %s", stderr.String())
+	}
+	if !strings.Contains(list, "GH030042.MP4") {
+		t.Errorf("Expected the final chapter to be merged, got:\n%s", list)
+	}
+	// The merge ends where the video of the final chapter does
+	expected := fmt.Sprintf("-t %f", 2*hero.Duration+100)
+	if args := strings.Join(merge, " "); !strings.Contains(args, expected) {
+		t.Errorf("Expected %s in the merge command, got: %s", expected, args)
+	}
+}
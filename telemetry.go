@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// countPackets is a variable so tests can mock ffprobe's packet counting.
+var countPackets = ffprobeCountPackets
+
+// ffprobeCountPackets counts the packets of one stream by reading the
+// whole file, which is fast for data streams since nothing is decoded.
+func ffprobeCountPackets(path string, streamIndex int) (int, error) {
+	cmd := exec.Command(
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", strconv.Itoa(streamIndex),
+		"-count_packets",
+		"-show_entries", "stream=nb_read_packets",
+		"-of", "csv=p=0",
+		path)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed for %s: %v", path, err)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid packet count %q for %s: %v", strings.TrimSpace(string(out)), path, err)
+	}
+	return count, nil
+}
+
+// telemetryStreamIndex returns the index of the first GPMF stream.
+func (r ProbeResult) telemetryStreamIndex() (int, bool) {
+	for _, stream := range r.Streams {
+		if stream.isTelemetry() {
+			return stream.Index, true
+		}
+	}
+	return 0, false
+}
+
+// telemetryPackets counts the GPMF packets of path, 0 when it has none.
+func telemetryPackets(path string) (int, error) {
+	probe, err := probeFile(path)
+	if err != nil {
+		return 0, err
+	}
+	index, ok := probe.telemetryStreamIndex()
+	if !ok {
+		return 0, nil
+	}
+	return countPackets(path, index)
+}
+
+// verifyTelemetry checks that the GPMF stream of outputPath holds as many
+// packets as those of inputPaths together, give or take tolerance.
+func verifyTelemetry(outputPath string, inputPaths []string, tolerance int) error {
+	expected := 0
+	for _, inputPath := range inputPaths {
+		count, err := telemetryPackets(inputPath)
+		if err != nil {
+			return err
+		}
+		expected += count
+	}
+
+	actual, err := telemetryPackets(outputPath)
+	if err != nil {
+		return err
+	}
+
+	diff := actual - expected
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > tolerance {
+		return fmt.Errorf("telemetry verification failed for %s: expected %d gpmd packets, found %d", outputPath, expected, actual)
+	}
+	return nil
+}
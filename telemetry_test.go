@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyTelemetry(t *testing.T) {
+	origProbeFile := probeFile
+	origCountPackets := countPackets
+	defer func() {
+		probeFile = origProbeFile
+		countPackets = origCountPackets
+	}()
+
+	// Every file has its gpmd stream at index 3, except the one without telemetry
+	probeFile = func(path string) (ProbeResult, error) {
+		if path == "GH031234.MP4" {
+			return ProbeResult{Streams: []StreamInfo{{Index: 0, CodecType: "video"}}}, nil
+		}
+		return ProbeResult{Streams: []StreamInfo{
+			{Index: 0, CodecType: "video"},
+			{Index: 3, CodecType: "data", CodecTagString: "gpmd"},
+		}}, nil
+	}
+	counts := map[string]int{
+		"GH011234.MP4": 530,
+		"GH021234.MP4": 531,
+		"merged.mp4":   1061,
+	}
+	countPackets = func(path string, streamIndex int) (int, error) {
+		if streamIndex != 3 {
+			t.Errorf("Expected packets of stream 3 to be counted, got %d", streamIndex)
+		}
+		return counts[path], nil
+	}
+
+	inputPaths := []string{"GH011234.MP4", "GH021234.MP4", "GH031234.MP4"}
+	if err := verifyTelemetry("merged.mp4", inputPaths, 0); err != nil {
+		t.Errorf("verifyTelemetry() error: %v", err)
+	}
+
+	// Two packets dropped at a join
+	counts["merged.mp4"] = 1059
+	err := verifyTelemetry("merged.mp4", inputPaths, 1)
+	if err == nil || !strings.Contains(err.Error(), "expected 1061 gpmd packets, found 1059") {
+		t.Errorf("Expected packet count mismatch, got: %v", err)
+	}
+	if err := verifyTelemetry("merged.mp4", inputPaths, 2); err != nil {
+		t.Errorf("Expected mismatch within tolerance to pass, got: %v", err)
+	}
+}
+
+func TestMergeFilesNoTelemetry(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	// The output as ffmpeg should write it: video, audio and timecode
+	outputStreams := []StreamInfo{hero.Streams[0], hero.Streams[1], hero.Streams[2]}
+	probeFile = func(path string) (ProbeResult, error) {
+		if path == partialPath(outputPath) {
+			return ProbeResult{Streams: outputStreams}, nil
+		}
+		return hero, nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	opts := Options{NoTelemetry: true}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	command := strings.Join(merge, " ")
+	if !strings.Contains(command, "-map 0:0 -map 0:1 -copy_unknown") || strings.Contains(command, "-tag:") {
+		t.Errorf("Expected only video and audio to be mapped, got: %s", command)
+	}
+	if !strings.Contains(command, "-write_tmcd 1") {
+		t.Errorf("Expected the timecode to be kept, got: %s", command)
+	}
+
+	// A telemetry stream that slipped through fails the merge
+	outputStreams = hero.Streams[:4]
+	err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts)
+	if err == nil || !strings.Contains(err.Error(), "data stream gpmd despite -no-telemetry") {
+		t.Errorf("Expected the remaining telemetry to be reported, got: %v", err)
+	}
+
+	// A single input goes through ffmpeg too instead of being copied with its telemetry
+	outputStreams = []StreamInfo{hero.Streams[0], hero.Streams[1], hero.Streams[2]}
+	merge = nil
+	if err := mergeFiles(outputPath, inputPaths[:1], time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if command := strings.Join(merge, " "); !strings.Contains(command, "-map 0:0 -map 0:1 -copy_unknown") {
+		t.Errorf("Expected the single input to be remuxed without its telemetry, got: %s", command)
+	}
+	if data, err := os.ReadFile(outputPath); err != nil || string(data) != "output" {
+		t.Errorf("Expected the remuxed output, not a copy of the input, got %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// thumbnailArgs builds the ffmpeg arguments extracting the frame of
+// outputPath at position as a JPEG to thumbnailPath, with ffmpeg log level
+// logLevel.
+func thumbnailArgs(outputPath string, at time.Duration, thumbnailPath, logLevel string) []string {
+	return append(ffmpegArgs(logLevel),
+		"-ss", fmt.Sprintf("%.3f", at.Seconds()), // Seeking before -i jumps to the keyframe before the position
+		"-i", outputPath,
+		"-frames:v", "1",
+		"-q:v", "2",
+		thumbnailPath,
+	)
+}
+
+// writeThumbnail extracts a poster frame of the merged outputPath to
+// opts.Thumbnail.
+func writeThumbnail(outputPath string, opts Options) error {
+	if opts.Thumbnail == "" {
+		return nil
+	}
+	opts.logger().Info("writing thumbnail", "thumbnail", opts.Thumbnail, "at", opts.ThumbnailAt)
+	return extractFrame(outputPath, opts.ThumbnailAt, opts.Thumbnail, opts)
+}
+
+// extractFrame writes the frame of outputPath at position as the JPEG
+// jpegPath. A position past the end of the output falls back to the middle
+// of it.
+func extractFrame(outputPath string, at time.Duration, jpegPath string, opts Options) error {
+	logger := opts.logger()
+	probe, err := probeFile(outputPath)
+	if err != nil {
+		return err
+	}
+	duration := time.Duration(probe.Duration * float64(time.Second))
+	if duration > 0 && at >= duration {
+		logger.Warn("thumbnail position is past the end of the output, using its middle instead", "at", at, "duration", duration)
+		at = duration / 2
+	}
+
+	// The caller decided to write jpegPath, ffmpeg without -y would refuse
+	if err := os.Remove(jpegPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace thumbnail %s: %v", jpegPath, err)
+	}
+	cmd := ffmpegCommand(thumbnailArgs(outputPath, at, jpegPath, opts.FFmpegLogLevel)...)
+	if err := runCommand(logger, cmd); err != nil {
+		return fmt.Errorf("failed to write thumbnail %s: %v", jpegPath, err)
+	}
+	// ffmpeg succeeds without writing a frame when the seek finds none
+	info, err := os.Stat(jpegPath)
+	if err != nil || info.Size() == 0 {
+		return fmt.Errorf("ffmpeg wrote no thumbnail frame to %s", jpegPath)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeFilesThumbnail(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+	thumbnailPath := filepath.Join(dir, "poster.jpg")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		if path == partialPath(outputPath) {
+			output := hero
+			output.Duration = 20
+			return output, nil
+		}
+		return hero, nil
+	}
+	var thumbnail []string
+	frame := true
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		target := cmd.Args[len(cmd.Args)-1]
+		if target != thumbnailPath {
+			return os.WriteFile(target, []byte("output"), 0644)
+		}
+		thumbnail = cmd.Args
+		if !frame {
+			// ffmpeg creates no file when the seek finds no frame
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 9)), nil); err != nil {
+			return err
+		}
+		return os.WriteFile(target, buf.Bytes(), 0644)
+	}
+
+	opts := Options{Thumbnail: thumbnailPath, ThumbnailAt: time.Second}
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	command := strings.Join(thumbnail, " ")
+	if !strings.Contains(command, "-ss 1.000 -i "+partialPath(outputPath)+" -frames:v 1") {
+		t.Errorf("Expected a frame at 1s of the output to be extracted, got: %s", command)
+	}
+	data, err := os.ReadFile(thumbnailPath)
+	if err != nil || len(data) == 0 {
+		t.Fatalf("Expected a nonzero thumbnail, got %d bytes: %v", len(data), err)
+	}
+	if config, err := jpeg.DecodeConfig(bytes.NewReader(data)); err != nil || config.Width != 16 {
+		t.Errorf("Expected a 16 pixel wide JPEG thumbnail, got %+v: %v", config, err)
+	}
+
+	// A position past the end falls back to the middle of the output
+	opts.ThumbnailAt = time.Minute
+	if err := mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	if command := strings.Join(thumbnail, " "); !strings.Contains(command, "-ss 10.000 ") {
+		t.Errorf("Expected the thumbnail at the middle of the output, got: %s", command)
+	}
+
+	frame = false
+	os.Remove(thumbnailPath)
+	err = mergeFiles(outputPath, inputPaths, time.Now(), time.Now(), opts)
+	if err == nil || !strings.Contains(err.Error(), "wrote no thumbnail frame") {
+		t.Errorf("Expected the missing thumbnail to be reported, got: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timelapseFramePattern matches the photos of a GoPro time lapse: G, a
+// three digit sequence number and a four digit frame number.
+var timelapseFramePattern = regexp.MustCompile(`^G(\d{3})(\d{4})\.JPG$`)
+
+// defaultTimelapseRate shows a second of video for every 30 photos.
+const defaultTimelapseRate = "30"
+
+// isTimelapseFrame reports whether path is named like a time lapse photo.
+func isTimelapseFrame(path string) bool {
+	return timelapseFramePattern.MatchString(strings.ToUpper(filepath.Base(path)))
+}
+
+// imageSequence is a time lapse, the photos of one sequence number in one
+// directory, rendered into a video before merging.
+type imageSequence struct {
+	Dir    string
+	Number int
+	// First is the frame number of Frames[0]. The frames are numbered
+	// without gaps, since the image2 demuxer stops at the first one.
+	First  int
+	Frames []string
+}
+
+// pattern returns the image2 pattern naming the frames, which keeps the
+// case of their names.
+func (s imageSequence) pattern() string {
+	name := filepath.Base(s.Frames[0])
+	return filepath.Join(s.Dir, name[:4]+"%04d"+name[8:])
+}
+
+// duration returns how long the sequence lasts shown at rate photos per
+// second.
+func (s imageSequence) duration(rate float64) time.Duration {
+	return time.Duration(float64(len(s.Frames)) / rate * float64(time.Second))
+}
+
+// findImageSequences splits inputPaths into videos and the time lapses
+// among them, in the order their first photo appears. A time lapse with
+// missing frames is an error, since it would be cut short at the gap.
+func findImageSequences(inputPaths []string) ([]string, []imageSequence, error) {
+	type key struct {
+		dir    string
+		number int
+	}
+	var videos []string
+	var keys []key
+	frames := make(map[key]map[int]string)
+	for _, path := range inputPaths {
+		if isRemote(path) || !isTimelapseFrame(path) {
+			videos = append(videos, path)
+			continue
+		}
+		matches := timelapseFramePattern.FindStringSubmatch(strings.ToUpper(filepath.Base(path)))
+		number, _ := strconv.Atoi(matches[1])
+		frame, _ := strconv.Atoi(matches[2])
+		k := key{filepath.Dir(path), number}
+		if frames[k] == nil {
+			frames[k] = make(map[int]string)
+			keys = append(keys, k)
+		}
+		frames[k][frame] = path
+	}
+
+	var sequences []imageSequence
+	for _, k := range keys {
+		numbers := make([]int, 0, len(frames[k]))
+		for frame := range frames[k] {
+			numbers = append(numbers, frame)
+		}
+		sort.Ints(numbers)
+		sequence := imageSequence{Dir: k.dir, Number: k.number, First: numbers[0]}
+		for i, frame := range numbers {
+			if i > 0 && frame != numbers[i-1]+1 {
+				return nil, nil, fmt.Errorf("time lapse G%03d in %s is missing frames %04d to %04d", k.number, k.dir, numbers[i-1]+1, frame-1)
+			}
+			sequence.Frames = append(sequence.Frames, frames[k][frame])
+		}
+		sequences = append(sequences, sequence)
+	}
+	return videos, sequences, nil
+}
+
+// timelapseInput returns the ffmpeg input arguments reading sequence at
+// rate photos per second with the image2 demuxer. The duration keeps it
+// from reading frames that follow on disk but were not given.
+func timelapseInput(sequence imageSequence, rate string) ([]string, error) {
+	perSecond, err := parseFrameRate(rate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -timelapse-fps: %v", err)
+	}
+	return []string{
+		"-f", "image2",
+		"-framerate", rate,
+		"-start_number", strconv.Itoa(sequence.First),
+		"-t", strconv.FormatFloat(sequence.duration(perSecond).Seconds(), 'f', 6, 64),
+		"-i", sequence.pattern(),
+	}, nil
+}
+
+// timelapsePrefix returns the naming scheme prefix of videos written by
+// encoder.
+func timelapsePrefix(encoder string) string {
+	if encoderCodec(encoder) == codecHEVC {
+		return "GX"
+	}
+	return "GH"
+}
+
+// timelapseTarget returns the settings a time lapse is rendered with: the
+// format of chapter when there are chapters to merge it with, so they can
+// be concatenated with stream copy, otherwise the encoder of opts at the
+// size of the photos and rate. first is a photo of the time lapse.
+func timelapseTarget(first string, chapter *ProbeResult, rate string, opts Options) (encodeSettings, Options, error) {
+	if chapter != nil {
+		return chapterTarget(*chapter, opts)
+	}
+	probe, err := probeFile(first)
+	if err != nil {
+		return encodeSettings{}, opts, err
+	}
+	photo, ok := probe.firstStream("video")
+	if !ok {
+		return encodeSettings{}, opts, fmt.Errorf("no image found in %s", first)
+	}
+	target := opts.encoder()
+	// Players expect 4:2:0 and even dimensions, photos are usually 4:2:2
+	target.Width, target.Height = photo.Width&^1, photo.Height&^1
+	target.FrameRate, target.PixFmt = rate, "yuv420p"
+	return target, opts, nil
+}
+
+// renderTimelapses renders every sequence into a video in dir at rate
+// photos per second, named like a chapter of sequence number so it is
+// merged in order, and stamped with the times of its first photo. chapter
+// describes the videos it is merged with, nil when there are none.
+func renderTimelapses(dir string, sequences []imageSequence, chapter *ProbeResult, rate string, opts Options) ([]string, error) {
+	logger := opts.logger()
+	var videos []string
+	rendered := make(map[int]imageSequence)
+	for _, sequence := range sequences {
+		if other, ok := rendered[sequence.Number]; ok {
+			return nil, fmt.Errorf("time lapses %s and %s have the same number, merge them separately", other.pattern(), sequence.pattern())
+		}
+		rendered[sequence.Number] = sequence
+		target, renderOpts, err := timelapseTarget(sequence.Frames[0], chapter, rate, opts)
+		if err != nil {
+			return nil, fmt.Errorf("cannot render time lapse G%03d: %v", sequence.Number, err)
+		}
+		input, err := timelapseInput(sequence, rate)
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dir, formatFileName(timelapsePrefix(target.VideoCodec), 1, sequence.Number))
+
+		logger.Info("rendering time lapse", "photos", len(sequence.Frames), "pattern", sequence.pattern(), "rate", rate, "video", path, "settings", target.String())
+		cmd := ffmpegCommand(conformArgs(input, false, target, renderOpts, path)...)
+		if err := runCommand(logger, cmd); err != nil {
+			return nil, fmt.Errorf("failed to render time lapse G%03d: %v", sequence.Number, err)
+		}
+
+		birthTime, modTime, err := fileTimes(sequence.Frames[0])
+		if err != nil {
+			return nil, err
+		}
+		if birthTime.IsZero() {
+			birthTime = modTime
+		}
+		renderOpts.StrictTimes = false
+		if err := setOutputTimes(path, birthTime, modTime, renderOpts); err != nil {
+			return nil, err
+		}
+		videos = append(videos, path)
+	}
+	return videos, nil
+}
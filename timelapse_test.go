@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindImageSequences(t *testing.T) {
+	inputPaths := []string{
+		"/card/DCIM/100GOPRO/G0020002.JPG",
+		"/card/DCIM/100GOPRO/GH010042.MP4",
+		"/card/DCIM/100GOPRO/G0020001.JPG",
+		"/card/DCIM/101GOPRO/g0010007.jpg",
+		"/card/DCIM/100GOPRO/G0020003.JPG",
+		"/card/DCIM/101GOPRO/g0010008.jpg",
+		"/card/DCIM/100GOPRO/GOPR0042.JPG",
+	}
+	videos, sequences, err := findImageSequences(inputPaths)
+	if err != nil {
+		t.Fatalf("findImageSequences() error: %v", err)
+	}
+	// Single photos are not time lapses and are reported when they are read
+	if !reflect.DeepEqual(videos, []string{"/card/DCIM/100GOPRO/GH010042.MP4", "/card/DCIM/100GOPRO/GOPR0042.JPG"}) {
+		t.Errorf("Unexpected videos %v", videos)
+	}
+	if len(sequences) != 2 {
+		t.Fatalf("Expected 2 time lapses, got %+v", sequences)
+	}
+	first := sequences[0]
+	if first.Number != 2 || first.First != 1 || len(first.Frames) != 3 || first.Frames[0] != "/card/DCIM/100GOPRO/G0020001.JPG" {
+		t.Errorf("Unexpected first time lapse %+v", first)
+	}
+	if got := sequences[1].pattern(); got != "/card/DCIM/101GOPRO/g001%04d.jpg" {
+		t.Errorf("Expected the pattern to keep the case of the names, got %s", got)
+	}
+
+	_, _, err = findImageSequences([]string{"G0010001.JPG", "G0010002.JPG", "G0010005.JPG"})
+	if err == nil || !strings.Contains(err.Error(), "missing frames 0003 to 0004") {
+		t.Errorf("Expected the missing frames to be reported, got %v", err)
+	}
+}
+
+func TestTimelapseInput(t *testing.T) {
+	sequence := imageSequence{Dir: "/photos", Number: 1, First: 7, Frames: []string{"/photos/G0010007.JPG", "/photos/G0010008.JPG", "/photos/G0010009.JPG"}}
+	args, err := timelapseInput(sequence, "30")
+	if err != nil {
+		t.Fatalf("timelapseInput() error: %v", err)
+	}
+	expected := "-f image2 -framerate 30 -start_number 7 -t 0.100000 -i /photos/G001%04d.JPG"
+	if got := strings.Join(args, " "); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	if _, err := timelapseInput(sequence, "fast"); err == nil {
+		t.Error("Expected an invalid rate to be refused")
+	}
+}
+
+func TestRenderTimelapsesMatchesChapters(t *testing.T) {
+	dir := t.TempDir()
+	sequence := imageSequence{Dir: dir, Number: 3, First: 1}
+	for _, name := range []string{"G0030001.JPG", "G0030002.JPG"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("photo"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sequence.Frames = append(sequence.Frames, path)
+	}
+
+	chapter := loadProbeFixture(t, "hero_probe.json")
+	origRunCommand := runCommand
+	defer func() { runCommand = origRunCommand }()
+	var render []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		render = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("video"), 0644)
+	}
+
+	videos, err := renderTimelapses(t.TempDir(), []imageSequence{sequence}, &chapter, "15", Options{})
+	if err != nil {
+		t.Fatalf("renderTimelapses() error: %v", err)
+	}
+	// The video is named like a chapter of the codec of the chapters
+	if len(videos) != 1 || filepath.Base(videos[0]) != "GH010003.MP4" {
+		t.Errorf("Unexpected videos %v", videos)
+	}
+	command := strings.Join(render, " ")
+	for _, arg := range []string{"-framerate 15", "-i " + filepath.Join(dir, "G003%04d.JPG"), "anullsrc", "-c:v libx264"} {
+		if !strings.Contains(command, arg) {
+			t.Errorf("Expected %q in the render command, got: %s", arg, command)
+		}
+	}
+	_, modTime, err := fileTimes(sequence.Frames[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(videos[0]); err != nil || !info.ModTime().Equal(modTime) {
+		t.Errorf("Expected the video to have the time of the first photo %v, got %v (%v)", modTime, info, err)
+	}
+}
+
+func TestRenderTimelapse(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command("ffmpeg", "-y", "-f", "lavfi", "-i", "testsrc=size=640x480:rate=1", "-frames:v", "10", "-start_number", "1", filepath.Join(dir, "G001%04d.JPG"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to create photos: %v: %s", err, out)
+	}
+	var inputPaths []string
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		inputPaths = append(inputPaths, filepath.Join(dir, entry.Name()))
+	}
+
+	_, sequences, err := findImageSequences(inputPaths)
+	if err != nil || len(sequences) != 1 {
+		t.Fatalf("Expected one time lapse, got %+v (%v)", sequences, err)
+	}
+	videos, err := renderTimelapses(t.TempDir(), sequences, nil, "5", Options{})
+	if err != nil {
+		t.Fatalf("renderTimelapses() error: %v", err)
+	}
+	probe, err := probeFile(videos[0])
+	if err != nil {
+		t.Fatalf("Failed to probe the video: %v", err)
+	}
+	video, ok := probe.firstStream("video")
+	if !ok || video.Width != 640 || video.Height != 480 || video.PixFmt != "yuv420p" {
+		t.Errorf("Unexpected video stream %+v", video)
+	}
+	// Ten photos at five per second
+	if math.Abs(probe.Duration-2) > 0.1 {
+		t.Errorf("Expected a video of 2s, got %.3fs (%v)", probe.Duration, time.Duration(probe.Duration*float64(time.Second)))
+	}
+}
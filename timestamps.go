@@ -0,0 +1,48 @@
+package main
+
+import "strings"
+
+// timestampOutputArgs are the output options of -fix-timestamps. Shifting
+// the output to start at zero removes negative timestamps, at the cost of
+// the small audio priming offset some players use to align the first
+// audio frame.
+func timestampOutputArgs(opts Options) []string {
+	if !opts.FixTimestamps {
+		return nil
+	}
+	return []string{"-avoid_negative_ts", "make_zero"}
+}
+
+// timestampProblemPatterns are the ffmpeg warnings -fix-timestamps helps
+// with.
+var timestampProblemPatterns = []string{
+	"non-monotonous dts",
+	"non monotonically increasing dts",
+	"negative timestamp",
+	"negative cts",
+	"invalid dts",
+	"timestamps are unset",
+}
+
+// isTimestampProblem reports whether a line of ffmpeg output complains
+// about the timestamps of the inputs.
+func isTimestampProblem(line string) bool {
+	line = strings.ToLower(line)
+	for _, pattern := range timestampProblemPatterns {
+		if strings.Contains(line, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// suggestFixTimestamps reports whether the ffmpeg warnings of a merge
+// point at broken timestamps in the inputs.
+func suggestFixTimestamps(warnings []string) bool {
+	for _, warning := range warnings {
+		if isTimestampProblem(warning) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFixTimestampsArgs(t *testing.T) {
+	spec := mergeSpec{ListPath: "list.txt", OutputPath: "merged.mp4"}
+
+	args := mergeArgs(spec, Options{FixTimestamps: true})
+	command := strings.Join(args, " ")
+	if !strings.Contains(command, "-fflags +genpts -f concat -safe 0 -i list.txt") {
+		t.Errorf("Expected +genpts as an input option, got: %s", command)
+	}
+	if !strings.Contains(command, "-avoid_negative_ts make_zero -y") {
+		t.Errorf("Expected -avoid_negative_ts as an output option, got: %s", command)
+	}
+
+	args = reencodeArgs(spec, []string{"a.mp4", "b.mp4"}, encodeSettings{}, 3, Options{FixTimestamps: true})
+	if command := strings.Join(args, " "); strings.Count(command, "-fflags +genpts -") != 3 {
+		t.Errorf("Expected +genpts for every input, got: %s", command)
+	}
+
+	if command := strings.Join(mergeArgs(spec, Options{}), " "); strings.Contains(command, "genpts") || strings.Contains(command, "avoid_negative_ts") {
+		t.Errorf("Expected no timestamp options by default, got: %s", command)
+	}
+}
+
+func TestSuggestFixTimestamps(t *testing.T) {
+	warnings := parseFFmpegWarnings(`[mp4 @ 0x7f9] Non-monotonous DTS in output stream 0:1; previous: 2701312, current: 2700288; changing to 2701313. This may result in incorrect timestamps in the output file.
+[mov @ 0x7fa] Invalid DTS: 1024 PTS: 512 in output stream 0:0, replacing by guess
+`)
+	if len(warnings) != 2 || !suggestFixTimestamps(warnings) {
+		t.Errorf("Expected -fix-timestamps to be suggested for %q", warnings)
+	}
+	if suggestFixTimestamps([]string{"[h264 @ 0x1] Warning: not compiled with thread support"}) {
+		t.Errorf("Expected no suggestion for unrelated warnings")
+	}
+}
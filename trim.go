@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trimRange is the part of the merged recording that -start and -end keep,
+// as offsets into it.
+type trimRange struct {
+	// Start is where the output begins. With stream copy it is the
+	// keyframe at or before RequestedStart.
+	Start          time.Duration
+	RequestedStart time.Duration
+	End            time.Duration
+}
+
+// MarshalJSON encodes the range with its times in seconds.
+func (r trimRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Start          float64 `json:"start"`
+		RequestedStart float64 `json:"requested_start"`
+		End            float64 `json:"end"`
+	}{r.Start.Seconds(), r.RequestedStart.Seconds(), r.End.Seconds()})
+}
+
+func (r trimRange) Duration() time.Duration {
+	return r.End - r.Start
+}
+
+func (r trimRange) String() string {
+	s := fmt.Sprintf("%s to %s", formatOffset(r.Start), formatOffset(r.End))
+	if r.Start != r.RequestedStart {
+		s += fmt.Sprintf(" (cut at the keyframe before %s)", formatOffset(r.RequestedStart))
+	}
+	return s
+}
+
+// parseTimestamp parses a -start or -end value: HH:MM:SS, MM:SS or SS with
+// optional fractional seconds, or a Go duration such as 1m12s. A leading
+// minus sign makes the value negative.
+func parseTimestamp(value string) (time.Duration, error) {
+	s := strings.TrimSpace(value)
+	sign := time.Duration(1)
+	if strings.HasPrefix(s, "-") {
+		sign, s = -1, s[1:]
+	}
+	if !strings.Contains(s, ":") {
+		if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+			return sign * d, nil
+		}
+	}
+
+	fields := strings.Split(s, ":")
+	if len(fields) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q: use HH:MM:SS or a duration such as 1m12s", value)
+	}
+	var seconds float64
+	for i, field := range fields {
+		n, err := strconv.ParseFloat(field, 64)
+		last := i == len(fields)-1
+		if err != nil || n < 0 || (!last && n != math.Trunc(n)) || (i > 0 && n >= 60) {
+			return 0, fmt.Errorf("invalid timestamp %q: use HH:MM:SS or a duration such as 1m12s", value)
+		}
+		seconds = seconds*60 + n
+	}
+	return sign * time.Duration(seconds*float64(time.Second)), nil
+}
+
+// keyframeBefore is a variable so tests can replace ffprobe with canned
+// keyframes.
+var keyframeBefore = ffprobeKeyframeBefore
+
+// ffprobeKeyframeBefore returns the time of the video keyframe at or
+// before offset in path. ffprobe seeks to that keyframe to start reading
+// an interval, so the first packet it reads is the keyframe.
+func ffprobeKeyframeBefore(path string, offset time.Duration) (time.Duration, error) {
+	cmd := exec.Command(
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-read_intervals", fmt.Sprintf("%.6f%%+#1", offset.Seconds()),
+		"-show_entries", "packet=pts_time",
+		"-of", "csv=p=0",
+		path)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed for %s: %v", path, err)
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
+	if err != nil {
+		return 0, fmt.Errorf("no keyframe before %s in %s", formatOffset(offset), path)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// resolveTrim returns the range of the merged files, whose durations are
+// given, that opts.Start and opts.End keep, or nil when they keep all of
+// it. A negative opts.End counts from the end. With snap, the start moves
+// to the keyframe at or before it, where stream copy can cut.
+func resolveTrim(files []FileInfo, durations []time.Duration, snap bool, opts Options) (*trimRange, error) {
+	if opts.Start == 0 && opts.End == 0 {
+		return nil, nil
+	}
+	var total time.Duration
+	for _, duration := range durations {
+		total += duration
+	}
+
+	end := total
+	switch {
+	case opts.End < 0:
+		end = total + opts.End
+	case opts.End > 0:
+		end = opts.End
+	}
+	if opts.Start < 0 || opts.Start >= total {
+		return nil, fmt.Errorf("-start %s is not within the %s of the inputs", formatOffset(opts.Start), formatOffset(total))
+	}
+	if end > total {
+		return nil, fmt.Errorf("-end %s is past the %s of the inputs", formatOffset(end), formatOffset(total))
+	}
+	if end <= opts.Start {
+		return nil, fmt.Errorf("-end %s is not after -start %s", formatOffset(end), formatOffset(opts.Start))
+	}
+
+	r := &trimRange{Start: opts.Start, RequestedStart: opts.Start, End: end}
+	if !snap || opts.Start == 0 {
+		return r, nil
+	}
+	var offset time.Duration
+	for i, file := range files {
+		if opts.Start < offset+durations[i] {
+			keyframe, err := keyframeBefore(file.Path, opts.Start-offset)
+			if err != nil {
+				return nil, err
+			}
+			r.Start = offset + keyframe
+			break
+		}
+		offset += durations[i]
+	}
+	return r, nil
+}
+
+// trimInputArgs are the input options of the concat list that start a
+// stream copy merge at r.
+func trimInputArgs(r *trimRange) []string {
+	if r == nil || r.Start == 0 {
+		return nil
+	}
+	return []string{"-ss", strconv.FormatFloat(r.Start.Seconds(), 'f', 6, 64)}
+}
+
+// trimOutputArgs are the output options that end a merge at r. A
+// re-encoding merge, which decodes every frame, also starts at r with them.
+func trimOutputArgs(r *trimRange, reencode bool) []string {
+	if r == nil {
+		return nil
+	}
+	var args []string
+	if reencode && r.Start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(r.Start.Seconds(), 'f', 6, 64))
+	}
+	return append(args, "-t", strconv.FormatFloat(r.Duration().Seconds(), 'f', 6, 64))
+}
+
+// trimChapters moves chapters into r, dropping the ones outside it.
+func trimChapters(chapters []chapterMark, r trimRange) []chapterMark {
+	var trimmed []chapterMark
+	for _, chapter := range chapters {
+		if chapter.End <= r.Start || chapter.Start >= r.End {
+			continue
+		}
+		chapter.Start = max(chapter.Start, r.Start) - r.Start
+		chapter.End = min(chapter.End, r.End) - r.Start
+		trimmed = append(trimmed, chapter)
+	}
+	return trimmed
+}
+
+// trimHiLights moves hilights into r, dropping the ones outside it.
+func trimHiLights(hilights []time.Duration, r trimRange) []time.Duration {
+	var trimmed []time.Duration
+	for _, hilight := range hilights {
+		if hilight >= r.Start && hilight < r.End {
+			trimmed = append(trimmed, hilight-r.Start)
+		}
+	}
+	return trimmed
+}
+
+// advanceTimecode returns timecode, of a video with frameRate, offset
+// later. Drop-frame timecodes, separated by semicolons, are not supported.
+func advanceTimecode(timecode, frameRate string, offset time.Duration) (string, error) {
+	fields := strings.Split(timecode, ":")
+	if len(fields) != 4 {
+		return "", fmt.Errorf("unsupported timecode %q", timecode)
+	}
+	rate, err := parseFrameRate(frameRate)
+	if err != nil {
+		return "", err
+	}
+	// Timecodes count frames at the nominal rate, e.g. 60 for 59.94 fps
+	nominal := int(math.Round(rate))
+	var frames int
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return "", fmt.Errorf("unsupported timecode %q", timecode)
+		}
+		if i < 3 {
+			frames = frames*60 + n
+		} else {
+			frames = frames*nominal + n
+		}
+	}
+	frames += int(math.Round(offset.Seconds() * rate))
+
+	day := 24 * 3600 * nominal
+	frames %= day
+	return fmt.Sprintf("%02d:%02d:%02d:%02d",
+		frames/(3600*nominal), frames/(60*nominal)%60, frames/nominal%60, frames%nominal), nil
+}
+
+// parseFrameRate parses an ffprobe frame rate such as 60000/1001.
+func parseFrameRate(frameRate string) (float64, error) {
+	num, den, found := strings.Cut(frameRate, "/")
+	n, err1 := strconv.ParseFloat(num, 64)
+	d := 1.0
+	var err2 error
+	if found {
+		d, err2 = strconv.ParseFloat(den, 64)
+	}
+	if err1 != nil || err2 != nil || n <= 0 || d <= 0 {
+		return 0, fmt.Errorf("invalid frame rate %q", frameRate)
+	}
+	return n / d, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"00:01:12", 72 * time.Second},
+		{"1:12.5", 72500 * time.Millisecond},
+		{"-00:00:30", -30 * time.Second},
+		{"90", 90 * time.Second},
+		{"1m12s", 72 * time.Second},
+		{"-30s", -30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got, err := parseTimestamp(tt.value); err != nil || got != tt.want {
+			t.Errorf("parseTimestamp(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+	for _, value := range []string{"", "1:2:3:4", "00:75:00", "1.5:00", "soon"} {
+		if _, err := parseTimestamp(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestResolveTrim(t *testing.T) {
+	origKeyframeBefore := keyframeBefore
+	defer func() { keyframeBefore = origKeyframeBefore }()
+	var probed string
+	keyframeBefore = func(path string, offset time.Duration) (time.Duration, error) {
+		probed = path
+		// Keyframes every second
+		return offset.Truncate(time.Second), nil
+	}
+
+	files := []FileInfo{{Path: "GH011234.MP4"}, {Path: "GH021234.MP4"}}
+	durations := []time.Duration{10 * time.Minute, 5 * time.Minute}
+
+	r, err := resolveTrim(files, durations, true, Options{Start: 10*time.Minute + 1500*time.Millisecond, End: -30 * time.Second})
+	if err != nil {
+		t.Fatalf("resolveTrim() error: %v", err)
+	}
+	// The start is in the second chapter, the cut on its keyframe
+	if probed != "GH021234.MP4" || r.Start != 10*time.Minute+time.Second || r.End != 14*time.Minute+30*time.Second {
+		t.Errorf("Unexpected trim %+v from %s", r, probed)
+	}
+	if got := r.String(); got != "00:10:01.000 to 00:14:30.000 (cut at the keyframe before 00:10:01.500)" {
+		t.Errorf("Unexpected description %q", got)
+	}
+
+	// Re-encoding cuts exactly where asked
+	r, err = resolveTrim(files, durations, false, Options{Start: 1500 * time.Millisecond})
+	if err != nil || r.Start != 1500*time.Millisecond || r.End != 15*time.Minute {
+		t.Errorf("Expected an exact cut to the end, got %+v: %v", r, err)
+	}
+
+	if r, err := resolveTrim(files, durations, true, Options{}); r != nil || err != nil {
+		t.Errorf("Expected no trim, got %+v: %v", r, err)
+	}
+	for _, opts := range []Options{
+		{Start: 15 * time.Minute},
+		{End: 16 * time.Minute},
+		{End: -20 * time.Minute},
+		{Start: 5 * time.Minute, End: 4 * time.Minute},
+	} {
+		if _, err := resolveTrim(files, durations, true, opts); err == nil {
+			t.Errorf("Expected an error for start %v and end %v", opts.Start, opts.End)
+		}
+	}
+}
+
+func TestAdvanceTimecode(t *testing.T) {
+	tests := []struct {
+		timecode, frameRate string
+		offset              time.Duration
+		want                string
+	}{
+		{"09:41:23:12", "30/1", 72 * time.Second, "09:42:35:12"},
+		{"09:41:23:12", "60000/1001", 10 * time.Second, "09:41:33:11"},
+		{"23:59:59:00", "25/1", 2 * time.Second, "00:00:01:00"},
+	}
+	for _, tt := range tests {
+		if got, err := advanceTimecode(tt.timecode, tt.frameRate, tt.offset); err != nil || got != tt.want {
+			t.Errorf("advanceTimecode(%q, %q, %v) = %q, %v, want %q", tt.timecode, tt.frameRate, tt.offset, got, err, tt.want)
+		}
+	}
+	if _, err := advanceTimecode("09:41:23;12", "30000/1001", time.Second); err == nil {
+		t.Errorf("Expected drop-frame timecodes to be rejected")
+	}
+}
+
+func TestMergeFilesTrim(t *testing.T) {
+	dir := t.TempDir()
+	var inputPaths []string
+	for _, name := range []string{"GH011234.MP4", "GH021234.MP4"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("chapter "+name), 0644); err != nil {
+			t.Fatalf("Failed to create input file: %v", err)
+		}
+		inputPaths = append(inputPaths, path)
+	}
+	outputPath := filepath.Join(dir, "merged.mp4")
+
+	hero := loadProbeFixture(t, "hero_probe.json")
+	origProbeFile := probeFile
+	origRunCommand := runCommand
+	origKeyframeBefore := keyframeBefore
+	defer func() {
+		probeFile = origProbeFile
+		runCommand = origRunCommand
+		keyframeBefore = origKeyframeBefore
+	}()
+	probeFile = func(path string) (ProbeResult, error) {
+		result := hero
+		result.Duration = 600
+		if path == partialPath(outputPath) {
+			// The timecode moved with the start
+			result.Streams = append([]StreamInfo(nil), hero.Streams...)
+			result.Streams[2].Tags = map[string]string{"timecode": "14:33:17:08"}
+		}
+		return result, nil
+	}
+	keyframeBefore = func(path string, offset time.Duration) (time.Duration, error) {
+		return 70 * time.Second, nil
+	}
+	var merge []string
+	runCommand = func(logger *slog.Logger, cmd *exec.Cmd) error {
+		if cmd.Args[0] != "ffmpeg" {
+			return nil
+		}
+		merge = cmd.Args
+		return os.WriteFile(cmd.Args[len(cmd.Args)-1], []byte("output"), 0644)
+	}
+
+	creationTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	var start, end time.Duration
+	opts := Options{
+		Start: 72 * time.Second,
+		End:   -30 * time.Second,
+		TrimFunc: func(s, e time.Duration) {
+			start, end = s, e
+		},
+	}
+	if err := mergeFiles(outputPath, inputPaths, creationTime, creationTime.Add(20*time.Minute), opts); err != nil {
+		t.Fatalf("mergeFiles() error: %v", err)
+	}
+	command := strings.Join(merge, " ")
+	if !strings.Contains(command, "-ss 70.000000 -f concat") || !strings.Contains(command, "-t 1100.000000 -y") {
+		t.Errorf("Expected the merge to start at the keyframe and last until 30s before the end, got: %s", command)
+	}
+	if !strings.Contains(command, "timecode=14:33:17:08") {
+		t.Errorf("Expected the timecode to be advanced by 70s, got: %s", command)
+	}
+	// The creation time is when the kept footage starts
+	if !strings.Contains(command, "creation_time=2024-05-01T10:01:10") {
+		t.Errorf("Expected the creation time to be advanced by 70s, got: %s", command)
+	}
+	if start != 70*time.Second || end != 1170*time.Second {
+		t.Errorf("Expected the cut points 70s and 19m30s to be reported, got %v and %v", start, end)
+	}
+
+	// Trimming past the end fails before ffmpeg runs
+	merge = nil
+	opts.End = 25 * time.Minute
+	err := mergeFiles(outputPath, inputPaths, creationTime, creationTime, opts)
+	if err == nil || !strings.Contains(err.Error(), "past the 00:20:00.000 of the inputs") || merge != nil {
+		t.Errorf("Expected the end to be rejected before merging, got: %v", err)
+	}
+}
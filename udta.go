@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cameraInfo identifies the camera that recorded a file.
+type cameraInfo struct {
+	Model    string `json:"model,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// String formats the camera for display, e.g. "HERO11 Black (firmware H22.01.01.10.00)".
+func (c cameraInfo) String() string {
+	switch {
+	case c.Model != "" && c.Firmware != "":
+		return fmt.Sprintf("%s (firmware %s)", c.Model, c.Firmware)
+	case c.Firmware != "":
+		return "unknown model (firmware " + c.Firmware + ")"
+	default:
+		return c.Model
+	}
+}
+
+// skippedUserData lists udta children that are not copied from the first
+// chapter because they only describe that chapter.
+var skippedUserData = map[string]bool{
+	"HMMT": true, // HiLights, replaced by the HiLights of all chapters
+}
+
+func mp4BoxHeader(boxType string, payloadSize int) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(8+payloadSize))
+	copy(header[4:], boxType)
+	return header
+}
+
+// childBoxes parses the children of the box stored in data.
+func childBoxes(data []byte, box mp4Box) ([]mp4Box, error) {
+	return readBoxes(bytes.NewReader(data), box.PayloadOffset(), box.End())
+}
+
+// readCameraInfo reads the camera model and firmware version GoPro stores
+// in moov/udta. The model comes from the MINF entry of the udta GPMF box.
+func readCameraInfo(path string) (cameraInfo, error) {
+	var info cameraInfo
+
+	firmware, err := readFileBox(path, "moov", "udta", "FIRM")
+	if err != nil {
+		return info, err
+	}
+	info.Firmware = strings.TrimRight(string(firmware), "\x00 ")
+
+	gpmf, err := readFileBox(path, "moov", "udta", "GPMF")
+	if err != nil {
+		return info, err
+	}
+	info.Model = findGPMFString(gpmf, "MINF")
+	return info, nil
+}
+
+// findGPMFString searches GPMF key-length-value data for a string entry.
+// Each entry has a four character key, a type, a sample size and a repeat
+// count, followed by data padded to four bytes. Type 0 nests entries.
+func findGPMFString(data []byte, key string) string {
+	for len(data) >= 8 {
+		entryKey := string(data[:4])
+		entryType := data[4]
+		size := int(data[5]) * int(binary.BigEndian.Uint16(data[6:8]))
+		padded := (size + 3) &^ 3
+		if 8+padded > len(data) {
+			return ""
+		}
+		value := data[8 : 8+size]
+
+		switch {
+		case entryKey == key && entryType == 'c':
+			return strings.TrimRight(string(value), "\x00 ")
+		case entryType == 0:
+			if found := findGPMFString(value, key); found != "" {
+				return found
+			}
+		}
+		data = data[8+padded:]
+	}
+	return ""
+}
+
+// mergeUserData adds the boxes in userData to the udta box of moov (a
+// complete moov box) unless moov already has a child of the same type, and
+// returns the new moov box.
+func mergeUserData(moov, userData []byte) ([]byte, error) {
+	moovBox := mp4Box{Type: "moov", HeaderSize: 8, Size: int64(len(moov))}
+	if binary.BigEndian.Uint32(moov[:4]) == 1 {
+		moovBox.HeaderSize = 16
+	}
+	children, err := childBoxes(moov, moovBox)
+	if err != nil {
+		return nil, err
+	}
+
+	var udta []byte
+	existing := make(map[string]bool)
+	var newChildren [][]byte
+	for _, child := range children {
+		data := moov[child.Offset:child.End()]
+		if child.Type != "udta" {
+			newChildren = append(newChildren, data)
+			continue
+		}
+		udtaChildren, err := childBoxes(moov, child)
+		if err != nil {
+			return nil, err
+		}
+		for _, udtaChild := range udtaChildren {
+			existing[udtaChild.Type] = true
+		}
+		udta = append(udta, moov[child.PayloadOffset():child.End()]...)
+	}
+
+	boxes, err := readBoxes(bytes.NewReader(userData), 0, int64(len(userData)))
+	if err != nil {
+		return nil, err
+	}
+	for _, box := range boxes {
+		if !existing[box.Type] {
+			udta = append(udta, userData[box.Offset:box.End()]...)
+		}
+	}
+	newChildren = append(newChildren, append(mp4BoxHeader("udta", len(udta)), udta...))
+
+	payload := bytes.Join(newChildren, nil)
+	return append(mp4BoxHeader("moov", len(payload)), payload...), nil
+}
+
+// shiftChunkOffsets adds delta to every chunk offset in moov (a complete
+// moov box) that is at least threshold, as needed when the data the
+// offsets point at moves.
+func shiftChunkOffsets(moov []byte, threshold, delta int64) error {
+	var walk func(box mp4Box) error
+	walk = func(box mp4Box) error {
+		children, err := childBoxes(moov, box)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			payload := moov[child.PayloadOffset():child.End()]
+			switch child.Type {
+			case "trak", "mdia", "minf", "stbl":
+				if err := walk(child); err != nil {
+					return err
+				}
+			case "stco":
+				if len(payload) < 8 {
+					return fmt.Errorf("invalid stco box")
+				}
+				count := int(binary.BigEndian.Uint32(payload[4:8]))
+				if 8+count*4 > len(payload) {
+					return fmt.Errorf("invalid stco box")
+				}
+				for i := 0; i < count; i++ {
+					entry := payload[8+i*4:]
+					offset := int64(binary.BigEndian.Uint32(entry))
+					if offset < threshold {
+						continue
+					}
+					if offset+delta > 0xffffffff {
+						return fmt.Errorf("chunk offset overflow while shifting stco")
+					}
+					binary.BigEndian.PutUint32(entry, uint32(offset+delta))
+				}
+			case "co64":
+				if len(payload) < 8 {
+					return fmt.Errorf("invalid co64 box")
+				}
+				count := int(binary.BigEndian.Uint32(payload[4:8]))
+				if 8+count*8 > len(payload) {
+					return fmt.Errorf("invalid co64 box")
+				}
+				for i := 0; i < count; i++ {
+					entry := payload[8+i*8:]
+					offset := int64(binary.BigEndian.Uint64(entry))
+					if offset >= threshold {
+						binary.BigEndian.PutUint64(entry, uint64(offset+delta))
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	moovBox := mp4Box{Type: "moov", HeaderSize: 8, Size: int64(len(moov))}
+	if binary.BigEndian.Uint32(moov[:4]) == 1 {
+		moovBox.HeaderSize = 16
+	}
+	return walk(moovBox)
+}
+
+// sourceUserData returns the udta children of sourcePath that describe the
+// whole recording rather than a single chapter.
+func sourceUserData(sourcePath string) ([]byte, error) {
+	udta, err := readFileBox(sourcePath, "moov", "udta")
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := readBoxes(bytes.NewReader(udta), 0, int64(len(udta)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse udta of %s: %v", sourcePath, err)
+	}
+	var userData []byte
+	for _, box := range boxes {
+		if !skippedUserData[box.Type] {
+			userData = append(userData, udta[box.Offset:box.End()]...)
+		}
+	}
+	return userData, nil
+}
+
+// graftUserData copies the camera identification GoPro writes into
+// moov/udta (FIRM, LENS, CAME, GPMF, ...) from sourcePath into the merged
+// outputPath, since ffmpeg drops these vendor boxes when remuxing. A
+// combined HMMT box holding hilights is added when there are any.
+func graftUserData(outputPath, sourcePath string, hilights []time.Duration) error {
+	userData, err := sourceUserData(sourcePath)
+	if err != nil {
+		return err
+	}
+	if len(hilights) > 0 {
+		userData = append(userData, hiLightBox(hilights)...)
+	}
+	if len(userData) == 0 {
+		return nil
+	}
+	return rewriteMoov(outputPath, func(moov []byte) ([]byte, error) {
+		newMoov, err := mergeUserData(moov, userData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge udta of %s: %v", outputPath, err)
+		}
+		return newMoov, nil
+	})
+}
+
+// rewriteMoov replaces the moov atom of outputPath with the one edit makes
+// of it, moving the media data and its chunk offsets as needed.
+func rewriteMoov(outputPath string, edit func(moov []byte) ([]byte, error)) error {
+	file, err := os.OpenFile(outputPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	boxes, err := readBoxes(file, 0, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", outputPath, err)
+	}
+	moovIndex := -1
+	for i, box := range boxes {
+		if box.Type == "moov" {
+			moovIndex = i
+			break
+		}
+	}
+	if moovIndex < 0 {
+		return fmt.Errorf("no moov atom found in %s", outputPath)
+	}
+	moovBox := boxes[moovIndex]
+
+	moov := make([]byte, moovBox.Size)
+	if _, err := file.ReadAt(moov, moovBox.Offset); err != nil {
+		return fmt.Errorf("failed to read moov atom of %s: %v", outputPath, err)
+	}
+	newMoov, err := edit(moov)
+	if err != nil {
+		return err
+	}
+
+	// With the moov atom at the end, nothing else moves and it can be rewritten in place
+	if moovIndex == len(boxes)-1 {
+		if _, err := file.WriteAt(newMoov, moovBox.Offset); err != nil {
+			return fmt.Errorf("failed to write moov atom of %s: %v", outputPath, err)
+		}
+		if err := file.Truncate(moovBox.Offset + int64(len(newMoov))); err != nil {
+			return fmt.Errorf("failed to truncate %s: %v", outputPath, err)
+		}
+		return file.Close()
+	}
+
+	// Otherwise the media data behind the moov atom moves and the chunk offsets must follow
+	delta := int64(len(newMoov)) - moovBox.Size
+	if err := shiftChunkOffsets(newMoov, moovBox.End(), delta); err != nil {
+		return fmt.Errorf("failed to update chunk offsets of %s: %v", outputPath, err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(outputPath), filepath.Base(outputPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(temp.Name())
+
+	err = temp.Chmod(info.Mode())
+	if err == nil {
+		_, err = io.Copy(temp, io.NewSectionReader(file, 0, moovBox.Offset))
+	}
+	if err == nil {
+		_, err = temp.Write(newMoov)
+	}
+	if err == nil {
+		_, err = io.Copy(temp, io.NewSectionReader(file, moovBox.End(), info.Size()-moovBox.End()))
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rewrite %s: %v", outputPath, err)
+	}
+	file.Close()
+	return os.Rename(temp.Name(), outputPath)
+}
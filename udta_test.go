@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// gpmfString encodes a GPMF string entry padded to four bytes.
+func gpmfString(key, value string) []byte {
+	entry := make([]byte, 8, 8+len(value)+3)
+	copy(entry, key)
+	entry[4] = 'c'
+	entry[5] = 1
+	binary.BigEndian.PutUint16(entry[6:], uint16(len(value)))
+	entry = append(entry, value...)
+	for len(entry)%4 != 0 {
+		entry = append(entry, 0)
+	}
+	return entry
+}
+
+// gpmfNest encodes a GPMF entry of type 0 holding nested entries.
+func gpmfNest(key string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	entry := make([]byte, 8, 8+len(body))
+	copy(entry, key)
+	entry[5] = 4
+	binary.BigEndian.PutUint16(entry[6:], uint16(len(body)/4))
+	return append(entry, body...)
+}
+
+func cameraUserData() []byte {
+	return mp4BoxBytes("udta",
+		mp4BoxBytes("FIRM", []byte("H22.01.01.10.00")),
+		mp4BoxBytes("LENS", []byte("LAJ8052021302300")),
+		mp4BoxBytes("GPMF", gpmfNest("DEVC", gpmfString("DVNM", "Camera"), gpmfString("MINF", "HERO11 Black"))),
+		mp4BoxBytes("HMMT", make([]byte, 8)))
+}
+
+func writeFixture(t *testing.T, dir, name string, boxes ...[]byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, bytes.Join(boxes, nil), 0644); err != nil {
+		t.Fatalf("Failed to write fixture %s: %v", path, err)
+	}
+	return path
+}
+
+func TestReadCameraInfo(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFixture(t, dir, "GH011234.MP4", mp4BoxBytes("moov", cameraUserData()))
+
+	info, err := readCameraInfo(path)
+	if err != nil {
+		t.Fatalf("readCameraInfo() error: %v", err)
+	}
+	if info.Model != "HERO11 Black" || info.Firmware != "H22.01.01.10.00" {
+		t.Errorf("Unexpected camera info %+v", info)
+	}
+	if got := info.String(); got != "HERO11 Black (firmware H22.01.01.10.00)" {
+		t.Errorf("Unexpected camera description %q", got)
+	}
+
+	// Files without udta have no camera info
+	info, err = readCameraInfo(writeFixture(t, dir, "GH021234.MP4", mp4BoxBytes("moov")))
+	if err != nil || info != (cameraInfo{}) {
+		t.Errorf("Expected no camera info, got %+v, %v", info, err)
+	}
+}
+
+func TestMergeUserData(t *testing.T) {
+	moov := mp4BoxBytes("moov",
+		mp4BoxBytes("mvhd", make([]byte, 12)),
+		mp4BoxBytes("udta", mp4BoxBytes("FIRM", []byte("from ffmpeg"))))
+	source, err := sourceUserData(writeFixture(t, t.TempDir(), "GH011234.MP4", mp4BoxBytes("moov", cameraUserData())))
+	if err != nil {
+		t.Fatalf("sourceUserData() error: %v", err)
+	}
+
+	merged, err := mergeUserData(moov, source)
+	if err != nil {
+		t.Fatalf("mergeUserData() error: %v", err)
+	}
+	box := mp4Box{Type: "moov", HeaderSize: 8, Size: int64(len(merged))}
+	children, err := childBoxes(merged, box)
+	if err != nil {
+		t.Fatalf("Failed to parse merged moov: %v", err)
+	}
+	if len(children) != 2 || children[0].Type != "mvhd" || children[1].Type != "udta" {
+		t.Fatalf("Unexpected moov children %v", children)
+	}
+	udta, err := childBoxes(merged, children[1])
+	if err != nil {
+		t.Fatalf("Failed to parse merged udta: %v", err)
+	}
+	var types []string
+	for _, child := range udta {
+		types = append(types, child.Type)
+	}
+	// Existing boxes win and HiLights are not copied
+	expected := []string{"FIRM", "LENS", "GPMF"}
+	if len(types) != len(expected) || types[0] != expected[0] || types[1] != expected[1] || types[2] != expected[2] {
+		t.Errorf("Expected udta children %v, got %v", expected, types)
+	}
+	if firmware := merged[udta[0].PayloadOffset():udta[0].End()]; string(firmware) != "from ffmpeg" {
+		t.Errorf("Expected existing FIRM to be kept, got %q", firmware)
+	}
+}
+
+func TestGraftUserDataMoovLast(t *testing.T) {
+	dir := t.TempDir()
+	source := writeFixture(t, dir, "GH011234.MP4", mp4BoxBytes("moov", cameraUserData()))
+	output := writeFixture(t, dir, "merged.mp4",
+		mp4BoxBytes("ftyp", []byte("isom")),
+		mp4BoxBytes("mdat", make([]byte, 32)),
+		mp4BoxBytes("moov", mp4BoxBytes("mvhd", make([]byte, 12))))
+
+	if err := graftUserData(output, source, nil); err != nil {
+		t.Fatalf("graftUserData() error: %v", err)
+	}
+	info, err := readCameraInfo(output)
+	if err != nil {
+		t.Fatalf("readCameraInfo() error: %v", err)
+	}
+	if info.Model != "HERO11 Black" || info.Firmware != "H22.01.01.10.00" {
+		t.Errorf("Camera info not grafted, got %+v", info)
+	}
+}
+
+func TestGraftUserDataMoovFirst(t *testing.T) {
+	dir := t.TempDir()
+	source := writeFixture(t, dir, "GH011234.MP4", mp4BoxBytes("moov", cameraUserData()))
+
+	ftyp := mp4BoxBytes("ftyp", []byte("isom"))
+	stco := func(offset uint32) []byte {
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint32(payload[4:], 1)
+		binary.BigEndian.PutUint32(payload[8:], offset)
+		return mp4BoxBytes("moov", mp4BoxBytes("trak", mp4BoxBytes("mdia", mp4BoxBytes("minf", mp4BoxBytes("stbl", mp4BoxBytes("stco", payload))))))
+	}
+	moovSize := len(stco(0))
+	mdat := mp4BoxBytes("mdat", []byte("SAMPLEDATA"))
+	chunkOffset := uint32(len(ftyp) + moovSize + 8)
+	output := writeFixture(t, dir, "merged.mp4", ftyp, stco(chunkOffset), mdat)
+
+	if err := graftUserData(output, source, nil); err != nil {
+		t.Fatalf("graftUserData() error: %v", err)
+	}
+	if err := verifyFaststart(output); err != nil {
+		t.Errorf("Expected moov to stay in front: %v", err)
+	}
+
+	stcoPayload, err := readFileBox(output, "moov", "trak", "mdia", "minf", "stbl", "stco")
+	if err != nil {
+		t.Fatalf("Failed to read stco: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := binary.BigEndian.Uint32(stcoPayload[8:])
+	if got := string(data[offset : offset+10]); got != "SAMPLEDATA" {
+		t.Errorf("Chunk offset %d no longer points at the sample data, found %q", offset, got)
+	}
+	if info, err := readCameraInfo(output); err != nil || info.Model != "HERO11 Black" {
+		t.Errorf("Camera info not grafted, got %+v, %v", info, err)
+	}
+}
+
+func TestGraftUserDataHiLights(t *testing.T) {
+	dir := t.TempDir()
+	source := writeFixture(t, dir, "GH011234.MP4", mp4BoxBytes("moov", cameraUserData()))
+	output := writeFixture(t, dir, "merged.mp4",
+		mp4BoxBytes("ftyp", []byte("isom")),
+		mp4BoxBytes("mdat", make([]byte, 32)),
+		mp4BoxBytes("moov", mp4BoxBytes("mvhd", make([]byte, 12))))
+
+	expected := []time.Duration{1500 * time.Millisecond, 9*time.Minute + 2*time.Second}
+	if err := graftUserData(output, source, expected); err != nil {
+		t.Fatalf("graftUserData() error: %v", err)
+	}
+	hilights, err := readHiLights(output)
+	if err != nil {
+		t.Fatalf("readHiLights() error: %v", err)
+	}
+	if len(hilights) != len(expected) || hilights[0] != expected[0] || hilights[1] != expected[1] {
+		t.Errorf("Expected HiLights %v in the output, got %v", expected, hilights)
+	}
+}
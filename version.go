@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// ffmpegVersion returns the path of the ffmpeg GoProConcat runs and the
+// version it reports, e.g. 6.1.1 or a date-stamped build of the snapshots.
+func ffmpegVersion(logger *slog.Logger) (path, version string, err error) {
+	path, err = exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", "", err
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(path, "-version")
+	cmd.Stdout = &out
+	if err := runCommand(logger, cmd); err != nil {
+		return path, "", fmt.Errorf("failed to run ffmpeg -version: %v", err)
+	}
+
+	// The first line reads "ffmpeg version 6.1.1 Copyright (c) ..."
+	line, _, _ := strings.Cut(out.String(), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[1] != "version" {
+		return path, "", fmt.Errorf("unexpected output of ffmpeg -version: %q", line)
+	}
+	return path, fields[2], nil
+}
+
+// vcsRevision is the commit GoProConcat was built from, with a note when
+// the tree had local changes, or empty when the build has no VCS stamp.
+func vcsRevision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	var revision string
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision != "" && modified {
+		revision += " (modified)"
+	}
+	return revision
+}
+
+// printVersion prints the version of GoProConcat and what it was built
+// with and runs on, including the ffmpeg it found, for bug reports.
+func printVersion(w io.Writer, logger *slog.Logger) {
+	fmt.Fprintf(w, "GoProConcat %s\n", version)
+	if revision := vcsRevision(); revision != "" {
+		fmt.Fprintf(w, "Commit: %s\n", revision)
+	}
+	fmt.Fprintf(w, "Go: %s\n", runtime.Version())
+	fmt.Fprintf(w, "OS/Arch: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	path, ffmpeg, err := ffmpegVersion(logger)
+	switch {
+	case path == "":
+		fmt.Fprintln(w, "ffmpeg: not found in PATH")
+	case err != nil:
+		fmt.Fprintf(w, "ffmpeg: unknown version (%s): %v\n", path, err)
+	default:
+		fmt.Fprintf(w, "ffmpeg: %s (%s)\n", ffmpeg, path)
+	}
+}
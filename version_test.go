@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRunVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho 'ffmpeg version 6.1.1 Copyright (c) 2000-2023 the FFmpeg developers'\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-version"}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Expected exit code %d, got %d: %s", exitOK, code, stderr.String())
+	}
+	for _, expected := range []string{
+		"GoProConcat " + version + "\n",
+		"Go: " + runtime.Version() + "\n",
+		"OS/Arch: " + runtime.GOOS + "/" + runtime.GOARCH + "\n",
+		"ffmpeg: 6.1.1 (" + filepath.Join(dir, "ffmpeg") + ")\n",
+	} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Errorf("Expected %q in the version, got:\n%s", expected, stdout.String())
+		}
+	}
+
+	// Without ffmpeg the version is printed all the same
+	t.Setenv("PATH", t.TempDir())
+	stdout.Reset()
+	if code := run([]string{"--version"}, &stdout, &stderr); code != exitOK || !strings.Contains(stdout.String(), "ffmpeg: not found in PATH\n") {
+		t.Errorf("Expected the missing ffmpeg to be reported, got %d:\n%s", code, stdout.String())
+	}
+}
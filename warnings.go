@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// warningClass is a kind of ffmpeg warning, recognized by its patterns in
+// lower case, with what the user can do about it.
+type warningClass struct {
+	// Name is plural, as the summary counts the warnings of the class.
+	Name     string
+	Patterns []string
+	Advice   string
+}
+
+// warningClasses are the ffmpeg warnings the summary after a merge counts.
+// A warning belongs to the first class it matches. The advice of the
+// timestamp classes leaves -fix-timestamps to the hint run prints after the
+// summary.
+var warningClasses = []warningClass{
+	{
+		Name:     "corrupt packets",
+		Patterns: []string{"packet corrupt", "corrupt input packet", "corrupt decoded frame"},
+		Advice:   "consider -ignore-errors or re-copying the file from the card",
+	},
+	{
+		Name:     "decoding errors",
+		Patterns: []string{"invalid data found", "error while decoding", "missing picture"},
+		Advice:   "consider -ignore-errors or re-copying the file from the card",
+	},
+	{
+		Name:     "non-monotonous timestamps",
+		Patterns: []string{"non-monotonous dts", "non monotonically increasing dts"},
+		Advice:   "the audio may drift out of sync from there",
+	},
+	{
+		Name:     "timestamp discontinuities",
+		Patterns: []string{"timestamp discontinuity", "discontinuity detected"},
+		Advice:   "playback may jump at the join, check it",
+	},
+	{
+		Name:     "invalid timestamps",
+		Patterns: []string{"negative timestamp", "negative cts", "invalid dts", "timestamps are unset", "invalid timestamps"},
+		Advice:   "players may show a wrong duration or stall",
+	},
+	{
+		Name:     "packets past their duration",
+		Patterns: []string{"past duration"},
+		Advice:   "frames may be dropped at the join, check it",
+	},
+}
+
+// classifyWarning returns the class of an ffmpeg warning, or nil when it
+// belongs to none.
+func classifyWarning(line string) *warningClass {
+	line = strings.ToLower(line)
+	for i, class := range warningClasses {
+		for _, pattern := range class.Patterns {
+			if strings.Contains(line, pattern) {
+				return &warningClasses[i]
+			}
+		}
+	}
+	return nil
+}
+
+// warningCount counts the ffmpeg warnings of one class about one input.
+type warningCount struct {
+	Class string `json:"class"`
+	// Input is the input the warnings name, empty when they name none.
+	Input  string `json:"input,omitempty"`
+	Count  int    `json:"count"`
+	Advice string `json:"advice"`
+}
+
+// String formats the count, e.g. "3 corrupt packets in GH030042.MP4 —
+// consider -ignore-errors or re-copying the file from the card".
+func (c warningCount) String() string {
+	s := fmt.Sprintf("%d %s", c.Count, c.Class)
+	if c.Input != "" {
+		s += " in " + filepath.Base(c.Input)
+	}
+	return s + " — " + c.Advice
+}
+
+// warningInput returns the one of inputPaths an ffmpeg warning names, or
+// "" when it names none. ffmpeg does not say which input a packet came
+// from, only some messages include the file name.
+func warningInput(line string, inputPaths []string) string {
+	line = strings.ToLower(line)
+	for _, path := range inputPaths {
+		if strings.Contains(line, strings.ToLower(filepath.Base(path))) {
+			return path
+		}
+	}
+	return ""
+}
+
+// summarizeWarnings counts warnings by class and input, in the order of
+// warningClasses and inputPaths, and returns the warnings of no class.
+func summarizeWarnings(warnings, inputPaths []string) ([]warningCount, []string) {
+	type key struct{ class, input string }
+	counts := make(map[key]int)
+	var other []string
+	for _, warning := range warnings {
+		class := classifyWarning(warning)
+		if class == nil {
+			other = append(other, warning)
+			continue
+		}
+		counts[key{class.Name, warningInput(warning, inputPaths)}]++
+	}
+
+	var summary []warningCount
+	for _, class := range warningClasses {
+		for _, input := range append([]string{""}, inputPaths...) {
+			if count := counts[key{class.Name, input}]; count > 0 {
+				summary = append(summary, warningCount{Class: class.Name, Input: input, Count: count, Advice: class.Advice})
+			}
+		}
+	}
+	return summary, other
+}
+
+// printFFmpegWarnings summarizes the warnings ffmpeg printed during a merge
+// of inputPaths: the ones of warningClasses counted, the others in full.
+func printFFmpegWarnings(w io.Writer, warnings, inputPaths []string) {
+	if len(warnings) == 0 {
+		return
+	}
+	summary, other := summarizeWarnings(warnings, inputPaths)
+	fmt.Fprintf(w, "ffmpeg reported %d warning(s):\n", len(warnings))
+	for _, count := range summary {
+		fmt.Fprintf(w, "  %s\n", count)
+	}
+	for _, warning := range other {
+		fmt.Fprintf(w, "  %s\n", warning)
+	}
+}
+
+// mergeReport is printed as JSON after a merge with -json.
+type mergeReport struct {
+	Output string `json:"output"`
+	// Succeeded is unset when the merge failed with Error.
+	Succeeded bool   `json:"succeeded"`
+	Error     string `json:"error,omitempty"`
+	// ExpectedDuration and OutputDuration, in seconds, are the durations
+	// the duration check compared, zero when it did not run.
+	ExpectedDuration float64        `json:"expected_duration,omitempty"`
+	OutputDuration   float64        `json:"output_duration,omitempty"`
+	FFmpegWarnings   []warningCount `json:"ffmpeg_warnings"`
+	// OtherWarnings are the ffmpeg warnings of no warningClass.
+	OtherWarnings []string `json:"other_warnings,omitempty"`
+	// SettingWarnings are the camera settings in which chapters differ
+	// from the first one, see checkSettings.
+	SettingWarnings []inputMismatch `json:"setting_warnings,omitempty"`
+	// Loudness is the measurement of -normalize-audio, nil without it.
+	Loudness *Loudness `json:"loudness,omitempty"`
+	// Rotation is the clockwise display rotation set by -rotate, in
+	// degrees.
+	Rotation int `json:"rotation,omitempty"`
+	// LUT and ProxyLUT are the .cube files that graded the output and the
+	// proxy, which changes their footage.
+	LUT      string `json:"lut,omitempty"`
+	ProxyLUT string `json:"proxy_lut,omitempty"`
+	// BurnTimestamp is the timestamp burnt into the video.
+	BurnTimestamp *TimestampOverlay `json:"burn_timestamp,omitempty"`
+	// Geotag is the point of the -geotag track that located the output.
+	Geotag *GeotagMatch `json:"geotag,omitempty"`
+	// AlsoOutput is the second output of -also-output, and
+	// AlsoOutputError why it failed. The output is kept when it fails.
+	AlsoOutput      string `json:"also_output,omitempty"`
+	AlsoOutputError string `json:"also_output_error,omitempty"`
+	// Frames is the comparison of the frames of -verify deep, with the
+	// first frame that differs when it failed.
+	Frames *FrameCheck `json:"frames,omitempty"`
+	// Checksums are the digests -checksum wrote sidecars of.
+	Checksums []checksumResult `json:"checksums,omitempty"`
+}
+
+// printMergeReportJSON completes report of the merge of inputPaths, which
+// failed with err unless it is nil, and prints it.
+func printMergeReportJSON(w io.Writer, report mergeReport, inputPaths, warnings []string, err error) error {
+	report.Succeeded = err == nil
+	report.FFmpegWarnings, report.OtherWarnings = summarizeWarnings(warnings, inputPaths)
+	if report.FFmpegWarnings == nil {
+		report.FFmpegWarnings = []warningCount{}
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
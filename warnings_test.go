@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClassifyWarning(t *testing.T) {
+	tests := []struct {
+		line  string
+		class string
+	}{
+		{"[h264 @ 0x7f8] Packet corrupt (stream = 0, dts = 1023000)", "corrupt packets"},
+		{"[aac @ 0x7f9] corrupt input packet in stream 1", "corrupt packets"},
+		{"[hevc @ 0x7fa] Error while decoding stream #0:0: Invalid data found when processing input", "decoding errors"},
+		{"[h264 @ 0x7fb] missing picture in access unit with size 4096", "decoding errors"},
+		{"[mp4 @ 0x7fc] Non-monotonous DTS in output stream 0:1; previous: 2701312, current: 2700288", "non-monotonous timestamps"},
+		{"[mp4 @ 0x7fd] Application provided invalid, non monotonically increasing dts to muxer in stream 3", "non-monotonous timestamps"},
+		{"[concat @ 0x7fe] Timestamp discontinuity for stream #1 (id=2, type=audio): -21333", "timestamp discontinuities"},
+		{"[mov @ 0x7ff] Negative CTS in track 0", "invalid timestamps"},
+		{"[mp4 @ 0x800] Timestamps are unset in a packet for stream 2", "invalid timestamps"},
+		{"[null @ 0x801] Packet with pts 1000 past duration of stream 0", "packets past their duration"},
+		{"[h264 @ 0x802] Warning: not compiled with thread support, using thread emulation", ""},
+	}
+	for _, test := range tests {
+		class := classifyWarning(test.line)
+		got := ""
+		if class != nil {
+			got = class.Name
+		}
+		if got != test.class {
+			t.Errorf("classifyWarning(%q) = %q, expected %q", test.line, got, test.class)
+		}
+		if !isFFmpegWarning(test.line) {
+			t.Errorf("Expected %q to be collected as a warning", test.line)
+		}
+	}
+}
+
+func TestSummarizeWarnings(t *testing.T) {
+	inputPaths := []string{"/Volumes/GoPro/GH010042.MP4", "/Volumes/GoPro/GH020042.MP4", "/Volumes/GoPro/GH030042.MP4"}
+	warnings := []string{
+		"[h264 @ 0x1] Packet corrupt (stream = 0, dts = 1023000) in GH030042.MP4",
+		"[mp4 @ 0x2] Non-monotonous DTS in output stream 0:1",
+		"[h264 @ 0x1] Packet corrupt (stream = 0, dts = 1024000) in gh030042.mp4",
+		"[concat @ 0x3] Impossible to open 'GH020042.MP4': Invalid data found when processing input",
+		"[h264 @ 0x1] Packet corrupt (stream = 0, dts = 1025000) in GH030042.MP4",
+		"[h264 @ 0x4] Warning: not compiled with thread support",
+	}
+
+	summary, other := summarizeWarnings(warnings, inputPaths)
+	expected := []warningCount{
+		{Class: "corrupt packets", Input: inputPaths[2], Count: 3, Advice: "consider -ignore-errors or re-copying the file from the card"},
+		{Class: "decoding errors", Input: inputPaths[1], Count: 1, Advice: "consider -ignore-errors or re-copying the file from the card"},
+		{Class: "non-monotonous timestamps", Count: 1, Advice: "the audio may drift out of sync from there"},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Expected summary %+v, got %+v", expected, summary)
+	}
+	if len(other) != 1 || !strings.Contains(other[0], "thread support") {
+		t.Errorf("Expected the thread warning to stay unclassified, got %q", other)
+	}
+
+	var buf bytes.Buffer
+	printFFmpegWarnings(&buf, warnings, inputPaths)
+	for _, line := range []string{
+		"ffmpeg reported 6 warning(s):",
+		"  3 corrupt packets in GH030042.MP4 — consider -ignore-errors or re-copying the file from the card",
+		"  1 non-monotonous timestamps — the audio may drift out of sync from there",
+		"  [h264 @ 0x4] Warning: not compiled with thread support",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected %q in the summary, got:\n%s", line, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := printMergeReportJSON(&buf, mergeReport{Output: "merged.mp4"}, inputPaths, warnings, errors.New("ffmpeg command failed")); err != nil {
+		t.Fatalf("printMergeReportJSON() error: %v", err)
+	}
+	var report mergeReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.Succeeded || report.Error != "ffmpeg command failed" || !reflect.DeepEqual(report.FFmpegWarnings, expected) || len(report.OtherWarnings) != 1 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	// A clean merge reports an empty list rather than null
+	buf.Reset()
+	if err := printMergeReportJSON(&buf, mergeReport{Output: "merged.mp4", ExpectedDuration: 1061.06, OutputDuration: 1061.04}, inputPaths, nil, nil); err != nil {
+		t.Fatalf("printMergeReportJSON() error: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"ffmpeg_warnings": []`) || !strings.Contains(buf.String(), `"succeeded": true`) || !strings.Contains(buf.String(), `"output_duration": 1061.04`) {
+		t.Errorf("Unexpected report of a clean merge: %s", buf.String())
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/sys/unix"
+)
+
+// finderCommentXattr holds the comment of a file that the Finder shows in
+// Get Info, as a binary property list.
+const finderCommentXattr = "com.apple.metadata:kMDItemFinderComment"
+
+// finderXattrs are the extended attributes -copy-xattrs copies, the Finder
+// tags and comment. Others, such as com.apple.quarantine, describe the
+// file rather than the recording and are never copied.
+var finderXattrs = []string{
+	"com.apple.metadata:_kMDItemUserTags",
+	finderCommentXattr,
+}
+
+// listXattrs returns the names of the extended attributes of path.
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of the extended attribute name of path.
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Getxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+// copyXattrs copies the extended attributes of src named in opts.CopyXattrs
+// to dst. They are a nice-to-have, so a failure, e.g. on a file system
+// without extended attributes, only logs a warning.
+func copyXattrs(src, dst string, opts Options) {
+	logger := opts.logger()
+	if len(opts.CopyXattrs) == 0 || isRemote(src) {
+		return
+	}
+
+	names, err := listXattrs(src)
+	if err != nil {
+		logger.Warn("failed to read the extended attributes of the input, the output gets none", "input", src, "error", err)
+		return
+	}
+	for _, name := range names {
+		if !slices.Contains(opts.CopyXattrs, name) {
+			continue
+		}
+		value, err := getXattr(src, name)
+		if err == nil {
+			err = unix.Setxattr(dst, name, value, 0)
+		}
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+			logger.Warn("the file system of the output has no extended attributes, they are not copied", "output", dst)
+			return
+		}
+		if err != nil {
+			logger.Warn("failed to copy extended attribute", "input", src, "output", dst, "name", name, "error", err)
+			continue
+		}
+		logger.Debug("copied extended attribute", "input", src, "output", dst, "name", name)
+	}
+}
+
+// maxFinderCommentLength keeps the comment of -finder-comment readable in
+// Get Info.
+const maxFinderCommentLength = 500
+
+// finderComment is the Finder comment of an output merged from files on
+// day, listing as many of their names as fit in maxFinderCommentLength.
+func finderComment(files []FileInfo, day time.Time) string {
+	prefix := "Merged from "
+	suffix := fmt.Sprintf(" on %s by GoProConcat %s", day.Format("2006-01-02"), version)
+	return prefix + fileNameList(files, maxFinderCommentLength-len(prefix)-len(suffix)) + suffix
+}
+
+// setFinderComment writes comment as the Finder comment of path. Only
+// macOS has Finder comments, elsewhere nothing is written. Like
+// copyXattrs, a failure only logs a warning.
+func setFinderComment(path, comment string, opts Options) {
+	if runtime.GOOS != "darwin" {
+		return
+	}
+	logger := opts.logger()
+	if err := unix.Setxattr(path, finderCommentXattr, binaryPlistString(comment), 0); err != nil {
+		logger.Warn("failed to set the Finder comment of the output", "output", path, "error", err)
+		return
+	}
+	logger.Debug("set Finder comment", "output", path, "comment", comment)
+}
+
+// binaryPlistString encodes s as a binary property list holding only s,
+// the format of the metadata attributes of macOS.
+func binaryPlistString(s string) []byte {
+	plist := []byte("bplist00")
+	ascii := true
+	for _, r := range s {
+		ascii = ascii && r < 0x80
+	}
+	if ascii {
+		plist = append(plist, plistObjectHeader(0x50, len(s))...)
+		plist = append(plist, s...)
+	} else {
+		units := utf16.Encode([]rune(s))
+		plist = append(plist, plistObjectHeader(0x60, len(units))...)
+		for _, unit := range units {
+			plist = binary.BigEndian.AppendUint16(plist, unit)
+		}
+	}
+
+	// The offset table points at the only object, right after the magic
+	offsetTable := len(plist)
+	plist = append(plist, 8)
+	trailer := make([]byte, 6, 32)
+	trailer = append(trailer, 1, 1)
+	trailer = binary.BigEndian.AppendUint64(trailer, 1)
+	trailer = binary.BigEndian.AppendUint64(trailer, 0)
+	trailer = binary.BigEndian.AppendUint64(trailer, uint64(offsetTable))
+	return append(plist, trailer...)
+}
+
+// plistObjectHeader is the header of a binary property list object of
+// type marker holding count characters. Counts from 15 follow the marker
+// as an integer object.
+func plistObjectHeader(marker byte, count int) []byte {
+	switch {
+	case count < 15:
+		return []byte{marker | byte(count)}
+	case count < 1<<8:
+		return []byte{marker | 0xf, 0x10, byte(count)}
+	case count < 1<<16:
+		return binary.BigEndian.AppendUint16([]byte{marker | 0xf, 0x11}, uint16(count))
+	default:
+		return binary.BigEndian.AppendUint32([]byte{marker | 0xf, 0x12}, uint32(count))
+	}
+}
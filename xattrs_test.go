@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyXattrs(t *testing.T) {
+	// Linux only keeps attributes of users in the user namespace
+	namespace := ""
+	if runtime.GOOS != "darwin" {
+		namespace = "user."
+	}
+	tags := namespace + finderXattrs[0]
+	comment := namespace + finderXattrs[1]
+	quarantine := namespace + "com.apple.quarantine"
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "GH010042.MP4")
+	dst := filepath.Join(dir, "merged.mp4")
+	for _, path := range []string{src, dst} {
+		if err := os.WriteFile(path, []byte("recording"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values := map[string]string{
+		tags:       "bplist00\xa1\x01Tkeep",
+		comment:    "Summit push, day 3",
+		quarantine: "0083;65a1b2c3;Safari;",
+	}
+	for name, value := range values {
+		err := unix.Setxattr(src, name, []byte(value), 0)
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+			t.Skipf("No extended attributes here: %v", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is copied unless asked
+	copyXattrs(src, dst, Options{})
+	if names, err := listXattrs(dst); err != nil || len(names) != 0 {
+		t.Errorf("Expected no attributes without CopyXattrs, got %v: %v", names, err)
+	}
+
+	copyXattrs(src, dst, Options{CopyXattrs: []string{tags, comment}})
+	for _, name := range []string{tags, comment} {
+		if value, err := getXattr(dst, name); err != nil || string(value) != values[name] {
+			t.Errorf("Expected %s to be copied, got %q: %v", name, value, err)
+		}
+	}
+	if _, err := getXattr(dst, quarantine); err == nil {
+		t.Errorf("Expected %s not to be copied", quarantine)
+	}
+
+	// A missing output only logs a warning
+	copyXattrs(src, filepath.Join(dir, "missing.mp4"), Options{CopyXattrs: []string{tags}})
+}
+
+func TestBinaryPlistString(t *testing.T) {
+	trailer := func(offsetTable byte) []byte {
+		return []byte{0, 0, 0, 0, 0, 0, 1, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, offsetTable}
+	}
+	long := strings.Repeat("x", 20)
+	for s, object := range map[string][]byte{
+		"hi": []byte("\x52hi"),
+		long: append([]byte{0x5f, 0x10, 20}, long...),
+		// Anything but ASCII is stored as UTF-16
+		"Café": {0x64, 0, 'C', 0, 'a', 0, 'f', 0, 0xe9},
+	} {
+		expected := append([]byte("bplist00"), object...)
+		expected = append(expected, 8)
+		expected = append(expected, trailer(byte(8+len(object)))...)
+		if plist := binaryPlistString(s); !bytes.Equal(plist, expected) {
+			t.Errorf("Expected %q to encode as\n% x\ngot\n% x", s, expected, plist)
+		}
+	}
+}
+
+func TestFinderComment(t *testing.T) {
+	day := time.Date(2024, time.June, 1, 18, 0, 0, 0, time.UTC)
+	files := []FileInfo{{Path: "/trip/GH010042.MP4"}, {Path: "/trip/GH020042.MP4"}, {Path: "/trip/GH030042.MP4"}}
+	expected := "Merged from GH010042.MP4, GH020042.MP4, GH030042.MP4 on 2024-06-01 by GoProConcat " + version
+	if comment := finderComment(files, day); comment != expected {
+		t.Errorf("Expected %q, got %q", expected, comment)
+	}
+
+	files = nil
+	for i := 1; i <= 99; i++ {
+		files = append(files, FileInfo{Path: fmt.Sprintf("/trip/GH%02d0042.MP4", i)})
+	}
+	comment := finderComment(files, day)
+	if len(comment) > maxFinderCommentLength || !strings.HasSuffix(comment, " and 68 more on 2024-06-01 by GoProConcat "+version) {
+		t.Errorf("Expected a long list to be cut at %d characters, got %d: %s", maxFinderCommentLength, len(comment), comment)
+	}
+}
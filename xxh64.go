@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// The primes of XXH64.
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+// xxh64 is the XXH64 hash with seed 0, which archive tools use for fast
+// checksums of large files. It consumes the input in stripes of 32 bytes
+// and keeps the rest until the next Write or Sum.
+type xxh64 struct {
+	v      [4]uint64
+	total  uint64
+	buf    [32]byte
+	buffed int
+}
+
+func newXXH64() hash.Hash64 {
+	h := &xxh64{}
+	h.Reset()
+	return h
+}
+
+func (h *xxh64) Reset() {
+	// The sums wrap around, which constant expressions cannot
+	p1, p2 := xxhPrime1, xxhPrime2
+	h.v = [4]uint64{p1 + p2, p2, 0, -p1}
+	h.total = 0
+	h.buffed = 0
+}
+
+func (h *xxh64) Size() int      { return 8 }
+func (h *xxh64) BlockSize() int { return 32 }
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * xxhPrime2
+	return bits.RotateLeft64(acc, 31) * xxhPrime1
+}
+
+func xxhMergeRound(acc, v uint64) uint64 {
+	acc ^= xxhRound(0, v)
+	return acc*xxhPrime1 + xxhPrime4
+}
+
+func (h *xxh64) stripe(b []byte) {
+	for i := range h.v {
+		h.v[i] = xxhRound(h.v[i], binary.LittleEndian.Uint64(b[8*i:]))
+	}
+}
+
+func (h *xxh64) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	if h.buffed > 0 {
+		copied := copy(h.buf[h.buffed:], p)
+		h.buffed += copied
+		p = p[copied:]
+		if h.buffed < len(h.buf) {
+			return n, nil
+		}
+		h.stripe(h.buf[:])
+		h.buffed = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		h.stripe(p)
+	}
+	h.buffed = copy(h.buf[:], p)
+	return n, nil
+}
+
+func (h *xxh64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		acc = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) + bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			acc = xxhMergeRound(acc, v)
+		}
+	} else {
+		acc = xxhPrime5
+	}
+	acc += h.total
+
+	rest := h.buf[:h.buffed]
+	for ; len(rest) >= 8; rest = rest[8:] {
+		acc ^= xxhRound(0, binary.LittleEndian.Uint64(rest))
+		acc = bits.RotateLeft64(acc, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(rest) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(rest)) * xxhPrime1
+		acc = bits.RotateLeft64(acc, 23)*xxhPrime2 + xxhPrime3
+		rest = rest[4:]
+	}
+	for _, b := range rest {
+		acc ^= uint64(b) * xxhPrime5
+		acc = bits.RotateLeft64(acc, 11) * xxhPrime1
+	}
+
+	acc ^= acc >> 33
+	acc *= xxhPrime2
+	acc ^= acc >> 29
+	acc *= xxhPrime3
+	acc ^= acc >> 32
+	return acc
+}
+
+func (h *xxh64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, h.Sum64())
+}